@@ -7,12 +7,19 @@ import (
 	"time"
 )
 
-// AggregationJob handles periodic aggregation of session data for BigQuery
+// AggregationJob handles periodic aggregation of session data for the event sinks
 type AggregationJob struct {
 	sessionManager *SessionManager
-	hbaseReader    *HBaseWriter
-	bqWriter       *BigQueryWriter
+	store          EventStore
+	sinks          []EventSink
 	analyzer       *BehaviorAnalyzer
+	query          AnalyticsQuery
+	rollups        *rollupAccumulator
+	profiles       *UserProfileStore
+	ended          *SessionSubscription
+	endedDone      chan struct{}  // closed once the ended sessions are processed
+	summaries      sync.WaitGroup // summaries being written
+	retentionDay   string         // UTC date the retention tables were last written
 	interval       time.Duration
 	ctx            context.Context
 	cancel         context.CancelFunc
@@ -22,18 +29,25 @@ type AggregationJob struct {
 // NewAggregationJob creates a new aggregation job
 func NewAggregationJob(
 	sessionManager *SessionManager,
-	hbaseReader *HBaseWriter,
-	bqWriter *BigQueryWriter,
+	store EventStore,
+	sinks []EventSink,
 	analyzer *BehaviorAnalyzer,
+	query AnalyticsQuery,
 	interval time.Duration,
+	rollupWatermarkPath string,
+	profiles *UserProfileStore,
 ) *AggregationJob {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &AggregationJob{
 		sessionManager: sessionManager,
-		hbaseReader:    hbaseReader,
-		bqWriter:       bqWriter,
+		store:          store,
+		sinks:          sinks,
 		analyzer:       analyzer,
+		query:          query,
+		rollups:        newRollupAccumulator(interval, rollupWatermarkPath),
+		profiles:       profiles,
+		ended:          sessionManager.Subscribe("aggregation_job", SessionClosed, SessionExpired),
 		interval:       interval,
 		ctx:            ctx,
 		cancel:         cancel,
@@ -42,12 +56,18 @@ func NewAggregationJob(
 
 // Start begins the aggregation job
 func (aj *AggregationJob) Start() {
+	aj.endedDone = make(chan struct{})
 	go aj.run()
-	go aj.processExpiredSessions()
+	go aj.processEndedSessions()
 }
 
-// Stop gracefully stops the aggregation job
+// Stop gracefully stops the aggregation job. Call it once the session
+// manager is stopped, so every session that ended until then is processed.
 func (aj *AggregationJob) Stop() {
+	if aj.endedDone != nil {
+		<-aj.endedDone
+	}
+	aj.summaries.Wait()
 	aj.cancel()
 }
 
@@ -62,6 +82,9 @@ func (aj *AggregationJob) run() {
 			if err := aj.aggregateSessionData(); err != nil {
 				fmt.Printf("Aggregation job error: %v\n", err)
 			}
+			if err := aj.writeRetention(time.Now()); err != nil {
+				fmt.Printf("Retention job error: %v\n", err)
+			}
 
 		case <-aj.ctx.Done():
 			return
@@ -69,27 +92,129 @@ func (aj *AggregationJob) run() {
 	}
 }
 
-// aggregateSessionData aggregates data from all closed sessions
+// observeEvent counts a tracked event into its rollup window
+func (aj *AggregationJob) observeEvent(event UserEvent) {
+	aj.rollups.observe(event)
+}
+
+// aggregateSessionData rolls up every window that closed since the last run
+// and writes the rollups to every sink
 func (aj *AggregationJob) aggregateSessionData() error {
 	aj.mu.Lock()
 	defer aj.mu.Unlock()
 
-	fmt.Println("Running session data aggregation...")
+	// Keep a window open until sessions that went quiet in it have expired
+	// and late events have arrived
+	now := time.Now()
+	grace := aj.sessionManager.expiryDelay()
+	if _, err := aj.rollups.load(now, grace); err != nil {
+		return err
+	}
+
+	from := aj.rollups.Watermark()
+	to := now.Add(-grace).Truncate(aj.interval)
+	if !to.After(from) {
+		return nil
+	}
+
+	windows := aj.rollups.closed(to)
 
-	// This would typically query closed sessions from the last interval
-	// For now, we'll process based on expired session notifications
+	sessions := aj.sessionManager.FindSessions(func(session *Session) bool {
+		if inTimeRange(session.StartTime, from, to) {
+			return true
+		}
+		return session.EndTime != nil && inTimeRange(*session.EndTime, from, to)
+	})
+
+	rollups := buildRollups(aj.interval, from, to, windows, sessions)
+
+	// The watermark moves only once every sink has the rollups. Each sink's
+	// progress is persisted as it goes, so after a failure the next run
+	// writes a sink only the windows it misses; BigQuery's insert ID dedup
+	// is best-effort and would not stop a window being counted twice.
+	var writeErr error
+	for _, sink := range aj.sinks {
+		written := aj.rollups.writtenThrough(sink.Name())
+		for _, rollup := range rollups {
+			if rollup.WindowStart.Before(written) {
+				continue
+			}
+
+			_, err := DefaultRetryPolicy().Do(aj.ctx, func() error {
+				return sink.WriteRollup(rollup)
+			})
+			if err == nil {
+				err = aj.rollups.markWritten(sink.Name(), rollup.WindowEnd)
+			}
+			if err != nil {
+				if writeErr == nil {
+					writeErr = fmt.Errorf("failed to write rollup to %s: %w", sink.Name(), err)
+				}
+				break
+			}
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if err := aj.rollups.advance(to); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled up %d windows from %s to %s (%d late events dropped so far)\n",
+		len(rollups), from.Format(time.RFC3339), to.Format(time.RFC3339), aj.rollups.LateEvents())
 
 	return nil
 }
 
-// processExpiredSessions listens for expired sessions and creates summaries
-func (aj *AggregationJob) processExpiredSessions() {
-	expiredChannel := aj.sessionManager.GetExpiredSessionChannel()
+// restoreRollups loads the rollup watermark and the windows open at the last
+// checkpoint, returning the write-ahead log offset they count events up to
+func (aj *AggregationJob) restoreRollups() (uint64, error) {
+	return aj.rollups.load(time.Now(), aj.sessionManager.expiryDelay())
+}
+
+// replayEvent counts an event read back from the write-ahead log into its
+// rollup window
+func (aj *AggregationJob) replayEvent(event UserEvent) {
+	aj.rollups.replay(event)
+}
+
+// snapshotRollups copies the open rollup windows as counting every event
+// logged below offset; the caller must keep events from being observed
+// while it runs
+func (aj *AggregationJob) snapshotRollups(offset uint64) rollupState {
+	return aj.rollups.snapshot(offset)
+}
+
+// saveRollups persists a snapshot of the open rollup windows
+func (aj *AggregationJob) saveRollups(state rollupState) error {
+	return aj.rollups.save(state)
+}
+
+// processEndedSessions updates the profile of the user of every session that
+// is closed or expires, then creates summaries of the expired ones. The
+// profile goes first so the summary includes a baseline deviation.
+func (aj *AggregationJob) processEndedSessions() {
+	defer close(aj.endedDone)
 
 	for {
 		select {
-		case sessionID := <-expiredChannel:
-			go aj.createSessionSummary(sessionID)
+		case event, ok := <-aj.ended.C():
+			if !ok {
+				return
+			}
+
+			if err := aj.updateProfile(event.Session); err != nil {
+				fmt.Printf("Failed to update profile of user %s: %v\n", event.Session.UserID, err)
+			}
+			if event.Type == SessionExpired {
+				aj.summaries.Add(1)
+				go func(sessionID string) {
+					defer aj.summaries.Done()
+					aj.createSessionSummary(sessionID)
+				}(event.Session.SessionID)
+			}
 
 		case <-aj.ctx.Done():
 			return
@@ -97,7 +222,76 @@ func (aj *AggregationJob) processExpiredSessions() {
 	}
 }
 
-// createSessionSummary creates and writes a session summary to BigQuery
+// updateProfile adds an ended session to its user's profile, publishes a
+// deviation from the user's baseline and writes the profile to every sink
+func (aj *AggregationJob) updateProfile(session Session) error {
+	events, err := aj.store.GetSessionEvents(session.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session events: %w", err)
+	}
+
+	profile, anomaly := aj.profiles.Apply(session, events, time.Now())
+	if anomaly != nil {
+		aj.sessionManager.reportAnomalies(session, []AnomalyDetection{*anomaly})
+	}
+
+	var writeErr error
+	for _, sink := range aj.sinks {
+		if err := sink.WriteProfile(profile); err != nil && writeErr == nil {
+			writeErr = fmt.Errorf("failed to write profile to %s: %w", sink.Name(), err)
+		}
+	}
+	return writeErr
+}
+
+// writeRetention writes the daily and weekly retention tables of the first
+// seen and signup cohorts to every sink, once per UTC day
+func (aj *AggregationJob) writeRetention(now time.Time) error {
+	day := now.UTC().Format(profileDayLayout)
+	if day == aj.retentionDay {
+		return nil
+	}
+
+	queries := []RetentionQuery{
+		{Cohort: CohortFirstSeen, Period: RetentionDay, Periods: DefaultDailyRetentionPeriods},
+		{Cohort: CohortFirstSeen, Period: RetentionWeek, Periods: DefaultWeeklyRetentionPeriods},
+		{Cohort: CohortSignup, Period: RetentionDay, Periods: DefaultDailyRetentionPeriods},
+		{Cohort: CohortSignup, Period: RetentionWeek, Periods: DefaultWeeklyRetentionPeriods},
+	}
+
+	var writeErr error
+	for _, query := range queries {
+		// Report the cohorts still within the reported periods
+		query.To = now
+		if query.Period == RetentionDay {
+			query.From = periodStart(now, RetentionDay).AddDate(0, 0, -query.Periods)
+		} else {
+			query.From = periodStart(now, RetentionWeek).AddDate(0, 0, -7*query.Periods)
+		}
+
+		table, err := aj.profiles.Retention(query, now)
+		if err != nil {
+			return err
+		}
+		if len(table.Cohorts) == 0 {
+			continue
+		}
+
+		for _, sink := range aj.sinks {
+			if err := sink.WriteRetention(*table); err != nil && writeErr == nil {
+				writeErr = fmt.Errorf("failed to write retention to %s: %w", sink.Name(), err)
+			}
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	aj.retentionDay = day
+	return nil
+}
+
+// createSessionSummary creates and writes a session summary to every sink
 func (aj *AggregationJob) createSessionSummary(sessionID string) error {
 	// Get session from manager
 	session, exists := aj.sessionManager.GetSession(sessionID)
@@ -105,8 +299,8 @@ func (aj *AggregationJob) createSessionSummary(sessionID string) error {
 		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	// Get events from HBase
-	events, err := aj.hbaseReader.GetSessionEvents(sessionID)
+	// Get events from the event store
+	events, err := aj.store.GetSessionEvents(sessionID)
 	if err != nil {
 		return fmt.Errorf("failed to get session events: %w", err)
 	}
@@ -144,9 +338,11 @@ func (aj *AggregationJob) createSessionSummary(sessionID string) error {
 
 	hasAnomaly := len(anomalies) > 0
 	anomalyTypes := make([]string, 0)
+	var anomalySeverities []string
 	if hasAnomaly {
 		for _, anomaly := range anomalies {
 			anomalyTypes = append(anomalyTypes, anomaly.AnomalyType)
+			anomalySeverities = append(anomalySeverities, anomaly.Severity)
 		}
 	}
 
@@ -162,11 +358,19 @@ func (aj *AggregationJob) createSessionSummary(sessionID string) error {
 		ActionCounts:  actionCounts,
 		HasAnomaly:    hasAnomaly,
 		AnomalyTypes:  anomalyTypes,
+
+		AnomalySeverities: anomalySeverities,
 	}
 
-	// Write to BigQuery
-	if err := aj.bqWriter.WriteSummary(summary); err != nil {
-		return fmt.Errorf("failed to write summary to BQ: %w", err)
+	// Write to all sinks, a failing sink must not starve the others
+	var writeErr error
+	for _, sink := range aj.sinks {
+		if err := sink.WriteSummary(summary); err != nil && writeErr == nil {
+			writeErr = fmt.Errorf("failed to write summary to %s: %w", sink.Name(), err)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
 	}
 
 	fmt.Printf("Created summary for session %s: %d events, duration %d seconds, %d anomalies\n",
@@ -177,39 +381,24 @@ func (aj *AggregationJob) createSessionSummary(sessionID string) error {
 
 // GetTopActionsGlobal returns the most used actions across all sessions in a time range
 func (aj *AggregationJob) GetTopActionsGlobal(startTime, endTime time.Time) ([]ActionStats, error) {
-	// This would typically query BigQuery for aggregated data
-	// For demonstration, returning structure
-
-	// Example query would be:
-	// SELECT
-	//   action_type,
-	//   SUM(count) as total_count,
-	//   COUNT(DISTINCT session_id) as session_count
-	// FROM user_behavior_events
-	// WHERE timestamp BETWEEN @start AND @end
-	// GROUP BY action_type
-	// ORDER BY total_count DESC
-
-	return []ActionStats{}, nil
+	if aj.query == nil {
+		return nil, ErrNoAnalytics
+	}
+	return aj.query.TopActions(startTime, endTime)
 }
 
 // GetAnomalyReport generates a report of all anomalies in a time range
 func (aj *AggregationJob) GetAnomalyReport(startTime, endTime time.Time) ([]AnomalyDetection, error) {
-	// This would query BigQuery for sessions with anomalies
-	// Example query:
-	// SELECT *
-	// FROM session_summaries
-	// WHERE has_anomaly = true
-	//   AND start_time BETWEEN @start AND @end
-	// ORDER BY start_time DESC
-
-	return []AnomalyDetection{}, nil
+	if aj.query == nil {
+		return nil, ErrNoAnalytics
+	}
+	return aj.query.AnomalyReport(startTime, endTime)
 }
 
 // AnalyzeSessionBehavior provides a comprehensive analysis for a specific session
 func (aj *AggregationJob) AnalyzeSessionBehavior(sessionID string) (*SessionAnalysisReport, error) {
 	// Get session events
-	events, err := aj.hbaseReader.GetSessionEvents(sessionID)
+	events, err := aj.store.GetSessionEvents(sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -220,8 +409,12 @@ func (aj *AggregationJob) AnalyzeSessionBehavior(sessionID string) (*SessionAnal
 		return nil, err
 	}
 
-	// Get action patterns
-	patterns, err := aj.analyzer.GetActionPatterns(sessionID, 3)
+	// Get contiguous action patterns repeated within the session
+	patterns, err := aj.analyzer.GetActionPatterns(PatternQuery{
+		SessionID: sessionID,
+		MinCount:  2,
+		MaxLength: 3,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -242,7 +435,7 @@ func (aj *AggregationJob) AnalyzeSessionBehavior(sessionID string) (*SessionAnal
 		SessionID:        sessionID,
 		EventCount:       len(events),
 		MostUsedActions:  mostUsed,
-		CommonPatterns:   patterns,
+		CommonPatterns:   patterns.Patterns,
 		Anomalies:        anomalies,
 		RepeatedPatterns: repeatedPatterns,
 	}, nil
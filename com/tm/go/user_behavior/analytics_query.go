@@ -0,0 +1,178 @@
+package user_behavior
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Analytics backends accepted in EventCollectorConfig.AnalyticsBackend
+	AnalyticsBigQuery = "bigquery"
+	AnalyticsLocal    = "local"
+)
+
+// AnalyticsQuery answers cross-session questions over a time range
+type AnalyticsQuery interface {
+	// TopActions returns action counts across all sessions within
+	// [start, end), most used first
+	TopActions(start, end time.Time) ([]ActionStats, error)
+
+	// AnomalyReport returns the anomalies of sessions started within
+	// [start, end), newest first
+	AnomalyReport(start, end time.Time) ([]AnomalyDetection, error)
+
+	// Close releases the backend's resources
+	Close() error
+}
+
+// newAnalyticsQuery creates the configured backend. When none is set BigQuery
+// is used if it is a sink, then local analytics over a memory or file sink;
+// it returns nil when neither is available.
+func newAnalyticsQuery(config EventCollectorConfig, sinks []EventSink) (AnalyticsQuery, error) {
+	name := strings.ToLower(strings.TrimSpace(config.AnalyticsBackend))
+	if name == "" {
+		for _, sink := range sinkNames(config) {
+			if sink == SinkBigQuery {
+				name = AnalyticsBigQuery
+			}
+		}
+	}
+	if name == "" {
+		if findLocalReader(sinks) == nil {
+			return nil, nil
+		}
+		name = AnalyticsLocal
+	}
+
+	switch name {
+	case AnalyticsBigQuery:
+		return NewBigQueryAnalytics(config.BQProjectID, config.BQDataset, config.BQEventTable, config.BQSummaryTable)
+	case AnalyticsLocal:
+		reader := findLocalReader(sinks)
+		if reader == nil {
+			return nil, fmt.Errorf("local analytics needs a %s or %s sink", SinkMemory, SinkFile)
+		}
+		return NewLocalAnalytics(reader), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAnalytics, name)
+	}
+}
+
+// LocalReader is implemented by sinks whose records can be read back
+type LocalReader interface {
+	// ReadEvents returns the stored events within [from, to)
+	ReadEvents(from, to time.Time) ([]UserEvent, error)
+
+	// ReadSummaries returns the stored summaries of sessions started within [from, to)
+	ReadSummaries(from, to time.Time) ([]SessionSummary, error)
+}
+
+// findLocalReader returns the first sink that can read its records back
+func findLocalReader(sinks []EventSink) LocalReader {
+	for _, sink := range sinks {
+		if reader, ok := sink.(LocalReader); ok {
+			return reader
+		}
+	}
+	return nil
+}
+
+// LocalAnalytics aggregates over the records of a local sink, so analytics
+// work without BigQuery
+type LocalAnalytics struct {
+	reader LocalReader
+}
+
+// NewLocalAnalytics creates local analytics over a reader
+func NewLocalAnalytics(reader LocalReader) *LocalAnalytics {
+	return &LocalAnalytics{reader: reader}
+}
+
+// TopActions counts stored events by type
+func (la *LocalAnalytics) TopActions(start, end time.Time) ([]ActionStats, error) {
+	events, err := la.reader.ReadEvents(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[EventType]int64)
+	for _, event := range events {
+		counts[event.EventType]++
+	}
+
+	return actionStatsFromCounts(counts), nil
+}
+
+// AnomalyReport lists the anomalies recorded in stored session summaries
+func (la *LocalAnalytics) AnomalyReport(start, end time.Time) ([]AnomalyDetection, error) {
+	summaries, err := la.reader.ReadSummaries(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StartTime.After(summaries[j].StartTime)
+	})
+
+	var report []AnomalyDetection
+	for _, summary := range summaries {
+		if !summary.HasAnomaly {
+			continue
+		}
+		for i, anomalyType := range summary.AnomalyTypes {
+			var severity string
+			if i < len(summary.AnomalySeverities) {
+				severity = summary.AnomalySeverities[i]
+			}
+			report = append(report, summaryAnomaly(summary.SessionID, summary.UserID, anomalyType, severity, summary.EndTime))
+		}
+	}
+
+	return report, nil
+}
+
+// Close is a no-op, the reader belongs to the sink
+func (la *LocalAnalytics) Close() error {
+	return nil
+}
+
+// actionStatsFromCounts converts counts to stats sorted by count descending
+func actionStatsFromCounts(counts map[EventType]int64) []ActionStats {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+
+	stats := make([]ActionStats, 0, len(counts))
+	for eventType, count := range counts {
+		stats = append(stats, ActionStats{
+			EventType:  eventType,
+			Count:      count,
+			Percentage: float64(count) / float64(total) * 100,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].EventType < stats[j].EventType
+	})
+
+	return stats
+}
+
+// summaryAnomaly builds a report entry for an anomaly kept in a summary. The
+// severity is empty for summaries written before severities were stored.
+func summaryAnomaly(sessionID, userID, anomalyType, severity string, detectedAt time.Time) AnomalyDetection {
+	return AnomalyDetection{
+		SessionID:   sessionID,
+		UserID:      userID,
+		AnomalyType: anomalyType,
+		Description: "Recorded in session summary",
+		DetectedAt:  detectedAt,
+		Severity:    severity,
+	}
+}
@@ -0,0 +1,55 @@
+package user_behavior
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalAnalyticsAnomalyReport(t *testing.T) {
+	t0 := time.Date(2026, 7, 1, 8, 0, 0, 0, time.UTC)
+	sink := NewMemorySink()
+	summaries := []SessionSummary{
+		{
+			SessionID:         "s1",
+			UserID:            "u1",
+			StartTime:         t0,
+			EndTime:           t0.Add(time.Minute),
+			HasAnomaly:        true,
+			AnomalyTypes:      []string{"stuck_pattern", "custom_rule"},
+			AnomalySeverities: []string{SeverityCritical, SeverityLow},
+		},
+		{
+			SessionID:    "s2",
+			UserID:       "u1",
+			StartTime:    t0.Add(time.Hour),
+			EndTime:      t0.Add(time.Hour + time.Minute),
+			HasAnomaly:   true,
+			AnomalyTypes: []string{"repeated_action"},
+		},
+		{SessionID: "s3", UserID: "u2", StartTime: t0.Add(2 * time.Hour)},
+	}
+	for _, summary := range summaries {
+		if err := sink.WriteSummary(summary); err != nil {
+			t.Fatalf("WriteSummary() error = %v", err)
+		}
+	}
+
+	report, err := NewLocalAnalytics(sink).AnomalyReport(t0, t0.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("AnomalyReport() error = %v", err)
+	}
+
+	want := []AnomalyDetection{
+		{SessionID: "s2", AnomalyType: "repeated_action"},
+		{SessionID: "s1", AnomalyType: "stuck_pattern", Severity: SeverityCritical},
+		{SessionID: "s1", AnomalyType: "custom_rule", Severity: SeverityLow},
+	}
+	if len(report) != len(want) {
+		t.Fatalf("AnomalyReport() = %+v, want %d anomalies", report, len(want))
+	}
+	for i, anomaly := range report {
+		if anomaly.SessionID != want[i].SessionID || anomaly.AnomalyType != want[i].AnomalyType || anomaly.Severity != want[i].Severity {
+			t.Errorf("anomaly %d = %+v, want %+v", i, anomaly, want[i])
+		}
+	}
+}
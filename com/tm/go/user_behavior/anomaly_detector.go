@@ -0,0 +1,333 @@
+package user_behavior
+
+import "time"
+
+// ruleState is the incremental state of one rule over one session's events.
+// Its memory is bounded by the rule, not by the length of the session.
+type ruleState interface {
+	// observe feeds the next event, index being its position in the
+	// session, and returns the matches it completes
+	observe(event UserEvent, index int) []AnomalyMatch
+
+	// advance returns the matches that are due once event time reaches
+	// watermark, or all pending ones when the session has ended
+	advance(watermark time.Time, ended bool) []AnomalyMatch
+
+	// deadline returns the event time at which advance reports a pending
+	// match, zero when nothing is pending
+	deadline() time.Time
+}
+
+// newRuleState returns an empty state for a rule
+func newRuleState(rule *compiledRule) ruleState {
+	switch rule.Type {
+	case RuleSequence:
+		return &sequenceState{rule: rule}
+	case RuleFrequency:
+		return &frequencyState{rule: rule}
+	default:
+		return &absenceState{rule: rule}
+	}
+}
+
+// match returns the rule's matches in a session's events ordered by time by
+// replaying them through a fresh state. now ends absence rules whose trigger
+// is near the last event.
+func (r *compiledRule) match(events []UserEvent, now time.Time) []AnomalyMatch {
+	state := newRuleState(r)
+
+	var matches []AnomalyMatch
+	for i, event := range events {
+		matches = append(matches, state.observe(event, i)...)
+	}
+	return append(matches, state.advance(now, false)...)
+}
+
+// sessionDetector runs the streaming rules over one session as its events
+// are processed
+type sessionDetector struct {
+	rules      []*compiledRule
+	generation uint64
+	states     []ruleState
+	observed   int
+}
+
+// newSessionDetector creates the rule states of a session
+func newSessionDetector(rules []*compiledRule, generation uint64) *sessionDetector {
+	d := &sessionDetector{
+		rules:      rules,
+		generation: generation,
+		states:     make([]ruleState, len(rules)),
+	}
+	for i, rule := range rules {
+		d.states[i] = newRuleState(rule)
+	}
+	return d
+}
+
+// observe feeds an event to every rule and returns the anomalies detected
+func (d *sessionDetector) observe(event UserEvent, now time.Time) []AnomalyDetection {
+	var anomalies []AnomalyDetection
+	for i, state := range d.states {
+		for _, match := range state.observe(event, d.observed) {
+			anomalies = append(anomalies, d.rules[i].anomaly(match, now))
+		}
+	}
+	d.observed++
+	return anomalies
+}
+
+// advance returns the anomalies that became due at watermark, or every
+// pending one when the session has ended
+func (d *sessionDetector) advance(watermark time.Time, ended bool, now time.Time) []AnomalyDetection {
+	var anomalies []AnomalyDetection
+	for i, state := range d.states {
+		for _, match := range state.advance(watermark, ended) {
+			anomalies = append(anomalies, d.rules[i].anomaly(match, now))
+		}
+	}
+	return anomalies
+}
+
+// deadline returns the earliest pending deadline of the rules, zero when none
+func (d *sessionDetector) deadline() time.Time {
+	var earliest time.Time
+	for _, state := range d.states {
+		if deadline := state.deadline(); !deadline.IsZero() && (earliest.IsZero() || deadline.Before(earliest)) {
+			earliest = deadline
+		}
+	}
+	return earliest
+}
+
+// sequencePartial is a match of a sequence rule in progress
+type sequencePartial struct {
+	step       int // next step to match
+	gap        int // other events since the last matched step
+	count      int // completed occurrences
+	first      int
+	start      time.Time
+	occurrence time.Time // first step of the current occurrence
+}
+
+// sequenceState tracks the partial matches of a sequence rule, at most one
+// per step and occurrence count, keeping the one with the smallest gap
+type sequenceState struct {
+	rule     *compiledRule
+	partials []sequencePartial
+}
+
+func (s *sequenceState) observe(event UserEvent, index int) []AnomalyMatch {
+	r := s.rule
+	candidates := append(s.partials, sequencePartial{first: index, start: event.Timestamp, gap: -1})
+	s.partials = nil
+
+	for _, p := range candidates {
+		if p.gap >= 0 {
+			// The event may be skipped as a gap
+			skipped := p
+			skipped.gap++
+			if r.MaxGap < 0 || skipped.gap <= r.MaxGap {
+				s.keep(skipped)
+			}
+		}
+
+		if event.EventType != r.Steps[p.step] {
+			continue
+		}
+		if p.step == 0 {
+			p.occurrence = event.Timestamp
+		} else if r.Within > 0 && event.Timestamp.Sub(p.occurrence) > time.Duration(r.Within) {
+			continue
+		}
+
+		p.step++
+		p.gap = 0
+		if p.step == len(r.Steps) {
+			p.step = 0
+			p.count++
+			if p.count >= r.Repeat {
+				s.partials = nil
+				return []AnomalyMatch{{
+					Rule:       r.AnomalyRule,
+					SessionID:  event.SessionID,
+					UserID:     event.UserID,
+					Sequence:   r.Steps,
+					Count:      p.count,
+					FirstEvent: p.first,
+					LastEvent:  index,
+					Start:      p.start,
+					End:        event.Timestamp,
+				}}
+			}
+		}
+		s.keep(p)
+	}
+
+	return nil
+}
+
+// keep adds a partial unless an equivalent one with a smaller gap is kept
+func (s *sequenceState) keep(p sequencePartial) {
+	for i, kept := range s.partials {
+		if kept.step == p.step && kept.count == p.count {
+			if p.gap < kept.gap || (p.gap == kept.gap && p.occurrence.After(kept.occurrence)) {
+				s.partials[i] = p
+			}
+			return
+		}
+	}
+	s.partials = append(s.partials, p)
+}
+
+func (s *sequenceState) advance(time.Time, bool) []AnomalyMatch {
+	return nil
+}
+
+func (s *sequenceState) deadline() time.Time {
+	return time.Time{}
+}
+
+// frequencyEvent is a counted event of a frequency rule
+type frequencyEvent struct {
+	index     int
+	eventType EventType
+	timestamp time.Time
+}
+
+// frequencyState holds the current run of counted events, never more than
+// Count of them
+type frequencyState struct {
+	rule *compiledRule
+	run  []frequencyEvent
+}
+
+func (s *frequencyState) observe(event UserEvent, index int) []AnomalyMatch {
+	r := s.rule
+	if r.eventTypes != nil && !r.eventTypes[event.EventType] {
+		if r.Consecutive {
+			s.run = s.run[:0]
+		}
+		return nil
+	}
+
+	if len(s.run) > 0 {
+		previous := s.run[len(s.run)-1]
+		if (r.SameType && previous.eventType != event.EventType) ||
+			(r.Interval > 0 && event.Timestamp.Sub(previous.timestamp) >= time.Duration(r.Interval)) {
+			s.run = s.run[:0]
+		}
+	}
+
+	s.run = append(s.run, frequencyEvent{index: index, eventType: event.EventType, timestamp: event.Timestamp})
+	if r.Window > 0 {
+		drop := 0
+		for event.Timestamp.Sub(s.run[drop].timestamp) > time.Duration(r.Window) {
+			drop++
+		}
+		s.run = append(s.run[:0], s.run[drop:]...)
+	}
+
+	if len(s.run) < r.Count {
+		return nil
+	}
+
+	sequence := make([]EventType, len(s.run))
+	for i, counted := range s.run {
+		sequence[i] = counted.eventType
+	}
+	match := AnomalyMatch{
+		Rule:       r.AnomalyRule,
+		SessionID:  event.SessionID,
+		UserID:     event.UserID,
+		Sequence:   sequence,
+		Count:      len(s.run),
+		FirstEvent: s.run[0].index,
+		LastEvent:  index,
+		Start:      s.run[0].timestamp,
+		End:        event.Timestamp,
+	}
+	if r.SameType {
+		match.EventType = event.EventType
+	}
+	s.run = s.run[:0]
+
+	return []AnomalyMatch{match}
+}
+
+func (s *frequencyState) advance(time.Time, bool) []AnomalyMatch {
+	return nil
+}
+
+func (s *frequencyState) deadline() time.Time {
+	return time.Time{}
+}
+
+// absenceState holds the earliest unanswered trigger of an absence rule. A
+// trigger is not reported again until an expected event arrives.
+type absenceState struct {
+	rule     *compiledRule
+	pending  bool
+	reported bool
+	trigger  UserEvent
+	first    int
+	last     int
+}
+
+func (s *absenceState) observe(event UserEvent, index int) []AnomalyMatch {
+	r := s.rule
+
+	var matches []AnomalyMatch
+	if s.pending && event.Timestamp.After(s.deadline()) {
+		matches = append(matches, s.report())
+	}
+
+	if r.expected == nil || r.expected[event.EventType] {
+		s.pending = false
+		s.reported = false
+		return matches
+	}
+
+	if s.pending {
+		s.last = index
+	} else if event.EventType == r.Trigger && !s.reported {
+		s.pending = true
+		s.trigger = event
+		s.first = index
+		s.last = index
+	}
+	return matches
+}
+
+func (s *absenceState) advance(watermark time.Time, ended bool) []AnomalyMatch {
+	if !s.pending || (!ended && !watermark.After(s.deadline())) {
+		return nil
+	}
+	return []AnomalyMatch{s.report()}
+}
+
+func (s *absenceState) deadline() time.Time {
+	if !s.pending {
+		return time.Time{}
+	}
+	return s.trigger.Timestamp.Add(time.Duration(s.rule.Within))
+}
+
+// report returns the pending trigger as a match and clears it
+func (s *absenceState) report() AnomalyMatch {
+	match := AnomalyMatch{
+		Rule:       s.rule.AnomalyRule,
+		SessionID:  s.trigger.SessionID,
+		UserID:     s.trigger.UserID,
+		EventType:  s.rule.Trigger,
+		Sequence:   []EventType{s.rule.Trigger},
+		Count:      s.last - s.first + 1,
+		FirstEvent: s.first,
+		LastEvent:  s.last,
+		Start:      s.trigger.Timestamp,
+		End:        s.deadline(),
+	}
+	s.pending = false
+	s.reported = true
+	return match
+}
@@ -0,0 +1,370 @@
+package user_behavior
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRuleReloadInterval is how often rule files are checked for changes
+const DefaultRuleReloadInterval = 10 * time.Second
+
+// ruleFileExts are the file extensions loaded from rule directories
+var ruleFileExts = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// AnomalyRuleConfig selects the anomaly rule files
+type AnomalyRuleConfig struct {
+	// Paths lists rule files and directories of .yaml, .yml and .json
+	// files. DefaultAnomalyRules are used when empty.
+	Paths []string
+
+	// ReloadInterval is how often the files are checked for changes.
+	// Defaults to DefaultRuleReloadInterval.
+	ReloadInterval time.Duration
+}
+
+// withDefaults fills unset fields
+func (c AnomalyRuleConfig) withDefaults() AnomalyRuleConfig {
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = DefaultRuleReloadInterval
+	}
+	return c
+}
+
+// AnomalyRuleStatus describes the loaded rules
+type AnomalyRuleStatus struct {
+	Files     []string      `json:"files"`
+	Rules     []AnomalyRule `json:"rules"`
+	LoadedAt  time.Time     `json:"loaded_at"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// AnomalyRuleTest is the result of replaying a stored session through one
+// rule. Matches and Anomalies are in the same order.
+type AnomalyRuleTest struct {
+	Rule      string             `json:"rule"`
+	SessionID string             `json:"session_id"`
+	Events    int                `json:"events"`
+	Matches   []AnomalyMatch     `json:"matches"`
+	Anomalies []AnomalyDetection `json:"anomalies"`
+}
+
+// AnomalyRuleEngine evaluates anomaly rules loaded from files and reloads
+// them when the files change. A file that fails to load keeps the previous
+// rules in place.
+type AnomalyRuleEngine struct {
+	config      AnomalyRuleConfig
+	rules       []*compiledRule
+	enabled     []*compiledRule
+	generation  uint64 // changes whenever the rules are replaced
+	files       []string
+	fingerprint string
+	loadedAt    time.Time
+	lastError   error
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mu          sync.RWMutex
+}
+
+// NewAnomalyRuleEngine loads the configured rules, failing when they are
+// invalid
+func NewAnomalyRuleEngine(config AnomalyRuleConfig) (*AnomalyRuleEngine, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	re := &AnomalyRuleEngine{
+		config: config.withDefaults(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if len(re.config.Paths) == 0 {
+		rules, err := compileRules(DefaultAnomalyRules)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		re.setRules(rules)
+		return re, nil
+	}
+
+	if err := re.Reload(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return re, nil
+}
+
+// Start begins watching the rule files
+func (re *AnomalyRuleEngine) Start() {
+	if len(re.config.Paths) > 0 {
+		go re.reloadWorker()
+	}
+}
+
+// Stop stops watching the rule files
+func (re *AnomalyRuleEngine) Stop() {
+	re.cancel()
+}
+
+// Reload loads the rule files, keeping the current rules when they fail.
+// The default rules are kept when no paths are configured.
+func (re *AnomalyRuleEngine) Reload() error {
+	if len(re.config.Paths) == 0 {
+		return nil
+	}
+
+	files, fingerprint, err := ruleFiles(re.config.Paths)
+	if err == nil {
+		var rules []*compiledRule
+		rules, err = loadRuleFiles(files)
+		if err == nil {
+			re.mu.Lock()
+			re.setRules(rules)
+			re.files = files
+			re.fingerprint = fingerprint
+			re.lastError = nil
+			re.mu.Unlock()
+			return nil
+		}
+	}
+
+	// A path that cannot be read is remembered by its error, so the
+	// reload worker only retries once something changes
+	if fingerprint == "" {
+		fingerprint = err.Error()
+	}
+	re.mu.Lock()
+	re.fingerprint = fingerprint
+	re.lastError = err
+	re.mu.Unlock()
+	return err
+}
+
+// setRules replaces the rules; caller must hold re.mu
+func (re *AnomalyRuleEngine) setRules(rules []*compiledRule) {
+	enabled := make([]*compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		if !rule.Disabled {
+			enabled = append(enabled, rule)
+		}
+	}
+
+	re.rules = rules
+	re.enabled = enabled
+	re.generation++
+	re.loadedAt = time.Now()
+}
+
+// enabledRules returns the enabled rules and their generation, which
+// changes when a reload replaces them
+func (re *AnomalyRuleEngine) enabledRules() ([]*compiledRule, uint64) {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+
+	return re.enabled, re.generation
+}
+
+// Status returns the loaded rules and the last reload error
+func (re *AnomalyRuleEngine) Status() AnomalyRuleStatus {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+
+	status := AnomalyRuleStatus{
+		Files:    re.files,
+		Rules:    make([]AnomalyRule, 0, len(re.rules)),
+		LoadedAt: re.loadedAt,
+	}
+	for _, rule := range re.rules {
+		status.Rules = append(status.Rules, rule.AnomalyRule)
+	}
+	if re.lastError != nil {
+		status.LastError = re.lastError.Error()
+	}
+	return status
+}
+
+// Detect evaluates the enabled rules over a session's events ordered by time
+func (re *AnomalyRuleEngine) Detect(events []UserEvent, now time.Time) []AnomalyDetection {
+	rules, _ := re.enabledRules()
+
+	var anomalies []AnomalyDetection
+	for _, rule := range rules {
+		for _, match := range rule.match(events, now) {
+			anomalies = append(anomalies, rule.anomaly(match, now))
+		}
+	}
+	return anomalies
+}
+
+// sequenceRules returns the enabled sequence rules
+func (re *AnomalyRuleEngine) sequenceRules() []AnomalyRule {
+	enabled, _ := re.enabledRules()
+
+	var rules []AnomalyRule
+	for _, rule := range enabled {
+		if rule.Type == RuleSequence {
+			rules = append(rules, rule.AnomalyRule)
+		}
+	}
+	return rules
+}
+
+// TestRule replays events through the named rule, disabled or not
+func (re *AnomalyRuleEngine) TestRule(name string, events []UserEvent, now time.Time) (*AnomalyRuleTest, error) {
+	re.mu.RLock()
+	var rule *compiledRule
+	for _, candidate := range re.rules {
+		if candidate.Name == name {
+			rule = candidate
+		}
+	}
+	re.mu.RUnlock()
+
+	if rule == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRule, name)
+	}
+	return testRule(rule, events, now), nil
+}
+
+// TestRuleDefinition replays events through a rule that is not loaded, so a
+// rule can be tried before it is added to a rule file
+func (re *AnomalyRuleEngine) TestRuleDefinition(rule AnomalyRule, events []UserEvent, now time.Time) (*AnomalyRuleTest, error) {
+	compiled, err := compileRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	return testRule(compiled, events, now), nil
+}
+
+// testRule evaluates one rule and keeps every match
+func testRule(rule *compiledRule, events []UserEvent, now time.Time) *AnomalyRuleTest {
+	test := &AnomalyRuleTest{
+		Rule:      rule.Name,
+		Events:    len(events),
+		Matches:   []AnomalyMatch{},
+		Anomalies: []AnomalyDetection{},
+	}
+	if len(events) > 0 {
+		test.SessionID = events[0].SessionID
+	}
+
+	for _, match := range rule.match(events, now) {
+		test.Matches = append(test.Matches, match)
+		test.Anomalies = append(test.Anomalies, rule.anomaly(match, now))
+	}
+	return test
+}
+
+// reloadWorker reloads the rules when the rule files change
+func (re *AnomalyRuleEngine) reloadWorker() {
+	ticker := time.NewTicker(re.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, fingerprint, err := ruleFiles(re.config.Paths)
+			if err != nil {
+				fingerprint = err.Error()
+			}
+			re.mu.RLock()
+			changed := fingerprint != re.fingerprint
+			re.mu.RUnlock()
+			if !changed {
+				continue
+			}
+
+			if err := re.Reload(); err != nil {
+				fmt.Printf("Failed to reload anomaly rules, keeping the previous rules: %v\n", err)
+				continue
+			}
+			fmt.Printf("Reloaded %d anomaly rules\n", len(re.Status().Rules))
+
+		case <-re.ctx.Done():
+			return
+		}
+	}
+}
+
+// compileRules validates rules and checks their names are unique
+func compileRules(rules []AnomalyRule) ([]*compiledRule, error) {
+	compiled := make([]*compiledRule, 0, len(rules))
+	names := make(map[string]bool, len(rules))
+
+	for _, rule := range rules {
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%w: duplicate rule name %q", ErrInvalidRule, rule.Name)
+		}
+		names[rule.Name] = true
+
+		c, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+
+	return compiled, nil
+}
+
+// loadRuleFiles parses and compiles the rules of all files
+func loadRuleFiles(files []string) ([]*compiledRule, error) {
+	var rules []AnomalyRule
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rule file %s: %w", file, err)
+		}
+
+		set, err := parseRuleSet(file, data)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, set.Rules...)
+	}
+
+	return compileRules(rules)
+}
+
+// ruleFiles expands the configured paths into rule files sorted by name,
+// with a fingerprint of their names, sizes and modification times
+func ruleFiles(paths []string) ([]string, string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read rule path: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read rule directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && ruleFileExts[strings.ToLower(filepath.Ext(entry.Name()))] {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	var fingerprint strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read rule file: %w", err)
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return files, fingerprint.String(), nil
+}
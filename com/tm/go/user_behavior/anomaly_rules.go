@@ -0,0 +1,341 @@
+package user_behavior
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Anomaly rule types
+	RuleSequence  = "sequence"
+	RuleFrequency = "frequency"
+	RuleAbsence   = "absence"
+
+	// Anomaly severities, from least to most urgent
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// knownSeverities lists the severities a rule may set
+var knownSeverities = map[string]bool{
+	SeverityLow:      true,
+	SeverityMedium:   true,
+	SeverityHigh:     true,
+	SeverityCritical: true,
+}
+
+// defaultRuleDescriptions are used by rules without a description template
+var defaultRuleDescriptions = map[string]string{
+	RuleSequence:  `Pattern {{join .Sequence "->"}} seen {{.Count}} times`,
+	RuleFrequency: `{{.Count}} matching events between {{.Start.Format "15:04:05.000"}} and {{.End.Format "15:04:05.000"}}`,
+	RuleAbsence:   `No {{join .Rule.Expected ", "}} within {{.Rule.Within}} after {{.EventType}}`,
+}
+
+// DefaultAnomalyRules are used when no rule files are configured
+var DefaultAnomalyRules = []AnomalyRule{
+	{
+		Name:        "repeated_action",
+		Type:        RuleFrequency,
+		Severity:    SeverityMedium,
+		Description: "Action '{{.EventType}}' repeated {{.Count}} times in a row",
+		Count:       5,
+		SameType:    true,
+		Consecutive: true,
+	},
+	{
+		Name:        "rapid_fire_events",
+		Type:        RuleFrequency,
+		Severity:    SeverityHigh,
+		Description: "{{.Count}} events fired less than {{.Rule.Interval}} apart",
+		Count:       6,
+		Interval:    RuleDuration(100 * time.Millisecond),
+	},
+	{
+		Name:        "stuck_pattern",
+		Type:        RuleSequence,
+		Severity:    SeverityHigh,
+		Description: `User stuck in {{join .Sequence "->"}} pattern ({{.Count}} times)`,
+		Steps:       []EventType{EventTyping, EventSendMessage, EventBackToHome},
+		Repeat:      3,
+	},
+}
+
+// AnomalyRuleSet is the content of a rule file
+type AnomalyRuleSet struct {
+	Rules []AnomalyRule `json:"rules" yaml:"rules"`
+}
+
+// AnomalyRule is one anomaly detector. Its name is reported as the anomaly
+// type and its description is a text/template rendered with AnomalyMatch.
+type AnomalyRule struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type" yaml:"type"`
+	Severity    string `json:"severity" yaml:"severity"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+
+	// Sequence rules match Steps in order with at most MaxGap other events
+	// between two steps, -1 for any number. Repeat occurrences must follow
+	// each other under the same gap limit; Within bounds the time from the
+	// first to the last step of one occurrence.
+	Steps  []EventType `json:"steps,omitempty" yaml:"steps,omitempty"`
+	MaxGap int         `json:"max_gap,omitempty" yaml:"max_gap,omitempty"`
+	Repeat int         `json:"repeat,omitempty" yaml:"repeat,omitempty"`
+
+	// Frequency rules match Count events of EventTypes, any type when empty,
+	// within Window. Interval is the longest time allowed between two counted
+	// events, SameType requires one event type and Consecutive forbids other
+	// events in between.
+	EventTypes  []EventType  `json:"event_types,omitempty" yaml:"event_types,omitempty"`
+	Count       int          `json:"count,omitempty" yaml:"count,omitempty"`
+	Window      RuleDuration `json:"window,omitempty" yaml:"window,omitempty"`
+	Interval    RuleDuration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	SameType    bool         `json:"same_type,omitempty" yaml:"same_type,omitempty"`
+	Consecutive bool         `json:"consecutive,omitempty" yaml:"consecutive,omitempty"`
+
+	// Absence rules match a Trigger event not followed by one of Expected,
+	// any event when empty, within Within
+	Trigger  EventType    `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	Expected []EventType  `json:"expected,omitempty" yaml:"expected,omitempty"`
+	Within   RuleDuration `json:"within,omitempty" yaml:"within,omitempty"`
+}
+
+// RuleDuration is a duration written as a Go duration string in rule files
+type RuleDuration time.Duration
+
+// String formats the duration like time.Duration
+func (d RuleDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d RuleDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *RuleDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %w", err)
+	}
+	return d.parse(value)
+}
+
+func (d RuleDuration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *RuleDuration) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %w", err)
+	}
+	return d.parse(value)
+}
+
+// parse sets the duration from a Go duration string
+func (d *RuleDuration) parse(value string) error {
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	*d = RuleDuration(duration)
+	return nil
+}
+
+// AnomalyMatch is one occurrence of a rule in a session's events. It is the
+// data a rule's description template is rendered with.
+type AnomalyMatch struct {
+	Rule      AnomalyRule `json:"-"`
+	SessionID string      `json:"session_id"`
+	UserID    string      `json:"user_id"`
+
+	// EventType is the repeated type of a same_type rule or the trigger of
+	// an absence rule
+	EventType EventType   `json:"event_type,omitempty"`
+	Sequence  []EventType `json:"sequence"`
+
+	// Count is the number of matched events, or occurrences of a sequence
+	Count int `json:"count"`
+
+	// FirstEvent and LastEvent are the positions of the first and last
+	// matched events in the order the session's events were observed
+	FirstEvent int       `json:"first_event"`
+	LastEvent  int       `json:"last_event"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// Duration returns the time between the first and last matched event
+func (m AnomalyMatch) Duration() time.Duration {
+	return m.End.Sub(m.Start)
+}
+
+// compiledRule is a validated rule with its parsed description
+type compiledRule struct {
+	AnomalyRule
+	description *template.Template
+	eventTypes  map[EventType]bool
+	expected    map[EventType]bool
+}
+
+// ruleTemplateFuncs are available in description templates
+var ruleTemplateFuncs = template.FuncMap{
+	"join": func(sequence []EventType, separator string) string {
+		return patternKeySep(sequence, separator)
+	},
+}
+
+// compileRule validates a rule and parses its description template
+func compileRule(rule AnomalyRule) (*compiledRule, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("%w: missing name", ErrInvalidRule)
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: rule %q: %s", ErrInvalidRule, rule.Name, fmt.Sprintf(format, args...))
+	}
+
+	rule.Type = strings.ToLower(strings.TrimSpace(rule.Type))
+	rule.Severity = strings.ToLower(strings.TrimSpace(rule.Severity))
+	if rule.Severity == "" {
+		rule.Severity = SeverityMedium
+	}
+	if !knownSeverities[rule.Severity] {
+		return nil, invalid("unknown severity %q", rule.Severity)
+	}
+
+	switch rule.Type {
+	case RuleSequence:
+		if len(rule.Steps) == 0 {
+			return nil, invalid("sequence rule needs steps")
+		}
+		if rule.MaxGap < -1 {
+			return nil, invalid("max_gap must be -1 or more")
+		}
+		if rule.Repeat <= 0 {
+			rule.Repeat = 1
+		}
+	case RuleFrequency:
+		if rule.Count < 2 {
+			return nil, invalid("frequency rule needs a count of at least 2")
+		}
+	case RuleAbsence:
+		if rule.Trigger == "" {
+			return nil, invalid("absence rule needs a trigger")
+		}
+		if rule.Within <= 0 {
+			return nil, invalid("absence rule needs a positive within")
+		}
+	default:
+		return nil, invalid("unknown type %q", rule.Type)
+	}
+	if rule.Window < 0 || rule.Interval < 0 || rule.Within < 0 {
+		return nil, invalid("durations must not be negative")
+	}
+
+	for _, eventTypes := range [][]EventType{rule.Steps, rule.EventTypes, rule.Expected} {
+		for _, eventType := range eventTypes {
+			if !eventType.IsValid() {
+				return nil, invalid("unknown event type %q", eventType)
+			}
+		}
+	}
+	if rule.Trigger != "" && !rule.Trigger.IsValid() {
+		return nil, invalid("unknown event type %q", rule.Trigger)
+	}
+
+	text := rule.Description
+	if text == "" {
+		text = defaultRuleDescriptions[rule.Type]
+	}
+	description, err := template.New(rule.Name).Funcs(ruleTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, invalid("description: %v", err)
+	}
+
+	// Field errors only show when the template runs, so run it once now
+	sample := AnomalyMatch{Rule: rule, Sequence: rule.Steps, EventType: rule.Trigger}
+	if err := description.Execute(io.Discard, sample); err != nil {
+		return nil, invalid("description: %v", err)
+	}
+
+	return &compiledRule{
+		AnomalyRule: rule,
+		description: description,
+		eventTypes:  eventTypeSet(rule.EventTypes),
+		expected:    eventTypeSet(rule.Expected),
+	}, nil
+}
+
+// eventTypeSet returns the types as a set, nil when empty
+func eventTypeSet(eventTypes []EventType) map[EventType]bool {
+	if len(eventTypes) == 0 {
+		return nil
+	}
+
+	set := make(map[EventType]bool, len(eventTypes))
+	for _, eventType := range eventTypes {
+		set[eventType] = true
+	}
+	return set
+}
+
+// anomaly renders a match as a detected anomaly
+func (r *compiledRule) anomaly(match AnomalyMatch, detectedAt time.Time) AnomalyDetection {
+	var description bytes.Buffer
+	if err := r.description.Execute(&description, match); err != nil {
+		description.Reset()
+		fmt.Fprintf(&description, "%s (description template failed: %v)", r.Name, err)
+	}
+
+	return AnomalyDetection{
+		SessionID:     match.SessionID,
+		UserID:        match.UserID,
+		AnomalyType:   r.Name,
+		Description:   description.String(),
+		EventSequence: match.Sequence,
+		DetectedAt:    detectedAt,
+		Severity:      r.Severity,
+	}
+}
+
+// parseRuleSet decodes a rule file, YAML unless the name ends in .json.
+// Unknown fields are rejected so typos in rule files are caught.
+func parseRuleSet(name string, data []byte) (AnomalyRuleSet, error) {
+	var set AnomalyRuleSet
+
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&set); err != nil {
+			return set, fmt.Errorf("%w: %s: %v", ErrInvalidRule, name, err)
+		}
+		return set, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&set); err != nil && !errors.Is(err, io.EOF) {
+		return set, fmt.Errorf("%w: %s: %v", ErrInvalidRule, name, err)
+	}
+	return set, nil
+}
+
+// patternKeySep joins a pattern with a separator
+func patternKeySep(pattern []EventType, separator string) string {
+	parts := make([]string, len(pattern))
+	for i, eventType := range pattern {
+		parts[i] = string(eventType)
+	}
+	return strings.Join(parts, separator)
+}
@@ -0,0 +1,216 @@
+package user_behavior
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []AnomalyRule
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			file: "rules.yaml",
+			data: `
+rules:
+  - name: stuck
+    type: sequence
+    severity: high
+    steps: [typing, send_message]
+    max_gap: -1
+    within: 10s
+  - name: burst
+    type: frequency
+    count: 4
+    interval: 100ms
+    disabled: true
+`,
+			want: []AnomalyRule{
+				{
+					Name:     "stuck",
+					Type:     RuleSequence,
+					Severity: SeverityHigh,
+					Steps:    []EventType{EventTyping, EventSendMessage},
+					MaxGap:   -1,
+					Within:   RuleDuration(10 * time.Second),
+				},
+				{
+					Name:     "burst",
+					Type:     RuleFrequency,
+					Count:    4,
+					Interval: RuleDuration(100 * time.Millisecond),
+					Disabled: true,
+				},
+			},
+		},
+		{
+			name: "json",
+			file: "rules.JSON",
+			data: `{"rules": [{"name": "idle", "type": "absence", "trigger": "screen_view", "within": "5m"}]}`,
+			want: []AnomalyRule{
+				{Name: "idle", Type: RuleAbsence, Trigger: EventScreenView, Within: RuleDuration(5 * time.Minute)},
+			},
+		},
+		{
+			name: "empty yaml",
+			file: "rules.yml",
+			data: "",
+		},
+		{
+			name:    "unknown yaml field",
+			file:    "rules.yaml",
+			data:    "rules:\n  - name: stuck\n    stepz: [typing]\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown json field",
+			file:    "rules.json",
+			data:    `{"rules": [{"name": "idle", "trigger_type": "screen_view"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			file:    "rules.yaml",
+			data:    "rules:\n  - name: idle\n    within: soon\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := parseRuleSet(tt.file, []byte(tt.data))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRule) {
+					t.Fatalf("parseRuleSet() error = %v, want %v", err, ErrInvalidRule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRuleSet() error = %v", err)
+			}
+
+			if len(set.Rules) != len(tt.want) {
+				t.Fatalf("parseRuleSet() got %d rules, want %d", len(set.Rules), len(tt.want))
+			}
+			for i, rule := range set.Rules {
+				want := tt.want[i]
+				if rule.Name != want.Name || rule.Type != want.Type || rule.Severity != want.Severity ||
+					rule.MaxGap != want.MaxGap || rule.Count != want.Count || rule.Trigger != want.Trigger ||
+					rule.Within != want.Within || rule.Interval != want.Interval || rule.Disabled != want.Disabled ||
+					patternKey(rule.Steps) != patternKey(want.Steps) {
+					t.Errorf("rule %d = %+v, want %+v", i, rule, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         AnomalyRule
+		wantErr      bool
+		wantSeverity string
+		wantRepeat   int
+	}{
+		{
+			name:         "sequence defaults",
+			rule:         AnomalyRule{Name: "stuck", Type: " Sequence ", Steps: []EventType{EventTyping}},
+			wantSeverity: SeverityMedium,
+			wantRepeat:   1,
+		},
+		{
+			name:         "frequency",
+			rule:         AnomalyRule{Name: "burst", Type: RuleFrequency, Severity: "HIGH", Count: 3},
+			wantSeverity: SeverityHigh,
+		},
+		{
+			name:         "absence",
+			rule:         AnomalyRule{Name: "idle", Type: RuleAbsence, Trigger: EventScreenView, Within: RuleDuration(time.Minute)},
+			wantSeverity: SeverityMedium,
+		},
+		{
+			name:    "missing name",
+			rule:    AnomalyRule{Type: RuleFrequency, Count: 3},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			rule:    AnomalyRule{Name: "x", Type: "threshold"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown severity",
+			rule:    AnomalyRule{Name: "x", Type: RuleFrequency, Count: 3, Severity: "urgent"},
+			wantErr: true,
+		},
+		{
+			name:    "sequence without steps",
+			rule:    AnomalyRule{Name: "x", Type: RuleSequence},
+			wantErr: true,
+		},
+		{
+			name:    "max gap below -1",
+			rule:    AnomalyRule{Name: "x", Type: RuleSequence, Steps: []EventType{EventTyping}, MaxGap: -2},
+			wantErr: true,
+		},
+		{
+			name:    "frequency count below 2",
+			rule:    AnomalyRule{Name: "x", Type: RuleFrequency, Count: 1},
+			wantErr: true,
+		},
+		{
+			name:    "absence without within",
+			rule:    AnomalyRule{Name: "x", Type: RuleAbsence, Trigger: EventScreenView},
+			wantErr: true,
+		},
+		{
+			name:    "negative window",
+			rule:    AnomalyRule{Name: "x", Type: RuleFrequency, Count: 3, Window: RuleDuration(-time.Second)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown event type",
+			rule:    AnomalyRule{Name: "x", Type: RuleSequence, Steps: []EventType{"swipe"}},
+			wantErr: true,
+		},
+		{
+			name:    "unparsable description",
+			rule:    AnomalyRule{Name: "x", Type: RuleFrequency, Count: 3, Description: "{{.Count"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown description field",
+			rule:    AnomalyRule{Name: "x", Type: RuleFrequency, Count: 3, Description: "{{.Total}}"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compiled, err := compileRule(tt.rule)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRule) {
+					t.Fatalf("compileRule() error = %v, want %v", err, ErrInvalidRule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compileRule() error = %v", err)
+			}
+
+			if compiled.Severity != tt.wantSeverity {
+				t.Errorf("Severity = %q, want %q", compiled.Severity, tt.wantSeverity)
+			}
+			if compiled.Repeat != tt.wantRepeat {
+				t.Errorf("Repeat = %d, want %d", compiled.Repeat, tt.wantRepeat)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package user_behavior
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Baseline methods accepted in BaselineConfig.Method
+	BaselineNone   = ""
+	BaselineZScore = "zscore"
+	BaselineEWMA   = "ewma"
+
+	// AnomalyBaselineDeviation is the anomaly type of sessions far from
+	// their user's baseline
+	AnomalyBaselineDeviation = "baseline_deviation"
+
+	DefaultBaselineThreshold   = 3.0
+	DefaultBaselineWindow      = 20
+	DefaultBaselineAlpha       = 0.2
+	DefaultBaselineMinSessions = 5
+
+	// Baseline metrics
+	MetricEventsPerMinute = "events_per_minute"
+	MetricSessionLength   = "session_length_seconds"
+	MetricActionMix       = "action_mix_distance"
+
+	// baselineMinStdDevRatio is the smallest standard deviation used, as a
+	// share of the mean, so a user with identical sessions is not flagged
+	// for the smallest change
+	baselineMinStdDevRatio = 0.05
+)
+
+// baselineMinStdDev is the smallest standard deviation of each metric, for
+// baselines with a mean close to zero
+var baselineMinStdDev = map[string]float64{
+	MetricEventsPerMinute: 0.1,
+	MetricSessionLength:   1,
+	MetricActionMix:       0.02,
+}
+
+// BaselineConfig enables the per user baseline anomaly mode. Each ended
+// session is scored against the user's earlier sessions on events per
+// minute, session length and the distance of its action mix to the user's
+// usual mix.
+type BaselineConfig struct {
+	// Method is zscore, over the user's last Window sessions, or ewma,
+	// exponentially weighted with Alpha. Disabled when empty.
+	Method string
+
+	// Threshold is the deviation, in standard deviations, at which a session
+	// is flagged. Defaults to DefaultBaselineThreshold.
+	Threshold float64
+
+	Window int
+	Alpha  float64
+
+	// MinSessions is how many sessions a user needs before being scored.
+	// Defaults to DefaultBaselineMinSessions.
+	MinSessions int
+}
+
+// Enabled reports whether the baseline mode is on
+func (c BaselineConfig) Enabled() bool {
+	return c.Method != BaselineNone
+}
+
+// withDefaults fills unset fields
+func (c BaselineConfig) withDefaults() BaselineConfig {
+	c.Method = strings.ToLower(strings.TrimSpace(c.Method))
+	if c.Threshold <= 0 {
+		c.Threshold = DefaultBaselineThreshold
+	}
+	if c.Window <= 1 {
+		c.Window = DefaultBaselineWindow
+	}
+	if c.Alpha <= 0 || c.Alpha >= 1 {
+		c.Alpha = DefaultBaselineAlpha
+	}
+	if c.MinSessions <= 1 {
+		c.MinSessions = DefaultBaselineMinSessions
+	}
+	return c
+}
+
+// validate checks the method
+func (c BaselineConfig) validate() error {
+	switch c.Method {
+	case BaselineNone, BaselineZScore, BaselineEWMA:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownBaseline, c.Method)
+}
+
+// metricBaseline is the rolling baseline of one metric of a user
+type metricBaseline struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	Var   float64 `json:"var"`
+
+	// Recent holds the last values for the zscore method
+	Recent []float64 `json:"recent,omitempty"`
+}
+
+// userBaseline is the baseline of a user's sessions
+type userBaseline struct {
+	EventsPerMinute metricBaseline `json:"events_per_minute"`
+	SessionLength   metricBaseline `json:"session_length"`
+	ActionMix       metricBaseline `json:"action_mix"`
+
+	// Mix is the exponentially weighted share of each event type
+	Mix map[EventType]float64 `json:"mix,omitempty"`
+}
+
+// baselineDeviation is one metric of a session far from the baseline
+type baselineDeviation struct {
+	metric string
+	value  float64
+	mean   float64
+	stdDev float64
+	score  float64 // signed, in standard deviations
+}
+
+// baselineDetector scores sessions against user baselines
+type baselineDetector struct {
+	config BaselineConfig
+}
+
+// newBaselineDetector returns a detector, nil when the mode is disabled
+func newBaselineDetector(config BaselineConfig) (*baselineDetector, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if !config.Enabled() {
+		return nil, nil
+	}
+	return &baselineDetector{config: config}, nil
+}
+
+// observe scores a session against the baseline, then adds it to the
+// baseline. It returns a baseline_deviation anomaly when a metric is over
+// the threshold.
+func (bd *baselineDetector) observe(baseline *userBaseline, session Session, end time.Time, eventCounts map[EventType]int, now time.Time) *AnomalyDetection {
+	total := 0
+	for _, count := range eventCounts {
+		total += count
+	}
+	if total == 0 {
+		return nil
+	}
+
+	length := end.Sub(session.StartTime)
+	minutes := math.Max(length.Minutes(), 1)
+	mix := make(map[EventType]float64, len(eventCounts))
+	for eventType, count := range eventCounts {
+		mix[eventType] = float64(count) / float64(total)
+	}
+
+	var deviations []baselineDeviation
+	check := func(metric string, b *metricBaseline, value float64, twoSided bool) {
+		if deviation, ok := bd.score(b, value, baselineMinStdDev[metric]); ok && (twoSided || deviation.score > 0) &&
+			math.Abs(deviation.score) >= bd.config.Threshold {
+			deviation.metric = metric
+			deviations = append(deviations, deviation)
+		}
+		bd.update(b, value)
+	}
+
+	check(MetricEventsPerMinute, &baseline.EventsPerMinute, float64(total)/minutes, true)
+	check(MetricSessionLength, &baseline.SessionLength, length.Seconds(), true)
+
+	// The first session sets the usual mix; later ones are scored on how far
+	// they are from it, only when further than usual
+	if baseline.Mix != nil {
+		check(MetricActionMix, &baseline.ActionMix, mixDistance(mix, baseline.Mix), false)
+	}
+	baseline.Mix = blendMix(baseline.Mix, mix, bd.config.Alpha)
+
+	if len(deviations) == 0 {
+		return nil
+	}
+	return bd.anomaly(session, deviations, now)
+}
+
+// score returns how far value is from the baseline, false while the
+// baseline has too few sessions
+func (bd *baselineDetector) score(b *metricBaseline, value, minStdDev float64) (baselineDeviation, bool) {
+	if b.Count < bd.config.MinSessions {
+		return baselineDeviation{}, false
+	}
+
+	mean, variance := b.Mean, b.Var
+	if bd.config.Method == BaselineZScore {
+		mean, variance = meanVariance(b.Recent)
+	}
+
+	stdDev := math.Max(math.Sqrt(variance), math.Max(baselineMinStdDevRatio*math.Abs(mean), minStdDev))
+	return baselineDeviation{
+		value:  value,
+		mean:   mean,
+		stdDev: stdDev,
+		score:  (value - mean) / stdDev,
+	}, true
+}
+
+// update adds a value to the baseline
+func (bd *baselineDetector) update(b *metricBaseline, value float64) {
+	b.Count++
+
+	if bd.config.Method == BaselineZScore {
+		b.Recent = append(b.Recent, value)
+		if len(b.Recent) > bd.config.Window {
+			b.Recent = append(b.Recent[:0], b.Recent[len(b.Recent)-bd.config.Window:]...)
+		}
+		b.Mean, b.Var = meanVariance(b.Recent)
+		return
+	}
+
+	if b.Count == 1 {
+		b.Mean, b.Var = value, 0
+		return
+	}
+	alpha := bd.config.Alpha
+	diff := value - b.Mean
+	b.Mean += alpha * diff
+	b.Var = (1 - alpha) * (b.Var + alpha*diff*diff)
+}
+
+// anomaly reports the deviations of a session, with a severity following
+// the largest one
+func (bd *baselineDetector) anomaly(session Session, deviations []baselineDeviation, now time.Time) *AnomalyDetection {
+	sort.Slice(deviations, func(i, j int) bool {
+		return math.Abs(deviations[i].score) > math.Abs(deviations[j].score)
+	})
+
+	parts := make([]string, len(deviations))
+	for i, d := range deviations {
+		parts[i] = fmt.Sprintf("%s %.2f vs baseline %.2f±%.2f (%+.1fσ)", d.metric, d.value, d.mean, d.stdDev, d.score)
+	}
+
+	return &AnomalyDetection{
+		SessionID:   session.SessionID,
+		UserID:      session.UserID,
+		AnomalyType: AnomalyBaselineDeviation,
+		Description: "Session deviates from the user's baseline: " + strings.Join(parts, "; "),
+		DetectedAt:  now,
+		Severity:    bd.severity(math.Abs(deviations[0].score)),
+	}
+}
+
+// severity grows with the deviation relative to the threshold
+func (bd *baselineDetector) severity(score float64) string {
+	switch ratio := score / bd.config.Threshold; {
+	case ratio >= 3:
+		return SeverityCritical
+	case ratio >= 2:
+		return SeverityHigh
+	case ratio >= 1.5:
+		return SeverityMedium
+	default:
+		return SeverityLow
+	}
+}
+
+// meanVariance returns the mean and population variance of values
+func meanVariance(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, squares / float64(len(values))
+}
+
+// mixDistance is the total variation distance of two event type mixes,
+// from 0 for the same mix to 1 for disjoint ones
+func mixDistance(a, b map[EventType]float64) float64 {
+	var distance float64
+	for eventType, share := range a {
+		distance += math.Abs(share - b[eventType])
+	}
+	for eventType, share := range b {
+		if _, ok := a[eventType]; !ok {
+			distance += share
+		}
+	}
+	return distance / 2
+}
+
+// blendMix moves the usual mix towards a session's mix by alpha
+func blendMix(usual, mix map[EventType]float64, alpha float64) map[EventType]float64 {
+	if usual == nil {
+		blended := make(map[EventType]float64, len(mix))
+		for eventType, share := range mix {
+			blended[eventType] = share
+		}
+		return blended
+	}
+
+	for eventType := range usual {
+		usual[eventType] *= 1 - alpha
+	}
+	for eventType, share := range mix {
+		usual[eventType] += alpha * share
+	}
+	for eventType, share := range usual {
+		if share < 1e-4 {
+			delete(usual, eventType)
+		}
+	}
+	return usual
+}
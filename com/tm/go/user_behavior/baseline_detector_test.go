@@ -0,0 +1,235 @@
+package user_behavior
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaselineObserve(t *testing.T) {
+	t0 := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	usual := map[EventType]int{EventTyping: 10, EventButtonClick: 10}
+
+	tests := []struct {
+		name         string
+		method       string
+		history      int
+		length       time.Duration
+		counts       map[EventType]int
+		wantMetrics  []string // in order of deviation, none when no anomaly
+		wantSeverity string
+	}{
+		{
+			name:    "usual session",
+			method:  BaselineZScore,
+			history: 6,
+			length:  10 * time.Minute,
+			counts:  usual,
+		},
+		{
+			name:    "too few sessions",
+			method:  BaselineZScore,
+			history: 3,
+			length:  10 * time.Minute,
+			counts:  map[EventType]int{EventTyping: 200},
+		},
+		{
+			name:         "faster events",
+			method:       BaselineZScore,
+			history:      6,
+			length:       10 * time.Minute,
+			counts:       map[EventType]int{EventTyping: 12, EventButtonClick: 13},
+			wantMetrics:  []string{MetricEventsPerMinute},
+			wantSeverity: SeverityMedium,
+		},
+		{
+			name:         "much longer session",
+			method:       BaselineEWMA,
+			history:      6,
+			length:       2 * time.Hour,
+			counts:       map[EventType]int{EventTyping: 120, EventButtonClick: 120},
+			wantMetrics:  []string{MetricSessionLength},
+			wantSeverity: SeverityCritical,
+		},
+		{
+			name:         "different action mix",
+			method:       BaselineEWMA,
+			history:      6,
+			length:       10 * time.Minute,
+			counts:       map[EventType]int{EventTyping: 10, EventButtonClick: 8, EventSearch: 2},
+			wantMetrics:  []string{MetricActionMix},
+			wantSeverity: SeverityMedium,
+		},
+		{
+			name:         "slower and shorter",
+			method:       BaselineZScore,
+			history:      6,
+			length:       time.Minute,
+			counts:       map[EventType]int{EventTyping: 1},
+			wantMetrics:  []string{MetricActionMix, MetricSessionLength, MetricEventsPerMinute},
+			wantSeverity: SeverityCritical,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := newBaselineDetector(BaselineConfig{Method: tt.method})
+			if err != nil {
+				t.Fatalf("newBaselineDetector() error = %v", err)
+			}
+
+			var baseline userBaseline
+			for i := 0; i < tt.history; i++ {
+				start := t0.Add(time.Duration(i) * time.Hour)
+				session := Session{SessionID: "past", UserID: "u1", StartTime: start}
+				if anomaly := detector.observe(&baseline, session, start.Add(10*time.Minute), usual, start); anomaly != nil {
+					t.Fatalf("history session %d flagged: %s", i, anomaly.Description)
+				}
+			}
+
+			start := t0.Add(24 * time.Hour)
+			session := Session{SessionID: "s1", UserID: "u1", StartTime: start}
+			anomaly := detector.observe(&baseline, session, start.Add(tt.length), tt.counts, start)
+
+			if len(tt.wantMetrics) == 0 {
+				if anomaly != nil {
+					t.Fatalf("observe() = %s, want no anomaly", anomaly.Description)
+				}
+				return
+			}
+			if anomaly == nil {
+				t.Fatalf("observe() = nil, want %v", tt.wantMetrics)
+			}
+
+			if anomaly.AnomalyType != AnomalyBaselineDeviation || anomaly.SessionID != "s1" || anomaly.UserID != "u1" {
+				t.Errorf("anomaly = %+v", anomaly)
+			}
+			if anomaly.Severity != tt.wantSeverity {
+				t.Errorf("Severity = %q, want %q", anomaly.Severity, tt.wantSeverity)
+			}
+			parts := strings.Split(strings.TrimPrefix(anomaly.Description, "Session deviates from the user's baseline: "), "; ")
+			if len(parts) != len(tt.wantMetrics) {
+				t.Fatalf("Description = %q, want metrics %v", anomaly.Description, tt.wantMetrics)
+			}
+			for i, metric := range tt.wantMetrics {
+				if !strings.HasPrefix(parts[i], metric+" ") {
+					t.Errorf("deviation %d = %q, want %s", i, parts[i], metric)
+				}
+			}
+		})
+	}
+}
+
+func TestBaselineUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   BaselineConfig
+		values   []float64
+		wantMean float64
+		wantVar  float64
+	}{
+		{
+			name:     "zscore over the window",
+			config:   BaselineConfig{Method: BaselineZScore, Window: 3},
+			values:   []float64{100, 1, 2, 3},
+			wantMean: 2,
+			wantVar:  2.0 / 3,
+		},
+		{
+			name:     "ewma first value",
+			config:   BaselineConfig{Method: BaselineEWMA},
+			values:   []float64{4},
+			wantMean: 4,
+		},
+		{
+			name:     "ewma",
+			config:   BaselineConfig{Method: BaselineEWMA, Alpha: 0.5},
+			values:   []float64{4, 8},
+			wantMean: 6,
+			wantVar:  4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := newBaselineDetector(tt.config)
+			if err != nil {
+				t.Fatalf("newBaselineDetector() error = %v", err)
+			}
+
+			var b metricBaseline
+			for _, value := range tt.values {
+				detector.update(&b, value)
+			}
+			if b.Count != len(tt.values) {
+				t.Errorf("Count = %d, want %d", b.Count, len(tt.values))
+			}
+			if math.Abs(b.Mean-tt.wantMean) > 1e-9 || math.Abs(b.Var-tt.wantVar) > 1e-9 {
+				t.Errorf("Mean, Var = %v, %v, want %v, %v", b.Mean, b.Var, tt.wantMean, tt.wantVar)
+			}
+		})
+	}
+}
+
+func TestMixDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b map[EventType]float64
+		want float64
+	}{
+		{
+			name: "same mix",
+			a:    map[EventType]float64{EventTyping: 0.5, EventSearch: 0.5},
+			b:    map[EventType]float64{EventTyping: 0.5, EventSearch: 0.5},
+			want: 0,
+		},
+		{
+			name: "disjoint mixes",
+			a:    map[EventType]float64{EventTyping: 1},
+			b:    map[EventType]float64{EventSearch: 1},
+			want: 1,
+		},
+		{
+			name: "partial overlap",
+			a:    map[EventType]float64{EventTyping: 0.75, EventSearch: 0.25},
+			b:    map[EventType]float64{EventTyping: 0.5, EventButtonClick: 0.5},
+			want: 0.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mixDistance(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("mixDistance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBaselineDetector(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      BaselineConfig
+		wantEnabled bool
+		wantErr     error
+	}{
+		{name: "disabled", config: BaselineConfig{}},
+		{name: "zscore", config: BaselineConfig{Method: " ZScore "}, wantEnabled: true},
+		{name: "ewma", config: BaselineConfig{Method: BaselineEWMA}, wantEnabled: true},
+		{name: "unknown method", config: BaselineConfig{Method: "median"}, wantErr: ErrUnknownBaseline},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := newBaselineDetector(tt.config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newBaselineDetector() error = %v, want %v", err, tt.wantErr)
+			}
+			if (detector != nil) != tt.wantEnabled {
+				t.Errorf("newBaselineDetector() = %v, want enabled %v", detector, tt.wantEnabled)
+			}
+		})
+	}
+}
@@ -11,19 +11,27 @@ import (
 // BehaviorAnalyzer analyzes user behavior patterns and detects anomalies
 type BehaviorAnalyzer struct {
 	sessionManager *SessionManager
-	hbaseReader    *HBaseWriter
+	store          EventStore
+	rules          *AnomalyRuleEngine
+	profiles       *UserProfileStore
+	alerts         *SessionSubscription
+	alertsDone     chan struct{} // closed once the alerts are reported
 	ctx            context.Context
 	cancel         context.CancelFunc
 	mu             sync.RWMutex
 }
 
-// NewBehaviorAnalyzer creates a new behavior analyzer
-func NewBehaviorAnalyzer(sessionManager *SessionManager, hbaseReader *HBaseWriter) *BehaviorAnalyzer {
+// NewBehaviorAnalyzer creates a new behavior analyzer detecting anomalies
+// with the given rules and the baseline deviations kept by the profiles
+func NewBehaviorAnalyzer(sessionManager *SessionManager, store EventStore, rules *AnomalyRuleEngine, profiles *UserProfileStore) *BehaviorAnalyzer {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &BehaviorAnalyzer{
 		sessionManager: sessionManager,
-		hbaseReader:    hbaseReader,
+		store:          store,
+		rules:          rules,
+		profiles:       profiles,
+		alerts:         sessionManager.SubscribeAnomalies("behavior_analyzer"),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
@@ -31,17 +39,49 @@ func NewBehaviorAnalyzer(sessionManager *SessionManager, hbaseReader *HBaseWrite
 
 // Start begins the behavior analyzer
 func (ba *BehaviorAnalyzer) Start() {
-	go ba.monitorExpiredSessions()
+	ba.rules.Start()
+	ba.alertsDone = make(chan struct{})
+	go ba.monitorAnomalies()
 }
 
-// Stop gracefully stops the analyzer
+// Stop gracefully stops the analyzer. Call it once the session manager is
+// stopped, so every anomaly detected until then is reported.
 func (ba *BehaviorAnalyzer) Stop() {
+	if ba.alertsDone != nil {
+		<-ba.alertsDone
+	}
 	ba.cancel()
+	ba.rules.Stop()
+}
+
+// Rules returns the anomaly rule engine
+func (ba *BehaviorAnalyzer) Rules() *AnomalyRuleEngine {
+	return ba.rules
+}
+
+// scanEvents reads the events of the given types within [from, to), of
+// every type when none are given
+func (ba *BehaviorAnalyzer) scanEvents(eventTypes []EventType, from, to time.Time) ([]UserEvent, error) {
+	if len(eventTypes) == 0 {
+		for eventType := range knownEventTypes {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+
+	var events []UserEvent
+	for _, eventType := range eventTypes {
+		scanned, err := ba.store.ScanEventType(eventType, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s events: %w", eventType, err)
+		}
+		events = append(events, scanned...)
+	}
+	return events, nil
 }
 
 // GetMostUsedActions returns the most frequently used actions
 func (ba *BehaviorAnalyzer) GetMostUsedActions(sessionID string) ([]ActionStats, error) {
-	events, err := ba.hbaseReader.GetSessionEvents(sessionID)
+	events, err := ba.store.GetSessionEvents(sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -76,85 +116,53 @@ func (ba *BehaviorAnalyzer) GetMostUsedActions(sessionID string) ([]ActionStats,
 	return stats, nil
 }
 
-// GetActionPatterns identifies common sequences of actions
-func (ba *BehaviorAnalyzer) GetActionPatterns(sessionID string, patternLength int) ([]ActionPattern, error) {
-	events, err := ba.hbaseReader.GetSessionEvents(sessionID)
+// GetActionPatterns mines the frequent sequences of actions of one session,
+// a user's sessions or every session in a time range. Patterns of any length
+// within the query's bounds are found, with gaps of up to MaxGap actions.
+func (ba *BehaviorAnalyzer) GetActionPatterns(query PatternQuery) (*PatternReport, error) {
+	query, err := query.withDefaults()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(events) < patternLength {
-		return []ActionPattern{}, nil
+	var events []UserEvent
+	switch {
+	case query.SessionID != "":
+		events, err = ba.store.GetSessionEvents(query.SessionID)
+	case query.UserID != "":
+		events, err = ba.store.ScanUserEvents(query.UserID, query.From, query.To)
+	default:
+		events, err = ba.scanEvents(query.EventTypes, query.From, query.To)
 	}
-
-	// Extract patterns
-	patternCounts := make(map[string]*ActionPattern)
-
-	for i := 0; i <= len(events)-patternLength; i++ {
-		pattern := make([]EventType, patternLength)
-		startTime := events[i].Timestamp
-		endTime := events[i+patternLength-1].Timestamp
-
-		for j := 0; j < patternLength; j++ {
-			pattern[j] = events[i+j].EventType
-		}
-
-		// Create pattern key
-		key := patternKey(pattern)
-
-		if existing, exists := patternCounts[key]; exists {
-			existing.Count++
-			duration := endTime.Sub(startTime).Seconds()
-			existing.AvgDuration = (existing.AvgDuration*float64(existing.Count-1) + duration) / float64(existing.Count)
-		} else {
-			patternCounts[key] = &ActionPattern{
-				Pattern:     pattern,
-				Count:       1,
-				AvgDuration: endTime.Sub(startTime).Seconds(),
-			}
-		}
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert to slice and sort
-	var patterns []ActionPattern
-	for _, p := range patternCounts {
-		if p.Count > 1 { // Only include patterns that occur more than once
-			patterns = append(patterns, *p)
-		}
+	report := minePatterns(query, patternSessions(filterEventTypes(events, query.EventTypes)))
+	report.SessionID = query.SessionID
+	report.UserID = query.UserID
+	if query.SessionID == "" {
+		report.From = &query.From
+		report.To = &query.To
 	}
-
-	sort.Slice(patterns, func(i, j int) bool {
-		return patterns[i].Count > patterns[j].Count
-	})
-
-	return patterns, nil
+	return report, nil
 }
 
 // DetectAnomalies identifies unusual behavior patterns
 func (ba *BehaviorAnalyzer) DetectAnomalies(sessionID string) ([]AnomalyDetection, error) {
-	events, err := ba.hbaseReader.GetSessionEvents(sessionID)
+	events, err := ba.store.GetSessionEvents(sessionID)
 	if err != nil {
 		return nil, err
 	}
 
-	var anomalies []AnomalyDetection
-
-	// Check for repeated actions
-	repeatedAnomalies := ba.detectRepeatedActions(events)
-	anomalies = append(anomalies, repeatedAnomalies...)
-
-	// Check for rapid fire events
-	rapidFireAnomalies := ba.detectRapidFireEvents(events)
-	anomalies = append(anomalies, rapidFireAnomalies...)
-
-	// Check for stuck patterns (e.g., typing->send->back loop)
-	stuckPatternAnomalies := ba.detectStuckPatterns(events)
-	anomalies = append(anomalies, stuckPatternAnomalies...)
+	// Repeated actions, rapid fire events, stuck patterns and any other
+	// configured rules
+	anomalies := ba.rules.Detect(events, time.Now())
 
 	// Check for session without close
 	if len(events) > 0 {
 		lastEvent := events[len(events)-1]
-		if lastEvent.EventType != EventAppClose && time.Since(lastEvent.Timestamp) > SessionTimeout {
+		if lastEvent.EventType != EventAppClose && time.Since(lastEvent.Timestamp) > ba.sessionManager.SessionTimeout(sessionID) {
 			anomalies = append(anomalies, AnomalyDetection{
 				SessionID:   sessionID,
 				UserID:      lastEvent.UserID,
@@ -164,144 +172,61 @@ func (ba *BehaviorAnalyzer) DetectAnomalies(sessionID string) ([]AnomalyDetectio
 				Severity:    "low",
 			})
 		}
-	}
-
-	return anomalies, nil
-}
-
-// detectRepeatedActions finds actions repeated excessively
-func (ba *BehaviorAnalyzer) detectRepeatedActions(events []UserEvent) []AnomalyDetection {
-	var anomalies []AnomalyDetection
-
-	if len(events) < 5 {
-		return anomalies
-	}
-
-	// Sliding window to detect same action repeated
-	windowSize := 5
-	for i := 0; i <= len(events)-windowSize; i++ {
-		firstType := events[i].EventType
-		allSame := true
-
-		for j := 1; j < windowSize; j++ {
-			if events[i+j].EventType != firstType {
-				allSame = false
-				break
-			}
-		}
 
-		if allSame {
-			sequence := make([]EventType, windowSize)
-			for j := 0; j < windowSize; j++ {
-				sequence[j] = events[i+j].EventType
+		// Deviation from the user's baseline, known once the session ended
+		if ba.profiles != nil {
+			if anomaly, ok := ba.profiles.SessionAnomaly(lastEvent.UserID, sessionID); ok {
+				anomalies = append(anomalies, anomaly)
 			}
-
-			anomalies = append(anomalies, AnomalyDetection{
-				SessionID:     events[i].SessionID,
-				UserID:        events[i].UserID,
-				AnomalyType:   "repeated_action",
-				Description:   fmt.Sprintf("Action '%s' repeated %d times in a row", firstType, windowSize),
-				EventSequence: sequence,
-				DetectedAt:    time.Now(),
-				Severity:      "medium",
-			})
-
-			i += windowSize - 1 // Skip ahead
 		}
 	}
 
-	return anomalies
+	return anomalies, nil
 }
 
-// detectRapidFireEvents finds events happening too quickly
-func (ba *BehaviorAnalyzer) detectRapidFireEvents(events []UserEvent) []AnomalyDetection {
-	var anomalies []AnomalyDetection
-
-	rapidFireThreshold := 100 * time.Millisecond
-	rapidFireCount := 0
-
-	for i := 1; i < len(events); i++ {
-		timeDiff := events[i].Timestamp.Sub(events[i-1].Timestamp)
-
-		if timeDiff < rapidFireThreshold {
-			rapidFireCount++
-		} else {
-			rapidFireCount = 0
-		}
-
-		if rapidFireCount >= 5 {
-			anomalies = append(anomalies, AnomalyDetection{
-				SessionID:   events[i].SessionID,
-				UserID:      events[i].UserID,
-				AnomalyType: "rapid_fire_events",
-				Description: fmt.Sprintf("Multiple events fired within %v", rapidFireThreshold),
-				DetectedAt:  time.Now(),
-				Severity:    "high",
-			})
-			rapidFireCount = 0
-		}
+// TestAnomalyRule replays a stored session through one rule: the loaded rule
+// called name, or definition when it is set, so a rule can be checked
+// against real sessions before it is deployed or enabled
+func (ba *BehaviorAnalyzer) TestAnomalyRule(sessionID, name string, definition *AnomalyRule) (*AnomalyRuleTest, error) {
+	events, err := ba.store.GetSessionEvents(sessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	return anomalies
-}
-
-// detectStuckPatterns finds users stuck in repetitive patterns (typing->send->back)
-func (ba *BehaviorAnalyzer) detectStuckPatterns(events []UserEvent) []AnomalyDetection {
-	var anomalies []AnomalyDetection
-
-	// Define problematic patterns
-	stuckPattern := []EventType{EventTyping, EventSendMessage, EventBackToHome}
-
-	// Count pattern occurrences
-	patternCount := 0
-	patternIndex := 0
-
-	for i := 0; i < len(events); i++ {
-		if events[i].EventType == stuckPattern[patternIndex] {
-			patternIndex++
-
-			if patternIndex == len(stuckPattern) {
-				patternCount++
-				patternIndex = 0
-
-				// If pattern repeats 3+ times, it's anomalous
-				if patternCount >= 3 {
-					anomalies = append(anomalies, AnomalyDetection{
-						SessionID:     events[i].SessionID,
-						UserID:        events[i].UserID,
-						AnomalyType:   "stuck_pattern",
-						Description:   fmt.Sprintf("User stuck in typing->send->back pattern (%d times)", patternCount),
-						EventSequence: stuckPattern,
-						DetectedAt:    time.Now(),
-						Severity:      "high",
-					})
-					patternCount = 0
-				}
-			}
-		} else {
-			patternIndex = 0
-			patternCount = 0
-		}
+	var test *AnomalyRuleTest
+	if definition != nil {
+		test, err = ba.rules.TestRuleDefinition(*definition, events, time.Now())
+	} else {
+		test, err = ba.rules.TestRule(name, events, time.Now())
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return anomalies
+	test.SessionID = sessionID
+	return test, nil
 }
 
 // DetectRepeatedPatterns specifically detects repeated action sequences for chat scenarios
 func (ba *BehaviorAnalyzer) DetectRepeatedPatterns(sessionID string) ([]RepeatedActionPattern, error) {
-	events, err := ba.hbaseReader.GetSessionEvents(sessionID)
+	events, err := ba.store.GetSessionEvents(sessionID)
 	if err != nil {
 		return nil, err
 	}
 
 	var patterns []RepeatedActionPattern
 
-	// Look for typing -> send -> back pattern
-	chatPattern := []EventType{EventTyping, EventSendMessage, EventBackToHome}
-	chatRepeats := ba.countPatternRepeats(events, chatPattern)
+	// Look for the patterns of repeating sequence rules, such as the
+	// typing -> send -> back chat pattern
+	for _, rule := range ba.rules.sequenceRules() {
+		if rule.Repeat <= 1 {
+			continue
+		}
 
-	if chatRepeats.RepeatCount >= 3 {
-		patterns = append(patterns, chatRepeats)
+		repeats := ba.countPatternRepeats(events, rule.Steps)
+		if repeats.RepeatCount >= rule.Repeat {
+			patterns = append(patterns, repeats)
+		}
 	}
 
 	return patterns, nil
@@ -353,15 +278,20 @@ func (ba *BehaviorAnalyzer) countPatternRepeats(events []UserEvent, pattern []Ev
 	return result
 }
 
-// monitorExpiredSessions monitors for expired sessions and triggers analysis
-func (ba *BehaviorAnalyzer) monitorExpiredSessions() {
-	expiredChannel := ba.sessionManager.GetExpiredSessionChannel()
+// monitorAnomalies logs the anomalies detected as events are processed
+func (ba *BehaviorAnalyzer) monitorAnomalies() {
+	defer close(ba.alertsDone)
 
 	for {
 		select {
-		case sessionID := <-expiredChannel:
-			// Perform analysis on expired session
-			go ba.analyzeExpiredSession(sessionID)
+		case event, ok := <-ba.alerts.C():
+			if !ok {
+				return
+			}
+
+			anomaly := event.Anomaly
+			fmt.Printf("Detected anomaly in session %s: %s: %s (severity: %s)\n",
+				anomaly.SessionID, anomaly.AnomalyType, anomaly.Description, anomaly.Severity)
 
 		case <-ba.ctx.Done():
 			return
@@ -369,31 +299,7 @@ func (ba *BehaviorAnalyzer) monitorExpiredSessions() {
 	}
 }
 
-// analyzeExpiredSession performs full analysis on an expired session
-func (ba *BehaviorAnalyzer) analyzeExpiredSession(sessionID string) {
-	// Detect anomalies
-	anomalies, err := ba.DetectAnomalies(sessionID)
-	if err != nil {
-		fmt.Printf("Error detecting anomalies for session %s: %v\n", sessionID, err)
-		return
-	}
-
-	if len(anomalies) > 0 {
-		fmt.Printf("Detected %d anomalies in session %s\n", len(anomalies), sessionID)
-		for _, anomaly := range anomalies {
-			fmt.Printf("  - %s: %s (severity: %s)\n", anomaly.AnomalyType, anomaly.Description, anomaly.Severity)
-		}
-	}
-}
-
 // patternKey creates a string key from a pattern
 func patternKey(pattern []EventType) string {
-	key := ""
-	for i, et := range pattern {
-		if i > 0 {
-			key += "->"
-		}
-		key += string(et)
-	}
-	return key
+	return patternKeySep(pattern, "->")
 }
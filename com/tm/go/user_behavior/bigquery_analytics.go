@@ -0,0 +1,141 @@
+package user_behavior
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// topActionsSQL counts events per type; %s is the events table
+	topActionsSQL = `
+SELECT
+  event_type,
+  COUNT(*) AS total_count
+FROM %s
+WHERE timestamp >= @start AND timestamp < @end
+GROUP BY event_type
+ORDER BY total_count DESC`
+
+	// anomalyReportSQL lists one row per anomaly of each anomalous session
+	// with its stored severity; %s is the session summaries table
+	anomalyReportSQL = `
+SELECT
+  session_id,
+  user_id,
+  end_time,
+  anomaly_type,
+  IFNULL(anomaly_severities[SAFE_OFFSET(anomaly_index)], '') AS severity
+FROM %s, UNNEST(anomaly_types) AS anomaly_type WITH OFFSET AS anomaly_index
+WHERE has_anomaly = true
+  AND start_time >= @start AND start_time < @end
+ORDER BY start_time DESC`
+)
+
+// BigQueryAnalytics runs analytics queries against the tables written by BigQueryWriter
+type BigQueryAnalytics struct {
+	client       *bigquery.Client
+	eventTable   string
+	summaryTable string
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// NewBigQueryAnalytics creates a BigQuery analytics backend
+func NewBigQueryAnalytics(projectID, dataset, eventTable, summaryTable string) (*BigQueryAnalytics, error) {
+	ctx := context.Background()
+
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BQ client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &BigQueryAnalytics{
+		client:       client,
+		eventTable:   fmt.Sprintf("`%s.%s.%s`", projectID, dataset, eventTable),
+		summaryTable: fmt.Sprintf("`%s.%s.%s`", projectID, dataset, summaryTable),
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+// TopActions counts events per type in BigQuery
+func (ba *BigQueryAnalytics) TopActions(start, end time.Time) ([]ActionStats, error) {
+	it, err := ba.run(fmt.Sprintf(topActionsSQL, ba.eventTable), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[EventType]int64)
+	for {
+		var row struct {
+			EventType  string `bigquery:"event_type"`
+			TotalCount int64  `bigquery:"total_count"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read top actions: %w", err)
+		}
+		counts[EventType(row.EventType)] = row.TotalCount
+	}
+
+	return actionStatsFromCounts(counts), nil
+}
+
+// AnomalyReport reads anomalous sessions from the summaries table
+func (ba *BigQueryAnalytics) AnomalyReport(start, end time.Time) ([]AnomalyDetection, error) {
+	it, err := ba.run(fmt.Sprintf(anomalyReportSQL, ba.summaryTable), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []AnomalyDetection
+	for {
+		var row struct {
+			SessionID   string    `bigquery:"session_id"`
+			UserID      string    `bigquery:"user_id"`
+			EndTime     time.Time `bigquery:"end_time"`
+			AnomalyType string    `bigquery:"anomaly_type"`
+			Severity    string    `bigquery:"severity"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read anomaly report: %w", err)
+		}
+		report = append(report, summaryAnomaly(row.SessionID, row.UserID, row.AnomalyType, row.Severity, row.EndTime))
+	}
+
+	return report, nil
+}
+
+// Close closes the BigQuery client
+func (ba *BigQueryAnalytics) Close() error {
+	ba.cancel()
+	return ba.client.Close()
+}
+
+// run executes a query with the @start and @end parameters
+func (ba *BigQueryAnalytics) run(sql string, start, end time.Time) (*bigquery.RowIterator, error) {
+	query := ba.client.Query(sql)
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "start", Value: start},
+		{Name: "end", Value: end},
+	}
+
+	it, err := query.Read(ba.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run BQ query: %w", err)
+	}
+	return it, nil
+}
@@ -2,7 +2,9 @@ package user_behavior
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,6 +15,13 @@ const (
 	// BigQuery batch configuration
 	DefaultBatchSize     = 500
 	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultRollupTable is used when no rollup table is configured
+	DefaultRollupTable = "rollups"
+
+	// Default tables of user profiles and cohort retention tables
+	DefaultProfileTable   = "user_profiles"
+	DefaultRetentionTable = "cohort_retention"
 )
 
 // BigQueryWriter handles batch writing events to BigQuery
@@ -21,6 +30,9 @@ type BigQueryWriter struct {
 	dataset       string
 	eventTable    string
 	summaryTable  string
+	rollupTable   string
+	profileTable  string
+	cohortTable   string
 	eventBatch    []UserEvent
 	summaryBatch  []SessionSummary
 	eventMu       sync.Mutex
@@ -34,17 +46,30 @@ type BigQueryWriter struct {
 
 // BQMetrics tracks BigQuery write performance
 type BQMetrics struct {
-	EventsWritten   int64
+	EventsWritten    int64
 	SummariesWritten int64
-	ErrorCount      int64
-	BatchCount      int64
-	mu              sync.Mutex
+	RollupsWritten   int64
+	ProfilesWritten  int64
+	RetentionWritten int64
+	ErrorCount       int64
+	BatchCount       int64
+	mu               sync.Mutex
 }
 
 // NewBigQueryWriter creates a new BigQuery writer
-func NewBigQueryWriter(projectID, dataset, eventTable, summaryTable string) (*BigQueryWriter, error) {
+func NewBigQueryWriter(projectID, dataset, eventTable, summaryTable, rollupTable, profileTable, retentionTable string) (*BigQueryWriter, error) {
 	ctx := context.Background()
 
+	if rollupTable == "" {
+		rollupTable = DefaultRollupTable
+	}
+	if profileTable == "" {
+		profileTable = DefaultProfileTable
+	}
+	if retentionTable == "" {
+		retentionTable = DefaultRetentionTable
+	}
+
 	client, err := bigquery.NewClient(ctx, projectID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create BQ client: %w", err)
@@ -57,6 +82,9 @@ func NewBigQueryWriter(projectID, dataset, eventTable, summaryTable string) (*Bi
 		dataset:       dataset,
 		eventTable:    eventTable,
 		summaryTable:  summaryTable,
+		rollupTable:   rollupTable,
+		profileTable:  profileTable,
+		cohortTable:   retentionTable,
 		eventBatch:    make([]UserEvent, 0, DefaultBatchSize),
 		summaryBatch:  make([]SessionSummary, 0, DefaultBatchSize),
 		batchSize:     DefaultBatchSize,
@@ -67,6 +95,11 @@ func NewBigQueryWriter(projectID, dataset, eventTable, summaryTable string) (*Bi
 	}, nil
 }
 
+// Name returns the sink name of the BigQuery writer
+func (bw *BigQueryWriter) Name() string {
+	return SinkBigQuery
+}
+
 // Start begins the BigQuery writer background workers
 func (bw *BigQueryWriter) Start() {
 	// Start periodic flush worker
@@ -75,13 +108,12 @@ func (bw *BigQueryWriter) Start() {
 
 // Stop gracefully stops the BigQuery writer
 func (bw *BigQueryWriter) Stop() error {
+	// Flush remaining batches while the context is still usable
+	err := bw.Flush()
+
 	bw.cancel()
 
-	// Flush remaining batches
-	if err := bw.FlushEvents(); err != nil {
-		return err
-	}
-	if err := bw.FlushSummaries(); err != nil {
+	if err != nil {
 		return err
 	}
 
@@ -126,6 +158,59 @@ func (bw *BigQueryWriter) WriteSummary(summary SessionSummary) error {
 	return nil
 }
 
+// WriteRollup inserts a rollup right away, rollups are written once per window.
+// The window start is the insert ID so BigQuery drops a retried insert.
+func (bw *BigQueryWriter) WriteRollup(rollup Rollup) error {
+	inserter := bw.client.Dataset(bw.dataset).Table(bw.rollupTable).Inserter()
+
+	if err := inserter.Put(bw.ctx, rollupRow{rollup: rollup}); err != nil {
+		bw.metrics.incrementError()
+		return fmt.Errorf("failed to insert rollup to BQ: %w", err)
+	}
+
+	bw.metrics.incrementRollups()
+	return nil
+}
+
+// WriteProfile inserts a user profile right away, profiles are written once
+// per ended session. The user ID and update time are the insert ID.
+func (bw *BigQueryWriter) WriteProfile(profile UserProfile) error {
+	inserter := bw.client.Dataset(bw.dataset).Table(bw.profileTable).Inserter()
+
+	if err := inserter.Put(bw.ctx, profileRow{profile: profile}); err != nil {
+		bw.metrics.incrementError()
+		return fmt.Errorf("failed to insert profile to BQ: %w", err)
+	}
+
+	bw.metrics.incrementProfiles()
+	return nil
+}
+
+// WriteRetention inserts a retention table right away, one row per cohort
+func (bw *BigQueryWriter) WriteRetention(table RetentionTable) error {
+	inserter := bw.client.Dataset(bw.dataset).Table(bw.cohortTable).Inserter()
+
+	rows := make([]retentionRow, 0, len(table.Cohorts))
+	for _, cohort := range table.Cohorts {
+		rows = append(rows, retentionRow{table: table, cohort: cohort})
+	}
+	if err := inserter.Put(bw.ctx, rows); err != nil {
+		bw.metrics.incrementError()
+		return fmt.Errorf("failed to insert retention table to BQ: %w", err)
+	}
+
+	bw.metrics.incrementRetention()
+	return nil
+}
+
+// Flush writes all batched events and summaries to BigQuery
+func (bw *BigQueryWriter) Flush() error {
+	if err := bw.FlushEvents(); err != nil {
+		return err
+	}
+	return bw.FlushSummaries()
+}
+
 // FlushEvents writes all batched events to BigQuery
 func (bw *BigQueryWriter) FlushEvents() error {
 	bw.eventMu.Lock()
@@ -250,7 +335,32 @@ func (bw *BigQueryWriter) GetMetrics() BQMetrics {
 	bw.metrics.mu.Lock()
 	defer bw.metrics.mu.Unlock()
 
-	return *bw.metrics
+	return BQMetrics{
+		EventsWritten:    bw.metrics.EventsWritten,
+		SummariesWritten: bw.metrics.SummariesWritten,
+		RollupsWritten:   bw.metrics.RollupsWritten,
+		ProfilesWritten:  bw.metrics.ProfilesWritten,
+		RetentionWritten: bw.metrics.RetentionWritten,
+		ErrorCount:       bw.metrics.ErrorCount,
+		BatchCount:       bw.metrics.BatchCount,
+	}
+}
+
+// Metrics returns the BigQuery write metrics in the common sink format
+func (bw *BigQueryWriter) Metrics() SinkMetrics {
+	bw.metrics.mu.Lock()
+	defer bw.metrics.mu.Unlock()
+
+	return SinkMetrics{
+		Name:             SinkBigQuery,
+		EventsWritten:    bw.metrics.EventsWritten,
+		SummariesWritten: bw.metrics.SummariesWritten,
+		RollupsWritten:   bw.metrics.RollupsWritten,
+		ProfilesWritten:  bw.metrics.ProfilesWritten,
+		RetentionWritten: bw.metrics.RetentionWritten,
+		ErrorCount:       bw.metrics.ErrorCount,
+		BatchCount:       bw.metrics.BatchCount,
+	}
 }
 
 // incrementEvents increments event write count
@@ -271,6 +381,30 @@ func (m *BQMetrics) incrementSummaries(count int64) {
 	m.BatchCount++
 }
 
+// incrementRollups increments rollup write count
+func (m *BQMetrics) incrementRollups() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RollupsWritten++
+}
+
+// incrementProfiles increments profile write count
+func (m *BQMetrics) incrementProfiles() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ProfilesWritten++
+}
+
+// incrementRetention increments retention table write count
+func (m *BQMetrics) incrementRetention() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RetentionWritten++
+}
+
 // incrementError increments error count
 func (m *BQMetrics) incrementError() {
 	m.mu.Lock()
@@ -305,5 +439,92 @@ func summarySchema() bigquery.Schema {
 		{Name: "action_counts", Type: bigquery.JSONFieldType},
 		{Name: "has_anomaly", Type: bigquery.BooleanFieldType},
 		{Name: "anomaly_types", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "anomaly_severities", Type: bigquery.StringFieldType, Repeated: true},
 	}
 }
+
+// rollupRow saves a rollup with its window start as the insert ID
+type rollupRow struct {
+	rollup Rollup
+}
+
+// Save implements bigquery.ValueSaver
+func (r rollupRow) Save() (map[string]bigquery.Value, string, error) {
+	eventCounts, err := json.Marshal(r.rollup.EventCounts)
+	if err != nil {
+		return nil, "", err
+	}
+	screenViews, err := json.Marshal(r.rollup.ScreenViews)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return map[string]bigquery.Value{
+		"window_start":                 r.rollup.WindowStart,
+		"window_end":                   r.rollup.WindowEnd,
+		"active_users":                 r.rollup.ActiveUsers,
+		"sessions_started":             r.rollup.SessionsStarted,
+		"sessions_ended":               r.rollup.SessionsEnded,
+		"event_counts":                 string(eventCounts),
+		"screen_views":                 string(screenViews),
+		"avg_session_duration_seconds": r.rollup.AvgSessionDuration,
+	}, strconv.FormatInt(r.rollup.WindowStart.UnixNano(), 10), nil
+}
+
+// profileRow saves a user profile with its user ID and update time as the
+// insert ID
+type profileRow struct {
+	profile UserProfile
+}
+
+// Save implements bigquery.ValueSaver
+func (r profileRow) Save() (map[string]bigquery.Value, string, error) {
+	eventCounts, err := json.Marshal(r.profile.EventCounts)
+	if err != nil {
+		return nil, "", err
+	}
+	screenCounts, err := json.Marshal(r.profile.ScreenCounts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	row := map[string]bigquery.Value{
+		"user_id":                      r.profile.UserID,
+		"first_seen":                   r.profile.FirstSeen,
+		"last_seen":                    r.profile.LastSeen,
+		"session_count":                r.profile.SessionCount,
+		"event_count":                  r.profile.EventCount,
+		"avg_session_duration_seconds": r.profile.AvgSessionDuration,
+		"event_counts":                 string(eventCounts),
+		"screen_counts":                string(screenCounts),
+		"preferred_screens":            r.profile.PreferredScreens,
+		"updated_at":                   r.profile.UpdatedAt,
+	}
+	if r.profile.SignupAt != nil {
+		row["signup_at"] = *r.profile.SignupAt
+	}
+	return row, r.profile.UserID + "_" + strconv.FormatInt(r.profile.UpdatedAt.UnixNano(), 10), nil
+}
+
+// retentionRow saves one cohort of a retention table, keyed by the table,
+// cohort and generation date so a table is stored once a day
+type retentionRow struct {
+	table  RetentionTable
+	cohort RetentionCohort
+}
+
+// Save implements bigquery.ValueSaver
+func (r retentionRow) Save() (map[string]bigquery.Value, string, error) {
+	insertID := fmt.Sprintf("%s_%s_%d_%s", r.table.Cohort, r.table.Period,
+		r.cohort.Start.Unix(), r.table.GeneratedAt.UTC().Format(profileDayLayout))
+
+	return map[string]bigquery.Value{
+		"cohort":       r.table.Cohort,
+		"period":       r.table.Period,
+		"cohort_start": r.cohort.Start,
+		"users":        r.cohort.Users,
+		"retained":     r.cohort.Retained,
+		"rates":        r.cohort.Rates,
+		"generated_at": r.table.GeneratedAt,
+	}, insertID, nil
+}
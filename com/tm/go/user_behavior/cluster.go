@@ -0,0 +1,669 @@
+package user_behavior
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Cluster defaults for ClusterConfig
+	DefaultClusterVirtualNodes      = 64
+	DefaultClusterHeartbeatInterval = 2 * time.Second
+	DefaultClusterFailureTimeout    = 10 * time.Second
+	DefaultClusterRequestTimeout    = 5 * time.Second
+
+	// Internal endpoints served by every member
+	ClusterHeartbeatPath = "/cluster/heartbeat"
+	ClusterForwardPath   = "/cluster/forward"
+	ClusterHandoffPath   = "/cluster/handoff"
+	ClusterLeavePath     = "/cluster/leave"
+
+	// ClusterTokenHeader carries the shared token on requests between members
+	ClusterTokenHeader = "X-Cluster-Token"
+
+	// Operations of a forwarded request
+	ForwardTrack  = "track"
+	ForwardCreate = "create"
+	ForwardClose  = "close"
+)
+
+// ClusterConfig lets several tracker instances share sessions. Each session
+// is owned by one member chosen by consistent hashing of its client session
+// ID; other members forward its events to the owner.
+type ClusterConfig struct {
+	// Self is this member's base URL as the peers reach it, for example
+	// http://10.0.0.1:8080
+	Self string
+
+	// Peers are the base URLs of the other members known at startup. Members
+	// that join later are learned from heartbeats.
+	Peers []string
+
+	// VirtualNodes per member on the hash ring; defaults to
+	// DefaultClusterVirtualNodes
+	VirtualNodes int
+
+	// HeartbeatInterval between heartbeats to every member; a member missing
+	// heartbeats for FailureTimeout leaves the ring
+	HeartbeatInterval time.Duration
+	FailureTimeout    time.Duration
+
+	// RequestTimeout bounds forward, handoff and heartbeat requests
+	RequestTimeout time.Duration
+
+	// Token is the secret shared by every member. It is sent with each
+	// request to a member, and the internal endpoints reject requests
+	// without it.
+	Token string
+}
+
+// Enabled reports whether clustering is configured
+func (cc ClusterConfig) Enabled() bool {
+	return len(cc.Peers) > 0
+}
+
+// withDefaults fills zero fields with the package defaults
+func (cc ClusterConfig) withDefaults() ClusterConfig {
+	if cc.VirtualNodes <= 0 {
+		cc.VirtualNodes = DefaultClusterVirtualNodes
+	}
+	if cc.HeartbeatInterval <= 0 {
+		cc.HeartbeatInterval = DefaultClusterHeartbeatInterval
+	}
+	if cc.FailureTimeout <= 0 {
+		cc.FailureTimeout = DefaultClusterFailureTimeout
+	}
+	if cc.RequestTimeout <= 0 {
+		cc.RequestTimeout = DefaultClusterRequestTimeout
+	}
+	return cc
+}
+
+// hashRing maps session IDs to members with virtual nodes, so a membership
+// change only moves the sessions of the members that joined or left
+type hashRing struct {
+	members []string
+	hashes  []uint64
+	owners  map[uint64]string
+}
+
+// newHashRing builds a ring of the given members
+func newHashRing(members []string, virtualNodes int) *hashRing {
+	ring := &hashRing{
+		members: members,
+		owners:  make(map[uint64]string, len(members)*virtualNodes),
+	}
+
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			hash := ringHash(member + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[hash]; taken {
+				continue
+			}
+			ring.owners[hash] = member
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+	return ring
+}
+
+// owner returns the member owning a session ID; split parts map to the owner
+// of their client session ID
+func (ring *hashRing) owner(sessionID string) string {
+	if len(ring.hashes) == 0 {
+		return ""
+	}
+
+	hash := ringHash(shardKey(sessionID))
+	i := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.owners[ring.hashes[i]]
+}
+
+// ringHash hashes a ring key. FNV barely changes the high bits for keys that
+// differ in their last bytes, such as sequential session IDs, so the sum is
+// mixed to spread them around the ring.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// clusterMember is a peer as seen by this member
+type clusterMember struct {
+	lastSeen time.Time
+	started  time.Time // start of the peer's process, to tell restarts apart
+	left     bool
+}
+
+// ClusterMemberStatus reports one member in ClusterMetrics
+type ClusterMemberStatus struct {
+	ID       string    `json:"id"`
+	Alive    bool      `json:"alive"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ClusterMetrics reports membership and routing counters
+type ClusterMetrics struct {
+	Self            string                `json:"self"`
+	Members         []ClusterMemberStatus `json:"members"`
+	RingMembers     []string              `json:"ring_members"`
+	Forwarded       int64                 `json:"forwarded"`
+	ForwardErrors   int64                 `json:"forward_errors"`
+	HandedOff       int64                 `json:"handed_off"`
+	HandoffReceived int64                 `json:"handoff_received"`
+}
+
+// heartbeatMessage is exchanged by heartbeats in both directions, so every
+// member learns the members its peers know about
+type heartbeatMessage struct {
+	From    string    `json:"from"`
+	Started time.Time `json:"started"`
+	Members []string  `json:"members"`
+}
+
+// forwardRequest is an operation a member passes to a session's owner
+type forwardRequest struct {
+	Op            string    `json:"op"`
+	Event         UserEvent `json:"event"`
+	ClientEventID bool      `json:"client_event_id,omitempty"`
+	UserID        string    `json:"user_id,omitempty"`
+	SessionID     string    `json:"session_id,omitempty"`
+}
+
+// Cluster tracks the live members and routes sessions to their owners
+type Cluster struct {
+	config         ClusterConfig
+	members        map[string]*clusterMember
+	ring           *hashRing
+	leaving        bool
+	handoffPending bool // ring changed since the handler last succeeded
+	started        time.Time
+	client         *http.Client
+	metrics        ClusterMetrics
+	onChange       func() error
+	mu             sync.RWMutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// NewCluster creates a cluster view with the configured peers, which are
+// assumed alive until they miss heartbeats for FailureTimeout
+func NewCluster(config ClusterConfig) (*Cluster, error) {
+	config = config.withDefaults()
+	config.Self = strings.TrimRight(config.Self, "/")
+	if config.Self == "" {
+		return nil, fmt.Errorf("%w: self address is required", ErrInvalidCluster)
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("%w: token is required", ErrInvalidCluster)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Cluster{
+		config:  config,
+		members: make(map[string]*clusterMember),
+		client:  &http.Client{Timeout: config.RequestTimeout},
+		started: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	c.metrics.Self = config.Self
+
+	now := time.Now()
+	for _, peer := range config.Peers {
+		peer = strings.TrimRight(peer, "/")
+		if peer != "" && peer != config.Self {
+			c.members[peer] = &clusterMember{lastSeen: now}
+		}
+	}
+	c.ring = newHashRing(c.aliveLocked(now), config.VirtualNodes)
+
+	return c, nil
+}
+
+// Authorized reports whether a request to an internal endpoint carries the
+// cluster token
+func (c *Cluster) Authorized(r *http.Request) bool {
+	token := r.Header.Get(ClusterTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Token)) == 1
+}
+
+// SetMembershipHandler sets the function the heartbeat worker calls after
+// the ring changes; it is called again on the next heartbeat while it
+// returns an error. Must be called before Start.
+func (c *Cluster) SetMembershipHandler(fn func() error) {
+	c.onChange = fn
+}
+
+// Start begins sending heartbeats
+func (c *Cluster) Start() {
+	go c.heartbeatWorker()
+}
+
+// Stop stops the heartbeats and the membership handler calls
+func (c *Cluster) Stop() {
+	c.cancel()
+}
+
+// Leave removes this member from its own ring and tells the peers, so its
+// sessions can be handed off before it stops
+func (c *Cluster) Leave() {
+	c.mu.Lock()
+	c.leaving = true
+	peers := c.aliveLocked(time.Now())
+	c.ring = newHashRing(peers, c.config.VirtualNodes)
+	c.mu.Unlock()
+
+	for _, peer := range peers {
+		if err := c.post(peer+ClusterLeavePath, c.message(nil), nil); err != nil {
+			fmt.Printf("Failed to notify %s of leave: %v\n", peer, err)
+		}
+	}
+}
+
+// Owner returns the member owning a session and whether it is this member
+func (c *Cluster) Owner(sessionID string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owner := c.ring.owner(sessionID)
+	return owner, owner == c.config.Self
+}
+
+// Metrics returns the membership view and routing counters
+func (c *Cluster) Metrics() ClusterMetrics {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	metrics := c.metrics
+	metrics.RingMembers = append([]string(nil), c.ring.members...)
+	now := time.Now()
+	for _, id := range c.peersLocked() {
+		member := c.members[id]
+		metrics.Members = append(metrics.Members, ClusterMemberStatus{
+			ID:       id,
+			Alive:    c.isAlive(member, now),
+			LastSeen: member.lastSeen,
+		})
+	}
+	return metrics
+}
+
+// Forward sends an operation to the session owner. The owner's overload and
+// duplicate responses are returned as ErrEventChannelFull and
+// ErrDuplicateEvent so callers handle them as for local events.
+func (c *Cluster) Forward(owner string, req forwardRequest) error {
+	err := c.post(owner+ClusterForwardPath, req, nil)
+
+	c.mu.Lock()
+	if err != nil && !errors.Is(err, ErrDuplicateEvent) {
+		c.metrics.ForwardErrors++
+	} else {
+		c.metrics.Forwarded++
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// HandOff sends sessions to their new owner
+func (c *Cluster) HandOff(owner string, states []SessionState) error {
+	if err := c.post(owner+ClusterHandoffPath, states, nil); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.metrics.HandedOff += int64(len(states))
+	c.mu.Unlock()
+	return nil
+}
+
+// countReceived records sessions handed off to this member
+func (c *Cluster) countReceived(n int) {
+	c.mu.Lock()
+	c.metrics.HandoffReceived += int64(n)
+	c.mu.Unlock()
+}
+
+// ReceiveHeartbeat marks the sender alive, learns the members it knows and
+// returns this member's view. A leaving member returns ErrClusterLeaving so
+// the sender does not count it alive again.
+func (c *Cluster) ReceiveHeartbeat(msg heartbeatMessage) (heartbeatMessage, error) {
+	c.mu.Lock()
+	if c.leaving {
+		c.mu.Unlock()
+		return heartbeatMessage{}, ErrClusterLeaving
+	}
+
+	now := time.Now()
+	c.observeLocked(msg, now)
+	reply := c.message(c.aliveLocked(now))
+	c.mu.Unlock()
+
+	c.updateRing()
+	return reply, nil
+}
+
+// ReceiveLeave drops a member that is shutting down from the ring until the
+// member restarts
+func (c *Cluster) ReceiveLeave(msg heartbeatMessage) {
+	c.mu.Lock()
+	if member, ok := c.members[msg.From]; ok {
+		member.left = true
+		member.started = msg.Started
+	}
+	c.mu.Unlock()
+
+	c.updateRing()
+}
+
+// message returns a heartbeat message from this member
+func (c *Cluster) message(members []string) heartbeatMessage {
+	return heartbeatMessage{From: c.config.Self, Started: c.started, Members: members}
+}
+
+// heartbeatWorker exchanges heartbeats with every known member
+func (c *Cluster) heartbeatWorker() {
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.heartbeat()
+			c.updateRing()
+
+			c.mu.RLock()
+			pending := c.handoffPending
+			c.mu.RUnlock()
+			if pending && c.runMembershipHandler() == nil {
+				c.mu.Lock()
+				c.handoffPending = false
+				c.mu.Unlock()
+			}
+
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat sends this member's view to every peer and merges the replies
+func (c *Cluster) heartbeat() {
+	c.mu.RLock()
+	if c.leaving {
+		c.mu.RUnlock()
+		return
+	}
+	peers := c.peersLocked()
+	msg := c.message(c.aliveLocked(time.Now()))
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			var reply heartbeatMessage
+			if err := c.post(peer+ClusterHeartbeatPath, msg, &reply); err != nil {
+				return
+			}
+
+			c.mu.Lock()
+			c.observeLocked(reply, time.Now())
+			c.mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// updateRing rebuilds the ring when the live members changed and marks the
+// membership handler pending
+func (c *Cluster) updateRing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	alive := c.aliveLocked(time.Now())
+	if strings.Join(alive, ",") == strings.Join(c.ring.members, ",") {
+		return
+	}
+
+	c.ring = newHashRing(alive, c.config.VirtualNodes)
+	c.handoffPending = true
+	fmt.Printf("Cluster membership changed: %v\n", alive)
+}
+
+// runMembershipHandler calls the membership handler, logging its error
+func (c *Cluster) runMembershipHandler() error {
+	if c.onChange == nil {
+		return nil
+	}
+
+	err := c.onChange()
+	if err != nil {
+		fmt.Printf("Session handoff failed: %v\n", err)
+	}
+	return err
+}
+
+// observeLocked records a heartbeat exchanged with a member and learns the
+// members it reports. A member that left stays out of the ring until a
+// heartbeat from a later start of it arrives, so heartbeats still in flight
+// when it left are ignored. Caller must hold c.mu.
+func (c *Cluster) observeLocked(msg heartbeatMessage, now time.Time) {
+	for _, id := range msg.Members {
+		c.learnLocked(id, now)
+	}
+
+	if msg.From == "" || msg.From == c.config.Self {
+		return
+	}
+
+	member, ok := c.members[msg.From]
+	if !ok {
+		member = &clusterMember{}
+		c.members[msg.From] = member
+	}
+	if member.left && !msg.Started.After(member.started) {
+		return
+	}
+	member.lastSeen = now
+	member.started = msg.Started
+	member.left = false
+}
+
+// learnLocked adds a member reported by a peer, alive until it misses
+// heartbeats; caller must hold c.mu
+func (c *Cluster) learnLocked(id string, now time.Time) {
+	if id == "" || id == c.config.Self {
+		return
+	}
+	if _, ok := c.members[id]; !ok {
+		c.members[id] = &clusterMember{lastSeen: now}
+	}
+}
+
+// isAlive reports whether a member is part of the ring
+func (c *Cluster) isAlive(member *clusterMember, now time.Time) bool {
+	return !member.left && now.Sub(member.lastSeen) <= c.config.FailureTimeout
+}
+
+// aliveLocked returns the sorted ring members, this member included unless it
+// is leaving; caller must hold c.mu
+func (c *Cluster) aliveLocked(now time.Time) []string {
+	var alive []string
+	if !c.leaving {
+		alive = append(alive, c.config.Self)
+	}
+	for id, member := range c.members {
+		if c.isAlive(member, now) {
+			alive = append(alive, id)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+// peersLocked returns every known member but this one; caller must hold c.mu
+func (c *Cluster) peersLocked() []string {
+	peers := make([]string, 0, len(c.members))
+	for id := range c.members {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// post sends a JSON request to a member and decodes the JSON reply into out
+// when it is not nil
+func (c *Cluster) post(url string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create cluster request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ClusterTokenHeader, c.config.Token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrClusterRequest, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: forwarded to %s", ErrEventChannelFull, url)
+	case resp.StatusCode == http.StatusConflict:
+		return ErrDuplicateEvent
+	case resp.StatusCode == http.StatusBadRequest:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s", ErrInvalidEvent, strings.TrimSpace(string(message)))
+	case resp.StatusCode >= 300:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s returned %d: %s", ErrClusterRequest, url, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%w: invalid reply from %s: %v", ErrClusterRequest, url, err)
+		}
+	}
+	return nil
+}
+
+// forwardEvent sends an event to its session owner when that is another
+// member, reporting whether it did
+func (ec *EventCollector) forwardEvent(event UserEvent, clientEventID bool) (bool, error) {
+	if ec.cluster == nil {
+		return false, nil
+	}
+
+	owner, local := ec.cluster.Owner(event.SessionID)
+	if local || owner == "" {
+		return false, nil
+	}
+
+	return true, ec.cluster.Forward(owner, forwardRequest{
+		Op:            ForwardTrack,
+		Event:         event,
+		ClientEventID: clientEventID,
+	})
+}
+
+// HandleForward runs an operation forwarded by another member on this one,
+// without forwarding it again even if the members' rings disagree
+func (ec *EventCollector) HandleForward(req forwardRequest) error {
+	switch req.Op {
+	case ForwardTrack:
+		if err := req.Event.Validate(time.Now()); err != nil {
+			return err
+		}
+		return ec.trackLocal(req.Event, req.ClientEventID)
+	case ForwardCreate:
+		ec.sessionManager.createSession(req.SessionID, req.UserID)
+		return nil
+	case ForwardClose:
+		ec.sessionManager.CloseSession(req.SessionID)
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown forward op %q", ErrInvalidEvent, req.Op)
+	}
+}
+
+// HandleHandoff adopts sessions handed off by another member
+func (ec *EventCollector) HandleHandoff(states []SessionState) {
+	adopted := ec.sessionManager.restore(SessionSnapshot{Sessions: states})
+	if ec.cluster != nil {
+		ec.cluster.countReceived(len(states))
+	}
+	fmt.Printf("Adopted %d of %d handed off sessions\n", adopted, len(states))
+}
+
+// handOffSessions sends the active sessions this member no longer owns to
+// their owners; sessions that cannot be sent are kept and retried
+func (ec *EventCollector) handOffSessions() error {
+	states := ec.sessionManager.release(func(sessionID string) bool {
+		_, local := ec.cluster.Owner(sessionID)
+		return !local
+	})
+
+	byOwner := make(map[string][]SessionState)
+	for _, state := range states {
+		owner, _ := ec.cluster.Owner(state.Session.SessionID)
+		byOwner[owner] = append(byOwner[owner], state)
+	}
+
+	var firstErr error
+	for owner, owned := range byOwner {
+		if owner == "" {
+			ec.sessionManager.restore(SessionSnapshot{Sessions: owned})
+			continue
+		}
+
+		if err := ec.cluster.HandOff(owner, owned); err != nil {
+			ec.sessionManager.restore(SessionSnapshot{Sessions: owned})
+			if firstErr == nil {
+				firstErr = fmt.Errorf("handoff of %d sessions to %s: %w", len(owned), owner, err)
+			}
+			continue
+		}
+		fmt.Printf("Handed off %d sessions to %s\n", len(owned), owner)
+	}
+
+	return firstErr
+}
@@ -0,0 +1,265 @@
+package user_behavior
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	members := []string{"http://a", "http://b", "http://c"}
+	ring := newHashRing(members, DefaultClusterVirtualNodes)
+	grown := newHashRing(append(members, "http://d"), DefaultClusterVirtualNodes)
+
+	if owner := newHashRing(nil, DefaultClusterVirtualNodes).owner("s1"); owner != "" {
+		t.Errorf("empty ring owner = %q, want none", owner)
+	}
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		sessionID := "session-" + strconv.Itoa(i)
+		owner := ring.owner(sessionID)
+		owned[owner]++
+
+		if part := ring.owner(sessionID + "#2"); part != owner {
+			t.Fatalf("%s#2 owned by %s, want %s like its client session", sessionID, part, owner)
+		}
+		// A joining member only takes sessions, the others keep theirs
+		if moved := grown.owner(sessionID); moved != owner && moved != "http://d" {
+			t.Fatalf("%s moved from %s to %s, want it kept or on the new member", sessionID, owner, moved)
+		}
+	}
+
+	for _, member := range members {
+		if owned[member] < 600 {
+			t.Errorf("%s owns %d of 3000 sessions, want an even spread", member, owned[member])
+		}
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	if _, err := NewCluster(ClusterConfig{Peers: []string{"http://b"}, Token: "secret"}); !errors.Is(err, ErrInvalidCluster) {
+		t.Errorf("NewCluster() without self error = %v, want %v", err, ErrInvalidCluster)
+	}
+	if _, err := NewCluster(ClusterConfig{Self: "http://a", Peers: []string{"http://b"}}); !errors.Is(err, ErrInvalidCluster) {
+		t.Errorf("NewCluster() without token error = %v, want %v", err, ErrInvalidCluster)
+	}
+
+	c, err := NewCluster(ClusterConfig{
+		Self:           "http://a/",
+		Peers:          []string{"http://b/", "http://a"},
+		Token:          "secret",
+		FailureTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewCluster() error = %v", err)
+	}
+
+	ringMembers := func() string {
+		return strings.Join(c.Metrics().RingMembers, ",")
+	}
+	if got := ringMembers(); got != "http://a,http://b" {
+		t.Fatalf("initial ring = %s, want http://a,http://b", got)
+	}
+
+	t1 := time.Now()
+	reply, err := c.ReceiveHeartbeat(heartbeatMessage{From: "http://c", Started: t1, Members: []string{"http://d"}})
+	if err != nil {
+		t.Fatalf("ReceiveHeartbeat() error = %v", err)
+	}
+	if got := strings.Join(reply.Members, ","); got != "http://a,http://b,http://c,http://d" {
+		t.Errorf("heartbeat reply members = %s", got)
+	}
+	if got := ringMembers(); got != "http://a,http://b,http://c,http://d" {
+		t.Errorf("ring after heartbeat = %s", got)
+	}
+
+	// A heartbeat sent before the leave must not bring the member back
+	c.ReceiveLeave(heartbeatMessage{From: "http://c", Started: t1})
+	c.ReceiveHeartbeat(heartbeatMessage{From: "http://c", Started: t1})
+	if got := ringMembers(); got != "http://a,http://b,http://d" {
+		t.Errorf("ring after leave = %s, want http://a,http://b,http://d", got)
+	}
+	c.ReceiveHeartbeat(heartbeatMessage{From: "http://c", Started: t1.Add(time.Second)})
+	if got := ringMembers(); got != "http://a,http://b,http://c,http://d" {
+		t.Errorf("ring after restart = %s", got)
+	}
+
+	c.mu.Lock()
+	c.members["http://b"].lastSeen = time.Now().Add(-2 * time.Minute)
+	c.handoffPending = false
+	c.mu.Unlock()
+	c.updateRing()
+	if got := ringMembers(); got != "http://a,http://c,http://d" {
+		t.Errorf("ring after missed heartbeats = %s, want http://a,http://c,http://d", got)
+	}
+	if !c.handoffPending {
+		t.Error("handoffPending = false after a ring change")
+	}
+}
+
+// newTestPeer starts a member serving the cluster endpoints around a test
+// collector; its sessions are owned by the returned collector
+func newTestPeer(t *testing.T, self string) (*EventCollector, *httptest.Server) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	peer := newTestCollector(t, 64)
+	cluster, err := NewCluster(ClusterConfig{Self: server.URL, Peers: []string{self}, Token: "secret"})
+	if err != nil {
+		t.Fatalf("NewCluster() error = %v", err)
+	}
+	peer.cluster = cluster
+	setupClusterHandlers(mux, peer)
+
+	return peer, server
+}
+
+// newTestMember returns a collector in a cluster with the peer at peerURL
+func newTestMember(t *testing.T, self, peerURL, token string) *EventCollector {
+	ec := newTestCollector(t, 64)
+	cluster, err := NewCluster(ClusterConfig{Self: self, Peers: []string{peerURL}, Token: token})
+	if err != nil {
+		t.Fatalf("NewCluster() error = %v", err)
+	}
+	ec.cluster = cluster
+	return ec
+}
+
+func TestClusterForward(t *testing.T) {
+	const self = "http://self.test"
+	peer, server := newTestPeer(t, self)
+	ec := newTestMember(t, self, server.URL, "secret")
+
+	var local, remote []UserEvent
+	for i := 0; i < 20; i++ {
+		event := UserEvent{
+			EventID:   "evt-" + strconv.Itoa(i),
+			UserID:    "u1",
+			SessionID: "s" + strconv.Itoa(i),
+			EventType: EventTyping,
+			Timestamp: time.Now(),
+		}
+		if err := ec.trackEvent(event, true); err != nil {
+			t.Fatalf("trackEvent(%s) error = %v", event.EventID, err)
+		}
+		if _, isLocal := ec.cluster.Owner(event.SessionID); isLocal {
+			local = append(local, event)
+		} else {
+			remote = append(remote, event)
+		}
+	}
+	if len(local) == 0 || len(remote) == 0 {
+		t.Fatalf("%d local and %d remote sessions, want both", len(local), len(remote))
+	}
+
+	if depth := ec.sessionManager.QueueMetrics().Depth; depth != len(local) {
+		t.Errorf("local queue depth = %d, want %d", depth, len(local))
+	}
+	if depth := peer.sessionManager.QueueMetrics().Depth; depth != len(remote) {
+		t.Errorf("peer queue depth = %d, want %d", depth, len(remote))
+	}
+
+	if err := ec.trackEvent(remote[0], true); !errors.Is(err, ErrDuplicateEvent) {
+		t.Errorf("forwarded retry error = %v, want %v", err, ErrDuplicateEvent)
+	}
+	if metrics := ec.cluster.Metrics(); metrics.Forwarded != int64(len(remote)+1) || metrics.ForwardErrors != 0 {
+		t.Errorf("Forwarded, ForwardErrors = %d, %d, want %d, 0", metrics.Forwarded, metrics.ForwardErrors, len(remote)+1)
+	}
+}
+
+func TestClusterHandOff(t *testing.T) {
+	const self = "http://self.test"
+	t0 := time.Now()
+
+	tests := []struct {
+		name     string
+		token    string
+		wantErr  bool
+		wantMove bool
+	}{
+		{name: "handed to the owner", token: "secret", wantMove: true},
+		{name: "kept when the owner rejects it", token: "wrong", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, server := newTestPeer(t, self)
+			ec := newTestMember(t, self, server.URL, tt.token)
+
+			for i := 0; i < 20; i++ {
+				ec.sessionManager.processEvent(UserEvent{
+					EventID:   "evt-" + strconv.Itoa(i),
+					UserID:    "u1",
+					SessionID: "s" + strconv.Itoa(i),
+					EventType: EventTyping,
+					Timestamp: t0,
+				})
+			}
+
+			err := ec.handOffSessions()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handOffSessions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			moved := 0
+			for i := 0; i < 20; i++ {
+				sessionID := "s" + strconv.Itoa(i)
+				_, isLocal := ec.cluster.Owner(sessionID)
+				_, onSelf := ec.sessionManager.GetSession(sessionID)
+				_, onPeer := peer.sessionManager.GetSession(sessionID)
+
+				wantOnPeer := tt.wantMove && !isLocal
+				if onSelf == wantOnPeer || onPeer != wantOnPeer {
+					t.Errorf("%s on self, peer = %v, %v, want %v, %v", sessionID, onSelf, onPeer, !wantOnPeer, wantOnPeer)
+				}
+				if wantOnPeer {
+					moved++
+					if events := peer.sessionManager.GetSessionEvents(sessionID); len(events) != 1 {
+						t.Errorf("%s handed off with %d events, want 1", sessionID, len(events))
+					}
+				}
+			}
+			if tt.wantMove && moved == 0 {
+				t.Fatal("no session owned by the peer")
+			}
+			if handedOff := ec.cluster.Metrics().HandedOff; handedOff != int64(moved) {
+				t.Errorf("HandedOff = %d, want %d", handedOff, moved)
+			}
+			if received := peer.cluster.Metrics().HandoffReceived; received != int64(moved) {
+				t.Errorf("HandoffReceived = %d, want %d", received, moved)
+			}
+		})
+	}
+}
+
+func TestClusterLeave(t *testing.T) {
+	const self = "http://self.test"
+	peer, server := newTestPeer(t, self)
+	ec := newTestMember(t, self, server.URL, "secret")
+
+	// The peer must see this member in its ring before the leave
+	peer.cluster.ReceiveHeartbeat(heartbeatMessage{From: self, Started: ec.cluster.started})
+	if got := strings.Join(peer.cluster.Metrics().RingMembers, ","); !strings.Contains(got, self) {
+		t.Fatalf("peer ring = %s, want %s in it", got, self)
+	}
+
+	ec.cluster.Leave()
+
+	for i := 0; i < 20; i++ {
+		if owner, isLocal := ec.cluster.Owner("s" + strconv.Itoa(i)); isLocal || owner != server.URL {
+			t.Fatalf("owner after leave = %s, want %s", owner, server.URL)
+		}
+	}
+	if got := strings.Join(peer.cluster.Metrics().RingMembers, ","); got != server.URL {
+		t.Errorf("peer ring after leave = %s, want %s", got, server.URL)
+	}
+	if _, err := ec.cluster.ReceiveHeartbeat(heartbeatMessage{From: server.URL}); !errors.Is(err, ErrClusterLeaving) {
+		t.Errorf("ReceiveHeartbeat() while leaving error = %v, want %v", err, ErrClusterLeaving)
+	}
+}
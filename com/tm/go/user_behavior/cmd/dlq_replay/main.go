@@ -0,0 +1,9 @@
+package main
+
+import (
+	"com/tm/go/user_behavior"
+)
+
+func main() {
+	user_behavior.DeadLetterReplayMain()
+}
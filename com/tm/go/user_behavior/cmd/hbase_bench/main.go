@@ -0,0 +1,122 @@
+// Command hbase_bench measures HBaseWriter throughput against a fake HBase
+// client that charges a fixed round trip per RPC plus a small cost per row.
+// It compares one put per RPC (batch size 1) with multi-row batches.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"com/tm/go/user_behavior"
+
+	"github.com/tsuna/gohbase"
+	"github.com/tsuna/gohbase/hrpc"
+)
+
+// fakeHBaseClient simulates RPC latency; methods the writer does not use
+// panic through the nil embedded interface
+type fakeHBaseClient struct {
+	gohbase.Client
+	rpcLatency time.Duration
+	rowCost    time.Duration
+	rpcs       atomic.Int64
+	rows       atomic.Int64
+}
+
+func (c *fakeHBaseClient) Put(p *hrpc.Mutate) (*hrpc.Result, error) {
+	c.roundTrip(1)
+	return &hrpc.Result{}, nil
+}
+
+func (c *fakeHBaseClient) SendBatch(ctx context.Context, batch []hrpc.Call) ([]hrpc.RPCResult, bool) {
+	c.roundTrip(len(batch))
+	return make([]hrpc.RPCResult, len(batch)), true
+}
+
+func (c *fakeHBaseClient) Close() {}
+
+func (c *fakeHBaseClient) roundTrip(rows int) {
+	c.rpcs.Add(1)
+	c.rows.Add(int64(rows))
+	time.Sleep(c.rpcLatency + time.Duration(rows)*c.rowCost)
+}
+
+func main() {
+	rpcLatency := flag.Duration("rpc-latency", time.Millisecond, "simulated round trip per RPC")
+	rowCost := flag.Duration("row-cost", 5*time.Microsecond, "simulated server cost per row")
+	workers := flag.Int("workers", 20, "HBase writer workers")
+	inflight := flag.Int("inflight", user_behavior.DefaultHBaseMaxInflight, "max concurrent batch RPCs")
+	linger := flag.Duration("linger", user_behavior.DefaultHBaseBatchLinger, "batch linger time")
+	sizes := flag.String("sizes", "1,50,200,500", "comma separated batch sizes to compare")
+	flag.Parse()
+
+	fmt.Printf("rpc-latency=%v row-cost=%v workers=%d inflight=%d linger=%v\n",
+		*rpcLatency, *rowCost, *workers, *inflight, *linger)
+
+	for _, value := range strings.Split(*sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || size <= 0 {
+			fmt.Printf("skipping invalid batch size %q\n", value)
+			continue
+		}
+
+		config := user_behavior.HBaseBatchConfig{
+			Size:        size,
+			Linger:      *linger,
+			MaxInflight: *inflight,
+		}
+		// One put per RPC needs one slot per worker to match the old writer
+		if size == 1 {
+			config.MaxInflight = *workers
+		}
+
+		result := testing.Benchmark(func(b *testing.B) {
+			benchmarkWriter(b, *workers, config, *rpcLatency, *rowCost)
+		})
+		fmt.Printf("batch=%-5d %s\n", size, result.String())
+	}
+}
+
+// benchmarkWriter enqueues b.N events and waits until all are written
+func benchmarkWriter(b *testing.B, workers int, config user_behavior.HBaseBatchConfig, rpcLatency, rowCost time.Duration) {
+	client := &fakeHBaseClient{rpcLatency: rpcLatency, rowCost: rowCost}
+
+	writer := user_behavior.NewHBaseWriterWithClient(client, "", 10000, workers, user_behavior.BackpressureConfig{
+		Policy:       user_behavior.OverflowBlock,
+		BlockTimeout: time.Minute,
+	})
+	writer.SetBatchConfig(config)
+	writer.Start()
+
+	now := time.Now()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		event := user_behavior.UserEvent{
+			EventID:   strconv.Itoa(i),
+			UserID:    "bench_user",
+			SessionID: fmt.Sprintf("bench_session_%d", i%100),
+			EventType: user_behavior.EventTyping,
+			Timestamp: now.Add(time.Duration(i)),
+		}
+		if err := writer.WriteEvent(event); err != nil {
+			b.Fatalf("WriteEvent: %v", err)
+		}
+	}
+
+	for writer.GetMetrics().WriteCount < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.StopTimer()
+	writer.Stop()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+	b.ReportMetric(float64(client.rpcs.Load())/float64(b.N), "rpcs/op")
+}
@@ -0,0 +1,244 @@
+// Command session_bench measures SessionManager ingestion throughput while
+// readers look up sessions and timeout checks run. It compares the sharded
+// manager with the previous layout of one session map behind one lock,
+// where every timeout check walked all sessions under the write lock.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"com/tm/go/user_behavior"
+)
+
+const (
+	eventBufferSize  = 10000
+	maxSessionEvents = 1000
+)
+
+// sessionTracker is the part of a session manager the benchmark drives
+type sessionTracker interface {
+	TrackEvent(event user_behavior.UserEvent) error
+	GetSession(sessionID string) (*user_behavior.Session, bool)
+	Processed() int64
+	Stop() error
+}
+
+// shardedTracker drives the package SessionManager
+type shardedTracker struct {
+	*user_behavior.SessionManager
+}
+
+func (t shardedTracker) Processed() int64 {
+	return t.Metrics().EventsProcessed
+}
+
+// lockedTracker reproduces the previous SessionManager layout: workers share
+// one channel and one lock, and the timeout check scans every session
+type lockedTracker struct {
+	sessions  map[string]*user_behavior.Session
+	events    chan user_behavior.UserEvent
+	timeout   time.Duration
+	processed atomic.Int64
+	mu        sync.RWMutex
+	done      chan struct{}
+}
+
+func newLockedTracker(workers int, timeout, checkInterval time.Duration) *lockedTracker {
+	t := &lockedTracker{
+		sessions: make(map[string]*user_behavior.Session),
+		events:   make(chan user_behavior.UserEvent, eventBufferSize),
+		timeout:  timeout,
+		done:     make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case event := <-t.events:
+					t.process(event)
+				case <-t.done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.checkTimeouts()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+
+	return t
+}
+
+func (t *lockedTracker) TrackEvent(event user_behavior.UserEvent) error {
+	t.events <- event
+	return nil
+}
+
+func (t *lockedTracker) GetSession(sessionID string) (*user_behavior.Session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	session, exists := t.sessions[sessionID]
+	return session, exists
+}
+
+func (t *lockedTracker) Processed() int64 {
+	return t.processed.Load()
+}
+
+func (t *lockedTracker) Stop() error {
+	close(t.done)
+	return nil
+}
+
+func (t *lockedTracker) process(event user_behavior.UserEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, exists := t.sessions[event.SessionID]
+	if !exists {
+		session = &user_behavior.Session{
+			SessionID:      event.SessionID,
+			UserID:         event.UserID,
+			StartTime:      event.Timestamp,
+			LastActiveTime: event.Timestamp,
+			IsActive:       true,
+		}
+		t.sessions[event.SessionID] = session
+	}
+
+	session.LastActiveTime = event.Timestamp
+	session.EventCount++
+	session.Events = append(session.Events, event)
+	if len(session.Events) > maxSessionEvents {
+		session.Events = session.Events[1:]
+	}
+	t.processed.Add(1)
+}
+
+func (t *lockedTracker) checkTimeouts() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range t.sessions {
+		if session.IsActive && now.Sub(session.LastActiveTime) > t.timeout {
+			session.IsActive = false
+		}
+	}
+}
+
+func main() {
+	workers := flag.Int("workers", 10, "session workers")
+	sessions := flag.Int("sessions", 100000, "distinct sessions receiving events")
+	readers := flag.Int("readers", 4, "goroutines looking up sessions during ingestion")
+	checkInterval := flag.Duration("check-interval", 10*time.Millisecond, "timeout check interval")
+	shards := flag.String("shards", "1,8,32,128", "comma separated shard counts to compare")
+	flag.Parse()
+
+	fmt.Printf("workers=%d sessions=%d readers=%d check-interval=%v\n",
+		*workers, *sessions, *readers, *checkInterval)
+
+	result := testing.Benchmark(func(b *testing.B) {
+		tracker := newLockedTracker(*workers, user_behavior.SessionTimeout, *checkInterval)
+		benchmarkTracker(b, tracker, *sessions, *readers)
+	})
+	fmt.Printf("%-12s %s\n", "global-lock", result.String())
+
+	for _, value := range strings.Split(*shards, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || count <= 0 {
+			fmt.Printf("skipping invalid shard count %q\n", value)
+			continue
+		}
+
+		result := testing.Benchmark(func(b *testing.B) {
+			manager := user_behavior.NewSessionManager(eventBufferSize, user_behavior.BackpressureConfig{
+				Policy:       user_behavior.OverflowBlock,
+				BlockTimeout: time.Minute,
+			}, user_behavior.SessionConfig{
+				CleanupInterval: *checkInterval,
+				MaxEvents:       maxSessionEvents,
+				Shards:          count,
+			})
+			manager.Start(*workers)
+			benchmarkTracker(b, shardedTracker{manager}, *sessions, *readers)
+		})
+		fmt.Printf("shards=%-5d %s\n", count, result.String())
+	}
+}
+
+// benchmarkTracker tracks b.N events spread over the sessions and waits until
+// all are processed, while readers look up random sessions
+func benchmarkTracker(b *testing.B, tracker sessionTracker, sessions, readers int) {
+	sessionIDs := make([]string, sessions)
+	for i := range sessionIDs {
+		sessionIDs[i] = fmt.Sprintf("bench_session_%d", i)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			random := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					tracker.GetSession(sessionIDs[random.Intn(sessions)])
+				}
+			}
+		}(int64(r))
+	}
+
+	now := time.Now()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		event := user_behavior.UserEvent{
+			EventID:   strconv.Itoa(i),
+			UserID:    "bench_user",
+			SessionID: sessionIDs[i%sessions],
+			EventType: user_behavior.EventTyping,
+			Timestamp: now.Add(time.Duration(i)),
+		}
+		if err := tracker.TrackEvent(event); err != nil {
+			b.Fatalf("TrackEvent: %v", err)
+		}
+	}
+
+	for tracker.Processed() < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+	tracker.Stop()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
@@ -0,0 +1,178 @@
+package user_behavior
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Cohorts users are grouped by
+	CohortFirstSeen = "first_seen"
+	CohortSignup    = "signup"
+
+	// Retention periods
+	RetentionDay  = "day"
+	RetentionWeek = "week"
+
+	// Periods reported by default after the cohort period
+	DefaultDailyRetentionPeriods  = 30
+	DefaultWeeklyRetentionPeriods = 12
+)
+
+// RetentionQuery selects a cohort retention table. Cohorts starting within
+// [From, To) are reported.
+type RetentionQuery struct {
+	Cohort  string // first_seen or signup, first_seen by default
+	Period  string // day or week, day by default
+	From    time.Time
+	To      time.Time
+	Periods int // periods after the cohort period, defaults by Period
+}
+
+// withDefaults fills unset fields and checks the cohort and period
+func (q RetentionQuery) withDefaults() (RetentionQuery, error) {
+	q.Cohort = strings.ToLower(q.Cohort)
+	q.Period = strings.ToLower(q.Period)
+	if q.Cohort == "" {
+		q.Cohort = CohortFirstSeen
+	}
+	if q.Period == "" {
+		q.Period = RetentionDay
+	}
+
+	if q.Cohort != CohortFirstSeen && q.Cohort != CohortSignup {
+		return q, fmt.Errorf("%w: unknown cohort %q", ErrInvalidRetention, q.Cohort)
+	}
+	switch q.Period {
+	case RetentionDay:
+		if q.Periods <= 0 {
+			q.Periods = DefaultDailyRetentionPeriods
+		}
+	case RetentionWeek:
+		if q.Periods <= 0 {
+			q.Periods = DefaultWeeklyRetentionPeriods
+		}
+	default:
+		return q, fmt.Errorf("%w: unknown period %q", ErrInvalidRetention, q.Period)
+	}
+	if !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from must be before to", ErrInvalidRetention)
+	}
+	return q, nil
+}
+
+// RetentionTable holds the retention of each cohort for Period N after
+// the cohort period. Periods that have not started yet are left out.
+type RetentionTable struct {
+	Cohort      string            `json:"cohort"`
+	Period      string            `json:"period"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Cohorts     []RetentionCohort `json:"cohorts"`
+}
+
+// RetentionCohort is the retention of the users of one cohort. Retained[n]
+// counts the users active in the n-th period, Rates[n] in percent of Users.
+type RetentionCohort struct {
+	Start    time.Time `json:"start"`
+	Users    int       `json:"users"`
+	Retained []int     `json:"retained"`
+	Rates    []float64 `json:"rates"`
+}
+
+// periodStart returns the UTC start of the day or ISO week containing t
+func periodStart(t time.Time, period string) time.Time {
+	day := time.Date(t.UTC().Year(), t.UTC().Month(), t.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	if period == RetentionWeek {
+		// Weeks start on Monday
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// periodIndex returns how many periods after start the period of t is
+func periodIndex(start, t time.Time, period string) int {
+	days := int(periodStart(t, period).Sub(start).Hours() / 24)
+	if period == RetentionWeek {
+		return days / 7
+	}
+	return days
+}
+
+// Retention computes a cohort retention table from the profiles
+func (ps *UserProfileStore) Retention(query RetentionQuery, now time.Time) (*RetentionTable, error) {
+	query, err := query.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	cohorts := make(map[time.Time]*RetentionCohort)
+	ps.each(func(profile *UserProfile) {
+		anchor := profile.FirstSeen
+		if query.Cohort == CohortSignup {
+			if profile.SignupAt == nil {
+				return
+			}
+			anchor = *profile.SignupAt
+		}
+		if !inTimeRange(anchor, query.From, query.To) {
+			return
+		}
+
+		start := periodStart(anchor, query.Period)
+		cohort, ok := cohorts[start]
+		if !ok {
+			cohort = &RetentionCohort{Start: start, Retained: make([]int, query.Periods+1)}
+			cohorts[start] = cohort
+		}
+		cohort.Users++
+
+		// Active days are sorted, so a period is counted once per user
+		counted := -1
+		for _, value := range profile.ActiveDays {
+			day, err := time.Parse(profileDayLayout, value)
+			if err != nil {
+				continue
+			}
+			n := periodIndex(start, day, query.Period)
+			if n < 0 || n > query.Periods || n == counted {
+				continue
+			}
+			cohort.Retained[n]++
+			counted = n
+		}
+	})
+
+	table := &RetentionTable{
+		Cohort:      query.Cohort,
+		Period:      query.Period,
+		From:        query.From,
+		To:          query.To,
+		GeneratedAt: now,
+		Cohorts:     make([]RetentionCohort, 0, len(cohorts)),
+	}
+
+	current := periodStart(now, query.Period)
+	for _, cohort := range cohorts {
+		elapsed := periodIndex(cohort.Start, current, query.Period) + 1
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		if elapsed < len(cohort.Retained) {
+			cohort.Retained = cohort.Retained[:elapsed]
+		}
+		cohort.Rates = make([]float64, len(cohort.Retained))
+		for n, retained := range cohort.Retained {
+			cohort.Rates[n] = float64(retained) / float64(cohort.Users) * 100
+		}
+		table.Cohorts = append(table.Cohorts, *cohort)
+	}
+	sort.Slice(table.Cohorts, func(i, j int) bool {
+		return table.Cohorts[i].Start.Before(table.Cohorts[j].Start)
+	})
+
+	return table, nil
+}
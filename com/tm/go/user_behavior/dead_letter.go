@@ -0,0 +1,434 @@
+package user_behavior
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// Dead-letter store types accepted in DeadLetterConfig.Type
+	DeadLetterNone  = ""
+	DeadLetterFile  = "file"
+	DeadLetterKafka = "kafka"
+
+	DefaultDeadLetterFile = "user_behavior_dead_letters.jsonl"
+
+	deadLetterReplaySuffix  = ".replay-"
+	deadLetterCorruptSuffix = ".corrupt"
+	deadLetterReaderBytes   = 1 << 20
+
+	// deadLetterReplayIdle is how long a Kafka replay waits for the next
+	// message below the high water mark before giving up
+	deadLetterReplayIdle = 30 * time.Second
+)
+
+// DeadLetter is an event that exhausted its write retries
+type DeadLetter struct {
+	Event    UserEvent `json:"event"`
+	Sink     string    `json:"sink"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterStore keeps events that could not be written
+type DeadLetterStore interface {
+	// Write stores a dead letter
+	Write(letter DeadLetter) error
+
+	// Replay hands every stored dead letter to fn and removes the ones that
+	// were replayed. fn should re-dead-letter events that fail again.
+	Replay(fn func(letter DeadLetter) error) (ReplayStats, error)
+
+	// Close releases the store's resources
+	Close() error
+}
+
+// ReplayStats summarizes a dead-letter replay
+type ReplayStats struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
+
+// DeadLetterConfig selects and configures the dead-letter store
+type DeadLetterConfig struct {
+	Type         string
+	FilePath     string
+	KafkaBrokers []string
+	KafkaTopic   string
+}
+
+// NewDeadLetterStore creates the configured store; it returns nil when none is set
+func NewDeadLetterStore(config DeadLetterConfig) (DeadLetterStore, error) {
+	switch strings.ToLower(config.Type) {
+	case DeadLetterNone:
+		return nil, nil
+	case DeadLetterFile:
+		return NewFileDeadLetterStore(config.FilePath)
+	case DeadLetterKafka:
+		return NewKafkaDeadLetterStore(config.KafkaBrokers, config.KafkaTopic)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDeadLetter, config.Type)
+	}
+}
+
+// FileDeadLetterStore appends dead letters as JSON lines to a local file
+type FileDeadLetterStore struct {
+	path string
+	file *os.File
+	mu   sync.Mutex
+}
+
+// NewFileDeadLetterStore creates a file dead-letter store
+func NewFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	if path == "" {
+		path = DefaultDeadLetterFile
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create dead-letter dir: %w", err)
+		}
+	}
+
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDeadLetterStore{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Write appends a dead letter and syncs the file
+func (fs *FileDeadLetterStore) Write(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return fs.file.Sync()
+}
+
+// Replay moves the current file aside and replays it, together with any
+// file left over from an interrupted replay. Letters that fail again are
+// re-written by fn into the fresh file.
+func (fs *FileDeadLetterStore) Replay(fn func(letter DeadLetter) error) (ReplayStats, error) {
+	var stats ReplayStats
+
+	replayPath, err := fs.rotate()
+	if err != nil {
+		return stats, err
+	}
+
+	// Leftovers first, they are older than the file just rotated
+	leftovers, _ := filepath.Glob(fs.path + deadLetterReplaySuffix + "*")
+	sort.Strings(leftovers)
+
+	for _, path := range leftovers {
+		if path == replayPath {
+			continue
+		}
+		if err := fs.replayFile(path, fn, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := fs.replayFile(replayPath, fn, &stats); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// rotate renames the current file aside and opens a fresh one
+func (fs *FileDeadLetterStore) rotate() (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	replayPath := fmt.Sprintf("%s%s%d", fs.path, deadLetterReplaySuffix, time.Now().UnixNano())
+
+	if err := fs.file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close dead-letter file: %w", err)
+	}
+	if err := os.Rename(fs.path, replayPath); err != nil {
+		return "", fmt.Errorf("failed to rotate dead-letter file: %w", err)
+	}
+
+	file, err := openAppend(fs.path)
+	if err != nil {
+		return "", err
+	}
+	fs.file = file
+
+	return replayPath, nil
+}
+
+// replayFile replays every letter of a rotated file and removes it. Lines
+// that cannot be decoded are moved aside to the corrupt file rather than
+// dropped.
+func (fs *FileDeadLetterStore) replayFile(path string, fn func(letter DeadLetter) error, stats *ReplayStats) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), deadLetterReaderBytes)
+
+	var corrupt [][]byte
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			corrupt = append(corrupt, append([]byte(nil), scanner.Bytes()...))
+			stats.Failed++
+			continue
+		}
+
+		if err := fn(letter); err != nil {
+			stats.Failed++
+			continue
+		}
+		stats.Replayed++
+	}
+
+	scanErr := scanner.Err()
+	file.Close()
+	if scanErr != nil {
+		return fmt.Errorf("failed to read %s: %w", path, scanErr)
+	}
+
+	if err := fs.setAside(corrupt); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// setAside appends undecodable lines to the corrupt file next to the store
+func (fs *FileDeadLetterStore) setAside(lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	corruptPath := fs.path + deadLetterCorruptSuffix
+	file, err := openAppend(corruptPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, line := range lines {
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to set aside corrupt dead letters: %w", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to set aside corrupt dead letters: %w", err)
+	}
+
+	fmt.Printf("Moved %d undecodable dead letters to %s\n", len(lines), corruptPath)
+	return nil
+}
+
+// Close closes the dead-letter file
+func (fs *FileDeadLetterStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.file.Close()
+}
+
+// KafkaDeadLetterStore produces dead letters to a Kafka topic. Replay reads
+// each partition up to its current high water mark, tracking progress with a
+// consumer group so letters are replayed once.
+type KafkaDeadLetterStore struct {
+	client   sarama.Client
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewKafkaDeadLetterStore creates a Kafka dead-letter store
+func NewKafkaDeadLetterStore(brokers []string, topic string) (*KafkaDeadLetterStore, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, fmt.Errorf("kafka dead-letter store needs brokers and a topic")
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 3
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create kafka producer: %w", err)
+	}
+
+	return &KafkaDeadLetterStore{
+		client:   client,
+		producer: producer,
+		topic:    topic,
+	}, nil
+}
+
+// Write produces a dead letter keyed by session ID
+func (ks *KafkaDeadLetterStore) Write(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	_, _, err = ks.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: ks.topic,
+		Key:   sarama.StringEncoder(letter.Event.SessionID),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to produce dead letter: %w", err)
+	}
+	return nil
+}
+
+// Replay consumes every partition from the replay group's offset up to the
+// high water mark seen at the start, committing progress as it goes
+func (ks *KafkaDeadLetterStore) Replay(fn func(letter DeadLetter) error) (ReplayStats, error) {
+	var stats ReplayStats
+
+	partitions, err := ks.client.Partitions(ks.topic)
+	if err != nil {
+		return stats, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	offsets, err := sarama.NewOffsetManagerFromClient(ks.topic+"-replay", ks.client)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create offset manager: %w", err)
+	}
+	defer offsets.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(ks.client)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	for _, partition := range partitions {
+		if err := ks.replayPartition(consumer, offsets, partition, fn, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// replayPartition replays one partition from the committed offset, or the
+// oldest retained one, up to its high water mark
+func (ks *KafkaDeadLetterStore) replayPartition(
+	consumer sarama.Consumer,
+	offsets sarama.OffsetManager,
+	partition int32,
+	fn func(letter DeadLetter) error,
+	stats *ReplayStats,
+) error {
+	end, err := ks.client.GetOffset(ks.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return fmt.Errorf("failed to get high water mark: %w", err)
+	}
+	oldest, err := ks.client.GetOffset(ks.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return fmt.Errorf("failed to get oldest offset: %w", err)
+	}
+	if oldest >= end {
+		return nil
+	}
+
+	pom, err := offsets.ManagePartition(ks.topic, partition)
+	if err != nil {
+		return fmt.Errorf("failed to manage partition offset: %w", err)
+	}
+	defer pom.Close()
+
+	// Nothing committed yet, or retention dropped the committed offset
+	start, _ := pom.NextOffset()
+	if start < oldest {
+		start = oldest
+	}
+	if start >= end {
+		return nil
+	}
+
+	pc, err := consumer.ConsumePartition(ks.topic, partition, start)
+	if err != nil {
+		return fmt.Errorf("failed to consume partition %d: %w", partition, err)
+	}
+	defer pc.Close()
+
+	// Commit what was replayed even when the partition stalls
+	defer offsets.Commit()
+
+	idle := time.NewTimer(deadLetterReplayIdle)
+	defer idle.Stop()
+
+	for {
+		var msg *sarama.ConsumerMessage
+		select {
+		case msg = <-pc.Messages():
+		case <-idle.C:
+			return fmt.Errorf("timed out replaying partition %d at offset %d of %d", partition, start, end)
+		}
+		if msg == nil {
+			return fmt.Errorf("partition %d consumer closed at offset %d of %d", partition, start, end)
+		}
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(deadLetterReplayIdle)
+
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Value, &letter); err != nil {
+			stats.Failed++
+		} else if err := fn(letter); err != nil {
+			stats.Failed++
+		} else {
+			stats.Replayed++
+		}
+
+		start = msg.Offset + 1
+		pom.MarkOffset(start, "")
+		if start >= end {
+			return nil
+		}
+	}
+}
+
+// Close closes the producer and client
+func (ks *KafkaDeadLetterStore) Close() error {
+	if err := ks.producer.Close(); err != nil {
+		ks.client.Close()
+		return err
+	}
+	return ks.client.Close()
+}
@@ -0,0 +1,175 @@
+package user_behavior
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Event deduplication defaults
+	DefaultDedupWindow     = 10 * time.Minute
+	DefaultDedupMaxEntries = 100000
+)
+
+// eventDeduplicator remembers recently seen event IDs within a bounded window,
+// with how far each one got, so a retry only delivers what an earlier attempt
+// missed. Entries expire after the window or, when full, oldest first.
+type eventDeduplicator struct {
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // of *dedupEntry, oldest at the front
+	dropped    int64
+	mu         sync.Mutex
+}
+
+// dedupEntry is an event ID, the time it was first seen and its delivery
+type dedupEntry struct {
+	eventID    string
+	seenAt     time.Time
+	progress   eventProgress
+	delivering bool // an attempt is delivering the event right now
+	done       bool // the event reached the session manager and every sink
+}
+
+// eventProgress records the parts of the pipeline an event has reached
+type eventProgress struct {
+	logged  bool            // appended to the WAL
+	offset  uint64          // WAL offset once logged
+	tracked bool            // accepted by the session manager
+	counted bool            // counted in the open rollup window
+	sinks   map[string]bool // sinks the event was written to
+}
+
+// empty reports whether the event reached no part of the pipeline
+func (p eventProgress) empty() bool {
+	return !p.logged && !p.tracked && len(p.sinks) == 0
+}
+
+// clone returns a copy that does not share the sinks map
+func (p eventProgress) clone() eventProgress {
+	sinks := make(map[string]bool, len(p.sinks))
+	for name, written := range p.sinks {
+		sinks[name] = written
+	}
+	p.sinks = sinks
+	return p
+}
+
+// newEventDeduplicator creates a deduplicator, using defaults for zero values
+func newEventDeduplicator(window time.Duration, maxEntries int) *eventDeduplicator {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultDedupMaxEntries
+	}
+
+	return &eventDeduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// begin claims the delivery of an event ID and returns the progress of the
+// earlier attempts. It returns ErrDuplicateEvent once the event was fully
+// delivered, and a retryable error while another attempt is delivering it.
+// Every successful begin must be followed by finish.
+func (d *eventDeduplicator) begin(eventID string, now time.Time) (eventProgress, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if elem, exists := d.entries[eventID]; exists {
+		entry := elem.Value.(*dedupEntry)
+		if entry.done {
+			d.dropped++
+			return eventProgress{}, ErrDuplicateEvent
+		}
+		if entry.delivering {
+			return eventProgress{}, fmt.Errorf("%w: event %s is being delivered", ErrEventChannelFull, eventID)
+		}
+
+		entry.delivering = true
+		return entry.progress.clone(), nil
+	}
+
+	if d.order.Len() >= d.maxEntries {
+		d.removeElement(d.order.Front())
+	}
+
+	d.entries[eventID] = d.order.PushBack(&dedupEntry{eventID: eventID, seenAt: now, delivering: true})
+	return eventProgress{}, nil
+}
+
+// claim marks an event ID as being delivered by a re-delivery from the WAL.
+// It reports false while a client attempt is delivering the event or once
+// it is delivered. Unknown IDs are claimed without adding an entry.
+func (d *eventDeduplicator) claim(eventID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, exists := d.entries[eventID]
+	if !exists {
+		return true
+	}
+
+	entry := elem.Value.(*dedupEntry)
+	if entry.delivering || entry.done {
+		return false
+	}
+	entry.delivering = true
+	return true
+}
+
+// finish records the outcome of the attempt claimed by begin or claim. An
+// event that reached no part of the pipeline is forgotten, so its retry
+// starts afresh.
+func (d *eventDeduplicator) finish(eventID string, progress eventProgress, done bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, exists := d.entries[eventID]
+	if !exists {
+		return
+	}
+	if !done && progress.empty() {
+		d.removeElement(elem)
+		return
+	}
+
+	entry := elem.Value.(*dedupEntry)
+	entry.progress = progress
+	entry.delivering = false
+	entry.done = done
+}
+
+// droppedCount returns how many duplicates were dropped so far
+func (d *eventDeduplicator) droppedCount() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dropped
+}
+
+// expire removes entries older than the window; caller must hold d.mu
+func (d *eventDeduplicator) expire(now time.Time) {
+	cutoff := now.Add(-d.window)
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		if elem.Value.(*dedupEntry).seenAt.After(cutoff) {
+			return
+		}
+		d.removeElement(elem)
+	}
+}
+
+// removeElement drops an entry from both indexes; caller must hold d.mu
+func (d *eventDeduplicator) removeElement(elem *list.Element) {
+	entry := d.order.Remove(elem).(*dedupEntry)
+	delete(d.entries, entry.eventID)
+}
@@ -0,0 +1,109 @@
+package user_behavior
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventDeduplicator(t *testing.T) {
+	t0 := time.Date(2026, 7, 1, 8, 0, 0, 0, time.UTC)
+	partial := eventProgress{tracked: true, counted: true, sinks: map[string]bool{SinkMemory: true}}
+
+	type attempt struct {
+		eventID      string
+		at           time.Duration // after t0
+		wantErr      error
+		wantProgress eventProgress
+		finish       *eventProgress // nil leaves the attempt running
+		done         bool
+	}
+
+	tests := []struct {
+		name        string
+		window      time.Duration
+		maxEntries  int
+		attempts    []attempt
+		wantDropped int64
+	}{
+		{
+			name: "delivered event is a duplicate",
+			attempts: []attempt{
+				{eventID: "e1", finish: &partial, done: true},
+				{eventID: "e1", wantErr: ErrDuplicateEvent},
+			},
+			wantDropped: 1,
+		},
+		{
+			name: "retry of a partly delivered event gets its progress",
+			attempts: []attempt{
+				{eventID: "e1", finish: &partial},
+				{eventID: "e1", wantProgress: partial, finish: &partial, done: true},
+				{eventID: "e1", wantErr: ErrDuplicateEvent},
+			},
+			wantDropped: 1,
+		},
+		{
+			name: "event that reached nothing is forgotten",
+			attempts: []attempt{
+				{eventID: "e1", finish: &eventProgress{}},
+				{eventID: "e1", finish: &partial, done: true},
+			},
+		},
+		{
+			name: "retry while delivering",
+			attempts: []attempt{
+				{eventID: "e1"},
+				{eventID: "e1", wantErr: ErrEventChannelFull},
+			},
+		},
+		{
+			name:   "expired after the window",
+			window: time.Minute,
+			attempts: []attempt{
+				{eventID: "e1", finish: &partial, done: true},
+				{eventID: "e1", at: 2 * time.Minute},
+			},
+		},
+		{
+			name:       "oldest evicted when full",
+			maxEntries: 2,
+			attempts: []attempt{
+				{eventID: "e1", finish: &partial, done: true},
+				{eventID: "e2", finish: &partial, done: true},
+				{eventID: "e3", finish: &partial, done: true},
+				{eventID: "e2", wantErr: ErrDuplicateEvent},
+				{eventID: "e1"},
+			},
+			wantDropped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dedup := newEventDeduplicator(tt.window, tt.maxEntries)
+
+			for i, a := range tt.attempts {
+				progress, err := dedup.begin(a.eventID, t0.Add(a.at))
+				if !errors.Is(err, a.wantErr) {
+					t.Fatalf("attempt %d: begin(%s) error = %v, want %v", i, a.eventID, err, a.wantErr)
+				}
+				if err != nil {
+					continue
+				}
+
+				if progress.tracked != a.wantProgress.tracked || progress.counted != a.wantProgress.counted ||
+					len(progress.sinks) != len(a.wantProgress.sinks) {
+					t.Errorf("attempt %d: begin(%s) progress = %+v, want %+v", i, a.eventID, progress, a.wantProgress)
+				}
+				if a.finish != nil {
+					dedup.finish(a.eventID, *a.finish, a.done)
+				}
+			}
+
+			if got := dedup.droppedCount(); got != tt.wantDropped {
+				t.Errorf("droppedCount() = %d, want %d", got, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -3,8 +3,30 @@ package user_behavior
 import "errors"
 
 var (
-	ErrEventChannelFull = errors.New("event channel is full")
-	ErrSessionNotFound  = errors.New("session not found")
-	ErrHBaseWriteFailed = errors.New("hbase write failed")
-	ErrBQWriteFailed    = errors.New("bigquery write failed")
+	ErrEventChannelFull  = errors.New("event channel is full")
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrHBaseWriteFailed  = errors.New("hbase write failed")
+	ErrBQWriteFailed     = errors.New("bigquery write failed")
+	ErrUnknownSink       = errors.New("unknown event sink")
+	ErrUnknownStore      = errors.New("unknown event store")
+	ErrInvalidEvent      = errors.New("invalid event")
+	ErrDuplicateEvent    = errors.New("duplicate event")
+	ErrWALClosed         = errors.New("write-ahead log is closed")
+	ErrUnknownDeadLetter = errors.New("unknown dead-letter store")
+	ErrNoDeadLetter      = errors.New("no dead-letter store configured")
+	ErrUnknownRowKeys    = errors.New("unknown row key strategy")
+	ErrInvalidCursor     = errors.New("invalid cursor")
+	ErrUnknownAnalytics  = errors.New("unknown analytics backend")
+	ErrNoAnalytics       = errors.New("no analytics backend configured")
+	ErrUnknownSnapshot   = errors.New("unknown session snapshot store")
+	ErrInvalidSnapshot   = errors.New("invalid session snapshot config")
+	ErrInvalidCluster    = errors.New("invalid cluster config")
+	ErrClusterRequest    = errors.New("cluster request failed")
+	ErrClusterLeaving    = errors.New("cluster member is leaving")
+	ErrInvalidRule       = errors.New("invalid anomaly rule")
+	ErrUnknownRule       = errors.New("unknown anomaly rule")
+	ErrInvalidFunnel     = errors.New("invalid funnel")
+	ErrInvalidRetention  = errors.New("invalid retention query")
+	ErrUnknownBaseline   = errors.New("unknown baseline method")
+	ErrInvalidPattern    = errors.New("invalid pattern query")
 )
@@ -2,7 +2,9 @@ package user_behavior
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,10 +14,20 @@ import (
 // EventCollector is the main orchestrator for the user behavior tracking system
 type EventCollector struct {
 	sessionManager *SessionManager
-	hbaseWriter    *HBaseWriter
-	bqWriter       *BigQueryWriter
+	sinks          []EventSink
+	store          EventStore
 	analyzer       *BehaviorAnalyzer
 	aggregationJob *AggregationJob
+	profiles       *UserProfileStore
+	analytics      AnalyticsQuery // nil when no analytics backend is available
+	dedup          *eventDeduplicator
+	wal            *WriteAheadLog
+	walFailures    *walFailures   // logged offsets not yet taken by a consumer
+	walSessions    bool           // the session manager has a WAL checkpoint
+	walMu          sync.RWMutex   // read-held from WAL append until sink dispatch
+	walWG          sync.WaitGroup // the checkpoint worker
+	stopping       bool           // set under walMu once Stop begins
+	cluster        *Cluster       // nil unless clustering is configured
 	ctx            context.Context
 	cancel         context.CancelFunc
 	mu             sync.RWMutex
@@ -29,46 +41,217 @@ type EventCollectorConfig struct {
 	BQDataset           string
 	BQEventTable        string
 	BQSummaryTable      string
+	BQRollupTable       string
+	BQProfileTable      string
+	BQRetentionTable    string
 	EventBufferSize     int
 	NumSessionWorkers   int
 	NumHBaseWorkers     int
 	AggregationInterval time.Duration
+
+	// Sinks lists the event sinks to write to (hbase, bigquery, memory, file).
+	// Defaults to DefaultSinks when empty.
+	Sinks []string
+
+	// SinkFileDir is the directory used by the file sink
+	SinkFileDir string
+
+	// EventStore selects where analysis reads events from (hbase, memory).
+	// Defaults to hbase when it is a sink, memory otherwise.
+	EventStore string
+
+	// DedupWindow and DedupMaxEntries bound the client event ID dedup window.
+	// Zero values use DefaultDedupWindow and DefaultDedupMaxEntries.
+	DedupWindow     time.Duration
+	DedupMaxEntries int
+
+	// WALDir enables the write-ahead log when set. Events are appended to it
+	// before TrackEvent returns and replayed to sinks after a restart, and
+	// to the session manager when session snapshots are enabled.
+	WALDir                string
+	WALSegmentBytes       int64
+	WALSyncInterval       time.Duration
+	WALCheckpointInterval time.Duration
+
+	// Overflow policies for the session manager and HBase writer queues.
+	// The zero value rejects with ErrEventChannelFull when a queue is full.
+	SessionBackpressure BackpressureConfig
+	HBaseBackpressure   BackpressureConfig
+
+	// HBaseRetry configures retries of failed HBase writes; zero fields use
+	// DefaultRetryPolicy. Events that exhaust it go to the DeadLetter store.
+	HBaseRetry RetryPolicy
+	DeadLetter DeadLetterConfig
+
+	// HBaseBatch groups HBase writes into multi-row mutations; zero fields
+	// use the DefaultHBaseBatch* values
+	HBaseBatch HBaseBatchConfig
+
+	// HBaseLayout selects the HBase row key strategy and user index table,
+	// shared by the HBase sink and store
+	HBaseLayout HBaseLayoutConfig
+
+	// AnalyticsBackend answers the global stats queries (bigquery, local).
+	// Defaults to bigquery when it is a sink, otherwise local over a memory
+	// or file sink.
+	AnalyticsBackend string
+
+	// RollupWatermarkPath persists the end of the last rolled up window, so
+	// windows are not counted twice across restarts, and the windows still
+	// open at the last WAL checkpoint. Defaults to DefaultRollupWatermarkFile.
+	RollupWatermarkPath string
+
+	// Session sets session timeouts, retention and split rules; zero fields
+	// use the package defaults
+	Session SessionConfig
+
+	// SessionSnapshot persists active sessions so they survive a restart;
+	// disabled when Type is empty
+	SessionSnapshot SessionSnapshotConfig
+
+	// Cluster routes sessions to owner instances when peers are configured
+	Cluster ClusterConfig
+
+	// AnomalyRules lists the anomaly rule files, reloaded when they change;
+	// DefaultAnomalyRules are used when no files are set
+	AnomalyRules AnomalyRuleConfig
+
+	// Profiles configures the per user profiles updated as sessions end
+	Profiles UserProfileConfig
 }
 
 // NewEventCollector creates a new event collector
 func NewEventCollector(config EventCollectorConfig) (*EventCollector, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	rules, err := NewAnomalyRuleEngine(config.AnomalyRules)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	profiles, err := NewUserProfileStore(config.Profiles)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
 	// Initialize components
-	sessionManager := NewSessionManager(config.EventBufferSize)
-	hbaseWriter := NewHBaseWriter(config.HBaseHost, config.HBaseTable, config.EventBufferSize)
-
-	bqWriter, err := NewBigQueryWriter(
-		config.BQProjectID,
-		config.BQDataset,
-		config.BQEventTable,
-		config.BQSummaryTable,
-	)
+	sessionManager := NewSessionManager(config.EventBufferSize, config.SessionBackpressure, config.Session)
+	sessionManager.SetAnomalyRules(rules)
+
+	sinks, err := newEventSinks(config)
 	if err != nil {
 		cancel()
-		return nil, fmt.Errorf("failed to create BigQuery writer: %w", err)
+		return nil, err
 	}
 
-	analyzer := NewBehaviorAnalyzer(sessionManager, hbaseWriter)
+	store, err := newEventStore(config, sessionManager)
+	if err != nil {
+		cancel()
+		for _, sink := range sinks {
+			sink.Stop()
+		}
+		return nil, err
+	}
+
+	analytics, err := newAnalyticsQuery(config, sinks)
+	if err != nil {
+		cancel()
+		for _, sink := range sinks {
+			sink.Stop()
+		}
+		store.Close()
+		return nil, err
+	}
+
+	var wal *WriteAheadLog
+	if config.WALDir != "" {
+		wal, err = openCollectorWAL(config, sinks, config.SessionSnapshot.Type != SnapshotStoreNone)
+		if err != nil {
+			cancel()
+			for _, sink := range sinks {
+				sink.Stop()
+			}
+			store.Close()
+			if analytics != nil {
+				analytics.Close()
+			}
+			return nil, err
+		}
+	}
+
+	// Instances sharing a snapshot table keep apart by their cluster address
+	snapshotConfig := config.SessionSnapshot
+	if snapshotConfig.InstanceID == "" {
+		snapshotConfig.InstanceID = strings.TrimRight(config.Cluster.Self, "/")
+	}
+	snapshots, err := NewSessionSnapshotStore(snapshotConfig, config.HBaseHost)
+	if err != nil {
+		cancel()
+		for _, sink := range sinks {
+			sink.Stop()
+		}
+		store.Close()
+		if analytics != nil {
+			analytics.Close()
+		}
+		if wal != nil {
+			wal.Close()
+		}
+		return nil, err
+	}
+	if snapshots != nil {
+		sessionManager.SetSnapshotStore(snapshots, config.SessionSnapshot.Interval)
+	}
+
+	var cluster *Cluster
+	if config.Cluster.Enabled() {
+		cluster, err = NewCluster(config.Cluster)
+		if err != nil {
+			cancel()
+			for _, sink := range sinks {
+				sink.Stop()
+			}
+			store.Close()
+			if analytics != nil {
+				analytics.Close()
+			}
+			if wal != nil {
+				wal.Close()
+			}
+			if snapshots != nil {
+				snapshots.Close()
+			}
+			return nil, err
+		}
+	}
+
+	analyzer := NewBehaviorAnalyzer(sessionManager, store, rules, profiles)
 	aggregationJob := NewAggregationJob(
 		sessionManager,
-		hbaseWriter,
-		bqWriter,
+		store,
+		sinks,
 		analyzer,
+		analytics,
 		config.AggregationInterval,
+		config.RollupWatermarkPath,
+		profiles,
 	)
 
 	return &EventCollector{
 		sessionManager: sessionManager,
-		hbaseWriter:    hbaseWriter,
-		bqWriter:       bqWriter,
+		sinks:          sinks,
+		store:          store,
 		analyzer:       analyzer,
 		aggregationJob: aggregationJob,
+		profiles:       profiles,
+		analytics:      analytics,
+		dedup:          newEventDeduplicator(config.DedupWindow, config.DedupMaxEntries),
+		wal:            wal,
+		walFailures:    newWALFailures(),
+		walSessions:    wal != nil && snapshots != nil,
+		cluster:        cluster,
 		ctx:            ctx,
 		cancel:         cancel,
 	}, nil
@@ -77,75 +260,594 @@ func NewEventCollector(config EventCollectorConfig) (*EventCollector, error) {
 // Start starts all components of the event collector
 func (ec *EventCollector) Start(config EventCollectorConfig) {
 	ec.sessionManager.Start(config.NumSessionWorkers)
-	ec.hbaseWriter.Start(config.NumHBaseWorkers)
-	ec.bqWriter.Start()
+	for _, sink := range ec.sinks {
+		sink.Start()
+	}
+
+	// The windows open at the last checkpoint, before the replay counts the
+	// events logged since
+	rollupOffset, err := ec.aggregationJob.restoreRollups()
+	if err != nil {
+		fmt.Printf("Failed to restore rollup windows: %v\n", err)
+	}
+
+	if ec.wal != nil {
+		ec.replayWAL(rollupOffset)
+		ec.walWG.Add(1)
+		go ec.walCheckpointWorker(config.WALCheckpointInterval)
+	}
+
 	ec.analyzer.Start()
+	ec.profiles.Start()
 	ec.aggregationJob.Start()
 
+	if ec.cluster != nil {
+		ec.cluster.SetMembershipHandler(ec.handOffSessions)
+		ec.cluster.Start()
+	}
+
 	fmt.Println("User Behavior Tracking System started successfully")
 }
 
 // Stop gracefully stops all components
 func (ec *EventCollector) Stop() error {
+	// Stop accepting events; everything logged so far has been handed to
+	// the sinks once the write lock is held
+	ec.walMu.Lock()
+	ec.stopping = true
+	var walEnd uint64
+	if ec.wal != nil {
+		walEnd = ec.wal.NextOffset()
+	}
+	rollups := ec.aggregationJob.snapshotRollups(walEnd)
+	ec.walMu.Unlock()
+
 	ec.cancel()
+	ec.walWG.Wait()
 
+	// Leave the ring so new events go to the other members, then hand them
+	// the sessions once the queued events are applied
+	if ec.cluster != nil {
+		ec.cluster.Leave()
+		ec.sessionManager.drain()
+		if err := ec.handOffSessions(); err != nil {
+			fmt.Printf("Session handoff on stop failed: %v\n", err)
+		}
+		ec.cluster.Stop()
+	}
+
+	var stopErr error
+	sessionsSaved := true
+	if err := ec.sessionManager.Stop(); err != nil {
+		sessionsSaved = false
+		stopErr = fmt.Errorf("error stopping session manager: %w", err)
+	}
+	// The session bus is closed now, so these return once the sessions that
+	// ended before the drain are summarized and checked
 	ec.aggregationJob.Stop()
 	ec.analyzer.Stop()
-	ec.sessionManager.Stop()
-	ec.hbaseWriter.Stop()
+	if err := ec.profiles.Stop(); err != nil && stopErr == nil {
+		stopErr = fmt.Errorf("error saving user profiles: %w", err)
+	}
+	rollupsSaved := true
+	if err := ec.aggregationJob.saveRollups(rollups); err != nil {
+		rollupsSaved = false
+		if stopErr == nil {
+			stopErr = fmt.Errorf("error saving rollup windows: %w", err)
+		}
+	}
+	for _, sink := range ec.sinks {
+		if err := sink.Stop(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("error stopping %s sink: %w", sink.Name(), err)
+		}
+	}
+
+	if ec.wal != nil {
+		// Sinks that stopped cleanly have flushed everything appended
+		// before Stop, except the records they failed to take
+		if stopErr == nil {
+			for _, sink := range ec.sinks {
+				ec.wal.Commit(sink.Name(), ec.walFailures.limit(sink.Name(), walEnd))
+			}
+		}
+		// The final snapshot holds every event the session manager took
+		if ec.walSessions && sessionsSaved {
+			ec.wal.Commit(walSessionCheckpoint, ec.walFailures.limit(walSessionCheckpoint, walEnd))
+		}
+		if rollupsSaved {
+			ec.wal.Commit(walRollupCheckpoint, walEnd)
+		}
+		ec.wal.Compact()
+		if err := ec.wal.Close(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("error closing write-ahead log: %w", err)
+		}
+	}
+
+	if err := ec.store.Close(); err != nil && stopErr == nil {
+		stopErr = fmt.Errorf("error closing event store: %w", err)
+	}
 
-	if err := ec.bqWriter.Stop(); err != nil {
-		return fmt.Errorf("error stopping BigQuery writer: %w", err)
+	if ec.analytics != nil {
+		if err := ec.analytics.Close(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("error closing analytics backend: %w", err)
+		}
+	}
+
+	if stopErr != nil {
+		return stopErr
 	}
 
 	fmt.Println("User Behavior Tracking System stopped successfully")
 	return nil
 }
 
-// TrackEvent is the main entry point for tracking user events
+// TrackOption sets optional client-supplied fields of a tracked event
+type TrackOption func(*UserEvent)
+
+// WithEventID sets a client event ID; retries with the same ID are dropped
+func WithEventID(eventID string) TrackOption {
+	return func(event *UserEvent) {
+		event.EventID = eventID
+	}
+}
+
+// WithTimestamp sets the client-side time the event happened
+func WithTimestamp(timestamp time.Time) TrackOption {
+	return func(event *UserEvent) {
+		event.Timestamp = timestamp
+	}
+}
+
+// TrackEvent is the main entry point for tracking user events.
+// A retried event whose client event ID was already delivered is dropped
+// and reported as success, so retries are idempotent.
 func (ec *EventCollector) TrackEvent(
 	userID string,
 	sessionID string,
 	eventType EventType,
 	screenName string,
 	metadata map[string]interface{},
+	opts ...TrackOption,
 ) error {
 	// Create event
 	event := UserEvent{
-		EventID:    uuid.New().String(),
 		UserID:     userID,
 		SessionID:  sessionID,
 		EventType:  eventType,
-		Timestamp:  time.Now(),
 		ScreenName: screenName,
 		Metadata:   metadata,
 	}
+	for _, opt := range opts {
+		opt(&event)
+	}
+
+	now := time.Now()
+	clientEventID := event.EventID != ""
+
+	if !clientEventID {
+		event.EventID = uuid.New().String()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = now
+	}
+	if err := event.Validate(now); err != nil {
+		return err
+	}
+
+	err := ec.trackEvent(event, clientEventID)
+	if errors.Is(err, ErrDuplicateEvent) {
+		return nil
+	}
+	return err
+}
+
+// TrackEvents tracks a batch of client-built events, keeping their timestamps
+// and metadata. Each event is validated and tracked on its own; the result at
+// index i reports whether events[i] was accepted.
+func (ec *EventCollector) TrackEvents(events []UserEvent) []TrackResult {
+	results := make([]TrackResult, len(events))
+	now := time.Now()
+
+	for i, event := range events {
+		clientEventID := event.EventID != ""
+		if !clientEventID {
+			event.EventID = uuid.New().String()
+		}
+		if event.Timestamp.IsZero() {
+			event.Timestamp = now
+		}
+
+		results[i] = TrackResult{Index: i, EventID: event.EventID}
+
+		if err := event.Validate(now); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		err := ec.trackEvent(event, clientEventID)
+		if errors.Is(err, ErrDuplicateEvent) {
+			results[i].Accepted = true
+			results[i].Duplicate = true
+			continue
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			results[i].Retryable = errors.Is(err, ErrEventChannelFull)
+			continue
+		}
+
+		results[i].Accepted = true
+	}
+
+	return results
+}
+
+// TrackResult is the outcome of tracking a single event of a batch
+type TrackResult struct {
+	Index     int    `json:"index"`
+	EventID   string `json:"event_id"`
+	Accepted  bool   `json:"accepted"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// trackEvent forwards an event to the instance owning its session, or sends
+// it through the session manager and all sinks when this instance owns it
+func (ec *EventCollector) trackEvent(event UserEvent, clientEventID bool) error {
+	if forwarded, err := ec.forwardEvent(event, clientEventID); forwarded {
+		return err
+	}
+
+	return ec.trackLocal(event, clientEventID)
+}
+
+// trackLocal sends a complete event through the session manager and all sinks.
+// A client event ID is a duplicate only once an earlier attempt delivered it
+// everywhere; the retry of a partly delivered event delivers the rest, and
+// ErrDuplicateEvent is returned for retries of a delivered one.
+func (ec *EventCollector) trackLocal(event UserEvent, clientEventID bool) error {
+	if !clientEventID {
+		_, err := ec.deliverEvent(event, eventProgress{})
+		return err
+	}
+
+	progress, err := ec.dedup.begin(event.EventID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	progress, err = ec.deliverEvent(event, progress)
+	ec.dedup.finish(event.EventID, progress, err == nil)
+	return err
+}
+
+// deliverEvent logs the event to the WAL, when enabled, and hands it to the
+// session manager and to every sink the progress does not list yet. Each
+// part is tried even when another one fails; the returned progress records
+// the parts reached and the error is the first failure. The offsets of
+// logged events a part failed to take hold back that part's WAL checkpoint
+// until a retry or the checkpoint worker delivers them.
+func (ec *EventCollector) deliverEvent(event UserEvent, progress eventProgress) (eventProgress, error) {
+	ec.walMu.RLock()
+	defer ec.walMu.RUnlock()
+
+	if ec.stopping {
+		return progress, fmt.Errorf("%w: event collector is stopping", ErrEventChannelFull)
+	}
+
+	if ec.wal != nil && !progress.logged {
+		offset, err := ec.wal.Append(event)
+		if err != nil {
+			return progress, fmt.Errorf("failed to append event to WAL: %w", err)
+		}
+		progress.logged = true
+		progress.offset = offset
+	}
+
+	var deliverErr error
 
 	// Track in session manager
-	if err := ec.sessionManager.TrackEvent(event); err != nil {
-		return fmt.Errorf("failed to track event in session manager: %w", err)
+	if !progress.tracked {
+		err := ec.sessionManager.TrackEvent(event)
+		ec.recordDelivery(walSessionCheckpoint, progress, err)
+		if err != nil {
+			deliverErr = fmt.Errorf("failed to track event in session manager: %w", err)
+		} else {
+			progress.tracked = true
+		}
 	}
 
-	// Write to HBase (async)
-	if err := ec.hbaseWriter.WriteEvent(event); err != nil {
-		return fmt.Errorf("failed to queue event for HBase: %w", err)
+	// Count in the open rollup window once, as soon as the event is logged
+	// or tracked
+	if !progress.counted && (progress.logged || progress.tracked) {
+		ec.aggregationJob.observeEvent(event)
+		progress.counted = true
 	}
 
-	// Write to BigQuery (async batched)
-	if err := ec.bqWriter.WriteEvent(event); err != nil {
-		return fmt.Errorf("failed to queue event for BigQuery: %w", err)
+	// Write to sinks (HBase async, BigQuery async batched)
+	for _, sink := range ec.sinks {
+		if progress.sinks[sink.Name()] {
+			continue
+		}
+		err := sink.WriteEvent(event)
+		ec.recordDelivery(sink.Name(), progress, err)
+		if err != nil {
+			if deliverErr == nil {
+				deliverErr = fmt.Errorf("failed to queue event for %s: %w", sink.Name(), err)
+			}
+			continue
+		}
+
+		if progress.sinks == nil {
+			progress.sinks = make(map[string]bool, len(ec.sinks))
+		}
+		progress.sinks[sink.Name()] = true
 	}
 
-	return nil
+	return progress, deliverErr
+}
+
+// recordDelivery records whether the WAL checkpoint name took a logged event
+func (ec *EventCollector) recordDelivery(name string, progress eventProgress, err error) {
+	if !progress.logged {
+		return
+	}
+	if err != nil {
+		ec.walFailures.add(name, progress.offset)
+	} else {
+		ec.walFailures.remove(name, progress.offset)
+	}
+}
+
+// redeliverWAL hands the logged records below end that the session manager
+// or a sink failed to take to them again. Records a client retry is
+// delivering at the same time are left to it.
+func (ec *EventCollector) redeliverWAL(end uint64) {
+	pending := ec.walFailures.pending(end)
+	failed := make(map[uint64][]string)
+	from := end
+	for name, offsets := range pending {
+		for _, offset := range offsets {
+			failed[offset] = append(failed[offset], name)
+		}
+		if len(offsets) > 0 && offsets[0] < from {
+			from = offsets[0]
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	redelivered := 0
+	err := ec.wal.Replay(from, end, func(offset uint64, event UserEvent) error {
+		names, ok := failed[offset]
+		if !ok || !ec.dedup.claim(event.EventID) {
+			return nil
+		}
+
+		// Every other part took the event when it was tracked
+		progress := eventProgress{logged: true, offset: offset, tracked: true, counted: true,
+			sinks: make(map[string]bool, len(ec.sinks))}
+		for _, sink := range ec.sinks {
+			progress.sinks[sink.Name()] = true
+		}
+		for _, name := range names {
+			if name == walSessionCheckpoint {
+				progress.tracked = false
+			}
+			delete(progress.sinks, name)
+		}
+
+		progress, err := ec.deliverEvent(event, progress)
+		ec.dedup.finish(event.EventID, progress, err == nil)
+		if err == nil {
+			redelivered++
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("WAL re-delivery stopped: %v\n", err)
+	}
+	if redelivered > 0 {
+		fmt.Printf("Re-delivered %d events from WAL\n", redelivered)
+	}
+}
+
+// openCollectorWAL opens the write-ahead log and registers every sink, and
+// the session manager when its sessions are snapshotted
+func openCollectorWAL(config EventCollectorConfig, sinks []EventSink, sessions bool) (*WriteAheadLog, error) {
+	wal, err := OpenWriteAheadLog(WALConfig{
+		Dir:          config.WALDir,
+		SegmentBytes: config.WALSegmentBytes,
+		SyncInterval: config.WALSyncInterval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	names := make([]string, 0, len(sinks)+2)
+	for _, sink := range sinks {
+		names = append(names, sink.Name())
+	}
+	names = append(names, walRollupCheckpoint)
+	if sessions {
+		names = append(names, walSessionCheckpoint)
+	}
+	for _, name := range names {
+		if err := wal.Register(name); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("failed to register %s in write-ahead log: %w", name, err)
+		}
+	}
+
+	// Sinks removed from the config would keep their segments forever
+	dropped, err := wal.Prune(names)
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to drop stale write-ahead log checkpoints: %w", err)
+	}
+	if len(dropped) > 0 {
+		fmt.Printf("Dropped write-ahead log checkpoints of removed consumers: %s\n", strings.Join(dropped, ", "))
+	}
+
+	return wal, nil
+}
+
+// replayWAL re-delivers each sink's uncommitted records from its checkpoint,
+// replays the records after the session checkpoint into the restored
+// sessions and counts the records logged after rollupOffset into the rollup
+// windows. Records a sink fails to take hold back its checkpoint.
+func (ec *EventCollector) replayWAL(rollupOffset uint64) {
+	end := ec.wal.NextOffset()
+
+	from := ec.wal.Checkpoint(walRollupCheckpoint)
+	if rollupOffset > from {
+		from = rollupOffset
+	}
+	if from < end {
+		err := ec.wal.Replay(from, end, func(offset uint64, event UserEvent) error {
+			ec.aggregationJob.replayEvent(event)
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("WAL replay to rollups stopped: %v\n", err)
+		}
+	}
+
+	if ec.walSessions {
+		ec.replayConsumer(walSessionCheckpoint, end, ec.sessionManager.replayEvent)
+	}
+	for _, sink := range ec.sinks {
+		ec.replayConsumer(sink.Name(), end, sink.WriteEvent)
+	}
+}
+
+// replayConsumer hands the records from the checkpoint of name to end to
+// deliver, recording the ones it fails to take
+func (ec *EventCollector) replayConsumer(name string, end uint64, deliver func(UserEvent) error) {
+	from := ec.wal.Checkpoint(name)
+	if from >= end {
+		return
+	}
+
+	replayed, failed := 0, 0
+	err := ec.wal.Replay(from, end, func(offset uint64, event UserEvent) error {
+		if err := deliver(event); err != nil {
+			ec.walFailures.add(name, offset)
+			failed++
+			return nil
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		// The records not read stay below the checkpoint for the next start
+		ec.walFailures.add(name, from+uint64(replayed+failed))
+		fmt.Printf("WAL replay to %s stopped: %v\n", name, err)
+	}
+
+	fmt.Printf("Replayed %d events from WAL to %s, %d failed\n", replayed, name, failed)
+}
+
+// walCheckpointWorker periodically flushes sinks, commits their checkpoints
+// and compacts the write-ahead log
+func (ec *EventCollector) walCheckpointWorker(interval time.Duration) {
+	defer ec.walWG.Done()
+
+	if interval <= 0 {
+		interval = DefaultWALCheckpointInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Every record below this offset has been handed to the sinks
+			ec.walMu.Lock()
+			end := ec.wal.NextOffset()
+			rollups := ec.aggregationJob.snapshotRollups(end)
+			ec.walMu.Unlock()
+
+			ec.commitWAL(end, rollups)
+
+		case <-ec.ctx.Done():
+			return
+		}
+	}
+}
+
+// commitWAL re-delivers the records below end that failed, flushes each
+// sink and commits it up to end or its first failed record, commits the
+// session manager once a snapshot holds the records below end, persists the
+// rollup windows counting them, then compacts
+func (ec *EventCollector) commitWAL(end uint64, rollups rollupState) {
+	ec.redeliverWAL(end)
+
+	for _, sink := range ec.sinks {
+		if err := sink.Flush(); err != nil {
+			fmt.Printf("WAL checkpoint skipped for %s: %v\n", sink.Name(), err)
+			continue
+		}
+		if err := ec.wal.Commit(sink.Name(), ec.walFailures.limit(sink.Name(), end)); err != nil {
+			fmt.Printf("WAL checkpoint error for %s: %v\n", sink.Name(), err)
+		}
+	}
+
+	if ec.walSessions {
+		if !ec.sessionManager.settle(walSettleTimeout) {
+			fmt.Printf("WAL checkpoint skipped for sessions: queued events not processed within %v\n", walSettleTimeout)
+		} else if err := ec.sessionManager.saveSnapshot(); err != nil {
+			fmt.Printf("WAL checkpoint skipped for sessions: %v\n", err)
+		} else if err := ec.wal.Commit(walSessionCheckpoint, ec.walFailures.limit(walSessionCheckpoint, end)); err != nil {
+			fmt.Printf("WAL checkpoint error for sessions: %v\n", err)
+		}
+	}
+
+	if err := ec.aggregationJob.saveRollups(rollups); err != nil {
+		fmt.Printf("WAL checkpoint skipped for rollups: %v\n", err)
+	} else if err := ec.wal.Commit(walRollupCheckpoint, end); err != nil {
+		fmt.Printf("WAL checkpoint error for rollups: %v\n", err)
+	}
+
+	if _, err := ec.wal.Compact(); err != nil {
+		fmt.Printf("WAL compaction error: %v\n", err)
+	}
 }
 
 // CreateSession creates a new session for a user
 func (ec *EventCollector) CreateSession(userID string) string {
-	return ec.sessionManager.CreateSession(userID)
+	if ec.cluster == nil {
+		return ec.sessionManager.CreateSession(userID)
+	}
+
+	sessionID := uuid.New().String()
+	if owner, local := ec.cluster.Owner(sessionID); !local && owner != "" {
+		req := forwardRequest{Op: ForwardCreate, UserID: userID, SessionID: sessionID}
+		if err := ec.cluster.Forward(owner, req); err != nil {
+			// The owner starts the session with its first event instead
+			fmt.Printf("Failed to create session %s on %s: %v\n", sessionID, owner, err)
+		}
+		return sessionID
+	}
+
+	ec.sessionManager.createSession(sessionID, userID)
+	return sessionID
 }
 
 // CloseSession explicitly closes a session
 func (ec *EventCollector) CloseSession(sessionID string) {
+	if ec.cluster != nil {
+		if owner, local := ec.cluster.Owner(sessionID); !local && owner != "" {
+			if err := ec.cluster.Forward(owner, forwardRequest{Op: ForwardClose, SessionID: sessionID}); err != nil {
+				fmt.Printf("Failed to close session %s on %s: %v\n", sessionID, owner, err)
+			}
+			return
+		}
+	}
+
 	ec.sessionManager.CloseSession(sessionID)
 }
 
@@ -154,6 +856,75 @@ func (ec *EventCollector) GetSessionAnalysis(sessionID string) (*SessionAnalysis
 	return ec.aggregationJob.AnalyzeSessionBehavior(sessionID)
 }
 
+// AnomalyRules returns the loaded anomaly rules
+func (ec *EventCollector) AnomalyRules() AnomalyRuleStatus {
+	return ec.analyzer.Rules().Status()
+}
+
+// SubscribeAnomalies registers for anomalies as they are detected in the
+// tracked sessions
+func (ec *EventCollector) SubscribeAnomalies(name string) *SessionSubscription {
+	return ec.sessionManager.SubscribeAnomalies(name)
+}
+
+// OnAnomaly calls handle with every anomaly detected in the tracked sessions
+// until the returned subscription is closed
+func (ec *EventCollector) OnAnomaly(name string, handle func(AnomalyDetection)) *SessionSubscription {
+	return ec.sessionManager.OnAnomaly(name, handle)
+}
+
+// ReloadAnomalyRules reloads the anomaly rule files now
+func (ec *EventCollector) ReloadAnomalyRules() (AnomalyRuleStatus, error) {
+	err := ec.analyzer.Rules().Reload()
+	return ec.analyzer.Rules().Status(), err
+}
+
+// TestAnomalyRule replays a stored session through a loaded rule or a rule
+// definition
+func (ec *EventCollector) TestAnomalyRule(sessionID, name string, definition *AnomalyRule) (*AnomalyRuleTest, error) {
+	return ec.analyzer.TestAnomalyRule(sessionID, name, definition)
+}
+
+// AnalyzeFunnel computes a funnel over a session, a user or a time range
+func (ec *EventCollector) AnalyzeFunnel(funnel FunnelDefinition, query FunnelQuery) (*FunnelReport, error) {
+	return ec.analyzer.AnalyzeFunnel(funnel, query)
+}
+
+// ActionPatterns mines the frequent action sequences of a session, a user or a time range
+func (ec *EventCollector) ActionPatterns(query PatternQuery) (*PatternReport, error) {
+	return ec.analyzer.GetActionPatterns(query)
+}
+
+// SessionNavigation builds the screen navigation graph of a session
+func (ec *EventCollector) SessionNavigation(sessionID string, options NavigationOptions) (*NavigationGraph, error) {
+	return ec.analyzer.SessionNavigation(sessionID, options)
+}
+
+// NavigationGraph builds the screen navigation graph of the sessions within [from, to)
+func (ec *EventCollector) NavigationGraph(from, to time.Time, options NavigationOptions) (*NavigationGraph, error) {
+	return ec.analyzer.NavigationGraph(from, to, options)
+}
+
+// UserProfile returns the profile of a user, built from the user's ended sessions
+func (ec *EventCollector) UserProfile(userID string) (UserProfile, bool) {
+	return ec.profiles.Get(userID)
+}
+
+// CohortRetention computes a cohort retention table from the user profiles
+func (ec *EventCollector) CohortRetention(query RetentionQuery) (*RetentionTable, error) {
+	return ec.profiles.Retention(query, time.Now())
+}
+
+// GetTopActionsGlobal returns action counts across all sessions within [start, end)
+func (ec *EventCollector) GetTopActionsGlobal(start, end time.Time) ([]ActionStats, error) {
+	return ec.aggregationJob.GetTopActionsGlobal(start, end)
+}
+
+// GetAnomalyReport returns the anomalies of sessions started within [start, end)
+func (ec *EventCollector) GetAnomalyReport(start, end time.Time) ([]AnomalyDetection, error) {
+	return ec.aggregationJob.GetAnomalyReport(start, end)
+}
+
 // GetUserSessions returns all active sessions for a user
 func (ec *EventCollector) GetUserSessions(userID string) []*Session {
 	return ec.sessionManager.GetUserSessions(userID)
@@ -161,14 +932,71 @@ func (ec *EventCollector) GetUserSessions(userID string) []*Session {
 
 // GetMetrics returns metrics from all components
 func (ec *EventCollector) GetMetrics() SystemMetrics {
-	return SystemMetrics{
-		HBase:    ec.hbaseWriter.GetMetrics(),
-		BigQuery: ec.bqWriter.GetMetrics(),
+	metrics := SystemMetrics{
+		Sinks:             make([]SinkMetrics, 0, len(ec.sinks)),
+		Queues:            map[string]QueueMetrics{"session_manager": ec.sessionManager.QueueMetrics()},
+		Subscribers:       ec.sessionManager.SubscriptionMetrics(),
+		Sessions:          ec.sessionManager.Metrics(),
+		DuplicatesDropped: ec.dedup.droppedCount(),
 	}
+	if ec.cluster != nil {
+		clusterMetrics := ec.cluster.Metrics()
+		metrics.Cluster = &clusterMetrics
+	}
+	for _, sink := range ec.sinks {
+		metrics.Sinks = append(metrics.Sinks, sink.Metrics())
+		if reporter, ok := sink.(queueMetricsReporter); ok {
+			metrics.Queues[sink.Name()] = reporter.QueueMetrics()
+		}
+	}
+	return metrics
+}
+
+// ReplayDeadLetters replays the dead-letter store of every sink that has one
+func (ec *EventCollector) ReplayDeadLetters() (ReplayStats, error) {
+	var total ReplayStats
+	found := false
+
+	for _, sink := range ec.sinks {
+		replayer, ok := sink.(deadLetterReplayer)
+		if !ok {
+			continue
+		}
+
+		stats, err := replayer.ReplayDeadLetters()
+		if errors.Is(err, ErrNoDeadLetter) {
+			continue
+		}
+		found = true
+		total.Replayed += stats.Replayed
+		total.Failed += stats.Failed
+		if err != nil {
+			return total, fmt.Errorf("failed to replay %s dead letters: %w", sink.Name(), err)
+		}
+	}
+
+	if !found {
+		return total, ErrNoDeadLetter
+	}
+	return total, nil
+}
+
+// deadLetterReplayer is implemented by sinks with a dead-letter store
+type deadLetterReplayer interface {
+	ReplayDeadLetters() (ReplayStats, error)
+}
+
+// queueMetricsReporter is implemented by sinks that buffer events in a queue
+type queueMetricsReporter interface {
+	QueueMetrics() QueueMetrics
 }
 
 // SystemMetrics aggregates metrics from all components
 type SystemMetrics struct {
-	HBase    HBaseMetrics `json:"hbase"`
-	BigQuery BQMetrics    `json:"bigquery"`
+	Sinks             []SinkMetrics           `json:"sinks"`
+	Queues            map[string]QueueMetrics `json:"queues"`
+	Subscribers       []SubscriptionMetrics   `json:"session_subscribers"`
+	Sessions          SessionMetrics          `json:"sessions"`
+	DuplicatesDropped int64                   `json:"duplicates_dropped"`
+	Cluster           *ClusterMetrics         `json:"cluster,omitempty"`
 }
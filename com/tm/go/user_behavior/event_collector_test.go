@@ -0,0 +1,148 @@
+package user_behavior
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flakySink is a memory sink under its own name whose next writes fail
+type flakySink struct {
+	*MemorySink
+	name     string
+	failures int
+}
+
+func (fs *flakySink) Name() string {
+	return fs.name
+}
+
+func (fs *flakySink) WriteEvent(event UserEvent) error {
+	if fs.failures > 0 {
+		fs.failures--
+		return errors.New("sink unavailable")
+	}
+	return fs.MemorySink.WriteEvent(event)
+}
+
+// newTestCollector builds a collector around a session manager that is not
+// started, so tracked events stay in its queue of queueSize
+func newTestCollector(t *testing.T, queueSize int, sinks ...EventSink) *EventCollector {
+	sm := NewSessionManager(queueSize, BackpressureConfig{}, SessionConfig{})
+	watermark := filepath.Join(t.TempDir(), "rollup_watermark.json")
+
+	return &EventCollector{
+		sessionManager: sm,
+		sinks:          sinks,
+		aggregationJob: NewAggregationJob(sm, nil, sinks, nil, nil, time.Minute, watermark, nil),
+		dedup:          newEventDeduplicator(0, 0),
+		walFailures:    newWALFailures(),
+	}
+}
+
+func TestTrackLocalRetry(t *testing.T) {
+	event := UserEvent{
+		EventID:   "evt-1",
+		UserID:    "u1",
+		SessionID: "s1",
+		EventType: EventTyping,
+		Timestamp: time.Now(),
+	}
+
+	t.Run("sink failure", func(t *testing.T) {
+		flaky := &flakySink{MemorySink: NewMemorySink(), name: "flaky", failures: 1}
+		memory := NewMemorySink()
+		ec := newTestCollector(t, 4, flaky, memory)
+
+		if err := ec.trackLocal(event, true); err == nil {
+			t.Fatal("trackLocal() error = nil, want the sink failure")
+		}
+		if err := ec.trackLocal(event, true); err != nil {
+			t.Fatalf("retry error = %v", err)
+		}
+		if err := ec.trackLocal(event, true); !errors.Is(err, ErrDuplicateEvent) {
+			t.Fatalf("second retry error = %v, want %v", err, ErrDuplicateEvent)
+		}
+
+		if len(flaky.events) != 1 || len(memory.events) != 1 {
+			t.Errorf("sink events = %d, %d, want 1, 1", len(flaky.events), len(memory.events))
+		}
+		if depth := ec.sessionManager.QueueMetrics().Depth; depth != 1 {
+			t.Errorf("session manager queue depth = %d, want 1", depth)
+		}
+		if got := ec.dedup.droppedCount(); got != 1 {
+			t.Errorf("droppedCount() = %d, want 1", got)
+		}
+	})
+
+	t.Run("session manager full", func(t *testing.T) {
+		memory := NewMemorySink()
+		ec := newTestCollector(t, 1, memory)
+
+		if err := ec.trackLocal(UserEvent{EventID: "other", SessionID: "s2", Timestamp: time.Now()}, false); err != nil {
+			t.Fatalf("trackLocal() error = %v", err)
+		}
+		if err := ec.trackLocal(event, true); !errors.Is(err, ErrEventChannelFull) {
+			t.Fatalf("trackLocal() error = %v, want %v", err, ErrEventChannelFull)
+		}
+
+		<-ec.sessionManager.eventQueue.C()
+		if err := ec.trackLocal(event, true); err != nil {
+			t.Fatalf("retry error = %v", err)
+		}
+		if err := ec.trackLocal(event, true); !errors.Is(err, ErrDuplicateEvent) {
+			t.Fatalf("second retry error = %v, want %v", err, ErrDuplicateEvent)
+		}
+
+		if queued := <-ec.sessionManager.eventQueue.C(); queued.EventID != event.EventID {
+			t.Errorf("queued event = %s, want %s", queued.EventID, event.EventID)
+		}
+		if len(memory.events) != 2 {
+			t.Errorf("memory sink events = %d, want 2", len(memory.events))
+		}
+	})
+}
+
+func TestTrackEventValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		userID    string
+		sessionID string
+		eventType EventType
+		opts      []TrackOption
+		wantErr   error
+	}{
+		{name: "valid", userID: "u1", sessionID: "s1", eventType: EventTyping},
+		{name: "missing user", sessionID: "s1", eventType: EventTyping, wantErr: ErrInvalidEvent},
+		{name: "unknown event type", userID: "u1", sessionID: "s1", eventType: "swipe", wantErr: ErrInvalidEvent},
+		{name: "split part session", userID: "u1", sessionID: "s1#2", eventType: EventTyping, wantErr: ErrInvalidEvent},
+		{
+			name:      "future timestamp",
+			userID:    "u1",
+			sessionID: "s1",
+			eventType: EventTyping,
+			opts:      []TrackOption{WithTimestamp(time.Now().Add(2 * MaxClientClockSkew))},
+			wantErr:   ErrInvalidEvent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := NewMemorySink()
+			ec := newTestCollector(t, 4, memory)
+
+			err := ec.TrackEvent(tt.userID, tt.sessionID, tt.eventType, "", nil, tt.opts...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrackEvent() error = %v, want %v", err, tt.wantErr)
+			}
+			wantEvents := 0
+			if tt.wantErr == nil {
+				wantEvents = 1
+			}
+			if len(memory.events) != wantEvents {
+				t.Errorf("memory sink events = %d, want %d", len(memory.events), wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,579 @@
+package user_behavior
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a component's event queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowReject returns ErrEventChannelFull immediately
+	OverflowReject OverflowPolicy = "reject"
+
+	// OverflowBlock waits up to BlockTimeout for space, then rejects
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDropOldest discards the oldest queued event to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+
+	// OverflowDropNewest discards the incoming event
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+
+	// OverflowSpill appends overflow to a file and feeds it back as space frees
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+const (
+	// Backpressure defaults
+	DefaultBlockTimeout    = 100 * time.Millisecond
+	spillDrainInterval     = 100 * time.Millisecond
+	defaultSpillDirName    = "user_behavior_spill"
+	spillFileName          = "spill.jsonl"
+	spillReaderBufferBytes = 64 * 1024
+	spillDrainBatch        = 256
+)
+
+// BackpressureConfig configures the overflow behaviour of one component
+type BackpressureConfig struct {
+	Policy       OverflowPolicy
+	BlockTimeout time.Duration
+
+	// SpillDir holds the spill file; defaults to a directory under os.TempDir
+	SpillDir string
+}
+
+// ParseOverflowPolicy converts a config string to a policy, defaulting to reject
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case "":
+		return OverflowReject, nil
+	case OverflowReject, OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowSpill:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy: %s", value)
+	}
+}
+
+// QueueMetrics is a gauge snapshot of a component's event queue
+type QueueMetrics struct {
+	Depth    int            `json:"depth"`
+	Capacity int            `json:"capacity"`
+	Spilled  int64          `json:"spilled"`
+	Dropped  int64          `json:"dropped"`
+	Rejected int64          `json:"rejected"`
+	Policy   OverflowPolicy `json:"policy"`
+}
+
+// eventQueue is a bounded event channel with a configurable overflow policy
+type eventQueue struct {
+	name     string
+	ch       chan UserEvent
+	config   BackpressureConfig
+	closed   bool
+	closeMu  sync.RWMutex // read-held by senders so Close never races a send
+	counters QueueMetrics
+	countMu  sync.Mutex
+	spill    *spillFile
+	stop     chan struct{}
+	stopOnce sync.Once
+	drained  chan struct{}
+}
+
+// newEventQueue creates a queue; name identifies the component in spill paths
+func newEventQueue(name string, capacity int, config BackpressureConfig) *eventQueue {
+	if config.Policy == "" {
+		config.Policy = OverflowReject
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = DefaultBlockTimeout
+	}
+
+	q := &eventQueue{
+		name:   name,
+		ch:     make(chan UserEvent, capacity),
+		config: config,
+		stop:   make(chan struct{}),
+	}
+
+	if config.Policy == OverflowSpill {
+		dir := config.SpillDir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), defaultSpillDirName)
+		}
+		q.spill = &spillFile{path: filepath.Join(dir, name, spillFileName)}
+	}
+
+	return q
+}
+
+// C returns the channel consumers read from
+func (q *eventQueue) C() <-chan UserEvent {
+	return q.ch
+}
+
+// Enqueue adds an event according to the overflow policy
+func (q *eventQueue) Enqueue(ctx context.Context, event UserEvent) error {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+
+	if q.closed {
+		return context.Canceled
+	}
+
+	// Keep FIFO order while spilled events are waiting
+	if q.spill != nil && q.spill.pending() > 0 {
+		return q.spillEvent(event)
+	}
+
+	select {
+	case q.ch <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	switch q.config.Policy {
+	case OverflowBlock:
+		timer := time.NewTimer(q.config.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case q.ch <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			q.count(func(m *QueueMetrics) { m.Rejected++ })
+			return ErrEventChannelFull
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-q.ch:
+				q.count(func(m *QueueMetrics) { m.Dropped++ })
+			default:
+			}
+
+			select {
+			case q.ch <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+
+	case OverflowDropNewest:
+		q.count(func(m *QueueMetrics) { m.Dropped++ })
+		return nil
+
+	case OverflowSpill:
+		return q.spillEvent(event)
+
+	default:
+		q.count(func(m *QueueMetrics) { m.Rejected++ })
+		return ErrEventChannelFull
+	}
+}
+
+// EnqueueWait adds an event, waiting for room whatever the overflow policy.
+// While spilled events are waiting it is spilled behind them instead.
+func (q *eventQueue) EnqueueWait(ctx context.Context, event UserEvent) error {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+
+	if q.closed {
+		return context.Canceled
+	}
+	if q.spill != nil && q.spill.pending() > 0 {
+		return q.spillEvent(event)
+	}
+
+	select {
+	case q.ch <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spillEvent appends an event to the spill file
+func (q *eventQueue) spillEvent(event UserEvent) error {
+	if err := q.spill.append(event); err != nil {
+		q.count(func(m *QueueMetrics) { m.Rejected++ })
+		return fmt.Errorf("%w: spill failed: %v", ErrEventChannelFull, err)
+	}
+
+	q.count(func(m *QueueMetrics) { m.Spilled++ })
+	return nil
+}
+
+// Start runs the spill drainer when the spill policy is used. Events left in
+// the spill file by an earlier run are fed back first.
+func (q *eventQueue) Start(ctx context.Context) {
+	if q.spill != nil {
+		if err := q.spill.open(); err != nil {
+			fmt.Printf("Failed to open spill file for %s: %v\n", q.name, err)
+		} else if pending := q.spill.pending(); pending > 0 {
+			fmt.Printf("Replaying %d spilled events for %s\n", pending, q.name)
+		}
+
+		q.drained = make(chan struct{})
+		go q.drainSpill(ctx)
+	}
+}
+
+// drainSpill feeds spilled events back into the channel as space frees
+func (q *eventQueue) drainSpill(ctx context.Context) {
+	defer close(q.drained)
+
+	ticker := time.NewTicker(spillDrainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Close waits for this goroutine before closing the channel
+			err := q.spill.drain(func(event UserEvent) bool {
+				select {
+				case q.ch <- event:
+					return true
+				case <-ctx.Done():
+					return false
+				case <-q.stop:
+					return false
+				}
+			})
+			if err != nil {
+				fmt.Printf("Spill drain error for %s: %v\n", q.name, err)
+			}
+
+		case <-ctx.Done():
+			return
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// DrainAll synchronously hands every queued and spilled event to fn, oldest first
+func (q *eventQueue) DrainAll(fn func(UserEvent)) {
+	for {
+		select {
+		case event, ok := <-q.ch:
+			if !ok {
+				return
+			}
+			fn(event)
+			continue
+		default:
+		}
+		break
+	}
+
+	if q.spill != nil {
+		err := q.spill.drain(func(event UserEvent) bool {
+			fn(event)
+			return true
+		})
+		if err != nil {
+			fmt.Printf("Spill drain error for %s: %v\n", q.name, err)
+		}
+	}
+}
+
+// Close stops accepting events, hands the spilled events to the consumers
+// and closes the channel; later Enqueue calls fail instead of panicking.
+// Consumers must keep reading until the channel is closed. Spilled events
+// that cannot be handed over stay in the spill file for the next Start.
+func (q *eventQueue) Close() {
+	q.stopOnce.Do(func() { close(q.stop) })
+	if q.drained != nil {
+		<-q.drained
+	}
+
+	q.closeMu.Lock()
+	defer q.closeMu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	// Spilled events were already acknowledged to their clients
+	if q.spill != nil {
+		err := q.spill.drain(func(event UserEvent) bool {
+			q.ch <- event
+			return true
+		})
+		if err != nil {
+			fmt.Printf("Spill drain error for %s: %v\n", q.name, err)
+		}
+		if err := q.spill.close(); err != nil {
+			fmt.Printf("Failed to close spill file for %s: %v\n", q.name, err)
+		}
+	}
+
+	close(q.ch)
+}
+
+// Metrics returns the queue gauge snapshot
+func (q *eventQueue) Metrics() QueueMetrics {
+	q.countMu.Lock()
+	defer q.countMu.Unlock()
+
+	metrics := q.counters
+	metrics.Depth = len(q.ch)
+	metrics.Capacity = cap(q.ch)
+	metrics.Policy = q.config.Policy
+	if q.spill != nil {
+		metrics.Depth += int(q.spill.pending())
+	}
+	return metrics
+}
+
+// count applies an update to the counters under their lock
+func (q *eventQueue) count(update func(*QueueMetrics)) {
+	q.countMu.Lock()
+	defer q.countMu.Unlock()
+
+	update(&q.counters)
+}
+
+// spillFile is an append-only JSONL overflow file read back from the front.
+// It is truncated once fully drained and kept across restarts otherwise.
+type spillFile struct {
+	path       string
+	file       *os.File
+	readOffset int64
+	written    atomic.Int64
+	read       atomic.Int64
+	mu         sync.Mutex // guards the file and offsets
+	drainMu    sync.Mutex // serializes drains, not held by appends
+}
+
+// pending returns the number of spilled events not yet drained
+func (sf *spillFile) pending() int64 {
+	return sf.written.Load() - sf.read.Load()
+}
+
+// open opens the spill file, keeping the events an earlier run left in it.
+// A torn last line is cut off.
+func (sf *spillFile) open() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	return sf.openLocked()
+}
+
+// openLocked opens the spill file if it is not open; caller must hold sf.mu
+func (sf *spillFile) openLocked() error {
+	if sf.file != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sf.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(sf.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var lines, size int64
+	reader := bufio.NewReaderSize(file, spillReaderBufferBytes)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		lines++
+		size += int64(len(line))
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+
+	sf.file = file
+	sf.readOffset = 0
+	sf.read.Store(0)
+	sf.written.Store(lines)
+	return nil
+}
+
+// append writes an event at the end of the file, opening it on first use
+func (sf *spillFile) append(event UserEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if err := sf.openLocked(); err != nil {
+		return err
+	}
+
+	if _, err := sf.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := sf.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	sf.written.Add(1)
+	return nil
+}
+
+// drain reads spilled events in order and passes them to push until push
+// returns false or the file is exhausted. Events are read in batches and
+// pushed without holding sf.mu, so appends go on while push blocks; they
+// stay behind the spilled events since pending is not zero until the file
+// is exhausted.
+func (sf *spillFile) drain(push func(UserEvent) bool) error {
+	sf.drainMu.Lock()
+	defer sf.drainMu.Unlock()
+
+	for {
+		events, sizes, err := sf.readBatch()
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		pushed := 0
+		var pushedBytes int64
+		for i, event := range events {
+			if !push(event) {
+				break
+			}
+			pushed++
+			pushedBytes += sizes[i]
+		}
+
+		if err := sf.advance(pushed, pushedBytes); err != nil {
+			return err
+		}
+		if pushed < len(events) {
+			return nil
+		}
+	}
+}
+
+// readBatch reads up to spillDrainBatch events from the read offset
+func (sf *spillFile) readBatch() ([]UserEvent, []int64, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.file == nil || sf.pending() == 0 {
+		return nil, nil, nil
+	}
+
+	if _, err := sf.file.Seek(sf.readOffset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	count := sf.pending()
+	if count > spillDrainBatch {
+		count = spillDrainBatch
+	}
+
+	events := make([]UserEvent, 0, count)
+	sizes := make([]int64, 0, count)
+	reader := bufio.NewReaderSize(sf.file, spillReaderBufferBytes)
+	for int64(len(events)) < count {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var event UserEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, nil, err
+		}
+		events = append(events, event)
+		sizes = append(sizes, int64(len(line)))
+	}
+	return events, sizes, nil
+}
+
+// advance moves the read offset past pushed events and starts the file
+// over once it is fully drained
+func (sf *spillFile) advance(events int, size int64) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	sf.readOffset += size
+	sf.read.Add(int64(events))
+
+	if sf.file == nil || sf.pending() > 0 {
+		return nil
+	}
+
+	sf.readOffset = 0
+	sf.read.Store(0)
+	sf.written.Store(0)
+	return sf.file.Truncate(0)
+}
+
+// close closes the spill file, first cutting off the drained events so the
+// next open replays only the pending ones
+func (sf *spillFile) close() error {
+	sf.drainMu.Lock()
+	defer sf.drainMu.Unlock()
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.file == nil {
+		return nil
+	}
+
+	var err error
+	if sf.readOffset > 0 {
+		err = sf.compact()
+	}
+
+	if closeErr := sf.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	sf.file = nil
+	return err
+}
+
+// compact rewrites the spill file without its drained prefix; caller must
+// hold sf.mu
+func (sf *spillFile) compact() error {
+	if _, err := sf.file.Seek(sf.readOffset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(sf.file)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(sf.path, data); err != nil {
+		return err
+	}
+
+	pending := sf.pending()
+	sf.readOffset = 0
+	sf.read.Store(0)
+	sf.written.Store(pending)
+	return nil
+}
@@ -0,0 +1,276 @@
+package user_behavior
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// queueEvent builds the i-th test event
+func queueEvent(i int) UserEvent {
+	return UserEvent{EventID: "evt-" + strconv.Itoa(i), SessionID: "s1", EventType: EventTyping}
+}
+
+// drainIDs returns the IDs of every queued and spilled event, oldest first
+func drainIDs(q *eventQueue) []string {
+	var ids []string
+	q.DrainAll(func(event UserEvent) {
+		ids = append(ids, event.EventID)
+	})
+	return ids
+}
+
+// equalIDs reports whether two ID lists are the same
+func equalIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      OverflowPolicy
+		wantErr     error
+		wantIDs     []string
+		wantMetrics QueueMetrics
+	}{
+		{
+			name:        "reject",
+			policy:      OverflowReject,
+			wantErr:     ErrEventChannelFull,
+			wantIDs:     []string{"evt-0", "evt-1"},
+			wantMetrics: QueueMetrics{Depth: 2, Rejected: 1},
+		},
+		{
+			name:        "block times out",
+			policy:      OverflowBlock,
+			wantErr:     ErrEventChannelFull,
+			wantIDs:     []string{"evt-0", "evt-1"},
+			wantMetrics: QueueMetrics{Depth: 2, Rejected: 1},
+		},
+		{
+			name:        "drop oldest",
+			policy:      OverflowDropOldest,
+			wantIDs:     []string{"evt-1", "evt-2"},
+			wantMetrics: QueueMetrics{Depth: 2, Dropped: 1},
+		},
+		{
+			name:        "drop newest",
+			policy:      OverflowDropNewest,
+			wantIDs:     []string{"evt-0", "evt-1"},
+			wantMetrics: QueueMetrics{Depth: 2, Dropped: 1},
+		},
+		{
+			name:        "spill",
+			policy:      OverflowSpill,
+			wantIDs:     []string{"evt-0", "evt-1", "evt-2"},
+			wantMetrics: QueueMetrics{Depth: 3, Spilled: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newEventQueue("test", 2, BackpressureConfig{
+				Policy:       tt.policy,
+				BlockTimeout: 10 * time.Millisecond,
+				SpillDir:     t.TempDir(),
+			})
+
+			ctx := context.Background()
+			for i := 0; i < 2; i++ {
+				if err := q.Enqueue(ctx, queueEvent(i)); err != nil {
+					t.Fatalf("Enqueue(%d) error = %v", i, err)
+				}
+			}
+			if err := q.Enqueue(ctx, queueEvent(2)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Enqueue() on a full queue error = %v, want %v", err, tt.wantErr)
+			}
+
+			metrics := q.Metrics()
+			if metrics.Depth != tt.wantMetrics.Depth || metrics.Spilled != tt.wantMetrics.Spilled ||
+				metrics.Dropped != tt.wantMetrics.Dropped || metrics.Rejected != tt.wantMetrics.Rejected {
+				t.Errorf("Metrics() = %+v, want %+v", metrics, tt.wantMetrics)
+			}
+			if metrics.Capacity != 2 || metrics.Policy != tt.policy {
+				t.Errorf("Capacity, Policy = %d, %s, want 2, %s", metrics.Capacity, metrics.Policy, tt.policy)
+			}
+
+			if ids := drainIDs(q); !equalIDs(ids, tt.wantIDs) {
+				t.Errorf("queued events = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestEventQueueSpillOrder(t *testing.T) {
+	q := newEventQueue("test", 1, BackpressureConfig{Policy: OverflowSpill, SpillDir: t.TempDir()})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(ctx, queueEvent(i)); err != nil {
+			t.Fatalf("Enqueue(%d) error = %v", i, err)
+		}
+	}
+	if event := <-q.C(); event.EventID != "evt-0" {
+		t.Fatalf("first event = %s, want evt-0", event.EventID)
+	}
+
+	// The channel has room again, but evt-1 is still spilled
+	if err := q.Enqueue(ctx, queueEvent(2)); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := q.EnqueueWait(ctx, queueEvent(3)); err != nil {
+		t.Fatalf("EnqueueWait() error = %v", err)
+	}
+	if spilled := q.Metrics().Spilled; spilled != 3 {
+		t.Errorf("Spilled = %d, want 3", spilled)
+	}
+
+	want := []string{"evt-1", "evt-2", "evt-3"}
+	if ids := drainIDs(q); !equalIDs(ids, want) {
+		t.Errorf("drained events = %v, want %v", ids, want)
+	}
+	if depth := q.Metrics().Depth; depth != 0 {
+		t.Errorf("Depth after drain = %d, want 0", depth)
+	}
+}
+
+func TestEventQueueSpillReplay(t *testing.T) {
+	dir := t.TempDir()
+	config := BackpressureConfig{Policy: OverflowSpill, SpillDir: dir}
+	ctx := context.Background()
+
+	// The first run stops without Close, leaving evt-1 and a torn line behind
+	crashed := newEventQueue("test", 1, config)
+	for i := 0; i < 2; i++ {
+		if err := crashed.Enqueue(ctx, queueEvent(i)); err != nil {
+			t.Fatalf("Enqueue(%d) error = %v", i, err)
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "test", spillFileName), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open spill file: %v", err)
+	}
+	if _, err := file.WriteString(`{"event_id":"evt-`); err != nil {
+		t.Fatalf("write torn line: %v", err)
+	}
+	file.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := newEventQueue("test", 1, config)
+	q.Start(ctx)
+	if depth := q.Metrics().Depth; depth != 1 {
+		t.Errorf("Depth after Start = %d, want 1", depth)
+	}
+
+	select {
+	case event := <-q.C():
+		if event.EventID != "evt-1" {
+			t.Errorf("replayed event = %s, want evt-1", event.EventID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("spilled event not replayed")
+	}
+
+	q.Close()
+	if _, ok := <-q.C(); ok {
+		t.Error("replayed more than the spilled event")
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	q := newEventQueue("test", 1, BackpressureConfig{Policy: OverflowSpill, SpillDir: t.TempDir()})
+	ctx := context.Background()
+	q.Start(ctx)
+
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(ctx, queueEvent(i)); err != nil {
+			t.Fatalf("Enqueue(%d) error = %v", i, err)
+		}
+	}
+
+	// Spilled events were acknowledged, so Close hands them over
+	got := make(chan []string)
+	go func() {
+		var ids []string
+		for event := range q.C() {
+			ids = append(ids, event.EventID)
+		}
+		got <- ids
+	}()
+	q.Close()
+
+	want := []string{"evt-0", "evt-1", "evt-2"}
+	if ids := <-got; !equalIDs(ids, want) {
+		t.Errorf("delivered events = %v, want %v", ids, want)
+	}
+	if err := q.Enqueue(ctx, queueEvent(3)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Enqueue() after Close error = %v, want %v", err, context.Canceled)
+	}
+	if err := q.EnqueueWait(ctx, queueEvent(3)); !errors.Is(err, context.Canceled) {
+		t.Errorf("EnqueueWait() after Close error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestEventQueueEnqueueWait(t *testing.T) {
+	q := newEventQueue("test", 1, BackpressureConfig{Policy: OverflowReject})
+	if err := q.Enqueue(context.Background(), queueEvent(0)); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.EnqueueWait(ctx, queueEvent(1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("EnqueueWait() on a full queue error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.EnqueueWait(context.Background(), queueEvent(1))
+	}()
+	<-q.C()
+	if err := <-done; err != nil {
+		t.Fatalf("EnqueueWait() error = %v", err)
+	}
+	if rejected := q.Metrics().Rejected; rejected != 0 {
+		t.Errorf("Rejected = %d, want 0", rejected)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    OverflowPolicy
+		wantErr bool
+	}{
+		{value: "", want: OverflowReject},
+		{value: "spill", want: OverflowSpill},
+		{value: "drop_oldest", want: OverflowDropOldest},
+		{value: "drop-oldest", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseOverflowPolicy(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOverflowPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseOverflowPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
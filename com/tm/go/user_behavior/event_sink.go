@@ -0,0 +1,176 @@
+package user_behavior
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Sink names accepted in EventCollectorConfig.Sinks
+	SinkHBase    = "hbase"
+	SinkBigQuery = "bigquery"
+	SinkMemory   = "memory"
+	SinkFile     = "file"
+)
+
+// DefaultSinks are used when no sink is configured
+var DefaultSinks = []string{SinkHBase, SinkBigQuery}
+
+// EventSink is a destination for tracked events, session summaries, rollups,
+// user profiles and retention tables
+type EventSink interface {
+	// Name returns the sink name used in config and metrics
+	Name() string
+
+	// Start begins any background workers of the sink
+	Start()
+
+	// WriteEvent queues or writes a single event
+	WriteEvent(event UserEvent) error
+
+	// WriteSummary queues or writes a session summary
+	WriteSummary(summary SessionSummary) error
+
+	// WriteRollup writes the aggregates of a closed window
+	WriteRollup(rollup Rollup) error
+
+	// WriteProfile writes a user profile updated by an ended session
+	WriteProfile(profile UserProfile) error
+
+	// WriteRetention writes a cohort retention table
+	WriteRetention(table RetentionTable) error
+
+	// Flush writes everything buffered so far
+	Flush() error
+
+	// Stop flushes and releases the sink's resources
+	Stop() error
+
+	// Metrics returns a snapshot of the sink's write metrics
+	Metrics() SinkMetrics
+}
+
+// SinkMetrics is the common metrics view of an EventSink
+type SinkMetrics struct {
+	Name             string `json:"name"`
+	EventsWritten    int64  `json:"events_written"`
+	SummariesWritten int64  `json:"summaries_written"`
+	RollupsWritten   int64  `json:"rollups_written"`
+	ProfilesWritten  int64  `json:"profiles_written"`
+	RetentionWritten int64  `json:"retention_tables_written"`
+	ErrorCount       int64  `json:"errors"`
+	BatchCount       int64  `json:"batches"`
+	Retries          int64  `json:"retries"`
+	DeadLettered     int64  `json:"dead_lettered"`
+
+	// WriteLatency is set by sinks that measure their write RPCs
+	WriteLatency *LatencySnapshot `json:"write_latency,omitempty"`
+}
+
+// sinkNames returns the normalized, de-duplicated sink names of the config
+func sinkNames(config EventCollectorConfig) []string {
+	names := config.Sinks
+	if len(names) == 0 {
+		names = DefaultSinks
+	}
+
+	var result []string
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+
+	return result
+}
+
+// newEventSinks creates the sinks named in the config
+func newEventSinks(config EventCollectorConfig) ([]EventSink, error) {
+	var sinks []EventSink
+
+	for _, name := range sinkNames(config) {
+		sink, err := newEventSink(name, config)
+		if err != nil {
+			for _, created := range sinks {
+				created.Stop()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// newEventSink creates a single sink by name
+func newEventSink(name string, config EventCollectorConfig) (EventSink, error) {
+	switch name {
+	case SinkHBase:
+		rowKeys, err := NewRowKeyStrategy(config.HBaseLayout)
+		if err != nil {
+			return nil, err
+		}
+
+		deadLetters, err := NewDeadLetterStore(config.DeadLetter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dead-letter store: %w", err)
+		}
+
+		hbaseWriter := NewHBaseWriter(
+			config.HBaseHost,
+			config.HBaseTable,
+			config.EventBufferSize,
+			config.NumHBaseWorkers,
+			config.HBaseBackpressure,
+		)
+		hbaseWriter.SetBatchConfig(config.HBaseBatch)
+		hbaseWriter.SetLayout(rowKeys, config.HBaseLayout.IndexTable)
+		hbaseWriter.SetDeadLetterPolicy(config.HBaseRetry, deadLetters)
+		return hbaseWriter, nil
+
+	case SinkBigQuery:
+		bqWriter, err := NewBigQueryWriter(
+			config.BQProjectID,
+			config.BQDataset,
+			config.BQEventTable,
+			config.BQSummaryTable,
+			config.BQRollupTable,
+			config.BQProfileTable,
+			config.BQRetentionTable,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create BigQuery writer: %w", err)
+		}
+		return bqWriter, nil
+
+	case SinkMemory:
+		return NewMemorySink(), nil
+
+	case SinkFile:
+		fileSink, err := NewFileSink(config.SinkFileDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file sink: %w", err)
+		}
+		return fileSink, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSink, name)
+	}
+}
+
+// ParseSinkNames splits a comma separated list of sink names, dropping empty
+// items. The other comma separated settings are parsed the same way.
+func ParseSinkNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,178 @@
+package user_behavior
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Store names accepted in EventCollectorConfig.EventStore
+	StoreHBase  = "hbase"
+	StoreMemory = "memory"
+)
+
+// EventStore is the read side of the tracker used by analysis
+type EventStore interface {
+	// GetSessionEvents returns all events of a session ordered by time
+	GetSessionEvents(sessionID string) ([]UserEvent, error)
+
+	// ScanUserEvents returns a user's events within [from, to)
+	ScanUserEvents(userID string, from, to time.Time) ([]UserEvent, error)
+
+	// ScanEventType returns events of one type within [from, to)
+	ScanEventType(eventType EventType, from, to time.Time) ([]UserEvent, error)
+
+	// Close releases the store's resources
+	Close() error
+}
+
+// newEventStore creates the store named in the config. When no store is set
+// HBase is used if it is also a sink, otherwise the in-memory session buffers.
+func newEventStore(config EventCollectorConfig, sessionManager *SessionManager) (EventStore, error) {
+	name := strings.ToLower(strings.TrimSpace(config.EventStore))
+	if name == "" {
+		name = StoreMemory
+		for _, sink := range sinkNames(config) {
+			if sink == SinkHBase {
+				name = StoreHBase
+			}
+		}
+	}
+
+	switch name {
+	case StoreHBase:
+		rowKeys, err := NewRowKeyStrategy(config.HBaseLayout)
+		if err != nil {
+			return nil, err
+		}
+		store := NewHBaseEventStore(config.HBaseHost, config.HBaseTable, rowKeys, config.HBaseLayout.IndexTable)
+		return splitSessionStore{EventStore: store, sessionManager: sessionManager}, nil
+	case StoreMemory:
+		return NewMemoryEventStore(sessionManager), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStore, name)
+	}
+}
+
+// splitSessionStore reads the parts of split sessions from a store that holds
+// events under the client session ID
+type splitSessionStore struct {
+	EventStore
+	sessionManager *SessionManager
+}
+
+// GetSessionEvents returns a split session part's share of its client
+// session's events, or the session's events when it was not split
+func (ss splitSessionStore) GetSessionEvents(sessionID string) ([]UserEvent, error) {
+	session, split, exists := ss.sessionManager.splitSession(sessionID)
+	if !exists || !split {
+		return ss.EventStore.GetSessionEvents(sessionID)
+	}
+
+	events, err := ss.EventStore.GetSessionEvents(session.clientSessionID())
+	if err != nil {
+		return nil, err
+	}
+
+	var part []UserEvent
+	for _, event := range events {
+		if event.Timestamp.Before(session.StartTime) {
+			continue
+		}
+		if session.EndTime != nil && event.Timestamp.After(*session.EndTime) {
+			continue
+		}
+		event.SessionID = sessionID
+		part = append(part, event)
+	}
+	return part, nil
+}
+
+// MemoryEventStore reads events from the SessionManager's buffered sessions.
+// Only sessions still held in memory are visible, and each session keeps at
+// most its first SessionConfig.MaxEvents events.
+type MemoryEventStore struct {
+	sessionManager *SessionManager
+}
+
+// NewMemoryEventStore creates an event store backed by a session manager
+func NewMemoryEventStore(sessionManager *SessionManager) *MemoryEventStore {
+	return &MemoryEventStore{
+		sessionManager: sessionManager,
+	}
+}
+
+// GetSessionEvents returns the buffered events of a session
+func (ms *MemoryEventStore) GetSessionEvents(sessionID string) ([]UserEvent, error) {
+	events := ms.sessionManager.GetSessionEvents(sessionID)
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// ScanUserEvents returns a user's buffered events within [from, to)
+func (ms *MemoryEventStore) ScanUserEvents(userID string, from, to time.Time) ([]UserEvent, error) {
+	events := ms.sessionManager.FindEvents(func(event UserEvent) bool {
+		return event.UserID == userID && inTimeRange(event.Timestamp, from, to)
+	})
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// ScanEventType returns buffered events of one type within [from, to)
+func (ms *MemoryEventStore) ScanEventType(eventType EventType, from, to time.Time) ([]UserEvent, error) {
+	events := ms.sessionManager.FindEvents(func(event UserEvent) bool {
+		return event.EventType == eventType && inTimeRange(event.Timestamp, from, to)
+	})
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// Close is a no-op, the session manager is owned by the collector
+func (ms *MemoryEventStore) Close() error {
+	return nil
+}
+
+// inTimeRange reports whether t is within [from, to); a zero bound is open
+func inTimeRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !t.Before(to) {
+		return false
+	}
+	return true
+}
+
+// sortEventsByTime sorts events by timestamp, keeping arrival order for ties
+func sortEventsByTime(events []UserEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+}
+
+// sortEventsInOrder orders events by timestamp, then event ID, so events
+// with the same timestamp keep a stable order across scans
+func sortEventsInOrder(events []UserEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventBefore(events[i], events[j])
+	})
+}
+
+// groupEvents splits events by session, or by user, each group ordered
+// with sortEventsInOrder
+func groupEvents(events []UserEvent, byUser bool) map[string][]UserEvent {
+	groups := make(map[string][]UserEvent)
+	for _, event := range events {
+		key := event.SessionID
+		if byUser {
+			key = event.UserID
+		}
+		groups[key] = append(groups[key], event)
+	}
+	for _, group := range groups {
+		sortEventsInOrder(group)
+	}
+	return groups
+}
@@ -0,0 +1,86 @@
+package user_behavior
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Event-time defaults for SessionConfig
+	DefaultWatermarkDelay       = 10 * time.Second
+	DefaultAllowedLateness      = 5 * time.Minute
+	DefaultWatermarkIdleTimeout = time.Minute
+)
+
+// SessionMetrics reports the session manager's counts and event-time state
+type SessionMetrics struct {
+	Shards            int       `json:"shards"`
+	Sessions          int       `json:"sessions"`
+	ActiveSessions    int       `json:"active_sessions"`
+	EventsProcessed   int64     `json:"events_processed"`
+	Watermark         time.Time `json:"watermark"`
+	LateDropped       int64     `json:"late_dropped"`
+	Reopened          int64     `json:"reopened"`
+	Splits            int64     `json:"splits"`
+	AnomaliesDetected int64     `json:"anomalies_detected"`
+}
+
+// eventClock follows the latest event time seen. When no newer event
+// arrives for idleTimeout it advances with wall time, so sessions still
+// expire when traffic stops. Event times are capped at wall time, so a
+// client with a fast clock cannot expire other sessions early.
+type eventClock struct {
+	latest      time.Time
+	observedAt  time.Time
+	idleTimeout time.Duration
+}
+
+// newEventClock creates a clock starting at now
+func newEventClock(now time.Time, idleTimeout time.Duration) *eventClock {
+	return &eventClock{
+		latest:      now,
+		observedAt:  now,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// observe moves the clock forward to an event's time
+func (c *eventClock) observe(timestamp, now time.Time) {
+	if timestamp.After(now) {
+		timestamp = now
+	}
+	if current := c.now(now); timestamp.After(current) {
+		c.latest = timestamp
+		c.observedAt = now
+	}
+}
+
+// now returns the current event time
+func (c *eventClock) now(wallNow time.Time) time.Time {
+	idle := wallNow.Sub(c.observedAt) - c.idleTimeout
+	if idle <= 0 {
+		return c.latest
+	}
+	return c.latest.Add(idle)
+}
+
+// insertEvent inserts an event into a slice ordered by timestamp, then event
+// ID, keeping at most limit events; it returns false when the event falls
+// after the kept ones
+func insertEvent(events []UserEvent, event UserEvent, limit int) ([]UserEvent, bool) {
+	i := sort.Search(len(events), func(i int) bool {
+		return eventBefore(event, events[i])
+	})
+	if i >= limit {
+		return events, false
+	}
+
+	events = append(events, UserEvent{})
+	copy(events[i+1:], events[i:])
+	events[i] = event
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, true
+}
@@ -0,0 +1,361 @@
+package user_behavior
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// File sink configuration
+	DefaultSinkFileDir  = "user_behavior_data"
+	EventsFileName      = "events.jsonl"
+	SummariesFileName   = "session_summaries.jsonl"
+	RollupsFileName     = "rollups.jsonl"
+	ProfilesFileName    = "user_profiles.jsonl"
+	RetentionFileName   = "cohort_retention.jsonl"
+	fileSinkBufferBytes = 64 * 1024
+	fileSinkMaxLine     = 1 << 20
+)
+
+// FileSink appends events, summaries, rollups, profiles and retention tables
+// as JSON lines to local files
+type FileSink struct {
+	dir           string
+	eventFile     *os.File
+	summaryFile   *os.File
+	rollupFile    *os.File
+	profileFile   *os.File
+	retentionFile *os.File
+	eventWriter   *bufio.Writer
+	summaryWriter *bufio.Writer
+	lastRollup    time.Time // start of the last rollup window written
+	mu            sync.Mutex
+	metrics       SinkMetrics
+}
+
+// NewFileSink creates a file sink writing into dir
+func NewFileSink(dir string) (*FileSink, error) {
+	if dir == "" {
+		dir = DefaultSinkFileDir
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create sink dir: %w", err)
+	}
+
+	eventFile, err := openAppend(filepath.Join(dir, EventsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	summaryFile, err := openAppend(filepath.Join(dir, SummariesFileName))
+	if err != nil {
+		eventFile.Close()
+		return nil, err
+	}
+
+	rollupFile, err := openAppend(filepath.Join(dir, RollupsFileName))
+	if err != nil {
+		eventFile.Close()
+		summaryFile.Close()
+		return nil, err
+	}
+
+	lastRollup, err := lastRollupStart(filepath.Join(dir, RollupsFileName))
+	if err != nil {
+		eventFile.Close()
+		summaryFile.Close()
+		rollupFile.Close()
+		return nil, err
+	}
+
+	profileFile, err := openAppend(filepath.Join(dir, ProfilesFileName))
+	if err != nil {
+		eventFile.Close()
+		summaryFile.Close()
+		rollupFile.Close()
+		return nil, err
+	}
+
+	retentionFile, err := openAppend(filepath.Join(dir, RetentionFileName))
+	if err != nil {
+		eventFile.Close()
+		summaryFile.Close()
+		rollupFile.Close()
+		profileFile.Close()
+		return nil, err
+	}
+
+	return &FileSink{
+		dir:           dir,
+		eventFile:     eventFile,
+		summaryFile:   summaryFile,
+		rollupFile:    rollupFile,
+		profileFile:   profileFile,
+		retentionFile: retentionFile,
+		eventWriter:   bufio.NewWriterSize(eventFile, fileSinkBufferBytes),
+		summaryWriter: bufio.NewWriterSize(summaryFile, fileSinkBufferBytes),
+		lastRollup:    lastRollup,
+		metrics:       SinkMetrics{Name: SinkFile},
+	}, nil
+}
+
+// openAppend opens a file for appending, creating it if needed
+func openAppend(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// Name returns the sink name of the file sink
+func (fs *FileSink) Name() string {
+	return SinkFile
+}
+
+// Start is a no-op, the file sink has no background workers
+func (fs *FileSink) Start() {}
+
+// WriteEvent appends an event as a JSON line
+func (fs *FileSink) WriteEvent(event UserEvent) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writeLine(fs.eventWriter, event); err != nil {
+		return err
+	}
+
+	fs.metrics.EventsWritten++
+	return nil
+}
+
+// WriteSummary appends a session summary as a JSON line
+func (fs *FileSink) WriteSummary(summary SessionSummary) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writeLine(fs.summaryWriter, summary); err != nil {
+		return err
+	}
+
+	fs.metrics.SummariesWritten++
+	return nil
+}
+
+// WriteRollup appends a rollup as a JSON line and flushes it. Rollups come
+// oldest first, so a window not after the last one written is a retry and
+// is dropped.
+func (fs *FileSink) WriteRollup(rollup Rollup) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.lastRollup.IsZero() && !rollup.WindowStart.After(fs.lastRollup) {
+		return nil
+	}
+
+	if err := fs.writeFlushed(fs.rollupFile, rollup); err != nil {
+		return err
+	}
+
+	fs.lastRollup = rollup.WindowStart
+	fs.metrics.RollupsWritten++
+	return nil
+}
+
+// lastRollupStart returns the window start of the last rollup in the
+// rollups file, zero when it has none
+func lastRollupStart(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var last time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, fileSinkBufferBytes), fileSinkMaxLine)
+	for scanner.Scan() {
+		var rollup Rollup
+		if err := json.Unmarshal(scanner.Bytes(), &rollup); err != nil {
+			// Skip a line torn by a crash
+			continue
+		}
+		if rollup.WindowStart.After(last) {
+			last = rollup.WindowStart
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return last, nil
+}
+
+// WriteProfile appends a user profile as a JSON line and flushes it
+func (fs *FileSink) WriteProfile(profile UserProfile) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writeFlushed(fs.profileFile, profile); err != nil {
+		return err
+	}
+
+	fs.metrics.ProfilesWritten++
+	return nil
+}
+
+// WriteRetention appends a retention table as a JSON line and flushes it
+func (fs *FileSink) WriteRetention(table RetentionTable) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writeFlushed(fs.retentionFile, table); err != nil {
+		return err
+	}
+
+	fs.metrics.RetentionWritten++
+	return nil
+}
+
+// writeFlushed appends v as a JSON line straight to file; caller must hold fs.mu
+func (fs *FileSink) writeFlushed(file *os.File, v interface{}) error {
+	writer := bufio.NewWriter(file)
+	if err := fs.writeLine(writer, v); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		fs.metrics.ErrorCount++
+		return fmt.Errorf("failed to flush %s: %w", filepath.Base(file.Name()), err)
+	}
+	return nil
+}
+
+// writeLine encodes v as JSON followed by a newline; caller must hold fs.mu
+func (fs *FileSink) writeLine(w *bufio.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fs.metrics.ErrorCount++
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	data = append(data, '\n')
+	if _, err := w.Write(data); err != nil {
+		fs.metrics.ErrorCount++
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	return nil
+}
+
+// Flush writes buffered lines to disk
+func (fs *FileSink) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.flushLocked()
+}
+
+// flushLocked flushes both writers; caller must hold fs.mu
+func (fs *FileSink) flushLocked() error {
+	if err := fs.eventWriter.Flush(); err != nil {
+		fs.metrics.ErrorCount++
+		return fmt.Errorf("failed to flush events file: %w", err)
+	}
+	if err := fs.summaryWriter.Flush(); err != nil {
+		fs.metrics.ErrorCount++
+		return fmt.Errorf("failed to flush summaries file: %w", err)
+	}
+
+	fs.metrics.BatchCount++
+	return nil
+}
+
+// Stop flushes and closes the files
+func (fs *FileSink) Stop() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	flushErr := fs.flushLocked()
+
+	if err := fs.eventFile.Close(); err != nil && flushErr == nil {
+		flushErr = err
+	}
+	if err := fs.summaryFile.Close(); err != nil && flushErr == nil {
+		flushErr = err
+	}
+	if err := fs.rollupFile.Close(); err != nil && flushErr == nil {
+		flushErr = err
+	}
+	if err := fs.profileFile.Close(); err != nil && flushErr == nil {
+		flushErr = err
+	}
+	if err := fs.retentionFile.Close(); err != nil && flushErr == nil {
+		flushErr = err
+	}
+
+	return flushErr
+}
+
+// ReadEvents flushes and reads back the events within [from, to)
+func (fs *FileSink) ReadEvents(from, to time.Time) ([]UserEvent, error) {
+	var events []UserEvent
+	err := fs.readLines(EventsFileName, func(line []byte) {
+		var event UserEvent
+		if json.Unmarshal(line, &event) == nil && inTimeRange(event.Timestamp, from, to) {
+			events = append(events, event)
+		}
+	})
+	return events, err
+}
+
+// ReadSummaries flushes and reads back the summaries of sessions started within [from, to)
+func (fs *FileSink) ReadSummaries(from, to time.Time) ([]SessionSummary, error) {
+	var summaries []SessionSummary
+	err := fs.readLines(SummariesFileName, func(line []byte) {
+		var summary SessionSummary
+		if json.Unmarshal(line, &summary) == nil && inTimeRange(summary.StartTime, from, to) {
+			summaries = append(summaries, summary)
+		}
+	})
+	return summaries, err
+}
+
+// readLines flushes pending writes and passes each line of a sink file to fn
+func (fs *FileSink) readLines(name string, fn func(line []byte)) error {
+	fs.mu.Lock()
+	err := fs.flushLocked()
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(fs.dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, fileSinkBufferBytes), fileSinkMaxLine)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return nil
+}
+
+// Metrics returns the file sink metrics
+func (fs *FileSink) Metrics() SinkMetrics {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.metrics
+}
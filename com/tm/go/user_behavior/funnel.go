@@ -0,0 +1,425 @@
+package user_behavior
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Funnel scopes
+	FunnelScopeSession = "session"
+	FunnelScopeUser    = "user"
+	FunnelScopeRange   = "range"
+
+	// Metadata predicate operators
+	MetadataEquals      = "eq"
+	MetadataNotEquals   = "ne"
+	MetadataIn          = "in"
+	MetadataExists      = "exists"
+	MetadataContains    = "contains"
+	MetadataGreater     = "gt"
+	MetadataGreaterOrEq = "gte"
+	MetadataLess        = "lt"
+	MetadataLessOrEq    = "lte"
+)
+
+// FunnelDefinition is an ordered list of steps a session or user goes through
+type FunnelDefinition struct {
+	Name  string       `json:"name,omitempty"`
+	Steps []FunnelStep `json:"steps"`
+}
+
+// FunnelStep matches events on type, screen name and metadata; empty fields
+// match any event. MaxTime limits the time since the previous step.
+type FunnelStep struct {
+	Name       string              `json:"name,omitempty"`
+	EventType  EventType           `json:"event_type,omitempty"`
+	ScreenName string              `json:"screen_name,omitempty"`
+	Metadata   []MetadataPredicate `json:"metadata,omitempty"`
+	MaxTime    RuleDuration        `json:"max_time,omitempty"`
+}
+
+// MetadataPredicate compares one metadata value. Eq, ne, in and contains
+// compare as strings; gt, gte, lt and lte compare numbers.
+type MetadataPredicate struct {
+	Key    string        `json:"key"`
+	Op     string        `json:"op,omitempty"` // defaults to eq
+	Value  interface{}   `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"` // for in
+}
+
+// FunnelQuery selects the events a funnel is computed over: one session, one
+// user's events within [From, To), or every session or user within [From, To)
+type FunnelQuery struct {
+	SessionID string
+	UserID    string
+	From      time.Time
+	To        time.Time
+
+	// GroupBy is session or user for range queries, session by default
+	GroupBy string
+}
+
+// FunnelReport is the conversion of every step of a funnel
+type FunnelReport struct {
+	Funnel string `json:"funnel,omitempty"`
+	Scope  string `json:"scope"`
+
+	// Entities is the number of sessions or users evaluated
+	Entities int                `json:"entities"`
+	Steps    []FunnelStepReport `json:"steps"`
+}
+
+// FunnelStepReport counts the sessions or users reaching a step.
+// Conversion is relative to the first step, StepConversion to the previous
+// one; DropOff counts those that reached the previous step but not this one.
+type FunnelStepReport struct {
+	Name           string  `json:"name"`
+	Count          int     `json:"count"`
+	Conversion     float64 `json:"conversion"`
+	StepConversion float64 `json:"step_conversion"`
+	DropOff        int     `json:"drop_off"`
+	DropOffRate    float64 `json:"drop_off_rate"`
+
+	// MedianSecondsFromPrevious is the median time from the previous step
+	// to first reaching this one, zero for the first step
+	MedianSecondsFromPrevious float64 `json:"median_seconds_from_previous"`
+}
+
+// Validate checks that a funnel can be evaluated
+func (f FunnelDefinition) Validate() error {
+	if len(f.Steps) < 2 {
+		return fmt.Errorf("%w: a funnel needs at least 2 steps", ErrInvalidFunnel)
+	}
+
+	for i, step := range f.Steps {
+		invalid := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%w: step %d: %s", ErrInvalidFunnel, i+1, fmt.Sprintf(format, args...))
+		}
+
+		if step.EventType == "" && step.ScreenName == "" && len(step.Metadata) == 0 {
+			return invalid("needs an event_type, screen_name or metadata")
+		}
+		if step.EventType != "" && !step.EventType.IsValid() {
+			return invalid("unknown event type %q", step.EventType)
+		}
+		if step.MaxTime < 0 {
+			return invalid("max_time must not be negative")
+		}
+		for _, predicate := range step.Metadata {
+			if err := predicate.validate(); err != nil {
+				return invalid("%v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stepName returns the name a step is reported under
+func (f FunnelDefinition) stepName(i int) string {
+	step := f.Steps[i]
+	switch {
+	case step.Name != "":
+		return step.Name
+	case step.EventType != "" && step.ScreenName != "":
+		return string(step.EventType) + ":" + step.ScreenName
+	case step.EventType != "":
+		return string(step.EventType)
+	case step.ScreenName != "":
+		return step.ScreenName
+	}
+	return "step " + strconv.Itoa(i+1)
+}
+
+// eventTypes returns the event types the steps match, nil when a step
+// matches any type
+func (f FunnelDefinition) eventTypes() []EventType {
+	seen := make(map[EventType]bool)
+	var eventTypes []EventType
+
+	for _, step := range f.Steps {
+		if step.EventType == "" {
+			return nil
+		}
+		if !seen[step.EventType] {
+			seen[step.EventType] = true
+			eventTypes = append(eventTypes, step.EventType)
+		}
+	}
+	return eventTypes
+}
+
+// matches reports whether an event satisfies the step
+func (s FunnelStep) matches(event UserEvent) bool {
+	if s.EventType != "" && event.EventType != s.EventType {
+		return false
+	}
+	if s.ScreenName != "" && event.ScreenName != s.ScreenName {
+		return false
+	}
+	for _, predicate := range s.Metadata {
+		if !predicate.matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the operator and its operands
+func (p MetadataPredicate) validate() error {
+	if p.Key == "" {
+		return fmt.Errorf("metadata predicate needs a key")
+	}
+
+	switch p.operator() {
+	case MetadataExists:
+	case MetadataIn:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("metadata %q: in needs values", p.Key)
+		}
+	case MetadataEquals, MetadataNotEquals, MetadataContains:
+		if p.Value == nil {
+			return fmt.Errorf("metadata %q: %s needs a value", p.Key, p.operator())
+		}
+	case MetadataGreater, MetadataGreaterOrEq, MetadataLess, MetadataLessOrEq:
+		if _, ok := metadataNumber(p.Value); !ok {
+			return fmt.Errorf("metadata %q: %s needs a number", p.Key, p.operator())
+		}
+	default:
+		return fmt.Errorf("metadata %q: unknown op %q", p.Key, p.Op)
+	}
+	return nil
+}
+
+// operator returns the predicate operator, eq when unset
+func (p MetadataPredicate) operator() string {
+	if p.Op == "" {
+		return MetadataEquals
+	}
+	return strings.ToLower(p.Op)
+}
+
+// matches reports whether an event's metadata satisfies the predicate
+func (p MetadataPredicate) matches(event UserEvent) bool {
+	value, ok := metadataString(event, p.Key)
+	op := p.operator()
+	if !ok {
+		return op == MetadataNotEquals
+	}
+
+	switch op {
+	case MetadataExists:
+		return true
+	case MetadataEquals:
+		return value == fmt.Sprint(p.Value)
+	case MetadataNotEquals:
+		return value != fmt.Sprint(p.Value)
+	case MetadataContains:
+		return strings.Contains(value, fmt.Sprint(p.Value))
+	case MetadataIn:
+		for _, candidate := range p.Values {
+			if value == fmt.Sprint(candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	actual, ok := metadataNumber(event.Metadata[p.Key])
+	if !ok {
+		return false
+	}
+	expected, _ := metadataNumber(p.Value)
+	switch op {
+	case MetadataGreater:
+		return actual > expected
+	case MetadataGreaterOrEq:
+		return actual >= expected
+	case MetadataLess:
+		return actual < expected
+	case MetadataLessOrEq:
+		return actual <= expected
+	}
+	return false
+}
+
+// metadataNumber converts a numeric metadata value or numeric string
+func metadataNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// funnelProgress is how far one session or user got through a funnel
+type funnelProgress struct {
+	reached int             // number of steps reached
+	gaps    []time.Duration // time from the previous step to first reaching each step
+}
+
+// evaluateFunnel finds how far events ordered by time get through a funnel.
+// A step is reached by an event after the previous step and within its
+// MaxTime of the latest time the previous step was reached, so a later
+// retry of a step can still lead on.
+func evaluateFunnel(f FunnelDefinition, events []UserEvent) funnelProgress {
+	latest := make([]time.Time, len(f.Steps))
+	reached := make([]bool, len(f.Steps))
+	progress := funnelProgress{gaps: make([]time.Duration, len(f.Steps))}
+
+	for _, event := range events {
+		// From the last step down, so one event cannot complete two steps
+		for i := len(f.Steps) - 1; i >= 0; i-- {
+			step := f.Steps[i]
+			if !step.matches(event) {
+				continue
+			}
+
+			if i > 0 {
+				if !reached[i-1] {
+					continue
+				}
+				gap := event.Timestamp.Sub(latest[i-1])
+				if step.MaxTime > 0 && gap > time.Duration(step.MaxTime) {
+					continue
+				}
+				if !reached[i] {
+					progress.gaps[i] = gap
+				}
+			}
+
+			reached[i] = true
+			latest[i] = event.Timestamp
+			if i+1 > progress.reached {
+				progress.reached = i + 1
+			}
+		}
+	}
+
+	return progress
+}
+
+// buildFunnelReport aggregates the progress of every session or user
+func buildFunnelReport(f FunnelDefinition, scope string, groups map[string][]UserEvent) *FunnelReport {
+	report := &FunnelReport{
+		Funnel:   f.Name,
+		Scope:    scope,
+		Entities: len(groups),
+		Steps:    make([]FunnelStepReport, len(f.Steps)),
+	}
+
+	counts := make([]int, len(f.Steps))
+	gaps := make([][]time.Duration, len(f.Steps))
+	for _, events := range groups {
+		progress := evaluateFunnel(f, events)
+		for i := 0; i < progress.reached; i++ {
+			counts[i]++
+			if i > 0 {
+				gaps[i] = append(gaps[i], progress.gaps[i])
+			}
+		}
+	}
+
+	for i := range f.Steps {
+		step := FunnelStepReport{
+			Name:                      f.stepName(i),
+			Count:                     counts[i],
+			MedianSecondsFromPrevious: medianDuration(gaps[i]).Seconds(),
+		}
+		if counts[0] > 0 {
+			step.Conversion = float64(counts[i]) / float64(counts[0]) * 100
+		}
+		if i == 0 {
+			step.StepConversion = 100
+			if counts[0] == 0 {
+				step.StepConversion = 0
+			}
+		} else if counts[i-1] > 0 {
+			step.DropOff = counts[i-1] - counts[i]
+			step.StepConversion = float64(counts[i]) / float64(counts[i-1]) * 100
+			step.DropOffRate = float64(step.DropOff) / float64(counts[i-1]) * 100
+		}
+		report.Steps[i] = step
+	}
+
+	return report
+}
+
+// medianDuration returns the median of durations, zero when empty
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// AnalyzeFunnel computes a funnel over one session, one user or every
+// session or user within a time range
+func (ba *BehaviorAnalyzer) AnalyzeFunnel(f FunnelDefinition, query FunnelQuery) (*FunnelReport, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case query.SessionID != "":
+		events, err := ba.store.GetSessionEvents(query.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		return buildFunnelReport(f, FunnelScopeSession, entityEvents(query.SessionID, events)), nil
+
+	case query.UserID != "":
+		events, err := ba.store.ScanUserEvents(query.UserID, query.From, query.To)
+		if err != nil {
+			return nil, err
+		}
+		sortEventsInOrder(events)
+		return buildFunnelReport(f, FunnelScopeUser, entityEvents(query.UserID, events)), nil
+	}
+
+	groupBy := strings.ToLower(query.GroupBy)
+	if groupBy == "" {
+		groupBy = FunnelScopeSession
+	}
+	if groupBy != FunnelScopeSession && groupBy != FunnelScopeUser {
+		return nil, fmt.Errorf("%w: unknown group_by %q", ErrInvalidFunnel, query.GroupBy)
+	}
+
+	events, err := ba.scanEvents(f.eventTypes(), query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildFunnelReport(f, FunnelScopeRange, groupEvents(events, groupBy == FunnelScopeUser)), nil
+}
+
+// entityEvents groups the events of a single session or user, which counts
+// as evaluated only when it has events
+func entityEvents(key string, events []UserEvent) map[string][]UserEvent {
+	if len(events) == 0 {
+		return map[string][]UserEvent{}
+	}
+	return map[string][]UserEvent{key: events}
+}
@@ -0,0 +1,235 @@
+package user_behavior
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// funnelEvents builds events one second apart from t0
+func funnelEvents(t0 time.Time, steps ...UserEvent) []UserEvent {
+	events := make([]UserEvent, len(steps))
+	for i, event := range steps {
+		if event.Timestamp.IsZero() {
+			event.Timestamp = t0.Add(time.Duration(i) * time.Second)
+		}
+		events[i] = event
+	}
+	return events
+}
+
+func TestEvaluateFunnel(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	checkout := FunnelDefinition{
+		Steps: []FunnelStep{
+			{EventType: EventScreenView, ScreenName: "cart"},
+			{EventType: EventButtonClick},
+			{EventType: EventScreenView, ScreenName: "paid", MaxTime: RuleDuration(10 * time.Second)},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		funnel      FunnelDefinition
+		events      []UserEvent
+		wantReached int
+		wantGaps    []time.Duration
+	}{
+		{
+			name:   "completes every step",
+			funnel: checkout,
+			events: funnelEvents(t0,
+				UserEvent{EventType: EventScreenView, ScreenName: "cart"},
+				UserEvent{EventType: EventTyping},
+				UserEvent{EventType: EventButtonClick},
+				UserEvent{EventType: EventScreenView, ScreenName: "paid"},
+			),
+			wantReached: 3,
+			wantGaps:    []time.Duration{0, 2 * time.Second, time.Second},
+		},
+		{
+			name:   "steps out of order",
+			funnel: checkout,
+			events: funnelEvents(t0,
+				UserEvent{EventType: EventButtonClick},
+				UserEvent{EventType: EventScreenView, ScreenName: "cart"},
+				UserEvent{EventType: EventScreenView, ScreenName: "paid"},
+			),
+			wantReached: 1,
+			wantGaps:    []time.Duration{0, 0, 0},
+		},
+		{
+			name:   "max time exceeded",
+			funnel: checkout,
+			events: []UserEvent{
+				{EventType: EventScreenView, ScreenName: "cart", Timestamp: t0},
+				{EventType: EventButtonClick, Timestamp: t0.Add(time.Second)},
+				{EventType: EventScreenView, ScreenName: "paid", Timestamp: t0.Add(time.Minute)},
+			},
+			wantReached: 2,
+			wantGaps:    []time.Duration{0, time.Second, 0},
+		},
+		{
+			name:   "retried step leads on within max time",
+			funnel: checkout,
+			events: []UserEvent{
+				{EventType: EventScreenView, ScreenName: "cart", Timestamp: t0},
+				{EventType: EventButtonClick, Timestamp: t0.Add(time.Second)},
+				{EventType: EventButtonClick, Timestamp: t0.Add(55 * time.Second)},
+				{EventType: EventScreenView, ScreenName: "paid", Timestamp: t0.Add(time.Minute)},
+			},
+			wantReached: 3,
+			wantGaps:    []time.Duration{0, time.Second, 5 * time.Second},
+		},
+		{
+			name: "one event completes one step",
+			funnel: FunnelDefinition{
+				Steps: []FunnelStep{{EventType: EventButtonClick}, {EventType: EventButtonClick}},
+			},
+			events: funnelEvents(t0,
+				UserEvent{EventType: EventButtonClick},
+			),
+			wantReached: 1,
+			wantGaps:    []time.Duration{0, 0},
+		},
+		{
+			name: "metadata predicates",
+			funnel: FunnelDefinition{
+				Steps: []FunnelStep{
+					{EventType: EventSearch, Metadata: []MetadataPredicate{{Key: "results", Op: MetadataGreater, Value: 0}}},
+					{EventType: EventButtonClick, Metadata: []MetadataPredicate{{Key: "target", Op: MetadataIn, Values: []interface{}{"buy", "add"}}}},
+				},
+			},
+			events: funnelEvents(t0,
+				UserEvent{EventType: EventSearch, Metadata: map[string]interface{}{"results": 0.0}},
+				UserEvent{EventType: EventSearch, Metadata: map[string]interface{}{"results": "3"}},
+				UserEvent{EventType: EventButtonClick, Metadata: map[string]interface{}{"target": "back"}},
+				UserEvent{EventType: EventButtonClick, Metadata: map[string]interface{}{"target": "add"}},
+			),
+			wantReached: 2,
+			wantGaps:    []time.Duration{0, 2 * time.Second},
+		},
+		{
+			name:        "no events",
+			funnel:      checkout,
+			wantReached: 0,
+			wantGaps:    []time.Duration{0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progress := evaluateFunnel(tt.funnel, tt.events)
+			if progress.reached != tt.wantReached {
+				t.Errorf("reached = %d, want %d", progress.reached, tt.wantReached)
+			}
+			for i, want := range tt.wantGaps {
+				if progress.gaps[i] != want {
+					t.Errorf("gaps[%d] = %v, want %v", i, progress.gaps[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFunnelReport(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	funnel := FunnelDefinition{
+		Name:  "signup",
+		Steps: []FunnelStep{{EventType: EventAppOpen}, {Name: "form", ScreenName: "signup"}, {EventType: EventSendMessage}},
+	}
+	open := UserEvent{EventType: EventAppOpen}
+	form := UserEvent{EventType: EventScreenView, ScreenName: "signup"}
+	send := UserEvent{EventType: EventSendMessage}
+
+	report := buildFunnelReport(funnel, FunnelScopeRange, map[string][]UserEvent{
+		"s1": funnelEvents(t0, open, form, send),
+		"s2": funnelEvents(t0, open, UserEvent{EventType: EventTyping}, UserEvent{EventType: EventTyping}, form),
+		"s3": funnelEvents(t0, open),
+		"s4": funnelEvents(t0, form, send),
+	})
+
+	if report.Funnel != "signup" || report.Scope != FunnelScopeRange || report.Entities != 4 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	want := []FunnelStepReport{
+		{Name: "app_open", Count: 3, Conversion: 100, StepConversion: 100},
+		{Name: "form", Count: 2, Conversion: 200.0 / 3, StepConversion: 200.0 / 3, DropOff: 1, DropOffRate: 100.0 / 3, MedianSecondsFromPrevious: 2},
+		{Name: "send_message", Count: 1, Conversion: 100.0 / 3, StepConversion: 50, DropOff: 1, DropOffRate: 50, MedianSecondsFromPrevious: 1},
+	}
+	for i, step := range report.Steps {
+		w := want[i]
+		if step.Name != w.Name || step.Count != w.Count || step.DropOff != w.DropOff ||
+			!approxEqual(step.Conversion, w.Conversion) || !approxEqual(step.StepConversion, w.StepConversion) ||
+			!approxEqual(step.DropOffRate, w.DropOffRate) || !approxEqual(step.MedianSecondsFromPrevious, w.MedianSecondsFromPrevious) {
+			t.Errorf("step %d = %+v, want %+v", i, step, w)
+		}
+	}
+}
+
+// approxEqual compares floats computed in a different order
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestFunnelValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []FunnelStep
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			steps: []FunnelStep{{EventType: EventAppOpen}, {Metadata: []MetadataPredicate{{Key: "plan", Op: MetadataExists}}}},
+		},
+		{
+			name:    "one step",
+			steps:   []FunnelStep{{EventType: EventAppOpen}},
+			wantErr: true,
+		},
+		{
+			name:    "empty step",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown event type",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {EventType: "purchase"}},
+			wantErr: true,
+		},
+		{
+			name:    "negative max time",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {EventType: EventSearch, MaxTime: RuleDuration(-time.Second)}},
+			wantErr: true,
+		},
+		{
+			name:    "numeric op without number",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {Metadata: []MetadataPredicate{{Key: "price", Op: MetadataLess, Value: "cheap"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "in without values",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {Metadata: []MetadataPredicate{{Key: "plan", Op: MetadataIn}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown op",
+			steps:   []FunnelStep{{EventType: EventAppOpen}, {Metadata: []MetadataPredicate{{Key: "plan", Op: "like", Value: "pro"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := FunnelDefinition{Steps: tt.steps}.Validate()
+			if tt.wantErr && !errors.Is(err, ErrInvalidFunnel) {
+				t.Errorf("Validate() error = %v, want %v", err, ErrInvalidFunnel)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
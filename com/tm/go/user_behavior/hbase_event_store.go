@@ -0,0 +1,249 @@
+package user_behavior
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tsuna/gohbase"
+	"github.com/tsuna/gohbase/hrpc"
+)
+
+// HBaseEventStore reads events written by HBaseWriter
+type HBaseEventStore struct {
+	client       gohbase.Client
+	tableName    string
+	columnFamily string
+	rowKeys      RowKeyStrategy
+	index        *userIndex // nil when the user index is disabled
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// maxScanFanOut bounds the concurrent scans of one read
+const maxScanFanOut = 8
+
+// NewHBaseEventStore creates a new HBase event store. rowKeys and indexTable
+// must match the HBaseWriter's layout; indexTable may be empty.
+func NewHBaseEventStore(hbaseHost string, tableName string, rowKeys RowKeyStrategy, indexTable string) *HBaseEventStore {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if tableName == "" {
+		tableName = DefaultTableName
+	}
+
+	client := gohbase.NewClient(hbaseHost)
+
+	store := &HBaseEventStore{
+		client:       client,
+		tableName:    tableName,
+		columnFamily: DefaultColumnFamily,
+		rowKeys:      rowKeys,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	if indexTable != "" {
+		store.index = &userIndex{client: client, table: indexTable, rowKeys: rowKeys}
+	}
+
+	return store
+}
+
+// GetSessionEvents retrieves all events for a session from HBase, fanning
+// out one scan per key range the row key strategy reports
+func (hs *HBaseEventStore) GetSessionEvents(sessionID string) ([]UserEvent, error) {
+	location := SessionLocation{SessionID: sessionID}
+	if hs.index != nil {
+		var err error
+		location, err = hs.index.sessionLocation(hs.ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	events, err := hs.scanRanges(hs.rowKeys.SessionRanges(location), func(event UserEvent) bool {
+		return event.SessionID == sessionID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// ScanUserEvents returns a user's events within [from, to). It scans the
+// user's key range when rows are ordered by user, reads the user's sessions
+// through the index when there is one, and falls back to a full table scan
+// filtered client side.
+func (hs *HBaseEventStore) ScanUserEvents(userID string, from, to time.Time) ([]UserEvent, error) {
+	keep := func(event UserEvent) bool {
+		return event.UserID == userID && inTimeRange(event.Timestamp, from, to)
+	}
+
+	var events []UserEvent
+	var err error
+
+	switch ranges := hs.rowKeys.UserRanges(userID, from, to); {
+	case ranges != nil:
+		events, err = hs.scanRanges(ranges, keep)
+
+	case hs.index != nil:
+		var sessions []string
+		sessions, err = hs.index.userSessions(hs.ctx, userID)
+		if err == nil {
+			events, err = fanOut(len(sessions), func(i int) ([]UserEvent, error) {
+				sessionEvents, err := hs.GetSessionEvents(sessions[i])
+				return filterEvents(sessionEvents, keep), err
+			})
+		}
+
+	default:
+		events, err = hs.scanRanges(nil, keep)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// ScanEventType returns events of one type within [from, to).
+// This is a full table scan filtered client side.
+func (hs *HBaseEventStore) ScanEventType(eventType EventType, from, to time.Time) ([]UserEvent, error) {
+	scanRequest, err := hrpc.NewScanStr(hs.ctx, hs.tableName, hs.fullDataOnly())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scan request: %w", err)
+	}
+
+	events, err := hs.scanEvents(scanRequest, func(event UserEvent) bool {
+		return event.EventType == eventType && inTimeRange(event.Timestamp, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortEventsByTime(events)
+	return events, nil
+}
+
+// Close releases the HBase client
+func (hs *HBaseEventStore) Close() error {
+	hs.cancel()
+	hs.client.Close()
+	return nil
+}
+
+// scanRanges scans key ranges concurrently and returns the kept events. A
+// nil ranges slice scans the whole table.
+func (hs *HBaseEventStore) scanRanges(ranges []KeyRange, keep func(UserEvent) bool) ([]UserEvent, error) {
+	if ranges == nil {
+		scanRequest, err := hrpc.NewScanStr(hs.ctx, hs.tableName, hs.fullDataOnly())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create scan request: %w", err)
+		}
+		return hs.scanEvents(scanRequest, keep)
+	}
+
+	return fanOut(len(ranges), func(i int) ([]UserEvent, error) {
+		scanRequest, err := hrpc.NewScanRangeStr(
+			hs.ctx,
+			hs.tableName,
+			ranges[i].Start,
+			ranges[i].Stop,
+			hs.fullDataOnly(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create scan request: %w", err)
+		}
+		return hs.scanEvents(scanRequest, keep)
+	})
+}
+
+// fanOut runs read(0..n-1) with at most maxScanFanOut in parallel and
+// concatenates the results; it returns the first error
+func fanOut(n int, read func(i int) ([]UserEvent, error)) ([]UserEvent, error) {
+	results := make([][]UserEvent, n)
+	errs := make([]error, n)
+	slots := make(chan struct{}, maxScanFanOut)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i], errs[i] = read(i)
+		}(i)
+	}
+	wg.Wait()
+
+	var events []UserEvent
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		events = append(events, results[i]...)
+	}
+	return events, nil
+}
+
+// filterEvents returns the events keep accepts
+func filterEvents(events []UserEvent, keep func(UserEvent) bool) []UserEvent {
+	var kept []UserEvent
+	for _, event := range events {
+		if keep(event) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// fullDataOnly restricts a scan to the serialized event column
+func (hs *HBaseEventStore) fullDataOnly() func(hrpc.Call) error {
+	return hrpc.Families(map[string][]string{
+		hs.columnFamily: {"full_data"},
+	})
+}
+
+// scanEvents runs a scan and decodes the full_data column of each row.
+// A nil keep function keeps every event.
+func (hs *HBaseEventStore) scanEvents(scanRequest *hrpc.Scan, keep func(UserEvent) bool) ([]UserEvent, error) {
+	scanner := hs.client.Scan(scanRequest)
+	defer scanner.Close()
+
+	var events []UserEvent
+
+	for {
+		result, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+
+		// Extract full_data column
+		for _, cell := range result.Cells {
+			if string(cell.Qualifier) != "full_data" {
+				continue
+			}
+
+			var event UserEvent
+			if err := json.Unmarshal(cell.Value, &event); err != nil {
+				continue
+			}
+			if keep == nil || keep(event) {
+				events = append(events, event)
+			}
+		}
+	}
+
+	return events, nil
+}
@@ -4,17 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tsuna/gohbase"
 	"github.com/tsuna/gohbase/hrpc"
 )
 
 const (
 	// HBase table configuration
-	DefaultTableName   = "user_behavior_events"
+	DefaultTableName    = "user_behavior_events"
 	DefaultColumnFamily = "e" // events
+
+	// Batching defaults
+	DefaultHBaseBatchSize   = 200
+	DefaultHBaseBatchLinger = 10 * time.Millisecond
+	DefaultHBaseMaxInflight = 8
 )
 
 // HBaseWriter handles writing events to HBase
@@ -22,105 +29,565 @@ type HBaseWriter struct {
 	client       gohbase.Client
 	tableName    string
 	columnFamily string
-	writeChannel chan UserEvent
+	writeQueue   *eventQueue
+	numWorkers   int
+	batch        HBaseBatchConfig
+	rowKeys      RowKeyStrategy
+	index        *userIndex    // nil when the user index is disabled
+	rpcSlots     chan struct{} // caps concurrent SendBatch RPCs across workers
+	retry        RetryPolicy
+	deadLetters  DeadLetterStore
+	workerWG     sync.WaitGroup
+	flushMu      sync.Mutex // one Flush at a time, so every worker takes its barrier
+	barriers     sync.Map   // barrier ID -> *flushBarrier
+	stopErr      error      // first error writing the batches left at Stop
 	mu           sync.RWMutex
 	ctx          context.Context
 	cancel       context.CancelFunc
 	metrics      *HBaseMetrics
 }
 
+// HBaseBatchConfig controls how queued events are grouped into multi-row
+// mutations. A batch is sent when it reaches Size or its oldest event has
+// waited Linger; at most MaxInflight batches are in flight at once.
+type HBaseBatchConfig struct {
+	Size        int
+	Linger      time.Duration
+	MaxInflight int
+}
+
 // HBaseMetrics tracks HBase write performance
 type HBaseMetrics struct {
-	WriteCount    int64
-	ErrorCount    int64
-	TotalDuration time.Duration
-	mu            sync.Mutex
+	WriteCount      int64
+	ErrorCount      int64
+	RetryCount      int64
+	DeadLetterCount int64
+	BatchCount      int64
+
+	// WriteLatency is the duration of each SendBatch RPC; BatchLatency is the
+	// time from a batch's first event leaving the queue until it is written
+	WriteLatency LatencySnapshot
+	BatchLatency LatencySnapshot
+
+	writeLatency *LatencyHistogram
+	batchLatency *LatencyHistogram
+	mu           sync.Mutex
 }
 
 // NewHBaseWriter creates a new HBase writer
-func NewHBaseWriter(hbaseHost string, tableName string, bufferSize int) *HBaseWriter {
+func NewHBaseWriter(hbaseHost string, tableName string, bufferSize int, numWorkers int, backpressure BackpressureConfig) *HBaseWriter {
+	return NewHBaseWriterWithClient(gohbase.NewClient(hbaseHost), tableName, bufferSize, numWorkers, backpressure)
+}
+
+// NewHBaseWriterWithClient creates an HBase writer on an existing client
+func NewHBaseWriterWithClient(client gohbase.Client, tableName string, bufferSize int, numWorkers int, backpressure BackpressureConfig) *HBaseWriter {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	if tableName == "" {
 		tableName = DefaultTableName
 	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
 
-	return &HBaseWriter{
-		client:       gohbase.NewClient(hbaseHost),
+	hw := &HBaseWriter{
+		client:       client,
 		tableName:    tableName,
 		columnFamily: DefaultColumnFamily,
-		writeChannel: make(chan UserEvent, bufferSize),
+		writeQueue:   newEventQueue("hbase", bufferSize, backpressure),
+		numWorkers:   numWorkers,
+		rowKeys:      SessionRowKeys{},
+		retry:        RetryPolicy{MaxAttempts: 1}.withDefaults(),
 		ctx:          ctx,
 		cancel:       cancel,
-		metrics:      &HBaseMetrics{},
+		metrics: &HBaseMetrics{
+			writeLatency: NewLatencyHistogram(),
+			batchLatency: NewLatencyHistogram(),
+		},
 	}
+	hw.SetBatchConfig(HBaseBatchConfig{})
+
+	return hw
+}
+
+// SetBatchConfig sets the batching behaviour; zero fields use the defaults.
+// Call it before Start.
+func (hw *HBaseWriter) SetBatchConfig(config HBaseBatchConfig) {
+	if config.Size <= 0 {
+		config.Size = DefaultHBaseBatchSize
+	}
+	if config.Linger <= 0 {
+		config.Linger = DefaultHBaseBatchLinger
+	}
+	if config.MaxInflight <= 0 {
+		config.MaxInflight = DefaultHBaseMaxInflight
+	}
+
+	hw.batch = config
+	hw.rpcSlots = make(chan struct{}, config.MaxInflight)
+}
+
+// SetLayout sets the row key strategy and the user index table, which is
+// disabled when indexTable is empty. Call it before Start.
+func (hw *HBaseWriter) SetLayout(rowKeys RowKeyStrategy, indexTable string) {
+	hw.rowKeys = rowKeys
+	hw.index = nil
+	if indexTable != "" {
+		hw.index = &userIndex{client: hw.client, table: indexTable, rowKeys: rowKeys}
+	}
+}
+
+// SetDeadLetterPolicy makes failed writes retry with backoff and sends events
+// that exhaust their attempts to deadLetters, which may be nil. Call it before Start.
+func (hw *HBaseWriter) SetDeadLetterPolicy(retry RetryPolicy, deadLetters DeadLetterStore) {
+	hw.retry = retry.withDefaults()
+	hw.deadLetters = deadLetters
+}
+
+// Name returns the sink name of the HBase writer
+func (hw *HBaseWriter) Name() string {
+	return SinkHBase
 }
 
 // Start begins the HBase writer workers
-func (hw *HBaseWriter) Start(numWorkers int) {
-	for i := 0; i < numWorkers; i++ {
+func (hw *HBaseWriter) Start() {
+	hw.writeQueue.Start(hw.ctx)
+
+	for i := 0; i < hw.numWorkers; i++ {
+		hw.workerWG.Add(1)
 		go hw.writeWorker()
 	}
 }
 
 // Stop gracefully stops the HBase writer
-func (hw *HBaseWriter) Stop() {
+func (hw *HBaseWriter) Stop() error {
+	// Hand spilled events to the workers and let them write the queue out
+	// before the context is cancelled
+	hw.writeQueue.Close()
+	hw.workerWG.Wait()
+
+	hw.mu.RLock()
+	err := hw.stopErr
+	hw.mu.RUnlock()
+
 	hw.cancel()
-	close(hw.writeChannel)
 	hw.client.Close()
+
+	if hw.deadLetters != nil {
+		if closeErr := hw.deadLetters.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
 }
 
-// WriteEvent queues an event for writing to HBase
+// WriteEvent queues an event for writing to HBase; a full queue is handled
+// by the configured overflow policy
 func (hw *HBaseWriter) WriteEvent(event UserEvent) error {
+	return hw.writeQueue.Enqueue(hw.ctx, event)
+}
+
+// QueueMetrics returns the write queue depth and overflow counters
+func (hw *HBaseWriter) QueueMetrics() QueueMetrics {
+	return hw.writeQueue.Metrics()
+}
+
+// WriteSummary is a no-op, session summaries are only kept by the analytics sinks
+func (hw *HBaseWriter) WriteSummary(summary SessionSummary) error {
+	return nil
+}
+
+// WriteRollup is a no-op, rollups are only kept by the analytics sinks
+func (hw *HBaseWriter) WriteRollup(rollup Rollup) error {
+	return nil
+}
+
+// WriteProfile is a no-op, user profiles are only kept by the analytics sinks
+func (hw *HBaseWriter) WriteProfile(profile UserProfile) error {
+	return nil
+}
+
+// WriteRetention is a no-op, retention tables are only kept by the analytics sinks
+func (hw *HBaseWriter) WriteRetention(table RetentionTable) error {
+	return nil
+}
+
+// flushBarrierEvent marks the barrier events Flush queues; it is not a
+// valid client event type
+const flushBarrierEvent EventType = "hbase_flush"
+
+// flushBarrier is queued once per worker by Flush behind the events queued
+// before it. A worker taking it writes the batch it holds and waits there
+// until every worker has, so each one takes exactly one.
+type flushBarrier struct {
+	remaining int
+	done      chan struct{} // closed once every worker arrived
+	aborted   chan struct{} // closed when Flush gives up
+	err       error
+	mu        sync.Mutex
+}
+
+// arrive records that a worker reached the barrier, with the error writing
+// the batch it held
+func (b *flushBarrier) arrive(err error) {
+	b.mu.Lock()
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.remaining--
+	if b.remaining == 0 {
+		close(b.done)
+	}
+	b.mu.Unlock()
+}
+
+// Flush waits until the events queued before the call are written, by
+// passing a barrier to every worker behind them. It returns the first error
+// writing those events.
+func (hw *HBaseWriter) Flush() error {
+	hw.flushMu.Lock()
+	defer hw.flushMu.Unlock()
+
+	barrierID := uuid.New().String()
+	barrier := &flushBarrier{
+		remaining: hw.numWorkers,
+		done:      make(chan struct{}),
+		aborted:   make(chan struct{}),
+	}
+	hw.barriers.Store(barrierID, barrier)
+	defer hw.barriers.Delete(barrierID)
+
+	for i := 0; i < hw.numWorkers; i++ {
+		if err := hw.writeQueue.EnqueueWait(hw.ctx, UserEvent{EventID: barrierID, EventType: flushBarrierEvent}); err != nil {
+			close(barrier.aborted)
+			return fmt.Errorf("failed to queue HBase flush: %w", err)
+		}
+	}
+
 	select {
-	case hw.writeChannel <- event:
-		return nil
+	case <-barrier.done:
+		barrier.mu.Lock()
+		defer barrier.mu.Unlock()
+		return barrier.err
 	case <-hw.ctx.Done():
+		close(barrier.aborted)
 		return hw.ctx.Err()
-	default:
-		return ErrEventChannelFull
 	}
 }
 
-// writeWorker processes events from the write channel
+// writeWorker collects events from the write queue into batches and writes
+// each batch once it is full or has lingered long enough
 func (hw *HBaseWriter) writeWorker() {
+	defer hw.workerWG.Done()
+
+	batch := make([]UserEvent, 0, hw.batch.Size)
+	var batchStart time.Time
+
+	linger := time.NewTimer(hw.batch.Linger)
+	linger.Stop()
+	defer linger.Stop()
+
+	writePending := func() error {
+		linger.Stop()
+		err := hw.writeBatch(batch, batchStart)
+		if err != nil {
+			fmt.Printf("Error writing events to HBase: %v\n", err)
+		}
+		batch = batch[:0]
+		return err
+	}
+
 	for {
 		select {
-		case event, ok := <-hw.writeChannel:
+		case event, ok := <-hw.writeQueue.C():
 			if !ok {
+				if len(batch) > 0 {
+					if err := writePending(); err != nil {
+						hw.mu.Lock()
+						if hw.stopErr == nil {
+							hw.stopErr = err
+						}
+						hw.mu.Unlock()
+					}
+				}
 				return
 			}
 
-			if err := hw.writeEventToHBase(event); err != nil {
-				// Log error - in production, you might want to retry or use a dead letter queue
-				fmt.Printf("Error writing event to HBase: %v\n", err)
-				hw.metrics.incrementError()
-			} else {
-				hw.metrics.incrementSuccess(0) // Add actual duration if measured
+			if event.EventType == flushBarrierEvent {
+				// Barriers left in a spill file by an earlier run are unknown
+				value, known := hw.barriers.Load(event.EventID)
+				if !known {
+					continue
+				}
+
+				var err error
+				if len(batch) > 0 {
+					err = writePending()
+				}
+				barrier := value.(*flushBarrier)
+				barrier.arrive(err)
+
+				select {
+				case <-barrier.done:
+				case <-barrier.aborted:
+				case <-hw.ctx.Done():
+					return
+				}
+				continue
+			}
+
+			if len(batch) == 0 {
+				batchStart = time.Now()
+				linger.Reset(hw.batch.Linger)
+			}
+
+			batch = append(batch, event)
+			if len(batch) >= hw.batch.Size {
+				writePending()
+			}
+
+		case <-linger.C:
+			if len(batch) > 0 {
+				writePending()
 			}
 
 		case <-hw.ctx.Done():
+			// Writes fail once the context is cancelled, so the pending
+			// batch ends up in the dead-letter store
+			if len(batch) > 0 {
+				writePending()
+			}
 			return
 		}
 	}
 }
 
-// writeEventToHBase writes a single event to HBase
-func (hw *HBaseWriter) writeEventToHBase(event UserEvent) error {
+// writeBatch writes events as multi-row mutations, retrying the failed rows
+// with backoff. Rows that still fail are handed to the dead-letter store.
+func (hw *HBaseWriter) writeBatch(events []UserEvent, batchStart time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	pending := events
+	attempts, err := hw.retry.Do(hw.ctx, func() error {
+		failed, err := hw.sendBatch(pending)
+		pending = failed
+		return err
+	})
+
+	if attempts > 1 {
+		hw.metrics.incrementRetries(int64(attempts - 1))
+	}
+	hw.metrics.observeBatch(time.Since(batchStart))
+
+	if err == nil {
+		return nil
+	}
+
+	for _, event := range pending {
+		hw.deadLetter(event, err, attempts)
+	}
+	return err
+}
+
+// sendBatch writes events with one SendBatch RPC, then records them in the
+// user index, and returns the events whose event or index puts failed.
+// gohbase splits a batch per region server, so the puts are sorted by row
+// key to keep each region's rows together.
+func (hw *HBaseWriter) sendBatch(events []UserEvent) ([]UserEvent, error) {
+	type rowPut struct {
+		event UserEvent
+		put   *hrpc.Mutate
+	}
+
+	rows := make([]rowPut, 0, len(events))
+	for _, event := range events {
+		put, err := hw.newPut(event)
+		if err != nil {
+			// Retrying cannot fix an event that does not serialize
+			hw.deadLetter(event, err, 1)
+			continue
+		}
+		rows = append(rows, rowPut{event: event, put: put})
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return string(rows[i].put.Key()) < string(rows[j].put.Key())
+	})
+
+	written := make([]UserEvent, len(rows))
+	calls := make([]hrpc.Call, len(rows))
+	for i, row := range rows {
+		written[i] = row.event
+		calls[i] = row.put
+	}
+
+	rowErrs, firstErr := hw.send(calls)
+
+	if hw.index != nil {
+		// Index the rows that were written; a failed row is retried along
+		// with its index entry
+		var indexed []UserEvent
+		var positions []int
+		for i, err := range rowErrs {
+			if err == nil {
+				indexed = append(indexed, written[i])
+				positions = append(positions, i)
+			}
+		}
+
+		if len(indexed) > 0 {
+			indexErrs := make([]error, len(indexed))
+			if err := hw.sendIndex(indexed, indexErrs); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for j, err := range indexErrs {
+				if err != nil {
+					rowErrs[positions[j]] = err
+				}
+			}
+		}
+	}
+
+	var failed []UserEvent
+	for i, err := range rowErrs {
+		if err != nil {
+			failed = append(failed, written[i])
+		}
+	}
+
+	hw.metrics.incrementSuccess(int64(len(rows) - len(failed)))
+
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	return failed, fmt.Errorf("%w: %d of %d events failed: %w", ErrHBaseWriteFailed, len(failed), len(rows), firstErr)
+}
+
+// sendIndex writes the user index rows of a batch and marks the events of
+// failed index puts in rowErrs so they are retried
+func (hw *HBaseWriter) sendIndex(events []UserEvent, rowErrs []error) error {
+	puts, err := hw.index.puts(hw.ctx, events)
+	if err != nil {
+		for i := range rowErrs {
+			rowErrs[i] = err
+		}
+		return err
+	}
+
+	calls := make([]hrpc.Call, len(puts))
+	for i, put := range puts {
+		calls[i] = put.put
+	}
+
+	putErrs, firstErr := hw.send(calls)
+	for i, err := range putErrs {
+		if err == nil {
+			continue
+		}
+		for _, event := range puts[i].events {
+			rowErrs[event] = err
+		}
+	}
+
+	return firstErr
+}
+
+// send runs one SendBatch RPC within the in-flight cap and returns the error
+// of each call along with the first error
+func (hw *HBaseWriter) send(calls []hrpc.Call) ([]error, error) {
+	errs := make([]error, len(calls))
+
+	select {
+	case hw.rpcSlots <- struct{}{}:
+	case <-hw.ctx.Done():
+		for i := range errs {
+			errs[i] = hw.ctx.Err()
+		}
+		return errs, hw.ctx.Err()
+	}
+
 	start := time.Now()
+	results, allOK := hw.client.SendBatch(hw.ctx, calls)
+	<-hw.rpcSlots
+
+	hw.metrics.observeWrite(time.Since(start))
 
-	// Row key design: sessionId_timestamp_eventId
-	// This allows efficient range scans for session events
-	rowKey := fmt.Sprintf("%s_%d_%s",
-		event.SessionID,
-		event.Timestamp.UnixNano(),
-		event.EventID,
-	)
+	if allOK {
+		return errs, nil
+	}
+
+	var firstErr error
+	for i := range calls {
+		if i >= len(results) {
+			errs[i] = fmt.Errorf("no result for call")
+		} else {
+			errs[i] = results[i].Error
+		}
+
+		if errs[i] != nil && firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+
+	return errs, firstErr
+}
+
+// writeWithRetry writes a single event, retrying transient errors with backoff
+func (hw *HBaseWriter) writeWithRetry(event UserEvent) error {
+	return hw.writeBatch([]UserEvent{event}, time.Now())
+}
+
+// deadLetter counts a failed event and hands it to the dead-letter store
+func (hw *HBaseWriter) deadLetter(event UserEvent, cause error, attempts int) {
+	hw.metrics.incrementError()
+
+	if hw.deadLetters == nil {
+		return
+	}
+
+	letter := DeadLetter{
+		Event:    event,
+		Sink:     SinkHBase,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	if err := hw.deadLetters.Write(letter); err != nil {
+		fmt.Printf("Error dead-lettering event %s: %v\n", event.EventID, err)
+		return
+	}
+
+	hw.metrics.incrementDeadLetter()
+}
+
+// ReplayDeadLetters writes the dead-lettered events back through the writer.
+// Events that fail again are dead-lettered anew.
+func (hw *HBaseWriter) ReplayDeadLetters() (ReplayStats, error) {
+	if hw.deadLetters == nil {
+		return ReplayStats{}, ErrNoDeadLetter
+	}
+
+	return hw.deadLetters.Replay(func(letter DeadLetter) error {
+		return hw.writeWithRetry(letter.Event)
+	})
+}
+
+// newPut builds the put request for a single event
+func (hw *HBaseWriter) newPut(event UserEvent) (*hrpc.Mutate, error) {
+	// Row key layout comes from the configured strategy, see row_key.go
+	rowKey := hw.rowKeys.RowKey(event)
 
 	// Serialize event data
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
+		return nil, permanent(fmt.Errorf("failed to marshal event: %w", err))
 	}
 
 	// Prepare HBase values
@@ -139,79 +606,66 @@ func (hw *HBaseWriter) writeEventToHBase(event UserEvent) error {
 	// Create put request
 	putRequest, err := hrpc.NewPutStr(hw.ctx, hw.tableName, rowKey, values)
 	if err != nil {
-		return fmt.Errorf("failed to create put request: %w", err)
-	}
-
-	// Write to HBase
-	_, err = hw.client.Put(putRequest)
-	if err != nil {
-		return fmt.Errorf("failed to put to HBase: %w", err)
+		return nil, permanent(fmt.Errorf("failed to create put request: %w", err))
 	}
 
-	duration := time.Since(start)
-	hw.metrics.incrementSuccess(duration)
-
-	return nil
+	return putRequest, nil
 }
 
-// GetSessionEvents retrieves all events for a session from HBase
-func (hw *HBaseWriter) GetSessionEvents(sessionID string) ([]UserEvent, error) {
-	// Create scan with prefix (sessionId_)
-	startRow := fmt.Sprintf("%s_", sessionID)
-	endRow := fmt.Sprintf("%s_~", sessionID) // ~ is lexicographically after numbers
+// GetMetrics returns current HBase write metrics
+func (hw *HBaseWriter) GetMetrics() HBaseMetrics {
+	hw.metrics.mu.Lock()
+	defer hw.metrics.mu.Unlock()
 
-	scanRequest, err := hrpc.NewScanRangeStr(
-		hw.ctx,
-		hw.tableName,
-		startRow,
-		endRow,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create scan request: %w", err)
+	return HBaseMetrics{
+		WriteCount:      hw.metrics.WriteCount,
+		ErrorCount:      hw.metrics.ErrorCount,
+		RetryCount:      hw.metrics.RetryCount,
+		DeadLetterCount: hw.metrics.DeadLetterCount,
+		BatchCount:      hw.metrics.BatchCount,
+		WriteLatency:    hw.metrics.writeLatency.Snapshot(),
+		BatchLatency:    hw.metrics.batchLatency.Snapshot(),
 	}
+}
 
-	scanner := hw.client.Scan(scanRequest)
-	var events []UserEvent
+// Metrics returns the HBase write metrics in the common sink format
+func (hw *HBaseWriter) Metrics() SinkMetrics {
+	hw.metrics.mu.Lock()
+	defer hw.metrics.mu.Unlock()
 
-	for {
-		result, err := scanner.Next()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			return nil, fmt.Errorf("scan error: %w", err)
-		}
+	writeLatency := hw.metrics.writeLatency.Snapshot()
 
-		// Extract full_data column
-		for _, cell := range result.Cells {
-			if string(cell.Qualifier) == "full_data" {
-				var event UserEvent
-				if err := json.Unmarshal(cell.Value, &event); err != nil {
-					continue
-				}
-				events = append(events, event)
-			}
-		}
+	return SinkMetrics{
+		Name:          SinkHBase,
+		EventsWritten: hw.metrics.WriteCount,
+		ErrorCount:    hw.metrics.ErrorCount,
+		BatchCount:    hw.metrics.BatchCount,
+		Retries:       hw.metrics.RetryCount,
+		DeadLettered:  hw.metrics.DeadLetterCount,
+		WriteLatency:  &writeLatency,
 	}
-
-	return events, nil
 }
 
-// GetMetrics returns current HBase write metrics
-func (hw *HBaseWriter) GetMetrics() HBaseMetrics {
-	hw.metrics.mu.Lock()
-	defer hw.metrics.mu.Unlock()
+// incrementSuccess adds to the successful write count
+func (m *HBaseMetrics) incrementSuccess(count int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return *hw.metrics
+	m.WriteCount += count
 }
 
-// incrementSuccess increments successful write count
-func (m *HBaseMetrics) incrementSuccess(duration time.Duration) {
+// observeWrite records one SendBatch RPC
+func (m *HBaseMetrics) observeWrite(duration time.Duration) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.BatchCount++
+	m.mu.Unlock()
 
-	m.WriteCount++
-	m.TotalDuration += duration
+	m.writeLatency.Observe(duration)
+}
+
+// observeBatch records how long a batch took from first event to written
+func (m *HBaseMetrics) observeBatch(duration time.Duration) {
+	m.batchLatency.Observe(duration)
 }
 
 // incrementError increments error count
@@ -221,3 +675,19 @@ func (m *HBaseMetrics) incrementError() {
 
 	m.ErrorCount++
 }
+
+// incrementRetries adds to the retry count
+func (m *HBaseMetrics) incrementRetries(retries int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RetryCount += retries
+}
+
+// incrementDeadLetter increments dead-lettered event count
+func (m *HBaseMetrics) incrementDeadLetter() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.DeadLetterCount++
+}
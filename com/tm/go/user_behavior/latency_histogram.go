@@ -0,0 +1,137 @@
+package user_behavior
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBucketBounds are the upper bounds of the histogram buckets; a last
+// overflow bucket counts everything slower
+var latencyBucketBounds = []time.Duration{
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts durations in fixed exponential buckets
+type LatencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+	mu     sync.Mutex
+}
+
+// LatencySnapshot is a point-in-time view of a LatencyHistogram in milliseconds
+type LatencySnapshot struct {
+	Count   int64           `json:"count"`
+	MeanMs  float64         `json:"mean_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P95Ms   float64         `json:"p95_ms"`
+	P99Ms   float64         `json:"p99_ms"`
+	MaxMs   float64         `json:"max_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// LatencyBucket is the number of observations at or below LeMs; the
+// overflow bucket has LeMs set to -1
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms"`
+	Count int64   `json:"count"`
+}
+
+// NewLatencyHistogram creates an empty histogram
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		counts: make([]int64, len(latencyBucketBounds)+1),
+	}
+}
+
+// Observe records one duration
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := sort.Search(len(latencyBucketBounds), func(i int) bool {
+		return d <= latencyBucketBounds[i]
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Snapshot returns the counts with quantiles estimated from bucket bounds
+func (h *LatencyHistogram) Snapshot() LatencySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := LatencySnapshot{
+		Count: h.count,
+		MaxMs: toMillis(h.max),
+	}
+	if h.count > 0 {
+		snapshot.MeanMs = toMillis(h.sum) / float64(h.count)
+	}
+
+	for i, count := range h.counts {
+		le := -1.0
+		if i < len(latencyBucketBounds) {
+			le = toMillis(latencyBucketBounds[i])
+		}
+		snapshot.Buckets = append(snapshot.Buckets, LatencyBucket{LeMs: le, Count: count})
+	}
+
+	snapshot.P50Ms = h.quantile(0.50)
+	snapshot.P95Ms = h.quantile(0.95)
+	snapshot.P99Ms = h.quantile(0.99)
+
+	return snapshot
+}
+
+// quantile returns the upper bound of the bucket holding quantile q, capped
+// at the largest observation. Callers hold h.mu.
+func (h *LatencyHistogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(q * float64(h.count))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if i < len(latencyBucketBounds) && latencyBucketBounds[i] < h.max {
+			return toMillis(latencyBucketBounds[i])
+		}
+		break
+	}
+
+	return toMillis(h.max)
+}
+
+// toMillis converts a duration to fractional milliseconds
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -1,15 +1,51 @@
 package user_behavior
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+const (
+	// Limits for the batch tracking endpoint
+	MaxBatchEvents    = 1000
+	maxBatchBodyBytes = 10 << 20
+
+	// DefaultStatsRange is the window of /stats queries without a from parameter
+	DefaultStatsRange = 24 * time.Hour
+
+	// retryAfterSeconds is sent with 429 responses when the tracker is saturated
+	retryAfterSeconds = "1"
+)
+
+// TrackBatchRequest is the body of POST /track/batch
+type TrackBatchRequest struct {
+	Events []UserEvent `json:"events"`
+}
+
+// AnomalyRuleTestRequest is the body of POST /anomaly/rules/test. Rule names
+// a loaded rule; Definition tests a rule that is not loaded instead.
+type AnomalyRuleTestRequest struct {
+	SessionID  string       `json:"session_id"`
+	Rule       string       `json:"rule,omitempty"`
+	Definition *AnomalyRule `json:"definition,omitempty"`
+}
+
+// TrackBatchResponse is the per-event result of POST /track/batch
+type TrackBatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []TrackResult `json:"results"`
+}
+
 func Main() {
 	// Configuration
 	config := EventCollectorConfig{
@@ -19,10 +55,38 @@ func Main() {
 		BQDataset:           getEnv("BQ_DATASET", "user_behavior"),
 		BQEventTable:        getEnv("BQ_EVENT_TABLE", "events"),
 		BQSummaryTable:      getEnv("BQ_SUMMARY_TABLE", "session_summaries"),
+		BQRollupTable:       getEnv("BQ_ROLLUP_TABLE", DefaultRollupTable),
+		BQProfileTable:      getEnv("BQ_PROFILE_TABLE", DefaultProfileTable),
+		BQRetentionTable:    getEnv("BQ_RETENTION_TABLE", DefaultRetentionTable),
 		EventBufferSize:     10000,
 		NumSessionWorkers:   10,
 		NumHBaseWorkers:     20,
 		AggregationInterval: 5 * time.Minute,
+		Sinks:               ParseSinkNames(getEnv("EVENT_SINKS", "hbase,bigquery")),
+		SinkFileDir:         getEnv("SINK_FILE_DIR", DefaultSinkFileDir),
+		EventStore:          getEnv("EVENT_STORE", ""),
+		WALDir:              getEnv("WAL_DIR", ""),
+		SessionBackpressure: backpressureFromEnv("SESSION_OVERFLOW_POLICY"),
+		HBaseBackpressure:   backpressureFromEnv("HBASE_OVERFLOW_POLICY"),
+		HBaseRetry:          retryPolicyFromEnv(),
+		DeadLetter:          deadLetterConfigFromEnv(),
+		HBaseBatch:          hbaseBatchConfigFromEnv(),
+		HBaseLayout:         hbaseLayoutFromEnv(),
+		AnalyticsBackend:    getEnv("ANALYTICS_BACKEND", ""),
+		RollupWatermarkPath: getEnv("ROLLUP_WATERMARK_PATH", DefaultRollupWatermarkFile),
+		Session:             sessionConfigFromEnv(),
+		SessionSnapshot:     sessionSnapshotConfigFromEnv(),
+		Cluster:             clusterConfigFromEnv(),
+		AnomalyRules: AnomalyRuleConfig{
+			Paths:          ParseSinkNames(getEnv("ANOMALY_RULES_PATH", "")),
+			ReloadInterval: durationFromEnv("ANOMALY_RULES_RELOAD_INTERVAL"),
+		},
+		Profiles: UserProfileConfig{
+			FilePath:          getEnv("PROFILE_PATH", ""),
+			SaveInterval:      durationFromEnv("PROFILE_SAVE_INTERVAL"),
+			SignupMetadataKey: getEnv("SIGNUP_METADATA_KEY", DefaultSignupMetadataKey),
+			Baseline:          baselineConfigFromEnv(),
+		},
 	}
 
 	// Create event collector
@@ -41,6 +105,46 @@ func Main() {
 	waitForShutdown(collector)
 }
 
+// DeadLetterReplayMain is the admin command that writes the HBase dead
+// letters back through the writer, using the same environment as Main
+func DeadLetterReplayMain() {
+	deadLetterConfig := deadLetterConfigFromEnv()
+	if deadLetterConfig.Type == DeadLetterNone {
+		log.Fatalf("DLQ_TYPE is not set")
+	}
+
+	layout := hbaseLayoutFromEnv()
+	rowKeys, err := NewRowKeyStrategy(layout)
+	if err != nil {
+		log.Fatalf("Invalid HBase layout: %v", err)
+	}
+
+	deadLetters, err := NewDeadLetterStore(deadLetterConfig)
+	if err != nil {
+		log.Fatalf("Failed to open dead-letter store: %v", err)
+	}
+
+	hbaseWriter := NewHBaseWriter(
+		getEnv("HBASE_HOST", "localhost"),
+		getEnv("HBASE_TABLE", "user_behavior_events"),
+		1,
+		0,
+		BackpressureConfig{},
+	)
+	hbaseWriter.SetLayout(rowKeys, layout.IndexTable)
+	hbaseWriter.SetDeadLetterPolicy(retryPolicyFromEnv(), deadLetters)
+
+	stats, err := hbaseWriter.ReplayDeadLetters()
+	if stopErr := hbaseWriter.Stop(); stopErr != nil {
+		log.Printf("Error stopping HBase writer: %v", stopErr)
+	}
+	if err != nil {
+		log.Fatalf("Dead-letter replay failed after %d events: %v", stats.Replayed, err)
+	}
+
+	log.Printf("Dead-letter replay done: %d replayed, %d failed again", stats.Replayed, stats.Failed)
+}
+
 func setupHTTPServer(collector *EventCollector) {
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -50,25 +154,9 @@ func setupHTTPServer(collector *EventCollector) {
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		metrics := collector.GetMetrics()
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{
-			"hbase": {
-				"writes": %d,
-				"errors": %d
-			},
-			"bigquery": {
-				"events_written": %d,
-				"summaries_written": %d,
-				"errors": %d,
-				"batches": %d
-			}
-		}`,
-			metrics.HBase.WriteCount,
-			metrics.HBase.ErrorCount,
-			metrics.BigQuery.EventsWritten,
-			metrics.BigQuery.SummariesWritten,
-			metrics.BigQuery.ErrorCount,
-			metrics.BigQuery.BatchCount,
-		)
+		if err := json.NewEncoder(w).Encode(metrics); err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding metrics: %v", err), http.StatusInternalServerError)
+		}
 	})
 
 	// Example: Track event endpoint
@@ -88,7 +176,30 @@ func setupHTTPServer(collector *EventCollector) {
 			return
 		}
 
-		err := collector.TrackEvent(userID, sessionID, eventType, screenName, nil)
+		// Optional client event ID and timestamp for retries and late uploads
+		var opts []TrackOption
+		if eventID := r.URL.Query().Get("event_id"); eventID != "" {
+			opts = append(opts, WithEventID(eventID))
+		}
+		if value := r.URL.Query().Get("timestamp"); value != "" {
+			timestamp, err := parseTimestamp(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid timestamp: %v", err), http.StatusBadRequest)
+				return
+			}
+			opts = append(opts, WithTimestamp(timestamp))
+		}
+
+		err := collector.TrackEvent(userID, sessionID, eventType, screenName, nil, opts...)
+		if errors.Is(err, ErrEventChannelFull) {
+			w.Header().Set("Retry-After", retryAfterSeconds)
+			http.Error(w, fmt.Sprintf("Tracker saturated: %v", err), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, ErrInvalidEvent) {
+			http.Error(w, fmt.Sprintf("Error tracking event: %v", err), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error tracking event: %v", err), http.StatusInternalServerError)
 			return
@@ -98,6 +209,162 @@ func setupHTTPServer(collector *EventCollector) {
 		w.Write([]byte("Event tracked"))
 	})
 
+	// Batch track endpoint for clients that buffer events offline
+	http.HandleFunc("/track/batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req TrackBatchRequest
+		body := http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Events) == 0 {
+			http.Error(w, "No events in batch", http.StatusBadRequest)
+			return
+		}
+		if len(req.Events) > MaxBatchEvents {
+			http.Error(w, fmt.Sprintf("Batch too large: max %d events", MaxBatchEvents), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		results := collector.TrackEvents(req.Events)
+
+		resp := TrackBatchResponse{Results: results}
+		saturated := false
+		for _, result := range results {
+			if result.Accepted {
+				resp.Accepted++
+			} else {
+				resp.Rejected++
+			}
+			saturated = saturated || result.Retryable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if saturated {
+			w.Header().Set("Retry-After", retryAfterSeconds)
+		}
+		if saturated && resp.Accepted == 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	// User event history across sessions, streamed as NDJSON. The cursor for
+	// the next page is returned in the X-Next-Cursor header.
+	http.HandleFunc("/user/events", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		userID := query.Get("user_id")
+		if userID == "" {
+			http.Error(w, "Missing user_id", http.StatusBadRequest)
+			return
+		}
+
+		var from, to time.Time
+		for key, target := range map[string]*time.Time{"from": &from, "to": &to} {
+			value := query.Get(key)
+			if value == "" {
+				continue
+			}
+			parsed, err := parseTimestamp(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: %v", key, err), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+
+		filter := UserEventFilter{
+			ScreenNames: ParseSinkNames(query.Get("screen_name")),
+			Cursor:      query.Get("cursor"),
+		}
+		for _, eventType := range ParseSinkNames(query.Get("event_type")) {
+			filter.EventTypes = append(filter.EventTypes, EventType(eventType))
+		}
+		if value := query.Get("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		page, err := collector.GetUserEvents(userID, from, to, filter)
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting user events: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if page.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", page.NextCursor)
+		}
+
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		for i, event := range page.Events {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil && i%100 == 99 {
+				flusher.Flush()
+			}
+		}
+	})
+
+	// Global stats over a time range, the last 24 hours by default
+	http.HandleFunc("/stats/top-actions", func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := parseStatsRange(w, r)
+		if !ok {
+			return
+		}
+
+		stats, err := collector.GetTopActionsGlobal(start, end)
+		writeStatsResponse(w, stats, err)
+	})
+
+	http.HandleFunc("/stats/anomalies", func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := parseStatsRange(w, r)
+		if !ok {
+			return
+		}
+
+		report, err := collector.GetAnomalyReport(start, end)
+		writeStatsResponse(w, report, err)
+	})
+
+	// Replay dead-lettered events back through the sinks
+	http.HandleFunc("/admin/dlq/replay", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats, err := collector.ReplayDeadLetters()
+		if errors.Is(err, ErrNoDeadLetter) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error replaying dead letters: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
 	// Create session endpoint
 	http.HandleFunc("/session/create", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -168,6 +435,323 @@ func setupHTTPServer(collector *EventCollector) {
 		)
 	})
 
+	// Anomaly rules: list, reload and test against a stored session
+	http.HandleFunc("/anomaly/rules", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collector.AnomalyRules())
+	})
+
+	http.HandleFunc("/anomaly/rules/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := collector.ReloadAnomalyRules()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reloading rules: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	http.HandleFunc("/anomaly/rules/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req AnomalyRuleTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.SessionID == "" || (req.Rule == "" && req.Definition == nil) {
+			http.Error(w, "Missing session_id, or rule and definition", http.StatusBadRequest)
+			return
+		}
+
+		test, err := collector.TestAnomalyRule(req.SessionID, req.Rule, req.Definition)
+		switch {
+		case errors.Is(err, ErrUnknownRule):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrInvalidRule):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error testing rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(test)
+	})
+
+	// Anomalies as they are detected, streamed as NDJSON until the client
+	// disconnects
+	http.HandleFunc("/anomaly/alerts", func(w http.ResponseWriter, r *http.Request) {
+		sub := collector.SubscribeAnomalies("http_alerts_" + r.RemoteAddr)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case event, ok := <-sub.C():
+				if !ok {
+					return
+				}
+				if err := encoder.Encode(event.Anomaly); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	// Funnel analysis: the body is the funnel definition; session_id or
+	// user_id select one session or user, otherwise every session (or user
+	// with group_by=user) with events within from and to
+	http.HandleFunc("/analysis/funnel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var funnel FunnelDefinition
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&funnel); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid funnel: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		query := FunnelQuery{
+			SessionID: r.URL.Query().Get("session_id"),
+			UserID:    r.URL.Query().Get("user_id"),
+			GroupBy:   r.URL.Query().Get("group_by"),
+		}
+		if query.SessionID == "" {
+			start, end, ok := parseStatsRange(w, r)
+			if !ok {
+				return
+			}
+			query.From, query.To = start, end
+		}
+
+		report, err := collector.AnalyzeFunnel(funnel, query)
+		switch {
+		case errors.Is(err, ErrInvalidFunnel):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error analyzing funnel: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
+	// Frequent action sequences of one session, of a user's sessions or of
+	// every session within from and to, of any length up to max_length and
+	// with up to max_gap other actions between steps
+	http.HandleFunc("/analysis/patterns", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		patternQuery := PatternQuery{
+			SessionID: query.Get("session_id"),
+			UserID:    query.Get("user_id"),
+			MaxGap:    DefaultPatternMaxGap,
+		}
+		for _, eventType := range ParseSinkNames(query.Get("event_types")) {
+			patternQuery.EventTypes = append(patternQuery.EventTypes, EventType(eventType))
+		}
+
+		ints := map[string]*int{
+			"min_sessions": &patternQuery.MinSessions,
+			"min_count":    &patternQuery.MinCount,
+			"min_length":   &patternQuery.MinLength,
+			"max_length":   &patternQuery.MaxLength,
+			"max_gap":      &patternQuery.MaxGap,
+			"limit":        &patternQuery.Limit,
+		}
+		for name, target := range ints {
+			if value := query.Get(name); value != "" {
+				parsed, err := strconv.Atoi(value)
+				if err != nil || parsed < 0 {
+					http.Error(w, fmt.Sprintf("Invalid %s: %s", name, value), http.StatusBadRequest)
+					return
+				}
+				*target = parsed
+			}
+		}
+		if value := query.Get("min_support"); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid min_support: %s", value), http.StatusBadRequest)
+				return
+			}
+			patternQuery.MinSupport = parsed
+		}
+		if value := query.Get("max_gap_time"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid max_gap_time: %v", err), http.StatusBadRequest)
+				return
+			}
+			patternQuery.MaxGapTime = parsed
+		}
+
+		if patternQuery.SessionID == "" {
+			start, end, ok := parseStatsRange(w, r)
+			if !ok {
+				return
+			}
+			patternQuery.From, patternQuery.To = start, end
+		}
+
+		report, err := collector.ActionPatterns(patternQuery)
+		if errors.Is(err, ErrInvalidPattern) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error mining action patterns: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
+	// Screen navigation graph of one session, or of every session within
+	// from and to; format=dot returns Graphviz DOT instead of JSON
+	http.HandleFunc("/analysis/navigation", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var options NavigationOptions
+		for name, target := range map[string]*int{"top": &options.TopPaths, "path_length": &options.PathLength} {
+			if value := query.Get(name); value != "" {
+				parsed, err := strconv.Atoi(value)
+				if err != nil || parsed < 0 {
+					http.Error(w, fmt.Sprintf("Invalid %s: %s", name, value), http.StatusBadRequest)
+					return
+				}
+				*target = parsed
+			}
+		}
+
+		format := query.Get("format")
+		if format != "" && format != "json" && format != "dot" {
+			http.Error(w, "Invalid format, expected json or dot", http.StatusBadRequest)
+			return
+		}
+
+		var graph *NavigationGraph
+		var err error
+		if sessionID := query.Get("session_id"); sessionID != "" {
+			graph, err = collector.SessionNavigation(sessionID, options)
+		} else {
+			start, end, ok := parseStatsRange(w, r)
+			if !ok {
+				return
+			}
+			graph, err = collector.NavigationGraph(start, end, options)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building navigation graph: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if format == "dot" {
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			w.Write([]byte(graph.DOT()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(graph)
+	})
+
+	// Profile of a user, aggregated from the user's ended sessions
+	http.HandleFunc("/user/profile", func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			http.Error(w, "Missing user_id", http.StatusBadRequest)
+			return
+		}
+
+		profile, exists := collector.UserProfile(userID)
+		if !exists {
+			http.Error(w, "User profile not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	})
+
+	// Cohort retention: cohort=first_seen|signup, period=day|week, and
+	// optionally periods and the from/to range of cohort starts
+	http.HandleFunc("/analysis/retention", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		query := RetentionQuery{
+			Cohort: params.Get("cohort"),
+			Period: params.Get("period"),
+		}
+
+		if value := params.Get("periods"); value != "" {
+			periods, err := strconv.Atoi(value)
+			if err != nil || periods <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid periods: %s", value), http.StatusBadRequest)
+				return
+			}
+			query.Periods = periods
+		}
+		for name, target := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+			if value := params.Get(name); value != "" {
+				parsed, err := parseTimestamp(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid %s: %v", name, err), http.StatusBadRequest)
+					return
+				}
+				*target = parsed
+			}
+		}
+
+		table, err := collector.CohortRetention(query)
+		switch {
+		case errors.Is(err, ErrInvalidRetention):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error computing retention: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(table)
+	})
+
+	if collector.cluster != nil {
+		setupClusterHandlers(http.DefaultServeMux, collector)
+	}
+
 	port := getEnv("PORT", "8080")
 	go func() {
 		log.Printf("HTTP server listening on port %s", port)
@@ -177,6 +761,86 @@ func setupHTTPServer(collector *EventCollector) {
 	}()
 }
 
+// setupClusterHandlers registers the endpoints the other instances call
+func setupClusterHandlers(mux *http.ServeMux, collector *EventCollector) {
+	cluster := collector.cluster
+
+	mux.HandleFunc(ClusterHeartbeatPath, clusterOnly(cluster, func(w http.ResponseWriter, r *http.Request) {
+		var msg heartbeatMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid heartbeat: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		reply, err := cluster.ReceiveHeartbeat(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	}))
+
+	mux.HandleFunc(ClusterLeavePath, clusterOnly(cluster, func(w http.ResponseWriter, r *http.Request) {
+		var msg heartbeatMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid leave: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		cluster.ReceiveLeave(msg)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Events and session operations forwarded by a non-owner
+	mux.HandleFunc(ClusterForwardPath, clusterOnly(cluster, func(w http.ResponseWriter, r *http.Request) {
+		var req forwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		err := collector.HandleForward(req)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusOK)
+		case errors.Is(err, ErrDuplicateEvent):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, ErrEventChannelFull):
+			w.Header().Set("Retry-After", retryAfterSeconds)
+			http.Error(w, fmt.Sprintf("Tracker saturated: %v", err), http.StatusTooManyRequests)
+		case errors.Is(err, ErrInvalidEvent):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+
+	mux.HandleFunc(ClusterHandoffPath, clusterOnly(cluster, func(w http.ResponseWriter, r *http.Request) {
+		var states []SessionState
+		if err := json.NewDecoder(r.Body).Decode(&states); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		collector.HandleHandoff(states)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// clusterOnly rejects requests without the cluster token, so only members
+// reach the internal endpoints
+func clusterOnly(cluster *Cluster, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cluster.Authorized(r) {
+			http.Error(w, "Invalid cluster token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func waitForShutdown(collector *EventCollector) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -192,6 +856,305 @@ func waitForShutdown(collector *EventCollector) {
 	log.Println("Shutdown complete")
 }
 
+// backpressureFromEnv reads an overflow policy and the shared spill settings
+func backpressureFromEnv(policyKey string) BackpressureConfig {
+	policy, err := ParseOverflowPolicy(getEnv(policyKey, ""))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", policyKey, err)
+	}
+
+	blockTimeout, err := time.ParseDuration(getEnv("OVERFLOW_BLOCK_TIMEOUT", DefaultBlockTimeout.String()))
+	if err != nil {
+		log.Fatalf("Invalid OVERFLOW_BLOCK_TIMEOUT: %v", err)
+	}
+
+	return BackpressureConfig{
+		Policy:       policy,
+		BlockTimeout: blockTimeout,
+		SpillDir:     getEnv("SPILL_DIR", ""),
+	}
+}
+
+// parseStatsRange reads the from and to query parameters, defaulting to the
+// last DefaultStatsRange; it writes a 400 response and returns false on error
+func parseStatsRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	end := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := parseTimestamp(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid to: %v", err), http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		end = parsed
+	}
+
+	start := end.Add(-DefaultStatsRange)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := parseTimestamp(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid from: %v", err), http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		start = parsed
+	}
+
+	if !start.Before(end) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end, true
+}
+
+// writeStatsResponse writes a stats query result as JSON
+func writeStatsResponse(w http.ResponseWriter, result interface{}, err error) {
+	if errors.Is(err, ErrNoAnalytics) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error running stats query: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// retryPolicyFromEnv reads the HBase retry policy; unset values use the defaults
+func retryPolicyFromEnv() RetryPolicy {
+	policy := DefaultRetryPolicy()
+
+	if value := getEnv("HBASE_RETRY_MAX_ATTEMPTS", ""); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_RETRY_MAX_ATTEMPTS: %v", err)
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	if value := getEnv("HBASE_RETRY_MAX_BACKOFF", ""); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_RETRY_MAX_BACKOFF: %v", err)
+		}
+		policy.MaxBackoff = backoff
+	}
+
+	return policy
+}
+
+// hbaseBatchConfigFromEnv reads the HBase batching settings; unset values use the defaults
+func hbaseBatchConfigFromEnv() HBaseBatchConfig {
+	var config HBaseBatchConfig
+
+	if value := getEnv("HBASE_BATCH_SIZE", ""); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_BATCH_SIZE: %v", err)
+		}
+		config.Size = size
+	}
+
+	if value := getEnv("HBASE_BATCH_LINGER", ""); value != "" {
+		linger, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_BATCH_LINGER: %v", err)
+		}
+		config.Linger = linger
+	}
+
+	if value := getEnv("HBASE_MAX_INFLIGHT", ""); value != "" {
+		inflight, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_MAX_INFLIGHT: %v", err)
+		}
+		config.MaxInflight = inflight
+	}
+
+	return config
+}
+
+// hbaseLayoutFromEnv reads the HBase row key strategy and index table
+func hbaseLayoutFromEnv() HBaseLayoutConfig {
+	layout := HBaseLayoutConfig{
+		RowKeys:    getEnv("HBASE_ROW_KEYS", RowKeysSession),
+		IndexTable: getEnv("HBASE_INDEX_TABLE", ""),
+	}
+
+	if value := getEnv("HBASE_SALT_BUCKETS", ""); value != "" {
+		buckets, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_SALT_BUCKETS: %v", err)
+		}
+		layout.SaltBuckets = buckets
+	}
+
+	if value := getEnv("HBASE_TIME_BUCKET", ""); value != "" {
+		width, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid HBASE_TIME_BUCKET: %v", err)
+		}
+		layout.TimeBucket = width
+	}
+
+	return layout
+}
+
+// deadLetterConfigFromEnv reads the dead-letter store settings
+func deadLetterConfigFromEnv() DeadLetterConfig {
+	return DeadLetterConfig{
+		Type:         getEnv("DLQ_TYPE", DeadLetterNone),
+		FilePath:     getEnv("DLQ_FILE_PATH", DefaultDeadLetterFile),
+		KafkaBrokers: ParseSinkNames(getEnv("DLQ_KAFKA_BROKERS", "")),
+		KafkaTopic:   getEnv("DLQ_KAFKA_TOPIC", "user_behavior_dead_letters"),
+	}
+}
+
+// sessionConfigFromEnv reads the session timeout, retention and split rule
+// settings; unset values use the defaults
+func sessionConfigFromEnv() SessionConfig {
+	config := SessionConfig{
+		Timeout:          durationFromEnv("SESSION_TIMEOUT"),
+		TimeoutOverrides: make(map[string]time.Duration),
+		CleanupInterval:  durationFromEnv("SESSION_CHECK_INTERVAL"),
+		Retention:        durationFromEnv("SESSION_RETENTION"),
+		WatermarkDelay:   durationFromEnv("SESSION_WATERMARK_DELAY"),
+		AllowedLateness:  durationFromEnv("SESSION_ALLOWED_LATENESS"),
+		Split: SessionSplitRules{
+			Timezone:     getEnv("SESSION_TIMEZONE", "UTC"),
+			ReopenGap:    durationFromEnv("SESSION_REOPEN_GAP"),
+			MetadataKeys: ParseSinkNames(getEnv("SESSION_SPLIT_METADATA_KEYS", "")),
+		},
+	}
+
+	// SESSION_TIMEOUT_OVERRIDES lists app or platform timeouts as name=duration
+	for _, item := range ParseSinkNames(getEnv("SESSION_TIMEOUT_OVERRIDES", "")) {
+		name, value, ok := strings.Cut(item, "=")
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil {
+			log.Fatalf("Invalid SESSION_TIMEOUT_OVERRIDES entry %q", item)
+		}
+		config.TimeoutOverrides[strings.TrimSpace(name)] = timeout
+	}
+
+	if value := getEnv("SESSION_MAX_EVENTS", ""); value != "" {
+		maxEvents, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid SESSION_MAX_EVENTS: %v", err)
+		}
+		config.MaxEvents = maxEvents
+	}
+
+	if value := getEnv("SESSION_SHARDS", ""); value != "" {
+		shards, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid SESSION_SHARDS: %v", err)
+		}
+		config.Shards = shards
+	}
+
+	if value := getEnv("SESSION_SPLIT_MIDNIGHT", ""); value != "" {
+		atMidnight, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("Invalid SESSION_SPLIT_MIDNIGHT: %v", err)
+		}
+		config.Split.AtMidnight = atMidnight
+	}
+
+	if _, err := time.LoadLocation(config.Split.Timezone); err != nil {
+		log.Fatalf("Invalid SESSION_TIMEZONE: %v", err)
+	}
+
+	return config
+}
+
+// sessionSnapshotConfigFromEnv reads the session snapshot store settings
+func sessionSnapshotConfigFromEnv() SessionSnapshotConfig {
+	return SessionSnapshotConfig{
+		Type:       getEnv("SESSION_SNAPSHOT_TYPE", SnapshotStoreNone),
+		FilePath:   getEnv("SESSION_SNAPSHOT_PATH", DefaultSessionSnapshotFile),
+		HBaseTable: getEnv("SESSION_SNAPSHOT_TABLE", DefaultSessionSnapshotTable),
+		InstanceID: getEnv("SESSION_SNAPSHOT_INSTANCE", ""),
+		Interval:   durationFromEnv("SESSION_SNAPSHOT_INTERVAL"),
+	}
+}
+
+// clusterConfigFromEnv reads the cluster membership settings; clustering is
+// disabled without CLUSTER_PEERS
+func clusterConfigFromEnv() ClusterConfig {
+	return ClusterConfig{
+		Self:              getEnv("CLUSTER_SELF", ""),
+		Peers:             ParseSinkNames(getEnv("CLUSTER_PEERS", "")),
+		HeartbeatInterval: durationFromEnv("CLUSTER_HEARTBEAT_INTERVAL"),
+		FailureTimeout:    durationFromEnv("CLUSTER_FAILURE_TIMEOUT"),
+		Token:             getEnv("CLUSTER_TOKEN", ""),
+	}
+}
+
+// baselineConfigFromEnv reads the per user baseline anomaly settings; the
+// mode is disabled without BASELINE_METHOD
+func baselineConfigFromEnv() BaselineConfig {
+	config := BaselineConfig{
+		Method: getEnv("BASELINE_METHOD", BaselineNone),
+	}
+
+	if value := getEnv("BASELINE_THRESHOLD", ""); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("Invalid BASELINE_THRESHOLD: %v", err)
+		}
+		config.Threshold = threshold
+	}
+
+	if value := getEnv("BASELINE_ALPHA", ""); value != "" {
+		alpha, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("Invalid BASELINE_ALPHA: %v", err)
+		}
+		config.Alpha = alpha
+	}
+
+	if value := getEnv("BASELINE_WINDOW", ""); value != "" {
+		window, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid BASELINE_WINDOW: %v", err)
+		}
+		config.Window = window
+	}
+
+	if value := getEnv("BASELINE_MIN_SESSIONS", ""); value != "" {
+		minSessions, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid BASELINE_MIN_SESSIONS: %v", err)
+		}
+		config.MinSessions = minSessions
+	}
+
+	return config
+}
+
+// durationFromEnv parses an optional duration, zero when unset
+func durationFromEnv(key string) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return duration
+}
+
+// parseTimestamp accepts RFC 3339 or unix milliseconds
+func parseTimestamp(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,187 @@
+package user_behavior
+
+import (
+	"sync"
+	"time"
+)
+
+// MemorySink keeps events, summaries, rollups, profiles and retention tables
+// in memory, for local runs and tests
+type MemorySink struct {
+	events    []UserEvent
+	summaries []SessionSummary
+	rollups   []Rollup
+	profiles  []UserProfile
+	retention []RetentionTable
+	mu        sync.RWMutex
+}
+
+// NewMemorySink creates a new in-memory sink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{
+		events:    make([]UserEvent, 0),
+		summaries: make([]SessionSummary, 0),
+	}
+}
+
+// Name returns the sink name of the memory sink
+func (ms *MemorySink) Name() string {
+	return SinkMemory
+}
+
+// Start is a no-op, the memory sink has no background workers
+func (ms *MemorySink) Start() {}
+
+// WriteEvent stores an event
+func (ms *MemorySink) WriteEvent(event UserEvent) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.events = append(ms.events, event)
+	return nil
+}
+
+// WriteSummary stores a session summary
+func (ms *MemorySink) WriteSummary(summary SessionSummary) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.summaries = append(ms.summaries, summary)
+	return nil
+}
+
+// WriteRollup stores a rollup, replacing a retried one of the same window
+func (ms *MemorySink) WriteRollup(rollup Rollup) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i := range ms.rollups {
+		if ms.rollups[i].WindowStart.Equal(rollup.WindowStart) {
+			ms.rollups[i] = rollup
+			return nil
+		}
+	}
+	ms.rollups = append(ms.rollups, rollup)
+	return nil
+}
+
+// WriteProfile stores a user profile
+func (ms *MemorySink) WriteProfile(profile UserProfile) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.profiles = append(ms.profiles, profile)
+	return nil
+}
+
+// WriteRetention stores a retention table
+func (ms *MemorySink) WriteRetention(table RetentionTable) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.retention = append(ms.retention, table)
+	return nil
+}
+
+// Flush is a no-op, writes are applied immediately
+func (ms *MemorySink) Flush() error {
+	return nil
+}
+
+// Stop is a no-op, stored data stays readable after stop
+func (ms *MemorySink) Stop() error {
+	return nil
+}
+
+// Events returns a copy of all stored events
+func (ms *MemorySink) Events() []UserEvent {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	events := make([]UserEvent, len(ms.events))
+	copy(events, ms.events)
+	return events
+}
+
+// Summaries returns a copy of all stored session summaries
+func (ms *MemorySink) Summaries() []SessionSummary {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	summaries := make([]SessionSummary, len(ms.summaries))
+	copy(summaries, ms.summaries)
+	return summaries
+}
+
+// Rollups returns a copy of all stored rollups
+func (ms *MemorySink) Rollups() []Rollup {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	rollups := make([]Rollup, len(ms.rollups))
+	copy(rollups, ms.rollups)
+	return rollups
+}
+
+// Profiles returns a copy of all stored user profiles, one per update
+func (ms *MemorySink) Profiles() []UserProfile {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	profiles := make([]UserProfile, len(ms.profiles))
+	copy(profiles, ms.profiles)
+	return profiles
+}
+
+// RetentionTables returns a copy of all stored retention tables
+func (ms *MemorySink) RetentionTables() []RetentionTable {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tables := make([]RetentionTable, len(ms.retention))
+	copy(tables, ms.retention)
+	return tables
+}
+
+// ReadEvents returns the stored events within [from, to)
+func (ms *MemorySink) ReadEvents(from, to time.Time) ([]UserEvent, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var events []UserEvent
+	for _, event := range ms.events {
+		if inTimeRange(event.Timestamp, from, to) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// ReadSummaries returns the stored summaries of sessions started within [from, to)
+func (ms *MemorySink) ReadSummaries(from, to time.Time) ([]SessionSummary, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var summaries []SessionSummary
+	for _, summary := range ms.summaries {
+		if inTimeRange(summary.StartTime, from, to) {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, nil
+}
+
+// Metrics returns the memory sink metrics
+func (ms *MemorySink) Metrics() SinkMetrics {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return SinkMetrics{
+		Name:             SinkMemory,
+		EventsWritten:    int64(len(ms.events)),
+		SummariesWritten: int64(len(ms.summaries)),
+		RollupsWritten:   int64(len(ms.rollups)),
+		ProfilesWritten:  int64(len(ms.profiles)),
+		RetentionWritten: int64(len(ms.retention)),
+	}
+}
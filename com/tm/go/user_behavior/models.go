@@ -1,6 +1,8 @@
 package user_behavior
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -21,6 +23,29 @@ const (
 	EventCustom       EventType = "custom"
 )
 
+// MaxClientClockSkew is how far in the future a client timestamp may be
+const MaxClientClockSkew = 5 * time.Minute
+
+// knownEventTypes lists the accepted event types
+var knownEventTypes = map[EventType]bool{
+	EventAppOpen:     true,
+	EventAppClose:    true,
+	EventScreenView:  true,
+	EventButtonClick: true,
+	EventTyping:      true,
+	EventSendMessage: true,
+	EventBackToHome:  true,
+	EventScrollStart: true,
+	EventScrollEnd:   true,
+	EventSearch:      true,
+	EventCustom:      true,
+}
+
+// IsValid reports whether the event type is one of the known types
+func (et EventType) IsValid() bool {
+	return knownEventTypes[et]
+}
+
 // UserEvent represents a single user behavior event
 type UserEvent struct {
 	EventID    string                 `json:"event_id"`
@@ -32,6 +57,25 @@ type UserEvent struct {
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// Validate checks that an event has the fields required for tracking
+func (e UserEvent) Validate(now time.Time) error {
+	switch {
+	case e.UserID == "":
+		return fmt.Errorf("%w: missing user_id", ErrInvalidEvent)
+	case e.SessionID == "":
+		return fmt.Errorf("%w: missing session_id", ErrInvalidEvent)
+	case strings.Contains(e.SessionID, splitSessionSeparator):
+		return fmt.Errorf("%w: session_id must not contain %q", ErrInvalidEvent, splitSessionSeparator)
+	case e.EventType == "":
+		return fmt.Errorf("%w: missing event_type", ErrInvalidEvent)
+	case !e.EventType.IsValid():
+		return fmt.Errorf("%w: unknown event_type %q", ErrInvalidEvent, e.EventType)
+	case e.Timestamp.After(now.Add(MaxClientClockSkew)):
+		return fmt.Errorf("%w: timestamp too far in the future", ErrInvalidEvent)
+	}
+	return nil
+}
+
 // Session represents a user session
 type Session struct {
 	SessionID      string      `json:"session_id"`
@@ -42,13 +86,36 @@ type Session struct {
 	EventCount     int         `json:"event_count"`
 	IsActive       bool        `json:"is_active"`
 	Events         []UserEvent `json:"-"` // Not serialized to save memory
+
+	// ParentSessionID is the client session ID of a session started by a
+	// split rule
+	ParentSessionID string `json:"parent_session_id,omitempty"`
+
+	// Platform and App come from the first event's metadata and select
+	// the session's timeout
+	Platform string `json:"platform,omitempty"`
+	App      string `json:"app,omitempty"`
+
+	// EndReason is closed or expired once the session has ended
+	EndReason SessionEventType `json:"end_reason,omitempty"`
 }
 
-// ActionPattern represents a sequence of actions
+// clientSessionID returns the session ID clients and sinks use for a session
+func (s *Session) clientSessionID() string {
+	if s.ParentSessionID != "" {
+		return s.ParentSessionID
+	}
+	return s.SessionID
+}
+
+// ActionPattern represents a sequence of actions, possibly with gaps, and the
+// sessions it occurs in
 type ActionPattern struct {
-	Pattern   []EventType `json:"pattern"`
-	Count     int         `json:"count"`
-	AvgDuration float64   `json:"avg_duration_seconds"`
+	Pattern     []EventType `json:"pattern"`
+	Count       int         `json:"count"`
+	AvgDuration float64     `json:"avg_duration_seconds"`
+	Sessions    int         `json:"sessions"`
+	Coverage    float64     `json:"coverage"` // percent of the sessions mined
 }
 
 // ActionStats represents statistics for a specific action type
@@ -81,14 +148,18 @@ type RepeatedActionPattern struct {
 
 // SessionSummary for BigQuery aggregation
 type SessionSummary struct {
-	SessionID      string            `json:"session_id"`
-	UserID         string            `json:"user_id"`
-	StartTime      time.Time         `json:"start_time"`
-	EndTime        time.Time         `json:"end_time"`
-	Duration       int64             `json:"duration_seconds"`
-	EventCount     int               `json:"event_count"`
-	UniqueScreens  int               `json:"unique_screens"`
-	ActionCounts   map[EventType]int `json:"action_counts"`
-	HasAnomaly     bool              `json:"has_anomaly"`
-	AnomalyTypes   []string          `json:"anomaly_types"`
+	SessionID     string            `json:"session_id"`
+	UserID        string            `json:"user_id"`
+	StartTime     time.Time         `json:"start_time"`
+	EndTime       time.Time         `json:"end_time"`
+	Duration      int64             `json:"duration_seconds"`
+	EventCount    int               `json:"event_count"`
+	UniqueScreens int               `json:"unique_screens"`
+	ActionCounts  map[EventType]int `json:"action_counts"`
+	HasAnomaly    bool              `json:"has_anomaly"`
+	AnomalyTypes  []string          `json:"anomaly_types"`
+
+	// AnomalySeverities holds the severity each anomaly was detected with,
+	// in the order of AnomalyTypes
+	AnomalySeverities []string `json:"anomaly_severities,omitempty"`
 }
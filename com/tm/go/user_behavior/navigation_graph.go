@@ -0,0 +1,391 @@
+package user_behavior
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTopPaths is the number of paths a navigation graph reports by default
+const DefaultTopPaths = 10
+
+// NavigationOptions tunes the paths reported with a navigation graph
+type NavigationOptions struct {
+	// TopPaths is the number of most common paths and loops kept.
+	// Defaults to DefaultTopPaths.
+	TopPaths int
+
+	// PathLength counts every run of PathLength consecutive screens as a
+	// path; 0 counts each session's whole path
+	PathLength int
+}
+
+// withDefaults fills unset fields
+func (o NavigationOptions) withDefaults() NavigationOptions {
+	if o.TopPaths <= 0 {
+		o.TopPaths = DefaultTopPaths
+	}
+	if o.PathLength < 0 {
+		o.PathLength = 0
+	}
+	return o
+}
+
+// NavigationGraph is the weighted directed graph of screen to screen
+// transitions of one session or many
+type NavigationGraph struct {
+	SessionID string     `json:"session_id,omitempty"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+
+	// Sessions is the number of sessions with at least one screen
+	Sessions int              `json:"sessions"`
+	Nodes    []NavigationNode `json:"nodes"`
+	Edges    []NavigationEdge `json:"edges"`
+	Entries  []ScreenCount    `json:"entries"`
+	Exits    []ScreenCount    `json:"exits"`
+	Paths    []NavigationPath `json:"paths"`
+	Loops    []NavigationPath `json:"loops"`
+}
+
+// NavigationNode is a screen and how often it was visited. Consecutive
+// events on the same screen count as one visit.
+type NavigationNode struct {
+	Screen   string `json:"screen"`
+	Visits   int    `json:"visits"`
+	Sessions int    `json:"sessions"`
+	Entries  int    `json:"entries"`
+	Exits    int    `json:"exits"`
+}
+
+// NavigationEdge is a transition between two screens. AvgSeconds is the mean
+// time from arriving on From to arriving on To.
+type NavigationEdge struct {
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	Count      int     `json:"count"`
+	Sessions   int     `json:"sessions"`
+	AvgSeconds float64 `json:"avg_seconds"`
+}
+
+// ScreenCount is the number of sessions entering or exiting on a screen
+type ScreenCount struct {
+	Screen string `json:"screen"`
+	Count  int    `json:"count"`
+}
+
+// NavigationPath is a sequence of screens with the number of times and
+// sessions it occurred in. A loop starts and ends on the same screen.
+type NavigationPath struct {
+	Screens  []string `json:"screens"`
+	Count    int      `json:"count"`
+	Sessions int      `json:"sessions"`
+}
+
+// screenVisit is one visit of a screen, from the first of its consecutive
+// events
+type screenVisit struct {
+	screen  string
+	arrived time.Time
+}
+
+// screenVisits returns the screens a session's events ordered by time went
+// through, skipping events without a screen name
+func screenVisits(events []UserEvent) []screenVisit {
+	var visits []screenVisit
+	for _, event := range events {
+		if event.ScreenName == "" {
+			continue
+		}
+		if len(visits) > 0 && visits[len(visits)-1].screen == event.ScreenName {
+			continue
+		}
+		visits = append(visits, screenVisit{screen: event.ScreenName, arrived: event.Timestamp})
+	}
+	return visits
+}
+
+// navigationBuilder accumulates the visits of sessions into a graph
+type navigationBuilder struct {
+	options  NavigationOptions
+	sessions int
+	nodes    map[string]*NavigationNode
+	edges    map[[2]string]*navigationEdgeStats
+	paths    map[string]*NavigationPath
+	loops    map[string]*NavigationPath
+}
+
+// navigationEdgeStats is an edge with the total time of its transitions
+type navigationEdgeStats struct {
+	NavigationEdge
+	total time.Duration
+}
+
+// newNavigationBuilder creates an empty builder
+func newNavigationBuilder(options NavigationOptions) *navigationBuilder {
+	return &navigationBuilder{
+		options: options.withDefaults(),
+		nodes:   make(map[string]*NavigationNode),
+		edges:   make(map[[2]string]*navigationEdgeStats),
+		paths:   make(map[string]*NavigationPath),
+		loops:   make(map[string]*NavigationPath),
+	}
+}
+
+// add adds the events of one session ordered by time
+func (nb *navigationBuilder) add(events []UserEvent) {
+	visits := screenVisits(events)
+	if len(visits) == 0 {
+		return
+	}
+	nb.sessions++
+
+	screens := make([]string, len(visits))
+	seenNodes := make(map[string]bool)
+	seenEdges := make(map[[2]string]bool)
+	for i, visit := range visits {
+		screens[i] = visit.screen
+
+		node := nb.node(visit.screen)
+		node.Visits++
+		if !seenNodes[visit.screen] {
+			seenNodes[visit.screen] = true
+			node.Sessions++
+		}
+
+		if i == 0 {
+			continue
+		}
+		key := [2]string{visits[i-1].screen, visit.screen}
+		edge, ok := nb.edges[key]
+		if !ok {
+			edge = &navigationEdgeStats{NavigationEdge: NavigationEdge{From: key[0], To: key[1]}}
+			nb.edges[key] = edge
+		}
+		edge.Count++
+		edge.total += visit.arrived.Sub(visits[i-1].arrived)
+		if !seenEdges[key] {
+			seenEdges[key] = true
+			edge.Sessions++
+		}
+	}
+
+	nb.node(screens[0]).Entries++
+	nb.node(screens[len(screens)-1]).Exits++
+
+	seenPaths := make(map[string]bool)
+	if nb.options.PathLength == 0 || len(screens) <= nb.options.PathLength {
+		countPath(nb.paths, seenPaths, screens)
+	} else {
+		for i := 0; i+nb.options.PathLength <= len(screens); i++ {
+			countPath(nb.paths, seenPaths, screens[i:i+nb.options.PathLength])
+		}
+	}
+
+	// A loop runs from a screen back to its previous visit of the same screen
+	seenLoops := make(map[string]bool)
+	lastVisit := make(map[string]int)
+	for i, screen := range screens {
+		if previous, ok := lastVisit[screen]; ok {
+			countPath(nb.loops, seenLoops, screens[previous:i+1])
+		}
+		lastVisit[screen] = i
+	}
+}
+
+// node returns the node of a screen, creating it when missing
+func (nb *navigationBuilder) node(screen string) *NavigationNode {
+	node, ok := nb.nodes[screen]
+	if !ok {
+		node = &NavigationNode{Screen: screen}
+		nb.nodes[screen] = node
+	}
+	return node
+}
+
+// countPath counts one occurrence of a path, and its session the first time
+// the session has it
+func countPath(paths map[string]*NavigationPath, seen map[string]bool, screens []string) {
+	key := strings.Join(screens, "\x00")
+	path, ok := paths[key]
+	if !ok {
+		path = &NavigationPath{Screens: append([]string(nil), screens...)}
+		paths[key] = path
+	}
+	path.Count++
+	if !seen[key] {
+		seen[key] = true
+		path.Sessions++
+	}
+}
+
+// graph returns the accumulated graph sorted by weight
+func (nb *navigationBuilder) graph() *NavigationGraph {
+	g := &NavigationGraph{
+		Sessions: nb.sessions,
+		Nodes:    make([]NavigationNode, 0, len(nb.nodes)),
+		Edges:    make([]NavigationEdge, 0, len(nb.edges)),
+		Entries:  []ScreenCount{},
+		Exits:    []ScreenCount{},
+		Paths:    topPaths(nb.paths, nb.options.TopPaths),
+		Loops:    topPaths(nb.loops, nb.options.TopPaths),
+	}
+
+	for _, node := range nb.nodes {
+		g.Nodes = append(g.Nodes, *node)
+		if node.Entries > 0 {
+			g.Entries = append(g.Entries, ScreenCount{Screen: node.Screen, Count: node.Entries})
+		}
+		if node.Exits > 0 {
+			g.Exits = append(g.Exits, ScreenCount{Screen: node.Screen, Count: node.Exits})
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Visits != g.Nodes[j].Visits {
+			return g.Nodes[i].Visits > g.Nodes[j].Visits
+		}
+		return g.Nodes[i].Screen < g.Nodes[j].Screen
+	})
+	sortScreenCounts(g.Entries)
+	sortScreenCounts(g.Exits)
+
+	for _, edge := range nb.edges {
+		e := edge.NavigationEdge
+		e.AvgSeconds = (edge.total / time.Duration(edge.Count)).Seconds()
+		g.Edges = append(g.Edges, e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+
+	return g
+}
+
+// sortScreenCounts orders screens by count, then name
+func sortScreenCounts(counts []ScreenCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Screen < counts[j].Screen
+	})
+}
+
+// topPaths returns the n most frequent paths
+func topPaths(paths map[string]*NavigationPath, n int) []NavigationPath {
+	sorted := make([]NavigationPath, 0, len(paths))
+	for _, path := range paths {
+		sorted = append(sorted, *path)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		return strings.Join(a.Screens, "\x00") < strings.Join(b.Screens, "\x00")
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// DOT renders the graph in Graphviz DOT. Edge width follows the transition
+// count, and entry and exit counts hang off start and end points.
+func (g *NavigationGraph) DOT() string {
+	var b strings.Builder
+
+	name := "navigation"
+	if g.SessionID != "" {
+		name = "navigation " + g.SessionID
+	}
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(name))
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=rounded];\n")
+	b.WriteString("  \"__entry\" [shape=circle, label=\"start\"];\n")
+	b.WriteString("  \"__exit\" [shape=doublecircle, label=\"end\"];\n")
+
+	for _, node := range g.Nodes {
+		fmt.Fprintf(&b, "  %s [label=%s];\n",
+			dotQuote("screen:"+node.Screen),
+			dotQuote(fmt.Sprintf("%s\n%d visits", node.Screen, node.Visits)))
+	}
+
+	maxCount := 1
+	for _, edge := range g.Edges {
+		if edge.Count > maxCount {
+			maxCount = edge.Count
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "  %s -> %s [label=%s, penwidth=%.1f];\n",
+			dotQuote("screen:"+edge.From),
+			dotQuote("screen:"+edge.To),
+			dotQuote(fmt.Sprintf("%d (%.1fs)", edge.Count, edge.AvgSeconds)),
+			1+4*float64(edge.Count)/float64(maxCount))
+	}
+
+	for _, entry := range g.Entries {
+		fmt.Fprintf(&b, "  \"__entry\" -> %s [label=\"%d\", style=dashed];\n", dotQuote("screen:"+entry.Screen), entry.Count)
+	}
+	for _, exit := range g.Exits {
+		fmt.Fprintf(&b, "  %s -> \"__exit\" [label=\"%d\", style=dashed];\n", dotQuote("screen:"+exit.Screen), exit.Count)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotQuote quotes a DOT identifier or label
+func dotQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
+
+// SessionNavigation builds the navigation graph of one session
+func (ba *BehaviorAnalyzer) SessionNavigation(sessionID string, options NavigationOptions) (*NavigationGraph, error) {
+	events, err := ba.store.GetSessionEvents(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := newNavigationBuilder(options)
+	builder.add(events)
+
+	g := builder.graph()
+	g.SessionID = sessionID
+	return g, nil
+}
+
+// NavigationGraph builds the navigation graph of every session with events
+// within [from, to)
+func (ba *BehaviorAnalyzer) NavigationGraph(from, to time.Time, options NavigationOptions) (*NavigationGraph, error) {
+	events, err := ba.scanEvents(nil, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := newNavigationBuilder(options)
+	for _, sessionEvents := range groupEvents(events, false) {
+		builder.add(sessionEvents)
+	}
+
+	g := builder.graph()
+	g.From = &from
+	g.To = &to
+	return g, nil
+}
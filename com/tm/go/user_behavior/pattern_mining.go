@@ -0,0 +1,312 @@
+package user_behavior
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultPatternMinSupport  = 0.05
+	DefaultPatternMinSessions = 2
+	DefaultPatternMinLength   = 2
+	DefaultPatternMaxLength   = 5
+	DefaultPatternMaxGap      = 2
+	DefaultPatternLimit       = 50
+
+	// MaxPatternLength bounds the depth of the search
+	MaxPatternLength = 20
+)
+
+// PatternQuery selects the sessions action patterns are mined from: one
+// session, a user's sessions within [From, To), or every session within
+// [From, To)
+type PatternQuery struct {
+	SessionID string
+	UserID    string
+	From      time.Time
+	To        time.Time
+
+	// EventTypes restricts mining to these event types, others are skipped
+	// as if they did not happen. Every type when empty.
+	EventTypes []EventType
+
+	// A pattern is reported when it occurs in at least MinSupport of the
+	// sessions, as a fraction, and in at least MinSessions sessions, capped
+	// at the number of sessions
+	MinSupport  float64
+	MinSessions int
+
+	// MinCount is the minimum number of occurrences of a pattern
+	MinCount int
+
+	// MinLength and MaxLength bound the number of actions of a pattern.
+	// Default to DefaultPatternMinLength and DefaultPatternMaxLength.
+	MinLength int
+	MaxLength int
+
+	// MaxGap is the number of other actions allowed between two actions of
+	// a pattern, 0 for contiguous patterns. Negative uses
+	// DefaultPatternMaxGap. MaxGapTime also bounds the time between them
+	// when set.
+	MaxGap     int
+	MaxGapTime time.Duration
+
+	// Limit is the number of patterns reported, DefaultPatternLimit by default
+	Limit int
+}
+
+// withDefaults fills unset fields and checks the bounds
+func (q PatternQuery) withDefaults() (PatternQuery, error) {
+	if q.MinSupport < 0 || q.MinSupport > 1 {
+		return q, fmt.Errorf("%w: min support must be within [0, 1]", ErrInvalidPattern)
+	}
+	if q.MinSupport == 0 {
+		q.MinSupport = DefaultPatternMinSupport
+	}
+	if q.MinSessions <= 0 {
+		q.MinSessions = DefaultPatternMinSessions
+	}
+	if q.MinLength <= 0 {
+		q.MinLength = DefaultPatternMinLength
+	}
+	if q.MaxLength <= 0 {
+		q.MaxLength = DefaultPatternMaxLength
+	}
+	if q.MaxGap < 0 {
+		q.MaxGap = DefaultPatternMaxGap
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPatternLimit
+	}
+
+	if q.MaxLength > MaxPatternLength {
+		return q, fmt.Errorf("%w: max length must be at most %d", ErrInvalidPattern, MaxPatternLength)
+	}
+	if q.MinLength > q.MaxLength {
+		return q, fmt.Errorf("%w: min length %d is over max length %d", ErrInvalidPattern, q.MinLength, q.MaxLength)
+	}
+	if q.MaxGapTime < 0 {
+		return q, fmt.Errorf("%w: max gap time must not be negative", ErrInvalidPattern)
+	}
+	return q, nil
+}
+
+// PatternReport holds the frequent action patterns of a set of sessions,
+// most common first
+type PatternReport struct {
+	SessionID string     `json:"session_id,omitempty"`
+	UserID    string     `json:"user_id,omitempty"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+
+	// Sessions is the number of sessions mined, MinSessions the number a
+	// pattern had to occur in
+	Sessions    int             `json:"sessions"`
+	MinSessions int             `json:"min_sessions"`
+	Patterns    []ActionPattern `json:"patterns"`
+}
+
+// patternState is an occurrence of a pattern in a session: the positions of
+// its first and last actions. Only the latest start is kept for an end, the
+// shortest occurrence.
+type patternState struct {
+	start int
+	end   int
+}
+
+// patternProjection is the occurrences of a pattern in one session
+type patternProjection struct {
+	session int
+	states  []patternState
+}
+
+// patternMiner grows frequent patterns PrefixSpan style: each pattern is
+// extended only within the sessions it occurs in, from the positions its
+// occurrences end at
+type patternMiner struct {
+	query       PatternQuery
+	sessions    [][]UserEvent
+	minSessions int
+	patterns    []ActionPattern
+}
+
+// minePatterns returns the frequent patterns of the sessions' events, each
+// session ordered by time
+func minePatterns(query PatternQuery, sessions [][]UserEvent) *PatternReport {
+	minSessions := int(math.Ceil(query.MinSupport * float64(len(sessions))))
+	if query.MinSessions > minSessions {
+		minSessions = query.MinSessions
+	}
+	if minSessions > len(sessions) {
+		minSessions = len(sessions)
+	}
+	if minSessions < 1 {
+		minSessions = 1
+	}
+
+	pm := &patternMiner{query: query, sessions: sessions, minSessions: minSessions}
+
+	// Patterns of one action occur at every position of their type
+	first := make(map[EventType][]patternProjection)
+	for s, events := range sessions {
+		positions := make(map[EventType][]patternState)
+		for i, event := range events {
+			positions[event.EventType] = append(positions[event.EventType], patternState{start: i, end: i})
+		}
+		for eventType, states := range positions {
+			first[eventType] = append(first[eventType], patternProjection{session: s, states: states})
+		}
+	}
+	pm.growAll(nil, first)
+
+	sort.Slice(pm.patterns, func(i, j int) bool {
+		a, b := pm.patterns[i], pm.patterns[j]
+		if a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if len(a.Pattern) != len(b.Pattern) {
+			return len(a.Pattern) > len(b.Pattern)
+		}
+		return patternKey(a.Pattern) < patternKey(b.Pattern)
+	})
+	if len(pm.patterns) > query.Limit {
+		pm.patterns = pm.patterns[:query.Limit]
+	}
+
+	return &PatternReport{
+		Sessions:    len(sessions),
+		MinSessions: minSessions,
+		Patterns:    pm.patterns,
+	}
+}
+
+// growAll grows the extensions of prefix that occur in enough sessions, in
+// event type order so results are stable
+func (pm *patternMiner) growAll(prefix []EventType, extensions map[EventType][]patternProjection) {
+	eventTypes := make([]EventType, 0, len(extensions))
+	for eventType, projections := range extensions {
+		if len(projections) >= pm.minSessions {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	sort.Slice(eventTypes, func(i, j int) bool { return eventTypes[i] < eventTypes[j] })
+
+	for _, eventType := range eventTypes {
+		pattern := make([]EventType, len(prefix)+1)
+		copy(pattern, prefix)
+		pattern[len(prefix)] = eventType
+		pm.grow(pattern, extensions[eventType])
+	}
+}
+
+// grow reports a frequent pattern and grows it by one action
+func (pm *patternMiner) grow(pattern []EventType, projections []patternProjection) {
+	if len(pattern) >= pm.query.MinLength {
+		pm.report(pattern, projections)
+	}
+	if len(pattern) >= pm.query.MaxLength {
+		return
+	}
+
+	extensions := make(map[EventType][]patternProjection)
+	for _, projection := range projections {
+		events := pm.sessions[projection.session]
+
+		// Latest start per event type and end position, so the shortest
+		// occurrence ending there is kept
+		starts := make(map[EventType]map[int]int)
+		for _, state := range projection.states {
+			for k := state.end + 1; k < len(events) && k <= state.end+pm.query.MaxGap+1; k++ {
+				if pm.query.MaxGapTime > 0 && events[k].Timestamp.Sub(events[state.end].Timestamp) > pm.query.MaxGapTime {
+					break
+				}
+				eventType := events[k].EventType
+				if starts[eventType] == nil {
+					starts[eventType] = make(map[int]int)
+				}
+				if start, ok := starts[eventType][k]; !ok || state.start > start {
+					starts[eventType][k] = state.start
+				}
+			}
+		}
+
+		for eventType, ends := range starts {
+			states := make([]patternState, 0, len(ends))
+			for end, start := range ends {
+				states = append(states, patternState{start: start, end: end})
+			}
+			sort.Slice(states, func(i, j int) bool { return states[i].end < states[j].end })
+			extensions[eventType] = append(extensions[eventType], patternProjection{session: projection.session, states: states})
+		}
+	}
+
+	pm.growAll(pattern, extensions)
+}
+
+// report adds a pattern occurring often enough. Count is the number of
+// positions an occurrence ends at and AvgDuration the mean time of the
+// shortest occurrence ending at each.
+func (pm *patternMiner) report(pattern []EventType, projections []patternProjection) {
+	count := 0
+	var total time.Duration
+	for _, projection := range projections {
+		events := pm.sessions[projection.session]
+		for _, state := range projection.states {
+			count++
+			total += events[state.end].Timestamp.Sub(events[state.start].Timestamp)
+		}
+	}
+	if count < pm.query.MinCount {
+		return
+	}
+
+	pm.patterns = append(pm.patterns, ActionPattern{
+		Pattern:     pattern,
+		Count:       count,
+		AvgDuration: total.Seconds() / float64(count),
+		Sessions:    len(projections),
+		Coverage:    float64(len(projections)) / float64(len(pm.sessions)) * 100,
+	})
+}
+
+// filterEventTypes keeps the events of the given types, every event when
+// none are given
+func filterEventTypes(events []UserEvent, eventTypes []EventType) []UserEvent {
+	if len(eventTypes) == 0 {
+		return events
+	}
+
+	keep := make(map[EventType]bool, len(eventTypes))
+	for _, eventType := range eventTypes {
+		keep[eventType] = true
+	}
+	filtered := make([]UserEvent, 0, len(events))
+	for _, event := range events {
+		if keep[event.EventType] {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// patternSessions groups events by session into a stable order, dropping
+// empty sessions
+func patternSessions(events []UserEvent) [][]UserEvent {
+	groups := groupEvents(events, false)
+	sessionIDs := make([]string, 0, len(groups))
+	for sessionID := range groups {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	sort.Strings(sessionIDs)
+
+	sessions := make([][]UserEvent, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		sessions = append(sessions, groups[sessionID])
+	}
+	return sessions
+}
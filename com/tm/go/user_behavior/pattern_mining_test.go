@@ -0,0 +1,229 @@
+package user_behavior
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// patternSession builds the events of a session one second apart
+func patternSession(t0 time.Time, eventTypes ...EventType) []UserEvent {
+	events := make([]UserEvent, len(eventTypes))
+	for i, eventType := range eventTypes {
+		events[i] = UserEvent{EventType: eventType, Timestamp: t0.Add(time.Duration(i) * time.Second)}
+	}
+	return events
+}
+
+func TestMinePatterns(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	view, click, send, typing := EventScreenView, EventButtonClick, EventSendMessage, EventTyping
+	sessions := [][]UserEvent{
+		patternSession(t0, view, click, send),
+		patternSession(t0, view, typing, click, send),
+		patternSession(t0, view, click),
+	}
+
+	type wantPattern struct {
+		pattern  []EventType
+		sessions int
+		count    int
+	}
+
+	tests := []struct {
+		name            string
+		query           PatternQuery
+		sessions        [][]UserEvent
+		wantMinSessions int
+		want            []wantPattern
+	}{
+		{
+			name:            "gapped patterns",
+			query:           PatternQuery{MaxGap: -1},
+			sessions:        sessions,
+			wantMinSessions: 2,
+			want: []wantPattern{
+				{[]EventType{view, click}, 3, 3},
+				{[]EventType{view, click, send}, 2, 2},
+				{[]EventType{click, send}, 2, 2},
+				{[]EventType{view, send}, 2, 2},
+			},
+		},
+		{
+			name:            "contiguous patterns",
+			query:           PatternQuery{MaxGap: 0},
+			sessions:        sessions,
+			wantMinSessions: 2,
+			want: []wantPattern{
+				{[]EventType{click, send}, 2, 2},
+				{[]EventType{view, click}, 2, 2},
+			},
+		},
+		{
+			name:            "max gap time",
+			query:           PatternQuery{MaxGap: 2, MaxGapTime: time.Second},
+			sessions:        sessions,
+			wantMinSessions: 2,
+			want: []wantPattern{
+				{[]EventType{click, send}, 2, 2},
+				{[]EventType{view, click}, 2, 2},
+			},
+		},
+		{
+			name:            "min support over min sessions",
+			query:           PatternQuery{MaxGap: -1, MinSupport: 1},
+			sessions:        sessions,
+			wantMinSessions: 3,
+			want: []wantPattern{
+				{[]EventType{view, click}, 3, 3},
+			},
+		},
+		{
+			name:            "min sessions capped at the sessions mined",
+			query:           PatternQuery{MaxGap: -1, MinSessions: 10, MinLength: 3},
+			sessions:        sessions[:1],
+			wantMinSessions: 1,
+			want: []wantPattern{
+				{[]EventType{view, click, send}, 1, 1},
+			},
+		},
+		{
+			name:            "repeated occurrences and min count",
+			query:           PatternQuery{MaxGap: 0, MinCount: 2, MaxLength: 2},
+			sessions:        [][]UserEvent{patternSession(t0, typing, send, typing, send), patternSession(t0, typing, send)},
+			wantMinSessions: 2,
+			want: []wantPattern{
+				{[]EventType{typing, send}, 2, 3},
+			},
+		},
+		{
+			name:            "limit",
+			query:           PatternQuery{MaxGap: -1, Limit: 2},
+			sessions:        sessions,
+			wantMinSessions: 2,
+			want: []wantPattern{
+				{[]EventType{view, click}, 3, 3},
+				{[]EventType{view, click, send}, 2, 2},
+			},
+		},
+		{
+			name:            "no sessions",
+			query:           PatternQuery{MaxGap: -1},
+			wantMinSessions: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := tt.query.withDefaults()
+			if err != nil {
+				t.Fatalf("withDefaults() error = %v", err)
+			}
+
+			report := minePatterns(query, tt.sessions)
+			if report.Sessions != len(tt.sessions) || report.MinSessions != tt.wantMinSessions {
+				t.Errorf("Sessions, MinSessions = %d, %d, want %d, %d",
+					report.Sessions, report.MinSessions, len(tt.sessions), tt.wantMinSessions)
+			}
+			if len(report.Patterns) != len(tt.want) {
+				t.Fatalf("got %d patterns %+v, want %d", len(report.Patterns), report.Patterns, len(tt.want))
+			}
+
+			for i, pattern := range report.Patterns {
+				want := tt.want[i]
+				if patternKey(pattern.Pattern) != patternKey(want.pattern) || pattern.Sessions != want.sessions || pattern.Count != want.count {
+					t.Errorf("pattern %d = %s in %d sessions %d times, want %s in %d sessions %d times",
+						i, patternKey(pattern.Pattern), pattern.Sessions, pattern.Count,
+						patternKey(want.pattern), want.sessions, want.count)
+				}
+				wantCoverage := float64(want.sessions) / float64(len(tt.sessions)) * 100
+				if math.Abs(pattern.Coverage-wantCoverage) > 1e-9 {
+					t.Errorf("pattern %d Coverage = %v, want %v", i, pattern.Coverage, wantCoverage)
+				}
+			}
+		})
+	}
+}
+
+func TestMinePatternsAvgDuration(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	sessions := [][]UserEvent{
+		patternSession(t0, EventScreenView, EventButtonClick),
+		patternSession(t0, EventScreenView, EventTyping, EventTyping, EventButtonClick),
+	}
+
+	query, err := PatternQuery{MaxGap: -1, MaxLength: 2}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults() error = %v", err)
+	}
+
+	for _, pattern := range minePatterns(query, sessions).Patterns {
+		if patternKey(pattern.Pattern) == patternKey([]EventType{EventScreenView, EventButtonClick}) {
+			if pattern.AvgDuration != 2 {
+				t.Errorf("AvgDuration = %v, want 2", pattern.AvgDuration)
+			}
+			return
+		}
+	}
+	t.Fatal("screen_view->button_click not mined")
+}
+
+func TestPatternQueryWithDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   PatternQuery
+		want    PatternQuery
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: PatternQuery{MaxGap: -1},
+			want: PatternQuery{
+				MinSupport:  DefaultPatternMinSupport,
+				MinSessions: DefaultPatternMinSessions,
+				MinLength:   DefaultPatternMinLength,
+				MaxLength:   DefaultPatternMaxLength,
+				MaxGap:      DefaultPatternMaxGap,
+				Limit:       DefaultPatternLimit,
+			},
+		},
+		{
+			name:  "contiguous kept",
+			query: PatternQuery{MinSupport: 0.5, MinLength: 3, MaxLength: 3, Limit: 5},
+			want: PatternQuery{
+				MinSupport:  0.5,
+				MinSessions: DefaultPatternMinSessions,
+				MinLength:   3,
+				MaxLength:   3,
+				Limit:       5,
+			},
+		},
+		{name: "min support over 1", query: PatternQuery{MinSupport: 1.5}, wantErr: true},
+		{name: "negative min support", query: PatternQuery{MinSupport: -0.1}, wantErr: true},
+		{name: "max length over the bound", query: PatternQuery{MaxLength: MaxPatternLength + 1}, wantErr: true},
+		{name: "min length over max length", query: PatternQuery{MinLength: 4, MaxLength: 3}, wantErr: true},
+		{name: "negative max gap time", query: PatternQuery{MaxGapTime: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.query.withDefaults()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPattern) {
+					t.Fatalf("withDefaults() error = %v, want %v", err, ErrInvalidPattern)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("withDefaults() error = %v", err)
+			}
+
+			if got.MinSupport != tt.want.MinSupport || got.MinSessions != tt.want.MinSessions ||
+				got.MinLength != tt.want.MinLength || got.MaxLength != tt.want.MaxLength ||
+				got.MaxGap != tt.want.MaxGap || got.Limit != tt.want.Limit {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package user_behavior
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Retry defaults for transient write errors
+	DefaultRetryMaxAttempts    = 5
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryMultiplier     = 2.0
+	DefaultRetryJitter         = 0.2
+)
+
+// RetryPolicy configures exponential backoff with jitter
+type RetryPolicy struct {
+	// MaxAttempts includes the first try; 1 disables retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter randomizes each backoff by +/- this fraction (0 to 1)
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the default retry policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		Multiplier:     DefaultRetryMultiplier,
+		Jitter:         DefaultRetryJitter,
+	}
+}
+
+// withDefaults fills zero fields from DefaultRetryPolicy
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	defaults := DefaultRetryPolicy()
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = defaults.MaxAttempts
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = defaults.InitialBackoff
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = defaults.MaxBackoff
+	}
+	if rp.Multiplier < 1 {
+		rp.Multiplier = defaults.Multiplier
+	}
+	if rp.Jitter < 0 || rp.Jitter > 1 {
+		rp.Jitter = defaults.Jitter
+	}
+	return rp
+}
+
+// Backoff returns the wait before retry number attempt (1 is the first retry)
+func (rp RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(rp.InitialBackoff) * math.Pow(rp.Multiplier, float64(attempt-1))
+	if backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+
+	if rp.Jitter > 0 {
+		backoff *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(backoff)
+}
+
+// Do runs fn until it succeeds, returns a permanent error or runs out of
+// attempts. It returns the number of attempts made and the last error.
+func (rp RetryPolicy) Do(ctx context.Context, fn func() error) (int, error) {
+	var err error
+
+	for attempt := 1; attempt <= rp.MaxAttempts; attempt++ {
+		if err = fn(); err == nil || !isRetryable(err) {
+			return attempt, err
+		}
+
+		if attempt == rp.MaxAttempts {
+			break
+		}
+
+		timer := time.NewTimer(rp.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		}
+	}
+
+	return rp.MaxAttempts, err
+}
+
+// permanentError marks an error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so RetryPolicy.Do does not retry it
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isRetryable reports whether an error is worth retrying
+func isRetryable(err error) bool {
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
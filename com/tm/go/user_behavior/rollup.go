@@ -0,0 +1,414 @@
+package user_behavior
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRollupWatermarkFile keeps the rollup watermark when
+	// EventCollectorConfig.RollupWatermarkPath is not set
+	DefaultRollupWatermarkFile = "user_behavior_rollup_watermark.json"
+)
+
+// Rollup holds the aggregates of one aggregation interval window
+type Rollup struct {
+	WindowStart     time.Time           `json:"window_start"`
+	WindowEnd       time.Time           `json:"window_end"`
+	ActiveUsers     int64               `json:"active_users"`
+	SessionsStarted int64               `json:"sessions_started"`
+	SessionsEnded   int64               `json:"sessions_ended"`
+	EventCounts     map[EventType]int64 `json:"event_counts"`
+	ScreenViews     map[string]int64    `json:"screen_views"`
+
+	// AvgSessionDuration is the mean duration in seconds of the sessions
+	// ended within the window
+	AvgSessionDuration float64 `json:"avg_session_duration_seconds"`
+}
+
+// rollupWindow counts the events of a window that is still open
+type rollupWindow struct {
+	users       map[string]bool
+	eventCounts map[EventType]int64
+	screenViews map[string]int64
+}
+
+// newRollupWindow returns an empty window
+func newRollupWindow() *rollupWindow {
+	return &rollupWindow{
+		users:       make(map[string]bool),
+		eventCounts: make(map[EventType]int64),
+		screenViews: make(map[string]int64),
+	}
+}
+
+// rollupAccumulator counts events into interval windows until they are
+// rolled up. Windows starting before the watermark have been emitted and
+// never take events again.
+type rollupAccumulator struct {
+	interval      time.Duration
+	watermarkPath string
+	watermark     time.Time
+	closing       time.Time // windows before it are being written
+	loaded        bool
+	windows       map[int64]*rollupWindow // keyed by window start in unix nanos
+	written       map[string]time.Time    // sink name -> end of the windows written to it
+	saved         rollupState             // last persisted state
+	lateEvents    int64
+	mu            sync.Mutex
+}
+
+// rollupWindowState is the persisted form of an open window
+type rollupWindowState struct {
+	Users       []string            `json:"users"`
+	EventCounts map[EventType]int64 `json:"event_counts"`
+	ScreenViews map[string]int64    `json:"screen_views"`
+}
+
+// rollupState is the persisted watermark and the open windows as they were
+// once the events below Offset in the write-ahead log were counted. Sinks
+// holds how far past the watermark each sink has been written.
+type rollupState struct {
+	Watermark time.Time                    `json:"watermark"`
+	Offset    uint64                       `json:"offset,omitempty"`
+	Windows   map[int64]*rollupWindowState `json:"windows,omitempty"`
+	Sinks     map[string]time.Time         `json:"sinks,omitempty"`
+}
+
+// newRollupAccumulator creates an accumulator persisting its watermark to path
+func newRollupAccumulator(interval time.Duration, watermarkPath string) *rollupAccumulator {
+	if watermarkPath == "" {
+		watermarkPath = DefaultRollupWatermarkFile
+	}
+
+	return &rollupAccumulator{
+		interval:      interval,
+		watermarkPath: watermarkPath,
+		windows:       make(map[int64]*rollupWindow),
+		written:       make(map[string]time.Time),
+	}
+}
+
+// observe counts an event into its window; events of emitted windows are
+// dropped as late
+func (ra *rollupAccumulator) observe(event UserEvent) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if !ra.addLocked(event) {
+		ra.lateEvents++
+	}
+}
+
+// replay counts an event read back from the write-ahead log; events of
+// emitted windows are expected there and skipped
+func (ra *rollupAccumulator) replay(event UserEvent) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.addLocked(event)
+}
+
+// addLocked counts an event into its window, false when the window is
+// emitted or being written; caller must hold ra.mu
+func (ra *rollupAccumulator) addLocked(event UserEvent) bool {
+	start := event.Timestamp.Truncate(ra.interval)
+	if start.Before(ra.closing) {
+		return false
+	}
+
+	window, exists := ra.windows[start.UnixNano()]
+	if !exists {
+		window = newRollupWindow()
+		ra.windows[start.UnixNano()] = window
+	}
+
+	window.users[event.UserID] = true
+	window.eventCounts[event.EventType]++
+	if event.EventType == EventScreenView && event.ScreenName != "" {
+		window.screenViews[event.ScreenName]++
+	}
+	return true
+}
+
+// load reads the persisted state once: the watermark and the windows that
+// were open. Without a watermark file rollups start at the first window
+// that can still receive sessions and events, grace before now. It returns
+// the write-ahead log offset the windows count events up to.
+func (ra *rollupAccumulator) load(now time.Time, grace time.Duration) (uint64, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.loaded {
+		return ra.saved.Offset, nil
+	}
+
+	data, err := os.ReadFile(ra.watermarkPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		ra.saved = rollupState{Watermark: now.Add(-grace).Truncate(ra.interval)}
+	case err != nil:
+		return 0, fmt.Errorf("failed to read rollup watermark: %w", err)
+	default:
+		if err := json.Unmarshal(data, &ra.saved); err != nil {
+			return 0, fmt.Errorf("failed to decode rollup watermark: %w", err)
+		}
+	}
+
+	ra.watermark = ra.saved.Watermark
+	ra.closing = ra.saved.Watermark
+	for name, through := range ra.saved.Sinks {
+		ra.written[name] = through
+	}
+	for start, state := range ra.saved.Windows {
+		window, exists := ra.windows[start]
+		if !exists {
+			window = newRollupWindow()
+			ra.windows[start] = window
+		}
+		for _, userID := range state.Users {
+			window.users[userID] = true
+		}
+		for eventType, count := range state.EventCounts {
+			window.eventCounts[eventType] += count
+		}
+		for screen, count := range state.ScreenViews {
+			window.screenViews[screen] += count
+		}
+	}
+
+	ra.dropBeforeLocked(ra.watermark)
+	ra.loaded = true
+	return ra.saved.Offset, nil
+}
+
+// Watermark returns the start of the first window not yet emitted
+func (ra *rollupAccumulator) Watermark() time.Time {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.watermark
+}
+
+// closed returns the windows before cutoff for writing. They stop taking
+// events, and stay until advance so a failed write is retried next run.
+func (ra *rollupAccumulator) closed(cutoff time.Time) map[int64]*rollupWindow {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if cutoff.After(ra.closing) {
+		ra.closing = cutoff
+	}
+
+	closed := make(map[int64]*rollupWindow)
+	for start, window := range ra.windows {
+		if start < cutoff.UnixNano() {
+			closed[start] = window
+		}
+	}
+	return closed
+}
+
+// writtenThrough returns the end of the windows written to a sink, the
+// watermark when it has none past it
+func (ra *rollupAccumulator) writtenThrough(sinkName string) time.Time {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if through, ok := ra.written[sinkName]; ok && through.After(ra.watermark) {
+		return through
+	}
+	return ra.watermark
+}
+
+// markWritten persists that a sink has every window ending by through, so a
+// run retrying a failed sink does not write them to it again
+func (ra *rollupAccumulator) markWritten(sinkName string, through time.Time) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	previous, existed := ra.written[sinkName]
+	ra.written[sinkName] = through
+	if err := ra.saveLocked(ra.saved); err != nil {
+		if existed {
+			ra.written[sinkName] = previous
+		} else {
+			delete(ra.written, sinkName)
+		}
+		return err
+	}
+	return nil
+}
+
+// advance persists cutoff as the new watermark once the windows before it
+// are written to every sink, and removes them
+func (ra *rollupAccumulator) advance(cutoff time.Time) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	state := rollupState{Watermark: cutoff, Offset: ra.saved.Offset, Windows: make(map[int64]*rollupWindowState)}
+	for start, window := range ra.saved.Windows {
+		if start >= cutoff.UnixNano() {
+			state.Windows[start] = window
+		}
+	}
+	if err := ra.saveLocked(state); err != nil {
+		return err
+	}
+
+	ra.dropBeforeLocked(cutoff)
+	ra.watermark = cutoff
+	for name, through := range ra.written {
+		if !through.After(cutoff) {
+			delete(ra.written, name)
+		}
+	}
+	return nil
+}
+
+// snapshot copies the open windows as counting every event below offset in
+// the write-ahead log. The caller must keep events from being observed
+// between reading offset and the call.
+func (ra *rollupAccumulator) snapshot(offset uint64) rollupState {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	state := rollupState{Watermark: ra.watermark, Offset: offset, Windows: make(map[int64]*rollupWindowState, len(ra.windows))}
+	for start, window := range ra.windows {
+		users := make([]string, 0, len(window.users))
+		for userID := range window.users {
+			users = append(users, userID)
+		}
+		sort.Strings(users)
+
+		eventCounts := make(map[EventType]int64, len(window.eventCounts))
+		for eventType, count := range window.eventCounts {
+			eventCounts[eventType] = count
+		}
+		screenViews := make(map[string]int64, len(window.screenViews))
+		for screen, count := range window.screenViews {
+			screenViews[screen] = count
+		}
+
+		state.Windows[start] = &rollupWindowState{Users: users, EventCounts: eventCounts, ScreenViews: screenViews}
+	}
+	return state
+}
+
+// save persists a snapshot. Windows emitted since it was taken are left
+// out, so they are not emitted again after a restart.
+func (ra *rollupAccumulator) save(state rollupState) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if !ra.loaded {
+		return errors.New("rollup watermark is not loaded")
+	}
+	if state.Watermark.Before(ra.watermark) {
+		state.Watermark = ra.watermark
+		for start := range state.Windows {
+			if start < ra.watermark.UnixNano() {
+				delete(state.Windows, start)
+			}
+		}
+	}
+	return ra.saveLocked(state)
+}
+
+// saveLocked writes the state file with the sinks written past its
+// watermark; caller must hold ra.mu
+func (ra *rollupAccumulator) saveLocked(state rollupState) error {
+	state.Sinks = make(map[string]time.Time, len(ra.written))
+	for name, through := range ra.written {
+		if through.After(state.Watermark) {
+			state.Sinks[name] = through
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode rollup watermark: %w", err)
+	}
+	if err := writeFileAtomic(ra.watermarkPath, data); err != nil {
+		return fmt.Errorf("failed to save rollup watermark: %w", err)
+	}
+
+	ra.saved = state
+	return nil
+}
+
+// dropBeforeLocked removes windows starting before t; caller must hold ra.mu
+func (ra *rollupAccumulator) dropBeforeLocked(t time.Time) {
+	for start := range ra.windows {
+		if start < t.UnixNano() {
+			delete(ra.windows, start)
+		}
+	}
+}
+
+// LateEvents returns how many events arrived after their window was emitted
+func (ra *rollupAccumulator) LateEvents() int64 {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.lateEvents
+}
+
+// buildRollups combines the closed event windows with the sessions started or
+// ended in [from, to) into one rollup per window with any activity, oldest first
+func buildRollups(interval time.Duration, from, to time.Time, windows map[int64]*rollupWindow, sessions []Session) []Rollup {
+	rollups := make(map[int64]*Rollup)
+	durations := make(map[int64]float64)
+
+	rollupAt := func(start time.Time) *Rollup {
+		key := start.UnixNano()
+		rollup, exists := rollups[key]
+		if !exists {
+			rollup = &Rollup{
+				WindowStart: start,
+				WindowEnd:   start.Add(interval),
+				EventCounts: make(map[EventType]int64),
+				ScreenViews: make(map[string]int64),
+			}
+			rollups[key] = rollup
+		}
+		return rollup
+	}
+
+	for key, window := range windows {
+		rollup := rollupAt(time.Unix(0, key))
+		rollup.ActiveUsers = int64(len(window.users))
+		rollup.EventCounts = window.eventCounts
+		rollup.ScreenViews = window.screenViews
+	}
+
+	for _, session := range sessions {
+		if inTimeRange(session.StartTime, from, to) {
+			rollupAt(session.StartTime.Truncate(interval)).SessionsStarted++
+		}
+		if session.EndTime != nil && inTimeRange(*session.EndTime, from, to) {
+			start := session.EndTime.Truncate(interval)
+			rollupAt(start).SessionsEnded++
+			durations[start.UnixNano()] += session.EndTime.Sub(session.StartTime).Seconds()
+		}
+	}
+
+	result := make([]Rollup, 0, len(rollups))
+	for key, rollup := range rollups {
+		if rollup.SessionsEnded > 0 {
+			rollup.AvgSessionDuration = durations[key] / float64(rollup.SessionsEnded)
+		}
+		result = append(result, *rollup)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].WindowStart.Before(result[j].WindowStart)
+	})
+
+	return result
+}
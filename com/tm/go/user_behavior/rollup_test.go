@@ -0,0 +1,54 @@
+package user_behavior
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollupSinkProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollup_watermark.json")
+	now := time.Date(2026, 7, 1, 12, 0, 30, 0, time.UTC)
+	watermark := now.Truncate(time.Minute)
+
+	ra := newRollupAccumulator(time.Minute, path)
+	if _, err := ra.load(now, 0); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if err := ra.markWritten(SinkBigQuery, watermark.Add(2*time.Minute)); err != nil {
+		t.Fatalf("markWritten() error = %v", err)
+	}
+
+	// The progress of each sink survives a restart
+	ra = newRollupAccumulator(time.Minute, path)
+	if _, err := ra.load(now, 0); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	steps := []struct {
+		name      string
+		advance   time.Duration // watermark moved to, none when zero
+		sink      string
+		wantAfter time.Duration // past the first watermark
+	}{
+		{name: "written sink after restart", sink: SinkBigQuery, wantAfter: 2 * time.Minute},
+		{name: "unwritten sink at the watermark", sink: SinkFile, wantAfter: 0},
+		{name: "sink ahead of the watermark", advance: time.Minute, sink: SinkBigQuery, wantAfter: 2 * time.Minute},
+		{name: "watermark past the sink", advance: 3 * time.Minute, sink: SinkBigQuery, wantAfter: 3 * time.Minute},
+	}
+
+	for _, step := range steps {
+		if step.advance > 0 {
+			if err := ra.advance(watermark.Add(step.advance)); err != nil {
+				t.Fatalf("%s: advance() error = %v", step.name, err)
+			}
+		}
+		if got, want := ra.writtenThrough(step.sink), watermark.Add(step.wantAfter); !got.Equal(want) {
+			t.Errorf("%s: writtenThrough(%s) = %v, want %v", step.name, step.sink, got, want)
+		}
+	}
+
+	if len(ra.saved.Sinks) != 0 {
+		t.Errorf("saved sinks = %v after the watermark passed them, want none", ra.saved.Sinks)
+	}
+}
@@ -0,0 +1,268 @@
+package user_behavior
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+const (
+	// Row key strategy names accepted in HBaseLayoutConfig.RowKeys
+	RowKeysSession = "session"
+	RowKeysSalted  = "salted"
+	RowKeysUser    = "user"
+	RowKeysTime    = "time"
+
+	DefaultSaltBuckets = 16
+	DefaultTimeBucket  = time.Hour
+
+	// maxSaltBuckets keeps salts to two hex digits
+	maxSaltBuckets = 256
+)
+
+// RowKeyStrategy decides how events are laid out in the HBase event table
+type RowKeyStrategy interface {
+	// Name returns the strategy name used in config
+	Name() string
+
+	// RowKey returns the row key of an event
+	RowKey(event UserEvent) string
+
+	// SessionRanges returns the key ranges holding a session's rows. It
+	// returns nil when the location does not say enough to narrow the scan.
+	SessionRanges(location SessionLocation) []KeyRange
+
+	// UserRanges returns the key ranges holding a user's rows within
+	// [from, to), or nil when the layout is not ordered by user
+	UserRanges(userID string, from, to time.Time) []KeyRange
+
+	// TimeBucket returns the time bucket of t when the layout partitions
+	// rows by time, so the user index can record which buckets a session spans
+	TimeBucket(t time.Time) (int64, bool)
+}
+
+// KeyRange is a [Start, Stop) row key range
+type KeyRange struct {
+	Start string
+	Stop  string
+}
+
+// SessionLocation is what the user index knows about a session's rows
+type SessionLocation struct {
+	SessionID string
+	UserID    string
+	Buckets   []int64
+}
+
+// HBaseLayoutConfig selects the row key strategy and the user index table
+type HBaseLayoutConfig struct {
+	// RowKeys is one of session, salted, user or time; defaults to session,
+	// the layout used before strategies were configurable
+	RowKeys     string
+	SaltBuckets int
+	TimeBucket  time.Duration
+
+	// IndexTable enables the user to session index when set
+	IndexTable string
+}
+
+// NewRowKeyStrategy creates the strategy named in the layout config
+func NewRowKeyStrategy(config HBaseLayoutConfig) (RowKeyStrategy, error) {
+	buckets := config.SaltBuckets
+	if buckets <= 0 {
+		buckets = DefaultSaltBuckets
+	}
+	if buckets > maxSaltBuckets {
+		return nil, fmt.Errorf("salt buckets must be at most %d, got %d", maxSaltBuckets, buckets)
+	}
+
+	width := config.TimeBucket
+	if width <= 0 {
+		width = DefaultTimeBucket
+	}
+
+	switch strings.ToLower(config.RowKeys) {
+	case "", RowKeysSession:
+		return SessionRowKeys{}, nil
+	case RowKeysSalted:
+		return SaltedRowKeys{Buckets: buckets}, nil
+	case RowKeysUser:
+		return UserRowKeys{}, nil
+	case RowKeysTime:
+		return TimeBucketedRowKeys{Width: width, Buckets: buckets}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRowKeys, config.RowKeys)
+	}
+}
+
+// SessionRowKeys is the original sessionId_timestamp_eventId layout. It
+// allows single range scans per session but concentrates writes when
+// session IDs are sequential.
+type SessionRowKeys struct{}
+
+// Name returns the strategy name
+func (SessionRowKeys) Name() string { return RowKeysSession }
+
+// RowKey returns sessionId_timestamp_eventId
+func (SessionRowKeys) RowKey(event UserEvent) string {
+	return fmt.Sprintf("%s_%d_%s", event.SessionID, event.Timestamp.UnixNano(), event.EventID)
+}
+
+// SessionRanges returns the session's single prefix range
+func (SessionRowKeys) SessionRanges(location SessionLocation) []KeyRange {
+	return []KeyRange{prefixRange(location.SessionID + "_")}
+}
+
+// UserRanges returns nil, rows are not ordered by user
+func (SessionRowKeys) UserRanges(userID string, from, to time.Time) []KeyRange {
+	return nil
+}
+
+// TimeBucket returns false, rows are not partitioned by time
+func (SessionRowKeys) TimeBucket(t time.Time) (int64, bool) { return 0, false }
+
+// SaltedRowKeys prefixes the session layout with a salt derived from the
+// event ID, spreading every session over Buckets regions. Session reads
+// fan out one scan per salt.
+type SaltedRowKeys struct {
+	Buckets int
+}
+
+// Name returns the strategy name
+func (SaltedRowKeys) Name() string { return RowKeysSalted }
+
+// RowKey returns salt_sessionId_timestamp_eventId
+func (s SaltedRowKeys) RowKey(event UserEvent) string {
+	return fmt.Sprintf("%s_%s_%019d_%s",
+		saltPrefix(event.EventID, s.Buckets),
+		event.SessionID,
+		event.Timestamp.UnixNano(),
+		event.EventID,
+	)
+}
+
+// SessionRanges returns one range per salt bucket
+func (s SaltedRowKeys) SessionRanges(location SessionLocation) []KeyRange {
+	ranges := make([]KeyRange, 0, s.Buckets)
+	for salt := 0; salt < s.Buckets; salt++ {
+		ranges = append(ranges, prefixRange(fmt.Sprintf("%02x_%s_", salt, location.SessionID)))
+	}
+	return ranges
+}
+
+// UserRanges returns nil, rows are not ordered by user
+func (SaltedRowKeys) UserRanges(userID string, from, to time.Time) []KeyRange {
+	return nil
+}
+
+// TimeBucket returns false, rows are not partitioned by time
+func (SaltedRowKeys) TimeBucket(t time.Time) (int64, bool) { return 0, false }
+
+// UserRowKeys orders rows by user and time, so a user's history is a single
+// range scan. Session reads need the user ID from the index.
+type UserRowKeys struct{}
+
+// Name returns the strategy name
+func (UserRowKeys) Name() string { return RowKeysUser }
+
+// RowKey returns userId_timestamp_sessionId_eventId
+func (UserRowKeys) RowKey(event UserEvent) string {
+	return fmt.Sprintf("%s_%019d_%s_%s",
+		event.UserID,
+		event.Timestamp.UnixNano(),
+		event.SessionID,
+		event.EventID,
+	)
+}
+
+// SessionRanges returns the owning user's whole range, or nil when the user
+// is unknown
+func (u UserRowKeys) SessionRanges(location SessionLocation) []KeyRange {
+	if location.UserID == "" {
+		return nil
+	}
+	return u.UserRanges(location.UserID, time.Time{}, time.Time{})
+}
+
+// UserRanges returns the user's rows within [from, to)
+func (UserRowKeys) UserRanges(userID string, from, to time.Time) []KeyRange {
+	userRange := prefixRange(userID + "_")
+	if !from.IsZero() {
+		userRange.Start = fmt.Sprintf("%s_%019d", userID, from.UnixNano())
+	}
+	if !to.IsZero() {
+		userRange.Stop = fmt.Sprintf("%s_%019d", userID, to.UnixNano())
+	}
+	return []KeyRange{userRange}
+}
+
+// TimeBucket returns false, rows are not partitioned by time
+func (UserRowKeys) TimeBucket(t time.Time) (int64, bool) { return 0, false }
+
+// TimeBucketedRowKeys groups rows by a salt and a time bucket so old buckets
+// can be scanned or expired together while writes to the current bucket are
+// spread over Buckets regions
+type TimeBucketedRowKeys struct {
+	Width   time.Duration
+	Buckets int
+}
+
+// Name returns the strategy name
+func (TimeBucketedRowKeys) Name() string { return RowKeysTime }
+
+// RowKey returns salt_bucket_sessionId_timestamp_eventId
+func (tb TimeBucketedRowKeys) RowKey(event UserEvent) string {
+	bucket, _ := tb.TimeBucket(event.Timestamp)
+	return fmt.Sprintf("%s_%010d_%s_%019d_%s",
+		saltPrefix(event.SessionID, tb.Buckets),
+		bucket,
+		event.SessionID,
+		event.Timestamp.UnixNano(),
+		event.EventID,
+	)
+}
+
+// SessionRanges returns one range per time bucket the session spans, or nil
+// when the index has not recorded the buckets
+func (tb TimeBucketedRowKeys) SessionRanges(location SessionLocation) []KeyRange {
+	if len(location.Buckets) == 0 {
+		return nil
+	}
+
+	salt := saltPrefix(location.SessionID, tb.Buckets)
+	ranges := make([]KeyRange, 0, len(location.Buckets))
+	for _, bucket := range location.Buckets {
+		ranges = append(ranges, prefixRange(fmt.Sprintf("%s_%010d_%s_", salt, bucket, location.SessionID)))
+	}
+	return ranges
+}
+
+// UserRanges returns nil, rows are not ordered by user
+func (TimeBucketedRowKeys) UserRanges(userID string, from, to time.Time) []KeyRange {
+	return nil
+}
+
+// TimeBucket returns the start of t's bucket in unix seconds
+func (tb TimeBucketedRowKeys) TimeBucket(t time.Time) (int64, bool) {
+	return t.Truncate(tb.Width).Unix(), true
+}
+
+// saltPrefix hashes value into one of buckets two-digit hex prefixes
+func saltPrefix(value string, buckets int) string {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%02x", h.Sum32()%uint32(buckets))
+}
+
+// prefixRange returns the range of keys starting with prefix
+func prefixRange(prefix string) KeyRange {
+	stop := []byte(prefix)
+	for i := len(stop) - 1; i >= 0; i-- {
+		if stop[i] < 0xff {
+			stop[i]++
+			return KeyRange{Start: prefix, Stop: string(stop[:i+1])}
+		}
+	}
+	return KeyRange{Start: prefix}
+}
@@ -0,0 +1,259 @@
+package user_behavior
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionEventType is the kind of a session lifecycle change
+type SessionEventType string
+
+const (
+	SessionStarted    SessionEventType = "started"
+	SessionEventAdded SessionEventType = "event_added"
+	SessionClosed     SessionEventType = "closed"
+	SessionExpired    SessionEventType = "expired"
+	SessionReopened   SessionEventType = "reopened"
+	SessionEvicted    SessionEventType = "evicted"
+	SessionAnomaly    SessionEventType = "anomaly"
+)
+
+// SessionLifecycleEvent is published by the SessionManager whenever a session
+// changes state
+type SessionLifecycleEvent struct {
+	Type SessionEventType `json:"type"`
+
+	// Session is a copy of the session after the change, without its
+	// buffered events
+	Session Session `json:"session"`
+
+	// Event is the added event for SessionEventAdded, nil otherwise
+	Event *UserEvent `json:"event,omitempty"`
+
+	// Anomaly is the detected anomaly for SessionAnomaly, nil otherwise
+	Anomaly *AnomalyDetection `json:"anomaly,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// SessionEventBus delivers session lifecycle events to every subscriber.
+// Each subscription has its own unbounded queue, so publishing never blocks
+// and a slow subscriber never loses events or holds up the others.
+type SessionEventBus struct {
+	subscriptions []*SessionSubscription
+	mu            sync.RWMutex
+}
+
+// NewSessionEventBus creates an empty bus
+func NewSessionEventBus() *SessionEventBus {
+	return &SessionEventBus{}
+}
+
+// Subscribe registers a subscriber for the given event types, all types when
+// none are given. Events published before Subscribe are not delivered.
+func (bus *SessionEventBus) Subscribe(name string, types ...SessionEventType) *SessionSubscription {
+	sub := &SessionSubscription{
+		name:    name,
+		types:   make(map[SessionEventType]bool, len(types)),
+		ready:   make(chan struct{}, 1),
+		out:     make(chan SessionLifecycleEvent),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+		bus:     bus,
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+
+	bus.mu.Lock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+	bus.mu.Unlock()
+
+	go sub.deliver()
+	return sub
+}
+
+// Publish queues an event for every subscriber of its type
+func (bus *SessionEventBus) Publish(event SessionLifecycleEvent) {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for _, sub := range bus.subscriptions {
+		if sub.wants(event.Type) {
+			sub.enqueue(event)
+		}
+	}
+}
+
+// hasSubscribers reports whether any subscriber receives events of a type
+func (bus *SessionEventBus) hasSubscribers(eventType SessionEventType) bool {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for _, sub := range bus.subscriptions {
+		if sub.wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops publishing to every subscriber. The events already queued are
+// still delivered, then the subscription channels are closed; subscribers
+// must keep reading until then.
+func (bus *SessionEventBus) Close() {
+	bus.mu.Lock()
+	subscriptions := bus.subscriptions
+	bus.subscriptions = nil
+	bus.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.finish()
+	}
+}
+
+// Metrics returns the delivery counters of every subscription
+func (bus *SessionEventBus) Metrics() []SubscriptionMetrics {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	metrics := make([]SubscriptionMetrics, 0, len(bus.subscriptions))
+	for _, sub := range bus.subscriptions {
+		metrics = append(metrics, sub.Metrics())
+	}
+	return metrics
+}
+
+// remove unregisters a subscription
+func (bus *SessionEventBus) remove(sub *SessionSubscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for i, registered := range bus.subscriptions {
+		if registered == sub {
+			bus.subscriptions = append(bus.subscriptions[:i], bus.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// SubscriptionMetrics reports how far a subscriber is behind
+type SubscriptionMetrics struct {
+	Name      string `json:"name"`
+	Delivered int64  `json:"delivered"`
+	Pending   int    `json:"pending"`
+}
+
+// SessionSubscription receives the lifecycle events of a SessionEventBus in
+// publish order
+type SessionSubscription struct {
+	name       string
+	types      map[SessionEventType]bool
+	queue      []SessionLifecycleEvent
+	delivered  int64
+	ready      chan struct{} // signals a non-empty queue to deliver
+	out        chan SessionLifecycleEvent
+	done       chan struct{} // closed by Close, discarding the queue
+	closing    chan struct{} // closed by the bus, delivering the queue first
+	closeOnce  sync.Once
+	finishOnce sync.Once
+	bus        *SessionEventBus
+	mu         sync.Mutex
+}
+
+// C returns the channel events are delivered on; it is closed when the
+// subscription or the bus is closed
+func (sub *SessionSubscription) C() <-chan SessionLifecycleEvent {
+	return sub.out
+}
+
+// Close unsubscribes; events still queued are discarded
+func (sub *SessionSubscription) Close() {
+	sub.bus.remove(sub)
+	sub.stop()
+}
+
+// Metrics returns the subscription's delivery counters
+func (sub *SessionSubscription) Metrics() SubscriptionMetrics {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return SubscriptionMetrics{
+		Name:      sub.name,
+		Delivered: sub.delivered,
+		Pending:   len(sub.queue),
+	}
+}
+
+// wants reports whether the subscription receives events of a type
+func (sub *SessionSubscription) wants(eventType SessionEventType) bool {
+	return len(sub.types) == 0 || sub.types[eventType]
+}
+
+// enqueue appends an event and wakes the delivery goroutine
+func (sub *SessionSubscription) enqueue(event SessionLifecycleEvent) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, event)
+	sub.mu.Unlock()
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+		// Already signalled
+	}
+}
+
+// stop ends delivery
+func (sub *SessionSubscription) stop() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+	})
+}
+
+// finish ends delivery once the queued events are delivered
+func (sub *SessionSubscription) finish() {
+	sub.finishOnce.Do(func() {
+		close(sub.closing)
+	})
+}
+
+// deliver hands queued events to the subscriber one at a time
+func (sub *SessionSubscription) deliver() {
+	defer close(sub.out)
+
+	// Nothing is queued after the bus closes, so an empty queue then is the end
+	finishing := false
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			sub.mu.Unlock()
+			if finishing {
+				return
+			}
+
+			select {
+			case <-sub.ready:
+				continue
+			case <-sub.done:
+				return
+			case <-sub.closing:
+				finishing = true
+				continue
+			}
+		}
+
+		event := sub.queue[0]
+		sub.queue[0] = SessionLifecycleEvent{}
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+
+		select {
+		case sub.out <- event:
+			sub.mu.Lock()
+			sub.delivered++
+			sub.mu.Unlock()
+		case <-sub.done:
+			return
+		}
+	}
+}
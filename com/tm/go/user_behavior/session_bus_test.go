@@ -0,0 +1,51 @@
+package user_behavior
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionEventBusClose(t *testing.T) {
+	tests := []struct {
+		name      string
+		discard   bool
+		wantCount int
+	}{
+		{name: "bus close delivers the queue", wantCount: 3},
+		{name: "subscription close discards the queue", discard: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewSessionEventBus()
+			sub := bus.Subscribe("test", SessionExpired)
+			for i := 0; i < 3; i++ {
+				bus.Publish(SessionLifecycleEvent{Type: SessionExpired, Session: Session{SessionID: "s1"}})
+			}
+			bus.Publish(SessionLifecycleEvent{Type: SessionStarted})
+
+			if tt.discard {
+				sub.Close()
+			}
+			bus.Close()
+			bus.Publish(SessionLifecycleEvent{Type: SessionExpired})
+
+			count := 0
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case _, ok := <-sub.C():
+					if !ok {
+						if !tt.discard && count != tt.wantCount {
+							t.Errorf("delivered %d events, want %d", count, tt.wantCount)
+						}
+						return
+					}
+					count++
+				case <-timeout:
+					t.Fatal("subscription channel not closed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package user_behavior
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultSessionRetention keeps ended sessions in memory this long
+	DefaultSessionRetention = 24 * time.Hour
+
+	// DefaultMaxSessionEvents caps the events buffered per session
+	DefaultMaxSessionEvents = 1000
+
+	// Event metadata keys read by the session rules
+	MetadataPlatform = "platform"
+	MetadataApp      = "app"
+	MetadataTimezone = "timezone"
+
+	// Split rule names
+	SplitInactivity     = "inactivity"
+	SplitMidnight       = "midnight"
+	SplitReopen         = "reopen"
+	SplitMetadataChange = "metadata_change"
+
+	// splitSessionSeparator joins a client session ID and the part number
+	// of a session created by a split rule
+	splitSessionSeparator = "#"
+)
+
+// SessionConfig controls session timeouts, retention and splitting
+type SessionConfig struct {
+	// Timeout ends a session after this long without events; defaults to
+	// SessionTimeout
+	Timeout time.Duration
+
+	// TimeoutOverrides replaces Timeout for sessions whose app or platform
+	// metadata matches a key, the app taking precedence
+	TimeoutOverrides map[string]time.Duration
+
+	// CleanupInterval is how often timeouts are checked; defaults to
+	// SessionCleanupInterval
+	CleanupInterval time.Duration
+
+	// Retention keeps ended sessions in memory; defaults to DefaultSessionRetention
+	Retention time.Duration
+
+	// MaxEvents caps the events buffered per session; defaults to
+	// DefaultMaxSessionEvents
+	MaxEvents int
+
+	// WatermarkDelay holds the watermark this far behind the latest event
+	// time, so events reordered by up to this much are not late.
+	// Sessions expire when the watermark passes their last event plus
+	// their timeout.
+	WatermarkDelay time.Duration
+
+	// AllowedLateness is how far behind the watermark an event may be and
+	// still be added to an ended session, re-opening an expired one; older
+	// events for ended sessions are dropped
+	AllowedLateness time.Duration
+
+	// WatermarkIdleTimeout starts advancing event time with wall time when
+	// no newer event has arrived for this long
+	WatermarkIdleTimeout time.Duration
+
+	// Shards splits the sessions by client session ID hash, each shard with
+	// its own lock and worker; defaults to DefaultSessionShards
+	Shards int
+
+	Split SessionSplitRules
+}
+
+// SessionSplitRules start a new session within the same client session ID.
+// An event more than the session timeout after the session's last event
+// always does. The first part keeps the client ID, later parts are tracked as
+// <sessionId>#2, <sessionId>#3 and so on. Sinks keep the client ID.
+type SessionSplitRules struct {
+	// AtMidnight splits when an event falls on a later day than the
+	// session's last event, in the timezone metadata of the event or Timezone
+	AtMidnight bool
+	Timezone   string
+
+	// ReopenGap splits on an app_open more than ReopenGap after the
+	// session's app_close; zero disables the rule
+	ReopenGap time.Duration
+
+	// MetadataKeys split when one of these metadata values, such as a
+	// campaign or referrer, changes within a session
+	MetadataKeys []string
+}
+
+// withDefaults fills zero fields with the package defaults
+func (sc SessionConfig) withDefaults() SessionConfig {
+	if sc.Timeout <= 0 {
+		sc.Timeout = SessionTimeout
+	}
+	if sc.CleanupInterval <= 0 {
+		sc.CleanupInterval = SessionCleanupInterval
+	}
+	if sc.Retention <= 0 {
+		sc.Retention = DefaultSessionRetention
+	}
+	if sc.MaxEvents <= 0 {
+		sc.MaxEvents = DefaultMaxSessionEvents
+	}
+	if sc.WatermarkDelay <= 0 {
+		sc.WatermarkDelay = DefaultWatermarkDelay
+	}
+	if sc.AllowedLateness <= 0 {
+		sc.AllowedLateness = DefaultAllowedLateness
+	}
+	if sc.WatermarkIdleTimeout <= 0 {
+		sc.WatermarkIdleTimeout = DefaultWatermarkIdleTimeout
+	}
+	if sc.Shards <= 0 {
+		sc.Shards = DefaultSessionShards
+	}
+	if sc.Split.Timezone == "" {
+		sc.Split.Timezone = "UTC"
+	}
+	return sc
+}
+
+// timeoutFor returns the inactivity timeout of a session
+func (sc SessionConfig) timeoutFor(session *Session) time.Duration {
+	if timeout, ok := sc.TimeoutOverrides[session.App]; ok && session.App != "" {
+		return timeout
+	}
+	if timeout, ok := sc.TimeoutOverrides[session.Platform]; ok && session.Platform != "" {
+		return timeout
+	}
+	return sc.Timeout
+}
+
+// maxTimeout returns the longest timeout any session can have
+func (sc SessionConfig) maxTimeout() time.Duration {
+	longest := sc.Timeout
+	for _, timeout := range sc.TimeoutOverrides {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// sessionLineage tracks the parts a client session has been split into
+type sessionLineage struct {
+	current   string // ID of the part receiving events
+	parts     int
+	lastClose time.Time
+	values    map[string]string
+}
+
+// partID returns the tracked ID of part n of a client session
+func partID(clientSessionID string, n int) string {
+	if n <= 1 {
+		return clientSessionID
+	}
+	return clientSessionID + splitSessionSeparator + strconv.Itoa(n)
+}
+
+// splitReason returns the rule that starts a new session for an event, or
+// an empty string when the event continues the session
+func (sm *SessionManager) splitReason(session *Session, lineage *sessionLineage, event UserEvent) string {
+	rules := sm.config.Split
+
+	// An event after the inactivity gap starts a new session window
+	if event.Timestamp.Sub(session.LastActiveTime) > sm.config.timeoutFor(session) {
+		return SplitInactivity
+	}
+
+	if rules.AtMidnight && sm.crossesMidnight(session.LastActiveTime, event) {
+		return SplitMidnight
+	}
+
+	if rules.ReopenGap > 0 && event.EventType == EventAppOpen && !lineage.lastClose.IsZero() &&
+		event.Timestamp.Sub(lineage.lastClose) > rules.ReopenGap {
+		return SplitReopen
+	}
+
+	for _, key := range rules.MetadataKeys {
+		value, ok := metadataString(event, key)
+		if !ok {
+			continue
+		}
+		if previous, seen := lineage.values[key]; seen && previous != value {
+			return SplitMetadataChange
+		}
+	}
+
+	return ""
+}
+
+// record remembers what the split rules need from an event
+func (lineage *sessionLineage) record(event UserEvent, rules SessionSplitRules) {
+	if event.EventType == EventAppClose {
+		lineage.lastClose = event.Timestamp
+	}
+
+	for _, key := range rules.MetadataKeys {
+		if value, ok := metadataString(event, key); ok {
+			if lineage.values == nil {
+				lineage.values = make(map[string]string)
+			}
+			lineage.values[key] = value
+		}
+	}
+}
+
+// crossesMidnight reports whether an event falls on a later day than last in
+// the user's timezone
+func (sm *SessionManager) crossesMidnight(last time.Time, event UserEvent) bool {
+	location := sm.location(sm.config.Split.Timezone)
+	if name, ok := metadataString(event, MetadataTimezone); ok {
+		location = sm.location(name)
+	}
+
+	lastYear, lastMonth, lastDay := last.In(location).Date()
+	year, month, day := event.Timestamp.In(location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).
+		After(time.Date(lastYear, lastMonth, lastDay, 0, 0, 0, 0, time.UTC))
+}
+
+// location loads and caches a timezone, falling back to UTC for unknown
+// names
+func (sm *SessionManager) location(name string) *time.Location {
+	if location, ok := sm.locations.Load(name); ok {
+		return location.(*time.Location)
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		location = time.UTC
+	}
+	sm.locations.Store(name, location)
+	return location
+}
+
+// metadataString returns a metadata value of an event as a string
+func metadataString(event UserEvent, key string) (string, bool) {
+	value, ok := event.Metadata[key]
+	if !ok || value == nil {
+		return "", false
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(value), true
+}
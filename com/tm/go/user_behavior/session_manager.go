@@ -2,71 +2,268 @@ package user_behavior
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 const (
-	// SessionTimeout defines when a session is considered inactive
+	// SessionTimeout is the default inactivity timeout of a session
 	SessionTimeout = 30 * time.Minute
 
-	// SessionCleanupInterval defines how often to check for expired sessions
+	// SessionCleanupInterval is the default interval between timeout checks
 	SessionCleanupInterval = 5 * time.Minute
 )
 
-// SessionManager manages user sessions and handles session lifecycle
+// SessionManager manages user sessions and handles session lifecycle. The
+// sessions are sharded by client session ID, each shard with its own lock and
+// worker, so ingestion does not contend on a single lock.
 type SessionManager struct {
-	sessions      map[string]*Session
-	mu            sync.RWMutex
-	eventChannel  chan UserEvent
-	sessionExpiry chan string
-	ctx           context.Context
-	cancel        context.CancelFunc
+	shards     []*sessionShard
+	workers    []chan UserEvent
+	locations  sync.Map // timezone name -> *time.Location
+	config     SessionConfig
+	clock      *eventClock
+	clockMu    sync.Mutex
+	eventQueue *eventQueue
+	bus        *SessionEventBus
+	workerWG   sync.WaitGroup
+	barriers   sync.Map // barrier ID -> *sessionBarrier, see settle
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// snapshots is nil unless SetSnapshotStore was called
+	snapshots        SessionSnapshotStore
+	snapshotInterval time.Duration
+	snapshotMu       sync.Mutex
+
+	// rules is nil unless SetAnomalyRules was called
+	rules *AnomalyRuleEngine
 }
 
 // NewSessionManager creates a new session manager
-func NewSessionManager(eventBufferSize int) *SessionManager {
+func NewSessionManager(eventBufferSize int, backpressure BackpressureConfig, config SessionConfig) *SessionManager {
 	ctx, cancel := context.WithCancel(context.Background())
+	config = config.withDefaults()
 
 	sm := &SessionManager{
-		sessions:      make(map[string]*Session),
-		eventChannel:  make(chan UserEvent, eventBufferSize),
-		sessionExpiry: make(chan string, 100),
-		ctx:           ctx,
-		cancel:        cancel,
+		shards:     make([]*sessionShard, config.Shards),
+		config:     config,
+		clock:      newEventClock(time.Now(), config.WatermarkIdleTimeout),
+		eventQueue: newEventQueue("session_manager", eventBufferSize, backpressure),
+		bus:        NewSessionEventBus(),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	for i := range sm.shards {
+		sm.shards[i] = newSessionShard()
 	}
 
 	return sm
 }
 
-// Start begins the session manager background workers
+// Start begins the session manager background workers. Each shard is pinned
+// to one worker; more workers than shards are not started.
 func (sm *SessionManager) Start(numWorkers int) {
+	if sm.snapshots != nil {
+		sm.restoreSnapshot()
+	}
+
+	sm.eventQueue.Start(sm.ctx)
+
+	if numWorkers > len(sm.shards) {
+		numWorkers = len(sm.shards)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
 	// Start event processing workers
-	for i := 0; i < numWorkers; i++ {
-		go sm.eventWorker()
+	sm.workers = make([]chan UserEvent, numWorkers)
+	for i := range sm.workers {
+		sm.workers[i] = make(chan UserEvent, shardQueueSize)
+		sm.workerWG.Add(1)
+		go sm.eventWorker(sm.workers[i])
 	}
+	go sm.dispatchEvents()
 
 	// Start session timeout monitor
 	go sm.sessionTimeoutMonitor()
 
 	// Start cleanup worker
 	go sm.cleanupWorker()
+
+	if sm.snapshots != nil {
+		go sm.snapshotWorker()
+	}
 }
 
-// Stop gracefully stops the session manager
-func (sm *SessionManager) Stop() {
+// Stop gracefully stops the session manager. Queued events are processed
+// first, so the final snapshot holds every accepted event; the error of that
+// snapshot is returned.
+func (sm *SessionManager) Stop() error {
+	sm.drain()
+
+	var snapshotErr error
+	if sm.snapshots != nil {
+		snapshotErr = sm.saveSnapshot()
+	}
+
 	sm.cancel()
-	close(sm.eventChannel)
+	sm.bus.Close()
+
+	if sm.snapshots != nil {
+		if err := sm.snapshots.Close(); err != nil {
+			fmt.Printf("Failed to close session snapshot store: %v\n", err)
+		}
+	}
+
+	if snapshotErr != nil {
+		return fmt.Errorf("failed to save session snapshot: %w", snapshotErr)
+	}
+	return nil
+}
+
+// drain stops accepting events and waits until the queued ones are processed
+func (sm *SessionManager) drain() {
+	sm.eventQueue.Close()
+	sm.workerWG.Wait()
+}
+
+// sessionBarrierEvent marks the barrier events settle passes through the
+// queue; it is not a valid client event type
+const sessionBarrierEvent EventType = "session_barrier"
+
+// sessionBarrier is handed to every worker behind the events queued before
+// it; done is closed once all of them reached it
+type sessionBarrier struct {
+	remaining int32
+	done      chan struct{}
+}
+
+// settle waits until every event queued before the call is processed, or
+// until the timeout passes, and reports whether they were
+func (sm *SessionManager) settle(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(sm.ctx, timeout)
+	defer cancel()
+
+	barrierID := uuid.New().String()
+	barrier := &sessionBarrier{remaining: int32(len(sm.workers)), done: make(chan struct{})}
+	sm.barriers.Store(barrierID, barrier)
+	defer sm.barriers.Delete(barrierID)
+
+	if err := sm.eventQueue.EnqueueWait(ctx, UserEvent{EventID: barrierID, EventType: sessionBarrierEvent}); err != nil {
+		return false
+	}
+
+	select {
+	case <-barrier.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// passBarrier records that a worker reached a barrier. Barriers left in a
+// spill file by an earlier run are unknown and ignored.
+func (sm *SessionManager) passBarrier(barrierID string) {
+	value, ok := sm.barriers.Load(barrierID)
+	if !ok {
+		return
+	}
+
+	barrier := value.(*sessionBarrier)
+	if atomic.AddInt32(&barrier.remaining, -1) == 0 {
+		close(barrier.done)
+	}
+}
+
+// replayEvent queues an event read back from the write-ahead log, waiting
+// for room whatever the overflow policy. Events the restored snapshot holds
+// already are skipped.
+func (sm *SessionManager) replayEvent(event UserEvent) error {
+	if sm.hasEvent(event) {
+		return nil
+	}
+	return sm.eventQueue.EnqueueWait(sm.ctx, event)
+}
+
+// hasEvent reports whether a part of the event's client session holds it
+func (sm *SessionManager) hasEvent(event UserEvent) bool {
+	shard := sm.shardFor(event.SessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	parts := 1
+	if lineage, tracked := shard.lineages[event.SessionID]; tracked {
+		parts = lineage.parts
+	}
+
+	for n := 1; n <= parts; n++ {
+		session, exists := shard.sessions[partID(event.SessionID, n)]
+		if !exists {
+			continue
+		}
+		for _, stored := range session.Events {
+			if stored.EventID == event.EventID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Subscribe registers for session lifecycle events of the given types, all
+// types when none are given. Every subscriber receives every event.
+func (sm *SessionManager) Subscribe(name string, types ...SessionEventType) *SessionSubscription {
+	return sm.bus.Subscribe(name, types...)
+}
+
+// SubscriptionMetrics returns the delivery counters of every subscriber
+func (sm *SessionManager) SubscriptionMetrics() []SubscriptionMetrics {
+	return sm.bus.Metrics()
+}
+
+// publish sends a lifecycle event with a copy of the session, skipping the
+// copy when nobody subscribes to the event type. Events of a session are
+// published under its shard lock, so subscribers see them in order.
+func (sm *SessionManager) publish(eventType SessionEventType, session *Session, event *UserEvent) {
+	if !sm.bus.hasSubscribers(eventType) {
+		return
+	}
+
+	sm.bus.Publish(SessionLifecycleEvent{
+		Type:    eventType,
+		Session: copySession(session),
+		Event:   event,
+		Time:    time.Now(),
+	})
+}
+
+// shardFor returns the shard holding a session ID or client session ID
+func (sm *SessionManager) shardFor(sessionID string) *sessionShard {
+	return sm.shards[shardIndex(sessionID, len(sm.shards))]
 }
 
 // CreateSession creates a new session for a user
 func (sm *SessionManager) CreateSession(userID string) string {
 	sessionID := uuid.New().String()
+	sm.createSession(sessionID, userID)
+	return sessionID
+}
 
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// createSession starts a session with a given ID unless it is tracked already
+func (sm *SessionManager) createSession(sessionID string, userID string) {
+	shard := sm.shardFor(sessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, exists := shard.sessions[sessionID]; exists {
+		return
+	}
 
 	session := &Session{
 		SessionID:      sessionID,
@@ -78,43 +275,95 @@ func (sm *SessionManager) CreateSession(userID string) string {
 		Events:         make([]UserEvent, 0),
 	}
 
-	sm.sessions[sessionID] = session
-
-	return sessionID
+	shard.sessions[sessionID] = session
+	shard.active++
+	sm.scheduleExpiry(shard, session)
+	sm.publish(SessionStarted, session, nil)
 }
 
-// TrackEvent adds an event to the event channel for processing
+// TrackEvent adds an event to the event queue for processing; a full queue
+// is handled by the configured overflow policy
 func (sm *SessionManager) TrackEvent(event UserEvent) error {
-	select {
-	case sm.eventChannel <- event:
-		return nil
-	case <-sm.ctx.Done():
-		return sm.ctx.Err()
-	default:
-		// Channel is full, log or handle overflow
-		return ErrEventChannelFull
-	}
+	return sm.eventQueue.Enqueue(sm.ctx, event)
+}
+
+// QueueMetrics returns the event queue depth and overflow counters
+func (sm *SessionManager) QueueMetrics() QueueMetrics {
+	return sm.eventQueue.Metrics()
 }
 
 // GetSession retrieves a session by ID
 func (sm *SessionManager) GetSession(sessionID string) (*Session, bool) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	shard := sm.shardFor(sessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	session, exists := sm.sessions[sessionID]
+	session, exists := shard.sessions[sessionID]
 	return session, exists
 }
 
+// GetSessionEvents returns a copy of the events buffered for a session
+func (sm *SessionManager) GetSessionEvents(sessionID string) []UserEvent {
+	shard := sm.shardFor(sessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	session, exists := shard.sessions[sessionID]
+	if !exists {
+		return []UserEvent{}
+	}
+
+	events := make([]UserEvent, len(session.Events))
+	copy(events, session.Events)
+	return events
+}
+
+// FindEvents returns a copy of all buffered events matching the predicate
+func (sm *SessionManager) FindEvents(match func(UserEvent) bool) []UserEvent {
+	var events []UserEvent
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		for _, session := range shard.sessions {
+			for _, event := range session.Events {
+				if match(event) {
+					events = append(events, event)
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	return events
+}
+
+// FindSessions returns copies of the sessions matching the predicate, without
+// their buffered events
+func (sm *SessionManager) FindSessions(match func(*Session) bool) []Session {
+	var sessions []Session
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		for _, session := range shard.sessions {
+			if match(session) {
+				sessions = append(sessions, copySession(session))
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	return sessions
+}
+
 // GetUserSessions returns all active sessions for a user
 func (sm *SessionManager) GetUserSessions(userID string) []*Session {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
 	var userSessions []*Session
-	for _, session := range sm.sessions {
-		if session.UserID == userID && session.IsActive {
-			userSessions = append(userSessions, session)
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		for _, session := range shard.sessions {
+			if session.UserID == userID && session.IsActive {
+				userSessions = append(userSessions, session)
+			}
 		}
+		shard.mu.RUnlock()
 	}
 
 	return userSessions
@@ -122,25 +371,71 @@ func (sm *SessionManager) GetUserSessions(userID string) []*Session {
 
 // CloseSession explicitly closes a session
 func (sm *SessionManager) CloseSession(sessionID string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	shard := sm.shardFor(sessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	if session, exists := sm.sessions[sessionID]; exists {
-		now := time.Now()
-		session.EndTime = &now
-		session.IsActive = false
+	if session, exists := shard.sessions[sessionID]; exists {
+		sm.endSession(shard, session, time.Now(), SessionClosed)
 	}
 }
 
-// eventWorker processes events from the event channel
-func (sm *SessionManager) eventWorker() {
+// dispatchEvents routes queued events to the worker owning their shard and
+// closes the worker channels once the queue is closed
+func (sm *SessionManager) dispatchEvents() {
+	defer func() {
+		for _, worker := range sm.workers {
+			close(worker)
+		}
+	}()
+
 	for {
 		select {
-		case event, ok := <-sm.eventChannel:
+		case event, ok := <-sm.eventQueue.C():
 			if !ok {
 				return
 			}
 
+			// Barriers go to every worker, behind the events queued before them
+			if event.EventType == sessionBarrierEvent {
+				for _, worker := range sm.workers {
+					select {
+					case worker <- event:
+					case <-sm.ctx.Done():
+						return
+					}
+				}
+				continue
+			}
+
+			worker := sm.workers[shardIndex(event.SessionID, len(sm.shards))%len(sm.workers)]
+			select {
+			case worker <- event:
+			case <-sm.ctx.Done():
+				return
+			}
+
+		case <-sm.ctx.Done():
+			return
+		}
+	}
+}
+
+// eventWorker processes the events of the shards pinned to it
+func (sm *SessionManager) eventWorker(events <-chan UserEvent) {
+	defer sm.workerWG.Done()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.EventType == sessionBarrierEvent {
+				sm.passBarrier(event.EventID)
+				continue
+			}
+
 			sm.processEvent(event)
 
 		case <-sm.ctx.Done():
@@ -149,12 +444,112 @@ func (sm *SessionManager) eventWorker() {
 	}
 }
 
+// SetAnomalyRules enables streaming anomaly detection: every event of an
+// active session is fed to the rules as it is processed and anomalies are
+// published as SessionAnomaly events. Call before Start.
+func (sm *SessionManager) SetAnomalyRules(rules *AnomalyRuleEngine) {
+	sm.rules = rules
+}
+
+// SubscribeAnomalies registers for the anomalies detected while sessions
+// are tracked; each lifecycle event carries one anomaly
+func (sm *SessionManager) SubscribeAnomalies(name string) *SessionSubscription {
+	return sm.bus.Subscribe(name, SessionAnomaly)
+}
+
+// OnAnomaly calls handle with every anomaly detected while sessions are
+// tracked, one at a time, until the returned subscription is closed
+func (sm *SessionManager) OnAnomaly(name string, handle func(AnomalyDetection)) *SessionSubscription {
+	sub := sm.SubscribeAnomalies(name)
+	go func() {
+		for event := range sub.C() {
+			handle(*event.Anomaly)
+		}
+	}()
+	return sub
+}
+
 // processEvent processes a single event
 func (sm *SessionManager) processEvent(event UserEvent) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	now := time.Now()
+	sm.clockMu.Lock()
+	sm.clock.observe(event.Timestamp, now)
+	sm.clockMu.Unlock()
+
+	clientSessionID := event.SessionID
+	shard := sm.shardFor(clientSessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.processed++
+
+	lineage, tracked := shard.lineages[clientSessionID]
+	if !tracked {
+		lineage = &sessionLineage{current: clientSessionID, parts: 1}
+		shard.lineages[clientSessionID] = lineage
+	}
+
+	session, exists := shard.sessions[lineage.current]
+	previous := session
+	target := lineage.current
+
+	// An event older than the current part belongs to the earlier part
+	// covering its time, so parts never overlap; it is dropped as late once
+	// that part is gone
+	late := exists && lineage.parts > 1 && event.Timestamp.Before(session.StartTime)
+	if late {
+		session = sm.partCovering(shard, clientSessionID, lineage, event.Timestamp)
+		if session == nil {
+			shard.late++
+			return
+		}
+		target = session.SessionID
+	}
+
+	// Start the next part of the client session when a split rule fires
+	if exists && !late {
+		if reason := sm.splitReason(session, lineage, event); reason != "" {
+			endReason := SessionClosed
+			if reason == SplitInactivity {
+				endReason = SessionExpired
+			}
+			sm.endSession(shard, session, session.LastActiveTime, endReason)
+
+			lineage.parts++
+			lineage.current = partID(clientSessionID, lineage.parts)
+			lineage.lastClose = time.Time{}
+			lineage.values = nil
+
+			session, exists = shard.sessions[lineage.current]
+			target = lineage.current
+			shard.splits++
+		}
+	}
+	event.SessionID = target
+
+	// A late event for an ended session re-opens it, while events beyond
+	// the allowed lateness are dropped. A session that expired too early
+	// stays open; a closed one is closed again once the event is added, so
+	// subscribers see it with the event.
+	var closedAt time.Time
+	if exists && !session.IsActive {
+		if event.Timestamp.Before(sm.watermark(now).Add(-sm.config.AllowedLateness)) {
+			shard.late++
+			return
+		}
+		if session.EndReason == SessionClosed && session.EndTime != nil {
+			closedAt = *session.EndTime
+		}
+		if session.EndReason == SessionExpired || session.EndReason == SessionClosed {
+			session.EndTime = nil
+			session.EndReason = ""
+			session.IsActive = true
+			shard.active++
+			shard.reopened++
+			sm.publish(SessionReopened, session, nil)
+		}
+	}
 
-	session, exists := sm.sessions[event.SessionID]
 	if !exists {
 		// Auto-create session if it doesn't exist
 		session = &Session{
@@ -166,29 +561,73 @@ func (sm *SessionManager) processEvent(event UserEvent) {
 			EventCount:     0,
 			Events:         make([]UserEvent, 0),
 		}
-		sm.sessions[event.SessionID] = session
+		if event.SessionID != clientSessionID {
+			session.ParentSessionID = clientSessionID
+		}
+		session.Platform, _ = metadataString(event, MetadataPlatform)
+		session.App, _ = metadataString(event, MetadataApp)
+		if previous != nil && session.Platform == "" && session.App == "" {
+			session.Platform, session.App = previous.Platform, previous.App
+		}
+		shard.sessions[event.SessionID] = session
+		shard.active++
+		sm.publish(SessionStarted, session, nil)
 	}
 
-	// Update session
-	session.LastActiveTime = event.Timestamp
+	// Update session bounds in event time, whatever order events arrive in
+	if event.Timestamp.Before(session.StartTime) {
+		session.StartTime = event.Timestamp
+	}
+	if event.Timestamp.After(session.LastActiveTime) {
+		session.LastActiveTime = event.Timestamp
+	}
 	session.EventCount++
+	if !late {
+		lineage.record(event, sm.config.Split)
+	}
+	if session.IsActive {
+		sm.scheduleExpiry(shard, session)
+	}
+
+	// Keep the earliest events in time order (limited buffer to prevent memory overflow)
+	session.Events, _ = insertEvent(session.Events, event, sm.config.MaxEvents)
+	sm.publish(SessionEventAdded, session, &event)
+	if session.IsActive {
+		sm.detectAnomalies(shard, session, event)
+	}
 
-	// Store event in session (limited buffer to prevent memory overflow)
-	if len(session.Events) < 1000 {
-		session.Events = append(session.Events, event)
+	// Handle session close event; the close event's time ends the session
+	// so split parts do not overlap
+	switch {
+	case event.EventType == EventAppClose:
+		sm.endSession(shard, session, event.Timestamp, SessionClosed)
+	case !closedAt.IsZero():
+		if event.Timestamp.After(closedAt) {
+			closedAt = event.Timestamp
+		}
+		sm.endSession(shard, session, closedAt, SessionClosed)
 	}
+}
 
-	// Handle session close event
-	if event.EventType == EventAppClose {
-		now := time.Now()
-		session.EndTime = &now
-		session.IsActive = false
+// partCovering returns the earlier part of a split client session an event
+// at ts belongs to: the last part starting at or before ts, or the first
+// part. It returns nil when that part has been removed already.
+func (sm *SessionManager) partCovering(shard *sessionShard, clientSessionID string, lineage *sessionLineage, ts time.Time) *Session {
+	for n := lineage.parts - 1; n >= 1; n-- {
+		session, exists := shard.sessions[partID(clientSessionID, n)]
+		if !exists {
+			return nil
+		}
+		if n == 1 || !ts.Before(session.StartTime) {
+			return session
+		}
 	}
+	return nil
 }
 
 // sessionTimeoutMonitor monitors sessions for timeouts
 func (sm *SessionManager) sessionTimeoutMonitor() {
-	ticker := time.NewTicker(SessionCleanupInterval)
+	ticker := time.NewTicker(sm.config.CleanupInterval)
 	defer ticker.Stop()
 
 	for {
@@ -202,33 +641,45 @@ func (sm *SessionManager) sessionTimeoutMonitor() {
 	}
 }
 
-// checkSessionTimeouts identifies and marks timed-out sessions
+// checkSessionTimeouts expires the sessions whose deadline the watermark has
+// passed, locking one shard at a time
 func (sm *SessionManager) checkSessionTimeouts() {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	now := time.Now()
+	watermark := sm.watermark(time.Now())
+
+	for _, shard := range sm.shards {
+		shard.mu.Lock()
+		for {
+			sessionID, due := shard.alerts.popBefore(watermark)
+			if !due {
+				break
+			}
 
-	for sessionID, session := range sm.sessions {
-		if !session.IsActive {
-			continue
+			if detector, exists := shard.detectors[sessionID]; exists {
+				sm.publishAnomalies(shard, shard.sessions[sessionID], detector.advance(watermark, false, time.Now()))
+				sm.scheduleAlert(shard, sessionID, detector)
+			}
 		}
 
-		// Check if session has been inactive for too long
-		if now.Sub(session.LastActiveTime) > SessionTimeout {
-			session.EndTime = &session.LastActiveTime
-			session.IsActive = false
+		for {
+			sessionID, due := shard.expiry.popBefore(watermark)
+			if !due {
+				break
+			}
 
-			// Notify about expired session
-			select {
-			case sm.sessionExpiry <- sessionID:
-			default:
-				// Channel full, skip notification
+			if session, exists := shard.sessions[sessionID]; exists {
+				sm.endSession(shard, session, session.LastActiveTime, SessionExpired)
 			}
 		}
+		shard.mu.Unlock()
 	}
 }
 
+// scheduleExpiry sets when an active session times out in event time; caller
+// must hold shard.mu
+func (sm *SessionManager) scheduleExpiry(shard *sessionShard, session *Session) {
+	shard.expiry.schedule(session.SessionID, session.LastActiveTime.Add(sm.config.timeoutFor(session)))
+}
+
 // cleanupWorker removes old inactive sessions from memory
 func (sm *SessionManager) cleanupWorker() {
 	ticker := time.NewTicker(10 * time.Minute)
@@ -245,22 +696,196 @@ func (sm *SessionManager) cleanupWorker() {
 	}
 }
 
-// cleanupOldSessions removes sessions older than 24 hours
+// cleanupOldSessions removes sessions that ended before the retention period
 func (sm *SessionManager) cleanupOldSessions() {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
 	now := time.Now()
-	cutoff := now.Add(-24 * time.Hour)
+	cutoff := now.Add(-sm.config.Retention)
+
+	for _, shard := range sm.shards {
+		shard.mu.Lock()
+		for sessionID, session := range shard.sessions {
+			if !session.IsActive && session.EndTime != nil && session.EndTime.Before(cutoff) {
+				delete(shard.sessions, sessionID)
 
-	for sessionID, session := range sm.sessions {
-		if !session.IsActive && session.EndTime != nil && session.EndTime.Before(cutoff) {
-			delete(sm.sessions, sessionID)
+				clientSessionID := session.clientSessionID()
+				if lineage, ok := shard.lineages[clientSessionID]; ok && lineage.current == sessionID {
+					delete(shard.lineages, clientSessionID)
+				}
+
+				sm.publish(SessionEvicted, session, nil)
+			}
 		}
+		shard.mu.Unlock()
+	}
+}
+
+// endSession marks an active session as ended at endTime and publishes the
+// change; caller must hold shard.mu
+func (sm *SessionManager) endSession(shard *sessionShard, session *Session, endTime time.Time, eventType SessionEventType) {
+	if !session.IsActive {
+		return
 	}
+
+	session.EndTime = &endTime
+	session.EndReason = eventType
+	session.IsActive = false
+	shard.active--
+	shard.expiry.cancel(session.SessionID)
+
+	// Absence rules still waiting for an expected event fire now, since
+	// the session will not receive it
+	if detector, exists := shard.detectors[session.SessionID]; exists {
+		sm.publishAnomalies(shard, session, detector.advance(endTime, true, time.Now()))
+		sm.dropDetector(shard, session.SessionID)
+	}
+
+	sm.publish(eventType, session, nil)
 }
 
-// GetExpiredSessionChannel returns the channel that emits expired session IDs
-func (sm *SessionManager) GetExpiredSessionChannel() <-chan string {
-	return sm.sessionExpiry
+// detectAnomalies feeds an event to the streaming rules of its session and
+// publishes the anomalies it completes; caller must hold shard.mu
+func (sm *SessionManager) detectAnomalies(shard *sessionShard, session *Session, event UserEvent) {
+	if sm.rules == nil {
+		return
+	}
+
+	rules, generation := sm.rules.enabledRules()
+	detector, exists := shard.detectors[session.SessionID]
+
+	// Reloaded rules start over with fresh state
+	if !exists || detector.generation != generation {
+		if len(rules) == 0 {
+			sm.dropDetector(shard, session.SessionID)
+			return
+		}
+		detector = newSessionDetector(rules, generation)
+		shard.detectors[session.SessionID] = detector
+	}
+
+	sm.publishAnomalies(shard, session, detector.observe(event, time.Now()))
+	sm.scheduleAlert(shard, session.SessionID, detector)
+}
+
+// scheduleAlert queues the next pending deadline of a session's detector;
+// caller must hold shard.mu
+func (sm *SessionManager) scheduleAlert(shard *sessionShard, sessionID string, detector *sessionDetector) {
+	if deadline := detector.deadline(); !deadline.IsZero() {
+		shard.alerts.schedule(sessionID, deadline)
+		return
+	}
+	shard.alerts.cancel(sessionID)
+}
+
+// dropDetector frees the streaming rule state of a session; caller must hold
+// shard.mu
+func (sm *SessionManager) dropDetector(shard *sessionShard, sessionID string) {
+	delete(shard.detectors, sessionID)
+	shard.alerts.cancel(sessionID)
+}
+
+// publishAnomalies counts detected anomalies and publishes each one with a
+// copy of its session; caller must hold shard.mu
+func (sm *SessionManager) publishAnomalies(shard *sessionShard, session *Session, anomalies []AnomalyDetection) {
+	shard.anomalies += int64(len(anomalies))
+	if len(anomalies) == 0 || !sm.bus.hasSubscribers(SessionAnomaly) {
+		return
+	}
+
+	for i := range anomalies {
+		sm.bus.Publish(SessionLifecycleEvent{
+			Type:    SessionAnomaly,
+			Session: copySession(session),
+			Anomaly: &anomalies[i],
+			Time:    time.Now(),
+		})
+	}
+}
+
+// reportAnomalies counts and publishes anomalies detected outside the
+// streaming rules, such as baseline deviations of ended sessions
+func (sm *SessionManager) reportAnomalies(session Session, anomalies []AnomalyDetection) {
+	shard := sm.shardFor(session.SessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	sm.publishAnomalies(shard, &session, anomalies)
+}
+
+// watermark returns the event time up to which events are assumed to have
+// arrived
+func (sm *SessionManager) watermark(now time.Time) time.Time {
+	sm.clockMu.Lock()
+	defer sm.clockMu.Unlock()
+
+	return sm.clock.now(now).Add(-sm.config.WatermarkDelay)
+}
+
+// Metrics returns the session counts, watermark and late event counters
+func (sm *SessionManager) Metrics() SessionMetrics {
+	metrics := SessionMetrics{
+		Shards:    len(sm.shards),
+		Watermark: sm.watermark(time.Now()),
+	}
+
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		metrics.Sessions += len(shard.sessions)
+		metrics.ActiveSessions += shard.active
+		metrics.EventsProcessed += shard.processed
+		metrics.LateDropped += shard.late
+		metrics.Reopened += shard.reopened
+		metrics.Splits += shard.splits
+		metrics.AnomaliesDetected += shard.anomalies
+		shard.mu.RUnlock()
+	}
+	return metrics
+}
+
+// SessionTimeout returns the inactivity timeout of a session, the default
+// timeout when the session is unknown
+func (sm *SessionManager) SessionTimeout(sessionID string) time.Duration {
+	shard := sm.shardFor(sessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if session, exists := shard.sessions[sessionID]; exists {
+		return sm.config.timeoutFor(session)
+	}
+	return sm.config.Timeout
+}
+
+// expiryDelay is the longest a session can stay open after its last event
+// before it is expired, plus the time it can still be re-opened
+func (sm *SessionManager) expiryDelay() time.Duration {
+	return sm.config.maxTimeout() + sm.config.CleanupInterval + sm.config.WatermarkDelay +
+		sm.config.WatermarkIdleTimeout + sm.config.AllowedLateness
+}
+
+// splitSession returns a copy of a session and whether its client session was
+// split, in which case sinks hold its events under the client session ID
+// together with the other parts
+func (sm *SessionManager) splitSession(sessionID string) (session Session, split bool, exists bool) {
+	shard := sm.shardFor(sessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	found, exists := shard.sessions[sessionID]
+	if !exists {
+		return Session{}, false, false
+	}
+
+	lineage, tracked := shard.lineages[found.clientSessionID()]
+	split = found.ParentSessionID != "" || (tracked && lineage.parts > 1)
+	return copySession(found), split, true
+}
+
+// copySession returns a copy of a session without its buffered events
+func copySession(session *Session) Session {
+	found := *session
+	found.Events = nil
+	if session.EndTime != nil {
+		endTime := *session.EndTime
+		found.EndTime = &endTime
+	}
+	return found
 }
@@ -0,0 +1,320 @@
+package user_behavior
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionManagerSettle(t *testing.T) {
+	sm := NewSessionManager(64, BackpressureConfig{}, SessionConfig{Shards: 4})
+	sm.Start(3)
+	defer sm.Stop()
+
+	t0 := time.Now()
+	for i := 0; i < 50; i++ {
+		event := UserEvent{
+			EventID:   "evt-" + string(rune('A'+i)),
+			UserID:    "u1",
+			SessionID: "s" + string(rune('a'+i%5)),
+			EventType: EventTyping,
+			Timestamp: t0.Add(time.Duration(i) * time.Millisecond),
+		}
+		if err := sm.TrackEvent(event); err != nil {
+			t.Fatalf("TrackEvent() error = %v", err)
+		}
+	}
+
+	if !sm.settle(time.Second) {
+		t.Fatal("settle() = false, want the queued events processed")
+	}
+	if got := sm.Metrics().EventsProcessed; got != 50 {
+		t.Errorf("EventsProcessed = %d after settle, want 50", got)
+	}
+}
+
+func TestSessionManagerReplayEvent(t *testing.T) {
+	sm := NewSessionManager(8, BackpressureConfig{}, SessionConfig{})
+	t0 := time.Now()
+
+	held := UserEvent{EventID: "evt-1", UserID: "u1", SessionID: "s1", EventType: EventTyping, Timestamp: t0}
+	sm.processEvent(held)
+
+	// The restored session holds evt-1 already
+	if err := sm.replayEvent(held); err != nil {
+		t.Fatalf("replayEvent() error = %v", err)
+	}
+	if depth := sm.QueueMetrics().Depth; depth != 0 {
+		t.Errorf("queue depth = %d after replaying a held event, want 0", depth)
+	}
+
+	missing := held
+	missing.EventID = "evt-2"
+	if err := sm.replayEvent(missing); err != nil {
+		t.Fatalf("replayEvent() error = %v", err)
+	}
+	if depth := sm.QueueMetrics().Depth; depth != 1 {
+		t.Errorf("queue depth = %d after replaying a missing event, want 1", depth)
+	}
+}
+
+func TestSessionManagerLateEventInSplitSession(t *testing.T) {
+	t0 := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		late       time.Duration // after t0
+		removeHead bool
+		wantPart   string
+		wantCounts map[string]int
+	}{
+		{
+			name:       "within the first part",
+			late:       time.Minute,
+			wantPart:   "s1",
+			wantCounts: map[string]int{"s1": 3, "s1#2": 1},
+		},
+		{
+			name:       "between the parts",
+			late:       40 * time.Minute,
+			wantPart:   "s1",
+			wantCounts: map[string]int{"s1": 3, "s1#2": 1},
+		},
+		{
+			name:       "before the first part",
+			late:       -time.Minute,
+			wantPart:   "s1",
+			wantCounts: map[string]int{"s1": 3, "s1#2": 1},
+		},
+		{
+			name:       "earlier part removed",
+			late:       time.Minute,
+			removeHead: true,
+			wantCounts: map[string]int{"s1#2": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewSessionManager(8, BackpressureConfig{}, SessionConfig{
+				Timeout:         30 * time.Minute,
+				AllowedLateness: 24 * time.Hour,
+			})
+
+			track := func(eventID string, at time.Duration) {
+				sm.processEvent(UserEvent{
+					EventID:   eventID,
+					UserID:    "u1",
+					SessionID: "s1",
+					EventType: EventTyping,
+					Timestamp: t0.Add(at),
+				})
+			}
+			track("a", 0)
+			track("b", 2*time.Minute)
+			track("c", time.Hour) // past the inactivity timeout, starts s1#2
+
+			if tt.removeHead {
+				shard := sm.shardFor("s1")
+				delete(shard.sessions, "s1")
+			}
+			track("late", tt.late)
+
+			for id, want := range tt.wantCounts {
+				session, exists := sm.GetSession(id)
+				if !exists {
+					t.Fatalf("session %s missing", id)
+				}
+				if session.EventCount != want {
+					t.Errorf("%s EventCount = %d, want %d", id, session.EventCount, want)
+				}
+			}
+
+			if splits := sm.Metrics().Splits; splits != 1 {
+				t.Errorf("Splits = %d, want 1", splits)
+			}
+
+			second, _ := sm.GetSession("s1#2")
+			if !second.StartTime.Equal(t0.Add(time.Hour)) {
+				t.Errorf("s1#2 StartTime = %v, want %v", second.StartTime, t0.Add(time.Hour))
+			}
+			if tt.wantPart == "" {
+				if got := sm.Metrics().LateDropped; got != 1 {
+					t.Errorf("LateDropped = %d, want 1", got)
+				}
+				return
+			}
+			if first, _ := sm.GetSession(tt.wantPart); tt.late < 0 && !first.StartTime.Equal(t0.Add(tt.late)) {
+				t.Errorf("%s StartTime = %v, want %v", tt.wantPart, first.StartTime, t0.Add(tt.late))
+			}
+		})
+	}
+}
+
+func TestSessionManagerExpiry(t *testing.T) {
+	sm := NewSessionManager(8, BackpressureConfig{}, SessionConfig{Timeout: 5 * time.Minute, Shards: 4})
+	now := time.Now()
+
+	track := func(sessionID string, ago time.Duration) {
+		sm.processEvent(UserEvent{
+			EventID:   sessionID + "-" + ago.String(),
+			UserID:    "u1",
+			SessionID: sessionID,
+			EventType: EventTyping,
+			Timestamp: now.Add(-ago),
+		})
+	}
+	track("idle", 10*time.Minute)
+	track("idle", 7*time.Minute)
+	track("recent", 3*time.Minute)
+	// The second event moves the deadline past the watermark
+	track("extended", 6*time.Minute)
+	track("extended", 3*time.Minute)
+
+	sm.checkSessionTimeouts()
+
+	tests := []struct {
+		sessionID  string
+		wantActive bool
+	}{
+		{sessionID: "idle"},
+		{sessionID: "recent", wantActive: true},
+		{sessionID: "extended", wantActive: true},
+	}
+	for _, tt := range tests {
+		session, exists := sm.GetSession(tt.sessionID)
+		if !exists {
+			t.Fatalf("session %s missing", tt.sessionID)
+		}
+		if session.IsActive != tt.wantActive {
+			t.Errorf("%s IsActive = %v, want %v", tt.sessionID, session.IsActive, tt.wantActive)
+		}
+		if tt.wantActive {
+			continue
+		}
+		if session.EndReason != SessionExpired || session.EndTime == nil || !session.EndTime.Equal(session.LastActiveTime) {
+			t.Errorf("%s EndReason, EndTime = %s, %v, want %s at %v",
+				tt.sessionID, session.EndReason, session.EndTime, SessionExpired, session.LastActiveTime)
+		}
+	}
+
+	metrics := sm.Metrics()
+	if metrics.Sessions != 3 || metrics.ActiveSessions != 2 || metrics.EventsProcessed != 5 {
+		t.Errorf("Sessions, ActiveSessions, EventsProcessed = %d, %d, %d, want 3, 2, 5",
+			metrics.Sessions, metrics.ActiveSessions, metrics.EventsProcessed)
+	}
+	for _, shard := range sm.shards {
+		if len(shard.expiry.heap) != len(shard.expiry.items) {
+			t.Errorf("expiry heap holds %d sessions, index %d", len(shard.expiry.heap), len(shard.expiry.items))
+		}
+	}
+}
+
+func TestSessionManagerShards(t *testing.T) {
+	sm := NewSessionManager(64, BackpressureConfig{}, SessionConfig{Shards: 4})
+	sm.Start(2)
+
+	t0 := time.Now()
+	for i := 0; i < 40; i++ {
+		event := UserEvent{
+			EventID:   "evt-" + string(rune('A'+i)),
+			UserID:    "u1",
+			SessionID: "s" + string(rune('a'+i%8)),
+			EventType: EventTyping,
+			Timestamp: t0.Add(time.Duration(i) * time.Millisecond),
+		}
+		if err := sm.TrackEvent(event); err != nil {
+			t.Fatalf("TrackEvent() error = %v", err)
+		}
+	}
+	if err := sm.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	for i, shard := range sm.shards {
+		for sessionID := range shard.sessions {
+			if index := shardIndex(sessionID, len(sm.shards)); index != i {
+				t.Errorf("session %s in shard %d, want %d", sessionID, i, index)
+			}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		sessionID := "s" + string(rune('a'+i))
+		events := sm.GetSessionEvents(sessionID)
+		if len(events) != 5 {
+			t.Fatalf("%s has %d events, want 5", sessionID, len(events))
+		}
+		for j := 1; j < len(events); j++ {
+			if events[j].Timestamp.Before(events[j-1].Timestamp) {
+				t.Errorf("%s events out of order at %d", sessionID, j)
+			}
+		}
+	}
+	if metrics := sm.Metrics(); metrics.Shards != 4 || metrics.Sessions != 8 || metrics.EventsProcessed != 40 {
+		t.Errorf("Shards, Sessions, EventsProcessed = %d, %d, %d, want 4, 8, 40",
+			metrics.Shards, metrics.Sessions, metrics.EventsProcessed)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	tests := []struct {
+		sessionID string
+		want      string
+	}{
+		{sessionID: "s1", want: "s1"},
+		{sessionID: "s1#2", want: "s1"},
+		{sessionID: "s1#2#3", want: "s1"},
+		{sessionID: "s1#", want: "s1#"},
+		{sessionID: "s1#b", want: "s1#b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sessionID, func(t *testing.T) {
+			if got := shardKey(tt.sessionID); got != tt.want {
+				t.Errorf("shardKey() = %q, want %q", got, tt.want)
+			}
+			if shardIndex(tt.sessionID, 7) != shardIndex(tt.want, 7) {
+				t.Errorf("%s and %s hash to different shards", tt.sessionID, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiryQueue(t *testing.T) {
+	t0 := time.Date(2026, 8, 1, 9, 0, 0, 0, time.UTC)
+	q := expiryQueue{items: make(map[string]*expiryItem)}
+
+	q.schedule("a", t0.Add(3*time.Minute))
+	q.schedule("b", t0.Add(time.Minute))
+	q.schedule("c", t0.Add(2*time.Minute))
+	q.schedule("d", t0.Add(4*time.Minute))
+	q.schedule("b", t0.Add(5*time.Minute)) // rescheduled later
+	q.cancel("c")
+	q.cancel("missing")
+
+	if _, due := q.popBefore(t0.Add(3 * time.Minute)); due {
+		t.Fatal("popBefore() returned a session due at the cutoff")
+	}
+
+	var popped []string
+	for {
+		sessionID, due := q.popBefore(t0.Add(10 * time.Minute))
+		if !due {
+			break
+		}
+		popped = append(popped, sessionID)
+	}
+
+	want := []string{"a", "d", "b"}
+	if len(popped) != len(want) {
+		t.Fatalf("popped %v, want %v", popped, want)
+	}
+	for i := range want {
+		if popped[i] != want[i] {
+			t.Errorf("popped %v, want %v", popped, want)
+			break
+		}
+	}
+	if len(q.items) != 0 {
+		t.Errorf("items = %d after popping all, want 0", len(q.items))
+	}
+}
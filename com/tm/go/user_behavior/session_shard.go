@@ -0,0 +1,161 @@
+package user_behavior
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionShards is the number of session map shards when
+	// SessionConfig.Shards is not set
+	DefaultSessionShards = 32
+
+	// shardQueueSize buffers the events routed to each session worker
+	shardQueueSize = 256
+)
+
+// sessionShard holds the sessions of the client session IDs hashing to it,
+// together with their split lineages, so every part of a client session
+// lives in one shard. Each shard is processed by a single worker, keeping
+// the events of a session in arrival order.
+type sessionShard struct {
+	sessions  map[string]*Session
+	lineages  map[string]*sessionLineage // keyed by client session ID
+	expiry    expiryQueue
+	active    int
+	processed int64
+	late      int64
+	reopened  int64
+	splits    int64
+	mu        sync.RWMutex
+
+	// detectors hold the streaming anomaly rule state of active sessions,
+	// alerts the event time their pending absence rules fire
+	detectors map[string]*sessionDetector
+	alerts    expiryQueue
+	anomalies int64
+}
+
+// newSessionShard creates an empty shard
+func newSessionShard() *sessionShard {
+	return &sessionShard{
+		sessions: make(map[string]*Session),
+		lineages: make(map[string]*sessionLineage),
+		expiry:   expiryQueue{items: make(map[string]*expiryItem)},
+
+		detectors: make(map[string]*sessionDetector),
+		alerts:    expiryQueue{items: make(map[string]*expiryItem)},
+	}
+}
+
+// shardKey returns the client session ID of a tracked session ID by removing
+// the part suffixes added by split rules
+func shardKey(sessionID string) string {
+	for {
+		i := strings.LastIndex(sessionID, splitSessionSeparator)
+		if i < 0 || !isDigits(sessionID[i+1:]) {
+			return sessionID
+		}
+		sessionID = sessionID[:i]
+	}
+}
+
+// isDigits reports whether s is a non-empty run of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// shardIndex hashes a session ID into one of n shards
+func shardIndex(sessionID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(shardKey(sessionID)))
+	return int(h.Sum32() % uint32(n))
+}
+
+// expiryItem is the expiry deadline of an active session
+type expiryItem struct {
+	sessionID string
+	deadline  time.Time
+	index     int
+}
+
+// expiryQueue is a min-heap of session expiry deadlines, so a timeout check
+// only visits the sessions that are due instead of every session
+type expiryQueue struct {
+	heap  expiryHeap
+	items map[string]*expiryItem
+}
+
+// schedule sets the deadline of a session, adding it when not queued
+func (q *expiryQueue) schedule(sessionID string, deadline time.Time) {
+	if item, ok := q.items[sessionID]; ok {
+		item.deadline = deadline
+		heap.Fix(&q.heap, item.index)
+		return
+	}
+
+	item := &expiryItem{sessionID: sessionID, deadline: deadline}
+	q.items[sessionID] = item
+	heap.Push(&q.heap, item)
+}
+
+// cancel removes a session from the queue
+func (q *expiryQueue) cancel(sessionID string) {
+	item, ok := q.items[sessionID]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&q.heap, item.index)
+	delete(q.items, sessionID)
+}
+
+// popBefore removes and returns the session with the earliest deadline when
+// that deadline is before t
+func (q *expiryQueue) popBefore(t time.Time) (string, bool) {
+	if len(q.heap) == 0 || !q.heap[0].deadline.Before(t) {
+		return "", false
+	}
+
+	item := heap.Pop(&q.heap).(*expiryItem)
+	delete(q.items, item.sessionID)
+	return item.sessionID, true
+}
+
+// expiryHeap implements heap.Interface ordered by deadline
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
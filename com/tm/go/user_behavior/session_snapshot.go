@@ -0,0 +1,546 @@
+package user_behavior
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuna/gohbase"
+	"github.com/tsuna/gohbase/hrpc"
+)
+
+const (
+	// Snapshot store types accepted in SessionSnapshotConfig.Type
+	SnapshotStoreNone  = ""
+	SnapshotStoreFile  = "file"
+	SnapshotStoreHBase = "hbase"
+
+	DefaultSessionSnapshotFile     = "user_behavior_sessions.json"
+	DefaultSessionSnapshotTable    = "user_behavior_sessions"
+	DefaultSessionSnapshotInterval = time.Minute
+
+	// HBase snapshot layout: rows are prefixed with <instance>| so instances
+	// can share a table, with one s_<sessionId> row per session and a meta
+	// row holding the time of the last snapshot
+	snapshotColumnFamily     = "s"
+	snapshotDataQualifier    = "data"
+	snapshotTakenAtQualifier = "taken_at"
+	snapshotInstanceSep      = "|"
+	snapshotSessionRowPrefix = "s_"
+	snapshotMetaRow          = "meta"
+	snapshotBatchSize        = 500
+)
+
+// SessionSnapshot is the persisted state of the active sessions
+type SessionSnapshot struct {
+	TakenAt  time.Time      `json:"taken_at"`
+	Sessions []SessionState `json:"sessions"`
+}
+
+// SessionState is an active session with its buffered events and the split
+// rule state of its client session
+type SessionState struct {
+	Session Session     `json:"session"`
+	Events  []UserEvent `json:"events"`
+
+	Parts       int               `json:"parts,omitempty"`
+	LastClose   time.Time         `json:"last_close,omitempty"`
+	SplitValues map[string]string `json:"split_values,omitempty"`
+}
+
+// SessionSnapshotStore keeps the latest SessionManager snapshot. The
+// SessionManager serializes calls, so stores need not be safe for concurrent use.
+type SessionSnapshotStore interface {
+	// Save replaces the stored snapshot
+	Save(snapshot SessionSnapshot) error
+
+	// Load returns the stored snapshot, nil when there is none
+	Load() (*SessionSnapshot, error)
+
+	// Close releases the store's resources
+	Close() error
+}
+
+// SessionSnapshotConfig selects and configures the session snapshot store
+type SessionSnapshotConfig struct {
+	Type       string
+	FilePath   string
+	HBaseTable string
+
+	// InstanceID prefixes this instance's rows in the HBase table, so each
+	// instance only restores and deletes its own sessions. It must stay the
+	// same across restarts and is required by the HBase store; the collector
+	// defaults it to the cluster address.
+	InstanceID string
+
+	// Interval between snapshots; defaults to DefaultSessionSnapshotInterval.
+	// A final snapshot is taken on Stop.
+	Interval time.Duration
+}
+
+// NewSessionSnapshotStore creates the configured store; it returns nil when
+// none is set
+func NewSessionSnapshotStore(config SessionSnapshotConfig, hbaseHost string) (SessionSnapshotStore, error) {
+	switch strings.ToLower(config.Type) {
+	case SnapshotStoreNone:
+		return nil, nil
+	case SnapshotStoreFile:
+		return NewFileSnapshotStore(config.FilePath), nil
+	case SnapshotStoreHBase:
+		// A generated default such as the hostname changes when a container
+		// is rescheduled, leaving the previous snapshot unrestored
+		if config.InstanceID == "" {
+			return nil, fmt.Errorf("%w: the hbase store needs an instance ID", ErrInvalidSnapshot)
+		}
+		return NewHBaseSnapshotStore(hbaseHost, config.HBaseTable, config.InstanceID), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSnapshot, config.Type)
+	}
+}
+
+// FileSnapshotStore keeps the snapshot as a JSON file, replaced atomically
+type FileSnapshotStore struct {
+	path string
+}
+
+// NewFileSnapshotStore creates a store writing to path
+func NewFileSnapshotStore(path string) *FileSnapshotStore {
+	if path == "" {
+		path = DefaultSessionSnapshotFile
+	}
+	return &FileSnapshotStore{path: path}
+}
+
+// Save writes the snapshot to a temporary file and renames it into place
+func (fs *FileSnapshotStore) Save(snapshot SessionSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode session snapshot: %w", err)
+	}
+
+	if dir := filepath.Dir(fs.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create snapshot dir: %w", err)
+		}
+	}
+
+	return writeFileAtomic(fs.path, data)
+}
+
+// Load reads the snapshot file
+func (fs *FileSnapshotStore) Load() (*SessionSnapshot, error) {
+	data, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session snapshot: %w", err)
+	}
+
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode session snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// Close is a no-op; the file is only open while saving or loading
+func (fs *FileSnapshotStore) Close() error {
+	return nil
+}
+
+// HBaseSnapshotStore keeps one row per session, so no cell grows with the
+// number of sessions. Rows of sessions missing from a later snapshot are
+// deleted. Rows are prefixed with the instance ID and only this instance's
+// rows are read or deleted.
+type HBaseSnapshotStore struct {
+	client    gohbase.Client
+	tableName string
+	prefix    string
+	saved     map[string]bool // session IDs with a row
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewHBaseSnapshotStore creates a store writing instanceID's rows to tableName
+func NewHBaseSnapshotStore(hbaseHost string, tableName string, instanceID string) *HBaseSnapshotStore {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if tableName == "" {
+		tableName = DefaultSessionSnapshotTable
+	}
+
+	return &HBaseSnapshotStore{
+		client:    gohbase.NewClient(hbaseHost),
+		tableName: tableName,
+		prefix:    instanceID + snapshotInstanceSep,
+		saved:     make(map[string]bool),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Save writes a row per session and the snapshot time, then deletes the rows
+// of sessions no longer in the snapshot
+func (hs *HBaseSnapshotStore) Save(snapshot SessionSnapshot) error {
+	current := make(map[string]bool, len(snapshot.Sessions))
+	calls := make([]hrpc.Call, 0, len(snapshot.Sessions)+1)
+
+	for _, state := range snapshot.Sessions {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode session %s: %w", state.Session.SessionID, err)
+		}
+
+		put, err := hrpc.NewPutStr(hs.ctx, hs.tableName, hs.sessionRow(state.Session.SessionID),
+			map[string]map[string][]byte{snapshotColumnFamily: {snapshotDataQualifier: data}})
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot put: %w", err)
+		}
+		calls = append(calls, put)
+		current[state.Session.SessionID] = true
+	}
+
+	takenAt, err := snapshot.TakenAt.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot time: %w", err)
+	}
+	meta, err := hrpc.NewPutStr(hs.ctx, hs.tableName, hs.prefix+snapshotMetaRow,
+		map[string]map[string][]byte{snapshotColumnFamily: {snapshotTakenAtQualifier: takenAt}})
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot put: %w", err)
+	}
+	calls = append(calls, meta)
+
+	if err := hs.send(calls); err != nil {
+		// Track the new rows too, so a later snapshot deletes them once
+		// their sessions end
+		for sessionID := range current {
+			hs.saved[sessionID] = true
+		}
+		return err
+	}
+
+	var deletes []hrpc.Call
+	for sessionID := range hs.saved {
+		if current[sessionID] {
+			continue
+		}
+
+		del, err := hrpc.NewDelStr(hs.ctx, hs.tableName, hs.sessionRow(sessionID), nil)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot delete: %w", err)
+		}
+		deletes = append(deletes, del)
+	}
+	if err := hs.send(deletes); err != nil {
+		for sessionID := range current {
+			hs.saved[sessionID] = true
+		}
+		return err
+	}
+
+	hs.saved = current
+	return nil
+}
+
+// sessionRow returns the row key of one of this instance's sessions
+func (hs *HBaseSnapshotStore) sessionRow(sessionID string) string {
+	return hs.prefix + snapshotSessionRowPrefix + sessionID
+}
+
+// send runs calls in SendBatch RPCs of at most snapshotBatchSize calls
+func (hs *HBaseSnapshotStore) send(calls []hrpc.Call) error {
+	for start := 0; start < len(calls); start += snapshotBatchSize {
+		end := start + snapshotBatchSize
+		if end > len(calls) {
+			end = len(calls)
+		}
+
+		results, allOK := hs.client.SendBatch(hs.ctx, calls[start:end])
+		if allOK {
+			continue
+		}
+		for i := range calls[start:end] {
+			if i >= len(results) {
+				return fmt.Errorf("failed to save session snapshot: no result for call")
+			}
+			if results[i].Error != nil {
+				return fmt.Errorf("failed to save session snapshot: %w", results[i].Error)
+			}
+		}
+	}
+	return nil
+}
+
+// Load scans the session rows of this instance
+func (hs *HBaseSnapshotStore) Load() (*SessionSnapshot, error) {
+	keys := prefixRange(hs.prefix)
+	scanRequest, err := hrpc.NewScanRangeStr(hs.ctx, hs.tableName, keys.Start, keys.Stop,
+		hrpc.Families(map[string][]string{snapshotColumnFamily: nil}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot scan: %w", err)
+	}
+
+	scanner := hs.client.Scan(scanRequest)
+	defer scanner.Close()
+
+	var snapshot SessionSnapshot
+	found := false
+
+	for {
+		result, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+
+		for _, cell := range result.Cells {
+			switch string(cell.Qualifier) {
+			case snapshotTakenAtQualifier:
+				if err := snapshot.TakenAt.UnmarshalText(cell.Value); err != nil {
+					return nil, fmt.Errorf("failed to decode snapshot time: %w", err)
+				}
+				found = true
+
+			case snapshotDataQualifier:
+				var state SessionState
+				if err := json.Unmarshal(cell.Value, &state); err != nil {
+					fmt.Printf("Skipping undecodable session row %s: %v\n", cell.Row, err)
+					continue
+				}
+				snapshot.Sessions = append(snapshot.Sessions, state)
+				hs.saved[state.Session.SessionID] = true
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return &snapshot, nil
+}
+
+// Close closes the HBase client
+func (hs *HBaseSnapshotStore) Close() error {
+	hs.cancel()
+	hs.client.Close()
+	return nil
+}
+
+// SetSnapshotStore enables restoring sessions on Start and saving them every
+// interval and on Stop; must be called before Start
+func (sm *SessionManager) SetSnapshotStore(store SessionSnapshotStore, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSessionSnapshotInterval
+	}
+
+	sm.snapshots = store
+	sm.snapshotInterval = interval
+}
+
+// Snapshot returns the active sessions with their buffered events
+func (sm *SessionManager) Snapshot() SessionSnapshot {
+	snapshot := SessionSnapshot{TakenAt: time.Now()}
+
+	for _, shard := range sm.shards {
+		shard.mu.RLock()
+		for _, session := range shard.sessions {
+			if session.IsActive {
+				snapshot.Sessions = append(snapshot.Sessions, shard.sessionState(session))
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	return snapshot
+}
+
+// release removes the active sessions matching the predicate, with the split
+// state of their client sessions, and returns them. No lifecycle events are
+// published; the sessions continue wherever they are restored.
+func (sm *SessionManager) release(match func(sessionID string) bool) []SessionState {
+	var states []SessionState
+
+	for _, shard := range sm.shards {
+		shard.mu.Lock()
+		for sessionID, session := range shard.sessions {
+			if !session.IsActive || !match(sessionID) {
+				continue
+			}
+
+			states = append(states, shard.sessionState(session))
+
+			delete(shard.sessions, sessionID)
+			shard.active--
+			shard.expiry.cancel(sessionID)
+			sm.dropDetector(shard, sessionID)
+
+			clientSessionID := session.clientSessionID()
+			if lineage, ok := shard.lineages[clientSessionID]; ok && lineage.current == sessionID {
+				delete(shard.lineages, clientSessionID)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return states
+}
+
+// sessionState copies a session with its events and, when it is the current
+// part of its client session, the split rule state; caller must hold shard.mu
+func (shard *sessionShard) sessionState(session *Session) SessionState {
+	state := SessionState{
+		Session: copySession(session),
+		Events:  make([]UserEvent, len(session.Events)),
+	}
+	copy(state.Events, session.Events)
+
+	lineage, tracked := shard.lineages[session.clientSessionID()]
+	if tracked && lineage.current == session.SessionID {
+		state.Parts = lineage.parts
+		state.LastClose = lineage.lastClose
+		if len(lineage.values) > 0 {
+			state.SplitValues = make(map[string]string, len(lineage.values))
+			for key, value := range lineage.values {
+				state.SplitValues[key] = value
+			}
+		}
+	}
+
+	return state
+}
+
+// restore adds the sessions of a snapshot or handoff and returns how many
+// were added. A session already tracked, because events arrived before it
+// was restored, is merged with the restored one.
+func (sm *SessionManager) restore(snapshot SessionSnapshot) int {
+	restored := 0
+
+	for _, state := range snapshot.Sessions {
+		session := state.Session
+		session.Events = state.Events
+		session.IsActive = true
+		session.EndTime = nil
+		session.EndReason = ""
+
+		shard := sm.shardFor(session.SessionID)
+		shard.mu.Lock()
+
+		if existing, exists := shard.sessions[session.SessionID]; exists {
+			sm.mergeSession(shard, existing, &session)
+		} else {
+			shard.sessions[session.SessionID] = &session
+			shard.active++
+			sm.scheduleExpiry(shard, &session)
+			restored++
+		}
+
+		clientSessionID := session.clientSessionID()
+		lineage, tracked := shard.lineages[clientSessionID]
+		if state.Parts > 0 && (!tracked || lineage.parts < state.Parts) {
+			shard.lineages[clientSessionID] = &sessionLineage{
+				current:   session.SessionID,
+				parts:     state.Parts,
+				lastClose: state.LastClose,
+				values:    state.SplitValues,
+			}
+		}
+
+		shard.mu.Unlock()
+	}
+
+	return restored
+}
+
+// mergeSession adds the bounds and events of a restored session to the
+// tracked one; caller must hold shard.mu. Events tracked on both sides, as
+// when a handoff is retried, are kept and counted once.
+func (sm *SessionManager) mergeSession(shard *sessionShard, existing *Session, restored *Session) {
+	if restored.StartTime.Before(existing.StartTime) {
+		existing.StartTime = restored.StartTime
+	}
+	if restored.LastActiveTime.After(existing.LastActiveTime) {
+		existing.LastActiveTime = restored.LastActiveTime
+	}
+
+	seen := make(map[string]bool, len(existing.Events))
+	for _, event := range existing.Events {
+		if event.EventID != "" {
+			seen[event.EventID] = true
+		}
+	}
+	duplicates := 0
+	for _, event := range restored.Events {
+		if event.EventID != "" {
+			if seen[event.EventID] {
+				duplicates++
+				continue
+			}
+			seen[event.EventID] = true
+		}
+		existing.Events, _ = insertEvent(existing.Events, event, sm.config.MaxEvents)
+	}
+
+	// Events past MaxEvents are counted but not kept, so the count is the
+	// sum without the duplicates, and never below the events kept
+	existing.EventCount += restored.EventCount - duplicates
+	if existing.EventCount < len(existing.Events) {
+		existing.EventCount = len(existing.Events)
+	}
+
+	if existing.IsActive {
+		sm.scheduleExpiry(shard, existing)
+	}
+}
+
+// restoreSnapshot loads the stored snapshot into the session maps
+func (sm *SessionManager) restoreSnapshot() {
+	snapshot, err := sm.snapshots.Load()
+	if err != nil {
+		fmt.Printf("Failed to load session snapshot: %v\n", err)
+		return
+	}
+	if snapshot == nil {
+		return
+	}
+
+	restored := sm.restore(*snapshot)
+	fmt.Printf("Restored %d sessions from snapshot taken at %v\n", restored, snapshot.TakenAt)
+}
+
+// saveSnapshot stores a snapshot of the active sessions; saves are
+// serialized so an older snapshot never replaces a newer one
+func (sm *SessionManager) saveSnapshot() error {
+	sm.snapshotMu.Lock()
+	defer sm.snapshotMu.Unlock()
+
+	return sm.snapshots.Save(sm.Snapshot())
+}
+
+// snapshotWorker saves a snapshot every snapshot interval
+func (sm *SessionManager) snapshotWorker() {
+	ticker := time.NewTicker(sm.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := sm.saveSnapshot(); err != nil {
+				fmt.Printf("Failed to save session snapshot: %v\n", err)
+			}
+
+		case <-sm.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package user_behavior
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Page sizes for GetUserEvents
+	DefaultUserEventsPageSize = 100
+	MaxUserEventsPageSize     = 1000
+)
+
+// UserEventFilter narrows and pages a GetUserEvents query
+type UserEventFilter struct {
+	// EventTypes and ScreenNames keep only matching events when not empty
+	EventTypes  []EventType
+	ScreenNames []string
+
+	// Limit is the page size, DefaultUserEventsPageSize when zero
+	Limit int
+
+	// Cursor continues after the last event of a previous page
+	Cursor string
+}
+
+// UserEventsPage is one page of a user's event history
+type UserEventsPage struct {
+	Events []UserEvent `json:"events"`
+
+	// NextCursor is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// userEventsCursor is the position after the last returned event. Events are
+// ordered by timestamp, then event ID.
+type userEventsCursor struct {
+	timestamp time.Time
+	eventID   string
+}
+
+// GetUserEvents returns a page of a user's events within [from, to) across
+// all of the user's sessions, oldest first
+func (ec *EventCollector) GetUserEvents(userID string, from, to time.Time, filter UserEventFilter) (UserEventsPage, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultUserEventsPageSize
+	}
+	if limit > MaxUserEventsPageSize {
+		limit = MaxUserEventsPageSize
+	}
+
+	var after *userEventsCursor
+	if filter.Cursor != "" {
+		cursor, err := decodeUserEventsCursor(filter.Cursor)
+		if err != nil {
+			return UserEventsPage{}, err
+		}
+		after = &cursor
+
+		// Nothing before the cursor is needed, let the store skip it
+		if cursor.timestamp.After(from) {
+			from = cursor.timestamp
+		}
+	}
+
+	events, err := ec.store.ScanUserEvents(userID, from, to)
+	if err != nil {
+		return UserEventsPage{}, fmt.Errorf("failed to scan user events: %w", err)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventBefore(events[i], events[j])
+	})
+
+	keep := filter.matcher()
+	page := UserEventsPage{Events: make([]UserEvent, 0, limit)}
+
+	for _, event := range events {
+		if after != nil && !eventAfterCursor(event, *after) {
+			continue
+		}
+		if !keep(event) {
+			continue
+		}
+
+		if len(page.Events) == limit {
+			last := page.Events[limit-1]
+			page.NextCursor = encodeUserEventsCursor(userEventsCursor{
+				timestamp: last.Timestamp,
+				eventID:   last.EventID,
+			})
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+
+	return page, nil
+}
+
+// matcher returns the event type and screen name filter as a predicate
+func (f UserEventFilter) matcher() func(UserEvent) bool {
+	eventTypes := make(map[EventType]bool, len(f.EventTypes))
+	for _, eventType := range f.EventTypes {
+		eventTypes[eventType] = true
+	}
+
+	screenNames := make(map[string]bool, len(f.ScreenNames))
+	for _, screenName := range f.ScreenNames {
+		screenNames[screenName] = true
+	}
+
+	return func(event UserEvent) bool {
+		if len(eventTypes) > 0 && !eventTypes[event.EventType] {
+			return false
+		}
+		if len(screenNames) > 0 && !screenNames[event.ScreenName] {
+			return false
+		}
+		return true
+	}
+}
+
+// eventBefore orders events by timestamp, then event ID
+func eventBefore(a, b UserEvent) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	return a.EventID < b.EventID
+}
+
+// eventAfterCursor reports whether an event comes after the cursor position
+func eventAfterCursor(event UserEvent, cursor userEventsCursor) bool {
+	return eventBefore(UserEvent{Timestamp: cursor.timestamp, EventID: cursor.eventID}, event)
+}
+
+// encodeUserEventsCursor returns an opaque cursor string
+func encodeUserEventsCursor(cursor userEventsCursor) string {
+	raw := strconv.FormatInt(cursor.timestamp.UnixNano(), 10) + ":" + cursor.eventID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeUserEventsCursor parses a cursor made by encodeUserEventsCursor
+func decodeUserEventsCursor(value string) (userEventsCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return userEventsCursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	nanos, eventID, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return userEventsCursor{}, ErrInvalidCursor
+	}
+
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return userEventsCursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	return userEventsCursor{
+		timestamp: time.Unix(0, unixNano),
+		eventID:   eventID,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package user_behavior
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsuna/gohbase"
+	"github.com/tsuna/gohbase/hrpc"
+)
+
+const (
+	// User index table layout. Row u_<userId> has one column per session of
+	// the user; row s_<sessionId> holds the owning user and, for time
+	// bucketed layouts, one b_<bucket> column per bucket the session spans.
+	DefaultIndexTable     = "user_behavior_index"
+	indexColumnFamily     = "s"
+	indexUserRowPrefix    = "u_"
+	indexSessionRowPrefix = "s_"
+	indexUserIDQualifier  = "user_id"
+	indexBucketPrefix     = "b_"
+)
+
+// userIndex maintains and reads the user to session index table
+type userIndex struct {
+	client  gohbase.Client
+	table   string
+	rowKeys RowKeyStrategy
+}
+
+// indexPut is an index mutation and the events it records
+type indexPut struct {
+	put    *hrpc.Mutate
+	events []int
+}
+
+// puts builds the index mutations for a batch of events, one per user row
+// and one per session row
+func (ui *userIndex) puts(ctx context.Context, events []UserEvent) ([]indexPut, error) {
+	userSessions := make(map[string]map[string][]byte)
+	sessionValues := make(map[string]map[string][]byte)
+	userEvents := make(map[string][]int)
+	sessionEvents := make(map[string][]int)
+
+	for i, event := range events {
+		if userSessions[event.UserID] == nil {
+			userSessions[event.UserID] = make(map[string][]byte)
+		}
+		userSessions[event.UserID][event.SessionID] = []byte("1")
+		userEvents[event.UserID] = append(userEvents[event.UserID], i)
+
+		if sessionValues[event.SessionID] == nil {
+			sessionValues[event.SessionID] = map[string][]byte{
+				indexUserIDQualifier: []byte(event.UserID),
+			}
+		}
+		if bucket, ok := ui.rowKeys.TimeBucket(event.Timestamp); ok {
+			sessionValues[event.SessionID][indexBucketPrefix+strconv.FormatInt(bucket, 10)] = []byte("1")
+		}
+		sessionEvents[event.SessionID] = append(sessionEvents[event.SessionID], i)
+	}
+
+	result := make([]indexPut, 0, len(userSessions)+len(sessionValues))
+
+	for userID, sessions := range userSessions {
+		put, err := hrpc.NewPutStr(ctx, ui.table, indexUserRowPrefix+userID,
+			map[string]map[string][]byte{indexColumnFamily: sessions})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create index put: %w", err)
+		}
+		result = append(result, indexPut{put: put, events: userEvents[userID]})
+	}
+
+	for sessionID, values := range sessionValues {
+		put, err := hrpc.NewPutStr(ctx, ui.table, indexSessionRowPrefix+sessionID,
+			map[string]map[string][]byte{indexColumnFamily: values})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create index put: %w", err)
+		}
+		result = append(result, indexPut{put: put, events: sessionEvents[sessionID]})
+	}
+
+	return result, nil
+}
+
+// sessionLocation reads the owning user and time buckets of a session
+func (ui *userIndex) sessionLocation(ctx context.Context, sessionID string) (SessionLocation, error) {
+	location := SessionLocation{SessionID: sessionID}
+
+	cells, err := ui.getRow(ctx, indexSessionRowPrefix+sessionID)
+	if err != nil {
+		return location, err
+	}
+
+	for _, cell := range cells {
+		qualifier := string(cell.Qualifier)
+		switch {
+		case qualifier == indexUserIDQualifier:
+			location.UserID = string(cell.Value)
+		case strings.HasPrefix(qualifier, indexBucketPrefix):
+			bucket, err := strconv.ParseInt(strings.TrimPrefix(qualifier, indexBucketPrefix), 10, 64)
+			if err == nil {
+				location.Buckets = append(location.Buckets, bucket)
+			}
+		}
+	}
+
+	sort.Slice(location.Buckets, func(i, j int) bool {
+		return location.Buckets[i] < location.Buckets[j]
+	})
+	return location, nil
+}
+
+// userSessions returns the IDs of every session recorded for a user
+func (ui *userIndex) userSessions(ctx context.Context, userID string) ([]string, error) {
+	cells, err := ui.getRow(ctx, indexUserRowPrefix+userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		sessions = append(sessions, string(cell.Qualifier))
+	}
+	sort.Strings(sessions)
+	return sessions, nil
+}
+
+// getRow reads every index column of a row; a missing row has no cells
+func (ui *userIndex) getRow(ctx context.Context, rowKey string) ([]*hrpc.Cell, error) {
+	getRequest, err := hrpc.NewGetStr(ctx, ui.table, rowKey,
+		hrpc.Families(map[string][]string{indexColumnFamily: nil}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index get: %w", err)
+	}
+
+	result, err := ui.client.Get(getRequest)
+	if err != nil {
+		return nil, fmt.Errorf("index get error: %w", err)
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return result.Cells, nil
+}
@@ -0,0 +1,501 @@
+package user_behavior
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProfileSaveInterval = time.Minute
+	DefaultProfileTopScreens   = 5
+	DefaultSignupMetadataKey   = "signup_at"
+
+	// MaxProfileActiveDays bounds the active days kept per user, enough
+	// for a year of daily or weekly retention
+	MaxProfileActiveDays = 400
+
+	// profileRecentSessions is how many ended sessions a profile remembers,
+	// so a session that is reopened and ends again is not counted twice
+	profileRecentSessions = 8
+
+	profileDayLayout = "2006-01-02"
+)
+
+// UserProfileConfig configures the user profile store
+type UserProfileConfig struct {
+	// FilePath persists the profiles as a JSON file when set, saved every
+	// SaveInterval and on Stop
+	FilePath     string
+	SaveInterval time.Duration
+
+	// SignupMetadataKey is the event metadata holding the signup time, as
+	// RFC3339 or unix milliseconds. Defaults to DefaultSignupMetadataKey.
+	SignupMetadataKey string
+
+	// TopScreens is the number of preferred screens reported.
+	// Defaults to DefaultProfileTopScreens.
+	TopScreens int
+
+	// Baseline flags sessions that deviate from their user's baseline
+	Baseline BaselineConfig
+}
+
+// withDefaults fills unset fields
+func (c UserProfileConfig) withDefaults() UserProfileConfig {
+	if c.SaveInterval <= 0 {
+		c.SaveInterval = DefaultProfileSaveInterval
+	}
+	if c.SignupMetadataKey == "" {
+		c.SignupMetadataKey = DefaultSignupMetadataKey
+	}
+	if c.TopScreens <= 0 {
+		c.TopScreens = DefaultProfileTopScreens
+	}
+	return c
+}
+
+// UserProfile aggregates the ended sessions of a user
+type UserProfile struct {
+	UserID    string     `json:"user_id"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	SignupAt  *time.Time `json:"signup_at,omitempty"`
+
+	SessionCount       int     `json:"session_count"`
+	EventCount         int     `json:"event_count"`
+	TotalDuration      int64   `json:"total_duration_seconds"`
+	AvgSessionDuration float64 `json:"avg_session_duration_seconds"`
+
+	// EventDistribution is the share of each event type in percent
+	EventCounts       map[EventType]int     `json:"event_counts"`
+	EventDistribution map[EventType]float64 `json:"event_distribution"`
+
+	// PreferredScreens are the most viewed screens, most viewed first
+	ScreenCounts     map[string]int `json:"screen_counts"`
+	PreferredScreens []string       `json:"preferred_screens"`
+
+	// ActiveDays are the UTC dates the user had sessions on, oldest first
+	ActiveDays []string  `json:"active_days"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// clone returns a copy sharing no maps or slices with the profile
+func (p UserProfile) clone() UserProfile {
+	c := p
+	if p.SignupAt != nil {
+		signupAt := *p.SignupAt
+		c.SignupAt = &signupAt
+	}
+	c.EventCounts = make(map[EventType]int, len(p.EventCounts))
+	for eventType, count := range p.EventCounts {
+		c.EventCounts[eventType] = count
+	}
+	c.EventDistribution = make(map[EventType]float64, len(p.EventDistribution))
+	for eventType, share := range p.EventDistribution {
+		c.EventDistribution[eventType] = share
+	}
+	c.ScreenCounts = make(map[string]int, len(p.ScreenCounts))
+	for screen, count := range p.ScreenCounts {
+		c.ScreenCounts[screen] = count
+	}
+	c.PreferredScreens = append([]string(nil), p.PreferredScreens...)
+	c.ActiveDays = append([]string(nil), p.ActiveDays...)
+	return c
+}
+
+// profileSession is what one ended session added to a profile
+type profileSession struct {
+	SessionID    string            `json:"session_id"`
+	Duration     int64             `json:"duration_seconds"`
+	EventCounts  map[EventType]int `json:"event_counts"`
+	ScreenCounts map[string]int    `json:"screen_counts"`
+
+	// Anomaly is the baseline deviation of the session, if any
+	Anomaly *AnomalyDetection `json:"anomaly,omitempty"`
+}
+
+// userProfileState is a profile with the sessions it remembers
+type userProfileState struct {
+	Profile UserProfile      `json:"profile"`
+	Recent  []profileSession `json:"recent"`
+
+	// Baseline is kept when the baseline mode is enabled
+	Baseline *userBaseline `json:"baseline,omitempty"`
+}
+
+// userProfileFile is the persisted profile store
+type userProfileFile struct {
+	SavedAt  time.Time           `json:"saved_at"`
+	Profiles []*userProfileState `json:"profiles"`
+}
+
+// UserProfileStore keeps a profile per user, updated as sessions end
+type UserProfileStore struct {
+	config   UserProfileConfig
+	baseline *baselineDetector
+	profiles map[string]*userProfileState
+	dirty    bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.RWMutex
+}
+
+// NewUserProfileStore creates a profile store, loading the persisted
+// profiles when a file is configured
+func NewUserProfileStore(config UserProfileConfig) (*UserProfileStore, error) {
+	baseline, err := newBaselineDetector(config.Baseline)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ps := &UserProfileStore{
+		config:   config.withDefaults(),
+		baseline: baseline,
+		profiles: make(map[string]*userProfileState),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	if err := ps.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Start begins saving the profiles periodically when a file is configured
+func (ps *UserProfileStore) Start() {
+	if ps.config.FilePath != "" {
+		go ps.saveWorker()
+	}
+}
+
+// Stop stops the save worker and saves the profiles a last time
+func (ps *UserProfileStore) Stop() error {
+	ps.cancel()
+	return ps.Save()
+}
+
+// Apply adds an ended session and its events to the user's profile and
+// returns the updated profile. A session applied before is replaced, so a
+// reopened session is counted once. When the baseline mode is enabled, the
+// first end of a session is also scored against the user's baseline and the
+// deviation, if any, is returned.
+func (ps *UserProfileStore) Apply(session Session, events []UserEvent, now time.Time) (UserProfile, *AnomalyDetection) {
+	end := session.LastActiveTime
+	if session.EndTime != nil {
+		end = *session.EndTime
+	}
+
+	contribution := profileSession{
+		SessionID:    session.SessionID,
+		Duration:     int64(end.Sub(session.StartTime).Seconds()),
+		EventCounts:  make(map[EventType]int),
+		ScreenCounts: make(map[string]int),
+	}
+	var signupAt *time.Time
+	for _, event := range events {
+		contribution.EventCounts[event.EventType]++
+		if event.ScreenName != "" && event.EventType == EventScreenView {
+			contribution.ScreenCounts[event.ScreenName]++
+		}
+		if value, ok := metadataString(event, ps.config.SignupMetadataKey); ok && signupAt == nil {
+			if parsed, err := parseSignupTime(value); err == nil {
+				signupAt = &parsed
+			}
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	state, exists := ps.profiles[session.UserID]
+	if !exists {
+		state = &userProfileState{Profile: UserProfile{
+			UserID:       session.UserID,
+			FirstSeen:    session.StartTime,
+			LastSeen:     end,
+			EventCounts:  make(map[EventType]int),
+			ScreenCounts: make(map[string]int),
+		}}
+		ps.profiles[session.UserID] = state
+	}
+	profile := &state.Profile
+
+	// Take back what an earlier end of the same session added
+	replaced := false
+	for i, recent := range state.Recent {
+		if recent.SessionID == session.SessionID {
+			profile.SessionCount--
+			profile.TotalDuration -= recent.Duration
+			addEventCounts(profile.EventCounts, recent.EventCounts, -1)
+			addScreenCounts(profile.ScreenCounts, recent.ScreenCounts, -1)
+			contribution.Anomaly = recent.Anomaly
+			state.Recent = append(state.Recent[:i], state.Recent[i+1:]...)
+			replaced = true
+			break
+		}
+	}
+	if !replaced && len(state.Recent) >= profileRecentSessions {
+		state.Recent = state.Recent[1:]
+	}
+
+	// A reopened session was scored when it first ended
+	var anomaly *AnomalyDetection
+	if !replaced && ps.baseline != nil {
+		if state.Baseline == nil {
+			state.Baseline = &userBaseline{}
+		}
+		anomaly = ps.baseline.observe(state.Baseline, session, end, contribution.EventCounts, now)
+		contribution.Anomaly = anomaly
+	}
+	state.Recent = append(state.Recent, contribution)
+
+	profile.SessionCount++
+	profile.TotalDuration += contribution.Duration
+	addEventCounts(profile.EventCounts, contribution.EventCounts, 1)
+	addScreenCounts(profile.ScreenCounts, contribution.ScreenCounts, 1)
+
+	if session.StartTime.Before(profile.FirstSeen) {
+		profile.FirstSeen = session.StartTime
+	}
+	if end.After(profile.LastSeen) {
+		profile.LastSeen = end
+	}
+	if signupAt != nil && (profile.SignupAt == nil || signupAt.Before(*profile.SignupAt)) {
+		profile.SignupAt = signupAt
+	}
+	for day := session.StartTime.UTC().Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		profile.ActiveDays = addActiveDay(profile.ActiveDays, day.Format(profileDayLayout))
+	}
+
+	ps.refresh(profile, now)
+	ps.dirty = true
+	return profile.clone(), anomaly
+}
+
+// refresh recomputes the derived fields of a profile; caller must hold ps.mu
+func (ps *UserProfileStore) refresh(profile *UserProfile, now time.Time) {
+	profile.AvgSessionDuration = 0
+	if profile.SessionCount > 0 {
+		profile.AvgSessionDuration = float64(profile.TotalDuration) / float64(profile.SessionCount)
+	}
+
+	profile.EventCount = 0
+	for _, count := range profile.EventCounts {
+		profile.EventCount += count
+	}
+	profile.EventDistribution = make(map[EventType]float64, len(profile.EventCounts))
+	for eventType, count := range profile.EventCounts {
+		profile.EventDistribution[eventType] = float64(count) / float64(profile.EventCount) * 100
+	}
+
+	screens := make([]string, 0, len(profile.ScreenCounts))
+	for screen := range profile.ScreenCounts {
+		screens = append(screens, screen)
+	}
+	sort.Slice(screens, func(i, j int) bool {
+		a, b := profile.ScreenCounts[screens[i]], profile.ScreenCounts[screens[j]]
+		if a != b {
+			return a > b
+		}
+		return screens[i] < screens[j]
+	})
+	if len(screens) > ps.config.TopScreens {
+		screens = screens[:ps.config.TopScreens]
+	}
+	profile.PreferredScreens = screens
+	profile.UpdatedAt = now
+}
+
+// Get returns a copy of a user's profile
+func (ps *UserProfileStore) Get(userID string) (UserProfile, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	state, exists := ps.profiles[userID]
+	if !exists {
+		return UserProfile{}, false
+	}
+	return state.Profile.clone(), true
+}
+
+// SessionAnomaly returns the baseline deviation of one of the user's recent
+// sessions
+func (ps *UserProfileStore) SessionAnomaly(userID, sessionID string) (AnomalyDetection, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	state, exists := ps.profiles[userID]
+	if !exists {
+		return AnomalyDetection{}, false
+	}
+	for _, recent := range state.Recent {
+		if recent.SessionID == sessionID && recent.Anomaly != nil {
+			return *recent.Anomaly, true
+		}
+	}
+	return AnomalyDetection{}, false
+}
+
+// Len returns the number of profiles
+func (ps *UserProfileStore) Len() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.profiles)
+}
+
+// each calls fn with every profile under the read lock; fn must not keep
+// the profile
+func (ps *UserProfileStore) each(fn func(profile *UserProfile)) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for _, state := range ps.profiles {
+		fn(&state.Profile)
+	}
+}
+
+// Save writes the profiles to the configured file if they changed
+func (ps *UserProfileStore) Save() error {
+	if ps.config.FilePath == "" {
+		return nil
+	}
+
+	ps.mu.Lock()
+	if !ps.dirty {
+		ps.mu.Unlock()
+		return nil
+	}
+	file := userProfileFile{SavedAt: time.Now(), Profiles: make([]*userProfileState, 0, len(ps.profiles))}
+	for _, state := range ps.profiles {
+		file.Profiles = append(file.Profiles, state)
+	}
+	data, err := json.Marshal(file)
+	ps.dirty = false
+	ps.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode user profiles: %w", err)
+	}
+
+	if dir := filepath.Dir(ps.config.FilePath); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create profile dir: %w", err)
+		}
+	}
+	if err := writeFileAtomic(ps.config.FilePath, data); err != nil {
+		ps.mu.Lock()
+		ps.dirty = true
+		ps.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// load reads the profiles from the configured file
+func (ps *UserProfileStore) load() error {
+	if ps.config.FilePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(ps.config.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read user profiles: %w", err)
+	}
+
+	var file userProfileFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to decode user profiles: %w", err)
+	}
+	for _, state := range file.Profiles {
+		if state.Profile.EventCounts == nil {
+			state.Profile.EventCounts = make(map[EventType]int)
+		}
+		if state.Profile.ScreenCounts == nil {
+			state.Profile.ScreenCounts = make(map[string]int)
+		}
+		ps.profiles[state.Profile.UserID] = state
+	}
+
+	fmt.Printf("Loaded %d user profiles from %s\n", len(ps.profiles), ps.config.FilePath)
+	return nil
+}
+
+// saveWorker saves the profiles every SaveInterval
+func (ps *UserProfileStore) saveWorker() {
+	ticker := time.NewTicker(ps.config.SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ps.Save(); err != nil {
+				fmt.Printf("Failed to save user profiles: %v\n", err)
+			}
+
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
+
+// addEventCounts adds sign times the counts of from to counts, dropping zeros
+func addEventCounts(counts, from map[EventType]int, sign int) {
+	for eventType, count := range from {
+		counts[eventType] += sign * count
+		if counts[eventType] <= 0 {
+			delete(counts, eventType)
+		}
+	}
+}
+
+// addScreenCounts adds sign times the counts of from to counts, dropping zeros
+func addScreenCounts(counts, from map[string]int, sign int) {
+	for screen, count := range from {
+		counts[screen] += sign * count
+		if counts[screen] <= 0 {
+			delete(counts, screen)
+		}
+	}
+}
+
+// addActiveDay inserts a date into the sorted active days, keeping the
+// most recent MaxProfileActiveDays
+func addActiveDay(days []string, day string) []string {
+	i := sort.SearchStrings(days, day)
+	if i < len(days) && days[i] == day {
+		return days
+	}
+
+	days = append(days, "")
+	copy(days[i+1:], days[i:])
+	days[i] = day
+
+	if len(days) > MaxProfileActiveDays {
+		days = days[len(days)-MaxProfileActiveDays:]
+	}
+	return days
+}
+
+// parseSignupTime parses a signup time given as RFC3339 or unix milliseconds
+func parseSignupTime(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
@@ -0,0 +1,601 @@
+package user_behavior
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Write-ahead log defaults
+	DefaultWALSegmentBytes       = 64 << 20
+	DefaultWALCheckpointInterval = 10 * time.Second
+
+	walSegmentPrefix   = "wal-"
+	walSegmentSuffix   = ".log"
+	walCheckpointsFile = "checkpoints.json"
+
+	// walRollupCheckpoint is the checkpoint of the open rollup windows,
+	// kept beside the sinks' so their events stay in the log until the
+	// windows are persisted
+	walRollupCheckpoint = "rollups"
+
+	// walSessionCheckpoint is the checkpoint of the session manager, kept
+	// when session snapshots are enabled and committed once a snapshot holds
+	// the events below it
+	walSessionCheckpoint = "sessions"
+
+	// walSettleTimeout bounds how long a checkpoint waits for the session
+	// manager to process the events logged before it
+	walSettleTimeout = 5 * time.Second
+
+	// Record header: offset (8) + payload length (4) + payload crc32 (4)
+	walHeaderSize = 16
+)
+
+// WriteAheadLog is an append-only, segmented on-disk log of tracked events.
+// Each sink has a checkpoint: the offset of the first record it has not yet
+// durably written. Segments below every checkpoint are deleted by Compact.
+type WriteAheadLog struct {
+	dir          string
+	segmentBytes int64
+	syncInterval time.Duration
+	segments     []uint64 // first offset of each segment, the last one is active
+	active       *os.File
+	activeSize   int64
+	nextOffset   uint64
+	checkpoints  map[string]uint64
+	dirty        bool // appended since the last sync
+	mu           sync.Mutex
+	stopSync     chan struct{}
+	syncDone     chan struct{}
+}
+
+// WALConfig holds configuration for the write-ahead log
+type WALConfig struct {
+	Dir string
+
+	// SegmentBytes rolls to a new segment once the active one is this large
+	SegmentBytes int64
+
+	// SyncInterval batches fsyncs; zero syncs on every append
+	SyncInterval time.Duration
+}
+
+// OpenWriteAheadLog opens or creates a log in config.Dir, recovering the
+// next offset from existing segments and truncating a torn final record
+func OpenWriteAheadLog(config WALConfig) (*WriteAheadLog, error) {
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = DefaultWALSegmentBytes
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL dir: %w", err)
+	}
+
+	wal := &WriteAheadLog{
+		dir:          config.Dir,
+		segmentBytes: config.SegmentBytes,
+		syncInterval: config.SyncInterval,
+		checkpoints:  make(map[string]uint64),
+	}
+
+	if err := wal.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := wal.loadCheckpoints(); err != nil {
+		return nil, err
+	}
+
+	if wal.syncInterval > 0 {
+		wal.stopSync = make(chan struct{})
+		wal.syncDone = make(chan struct{})
+		go wal.syncWorker()
+	}
+
+	return wal, nil
+}
+
+// loadSegments finds existing segments and opens the last one for appending
+func (wal *WriteAheadLog) loadSegments() error {
+	entries, err := os.ReadDir(wal.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+
+		var firstOffset uint64
+		if _, err := fmt.Sscanf(name, walSegmentPrefix+"%020d"+walSegmentSuffix, &firstOffset); err != nil {
+			continue
+		}
+		wal.segments = append(wal.segments, firstOffset)
+	}
+
+	sort.Slice(wal.segments, func(i, j int) bool {
+		return wal.segments[i] < wal.segments[j]
+	})
+
+	if len(wal.segments) == 0 {
+		return wal.openSegment(0)
+	}
+
+	// Recover the next offset from the active segment
+	last := wal.segments[len(wal.segments)-1]
+	wal.nextOffset = last
+
+	validSize, err := readSegment(wal.segmentPath(last), func(offset uint64, payload []byte) error {
+		wal.nextOffset = offset + 1
+		return nil
+	})
+	if err != nil && !errors.Is(err, errTornRecord) {
+		return err
+	}
+
+	file, err := os.OpenFile(wal.segmentPath(last), os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+
+	// Drop a partially written record left by a crash
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to truncate WAL segment: %w", err)
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek WAL segment: %w", err)
+	}
+
+	wal.active = file
+	wal.activeSize = validSize
+	return nil
+}
+
+// openSegment creates a new active segment starting at firstOffset;
+// caller must hold wal.mu or own the log exclusively
+func (wal *WriteAheadLog) openSegment(firstOffset uint64) error {
+	file, err := os.OpenFile(wal.segmentPath(firstOffset), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+
+	wal.active = file
+	wal.activeSize = 0
+	wal.segments = append(wal.segments, firstOffset)
+	return nil
+}
+
+// segmentPath returns the file path of the segment starting at firstOffset
+func (wal *WriteAheadLog) segmentPath(firstOffset uint64) string {
+	return filepath.Join(wal.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, firstOffset, walSegmentSuffix))
+}
+
+// Append writes an event to the log and returns its offset. Unless a sync
+// interval is configured the record is fsynced before returning.
+func (wal *WriteAheadLog) Append(event UserEvent) (uint64, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal WAL record: %w", err)
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.active == nil {
+		return 0, ErrWALClosed
+	}
+
+	if wal.activeSize >= wal.segmentBytes {
+		if err := wal.rollSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := wal.nextOffset
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(record[0:8], offset)
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[12:16], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	if _, err := wal.active.Write(record); err != nil {
+		return 0, fmt.Errorf("failed to append WAL record: %w", err)
+	}
+
+	if wal.syncInterval <= 0 {
+		if err := wal.active.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	} else {
+		wal.dirty = true
+	}
+
+	wal.activeSize += int64(len(record))
+	wal.nextOffset++
+
+	return offset, nil
+}
+
+// rollSegment syncs and closes the active segment and starts a new one;
+// caller must hold wal.mu
+func (wal *WriteAheadLog) rollSegment() error {
+	if err := wal.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL segment: %w", err)
+	}
+	if err := wal.active.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	wal.dirty = false
+
+	return wal.openSegment(wal.nextOffset)
+}
+
+// NextOffset returns the offset the next appended record will get
+func (wal *WriteAheadLog) NextOffset() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.nextOffset
+}
+
+// Register adds a sink checkpoint. A sink seen for the first time starts at
+// the current end of the log instead of replaying history.
+func (wal *WriteAheadLog) Register(sinkName string) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if _, exists := wal.checkpoints[sinkName]; exists {
+		return nil
+	}
+
+	wal.checkpoints[sinkName] = wal.nextOffset
+	return wal.saveCheckpoints()
+}
+
+// Prune drops the checkpoints of sinks not in sinkNames and returns their
+// names, so a removed sink no longer pins old segments
+func (wal *WriteAheadLog) Prune(sinkNames []string) ([]string, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	keep := make(map[string]bool, len(sinkNames))
+	for _, name := range sinkNames {
+		keep[name] = true
+	}
+
+	var dropped []string
+	for name := range wal.checkpoints {
+		if !keep[name] {
+			delete(wal.checkpoints, name)
+			dropped = append(dropped, name)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+
+	sort.Strings(dropped)
+	return dropped, wal.saveCheckpoints()
+}
+
+// Checkpoint returns the first offset the sink has not committed
+func (wal *WriteAheadLog) Checkpoint(sinkName string) uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.checkpoints[sinkName]
+}
+
+// Commit records that the sink has durably written every record below offset
+func (wal *WriteAheadLog) Commit(sinkName string, offset uint64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if offset <= wal.checkpoints[sinkName] {
+		return nil
+	}
+
+	wal.checkpoints[sinkName] = offset
+	return wal.saveCheckpoints()
+}
+
+// Replay calls fn for every record in [from, to) in offset order
+func (wal *WriteAheadLog) Replay(from, to uint64, fn func(offset uint64, event UserEvent) error) error {
+	wal.mu.Lock()
+	if wal.dirty {
+		wal.active.Sync()
+		wal.dirty = false
+	}
+	segments := make([]uint64, len(wal.segments))
+	copy(segments, wal.segments)
+	wal.mu.Unlock()
+
+	for i, firstOffset := range segments {
+		// Skip segments that end before from
+		if i+1 < len(segments) && segments[i+1] <= from {
+			continue
+		}
+		if firstOffset >= to {
+			break
+		}
+
+		errStop := errors.New("replay done")
+		_, err := readSegment(wal.segmentPath(firstOffset), func(offset uint64, payload []byte) error {
+			if offset < from {
+				return nil
+			}
+			if offset >= to {
+				return errStop
+			}
+
+			var event UserEvent
+			if err := json.Unmarshal(payload, &event); err != nil {
+				return fmt.Errorf("failed to decode WAL record %d: %w", offset, err)
+			}
+			return fn(offset, event)
+		})
+		if errors.Is(err, errStop) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errTornRecord) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compact deletes segments whose records are committed by every sink
+func (wal *WriteAheadLog) Compact() (int, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if len(wal.checkpoints) == 0 {
+		return 0, nil
+	}
+
+	minCommitted := wal.nextOffset
+	for _, offset := range wal.checkpoints {
+		if offset < minCommitted {
+			minCommitted = offset
+		}
+	}
+
+	// A segment can go once the next segment starts at or below minCommitted.
+	// The active segment is never removed.
+	removed := 0
+	for len(wal.segments) > 1 && wal.segments[1] <= minCommitted {
+		if err := os.Remove(wal.segmentPath(wal.segments[0])); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		wal.segments = wal.segments[1:]
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Close syncs and closes the log
+func (wal *WriteAheadLog) Close() error {
+	if wal.stopSync != nil {
+		close(wal.stopSync)
+		<-wal.syncDone
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.active == nil {
+		return nil
+	}
+
+	syncErr := wal.active.Sync()
+	closeErr := wal.active.Close()
+	wal.active = nil
+
+	if syncErr != nil {
+		return fmt.Errorf("failed to sync WAL: %w", syncErr)
+	}
+	return closeErr
+}
+
+// syncWorker periodically fsyncs the active segment
+func (wal *WriteAheadLog) syncWorker() {
+	defer close(wal.syncDone)
+
+	ticker := time.NewTicker(wal.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			wal.mu.Lock()
+			if wal.dirty && wal.active != nil {
+				if err := wal.active.Sync(); err != nil {
+					fmt.Printf("WAL sync error: %v\n", err)
+				} else {
+					wal.dirty = false
+				}
+			}
+			wal.mu.Unlock()
+
+		case <-wal.stopSync:
+			return
+		}
+	}
+}
+
+// loadCheckpoints reads the sink checkpoints file if it exists
+func (wal *WriteAheadLog) loadCheckpoints() error {
+	data, err := os.ReadFile(filepath.Join(wal.dir, walCheckpointsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WAL checkpoints: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &wal.checkpoints); err != nil {
+		return fmt.Errorf("failed to decode WAL checkpoints: %w", err)
+	}
+	return nil
+}
+
+// saveCheckpoints atomically rewrites the checkpoints file; caller must hold wal.mu
+func (wal *WriteAheadLog) saveCheckpoints() error {
+	data, err := json.Marshal(wal.checkpoints)
+	if err != nil {
+		return fmt.Errorf("failed to encode WAL checkpoints: %w", err)
+	}
+
+	return writeFileAtomic(filepath.Join(wal.dir, walCheckpointsFile), data)
+}
+
+// writeFileAtomic writes data to a temp file, fsyncs it and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// walFailures records the logged offsets each checkpoint's consumer failed
+// to take, so the checkpoint is not committed past them before they are
+// re-delivered
+type walFailures struct {
+	offsets map[string]map[uint64]bool
+	mu      sync.Mutex
+}
+
+// newWALFailures creates an empty failure record
+func newWALFailures() *walFailures {
+	return &walFailures{offsets: make(map[string]map[uint64]bool)}
+}
+
+// add records that name failed to take the record at offset
+func (f *walFailures) add(name string, offset uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.offsets[name] == nil {
+		f.offsets[name] = make(map[uint64]bool)
+	}
+	f.offsets[name][offset] = true
+}
+
+// remove records that name took the record at offset after all
+func (f *walFailures) remove(name string, offset uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.offsets[name], offset)
+}
+
+// limit returns the offset name can be committed up to: end, or its lowest
+// failed offset below end
+func (f *walFailures) limit(name string, end uint64) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for offset := range f.offsets[name] {
+		if offset < end {
+			end = offset
+		}
+	}
+	return end
+}
+
+// pending returns the failed offsets below end by name, lowest first
+func (f *walFailures) pending(end uint64) map[string][]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending := make(map[string][]uint64)
+	for name, offsets := range f.offsets {
+		for offset := range offsets {
+			if offset < end {
+				pending[name] = append(pending[name], offset)
+			}
+		}
+		sort.Slice(pending[name], func(i, j int) bool {
+			return pending[name][i] < pending[name][j]
+		})
+	}
+	return pending
+}
+
+// errTornRecord marks a truncated or corrupt record at the end of a segment
+var errTornRecord = errors.New("torn WAL record")
+
+// readSegment calls fn for each record of a segment file and returns the size
+// of the valid prefix. errTornRecord is returned if the segment ends in a
+// partial or corrupt record.
+func readSegment(path string, fn func(offset uint64, payload []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	var validSize int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return validSize, nil
+			}
+			return validSize, errTornRecord
+		}
+
+		offset := binary.BigEndian.Uint64(header[0:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+		checksum := binary.BigEndian.Uint32(header[12:16])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return validSize, errTornRecord
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return validSize, errTornRecord
+		}
+
+		if err := fn(offset, payload); err != nil {
+			return validSize, err
+		}
+
+		validSize += int64(walHeaderSize) + int64(length)
+	}
+}
@@ -0,0 +1,310 @@
+package user_behavior
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// walEvent builds the event logged at position i of a test
+func walEvent(i int) UserEvent {
+	return UserEvent{
+		EventID:   "evt-" + string(rune('a'+i)),
+		UserID:    "u1",
+		SessionID: "s1",
+		EventType: EventTyping,
+		Timestamp: time.Date(2026, 7, 1, 8, 0, i, 0, time.UTC),
+	}
+}
+
+// openTestWAL opens a log in dir with tiny segments, so a few records span
+// several of them
+func openTestWAL(t *testing.T, dir string) *WriteAheadLog {
+	t.Helper()
+
+	wal, err := OpenWriteAheadLog(WALConfig{Dir: dir, SegmentBytes: 1})
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog() error = %v", err)
+	}
+	return wal
+}
+
+// replayIDs returns the event IDs of the records in [from, to)
+func replayIDs(t *testing.T, wal *WriteAheadLog, from, to uint64) []string {
+	t.Helper()
+
+	var ids []string
+	err := wal.Replay(from, to, func(offset uint64, event UserEvent) error {
+		ids = append(ids, event.EventID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay(%d, %d) error = %v", from, to, err)
+	}
+	return ids
+}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	wal := openTestWAL(t, t.TempDir())
+	defer wal.Close()
+
+	for i := 0; i < 5; i++ {
+		offset, err := wal.Append(walEvent(i))
+		if err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+		if offset != uint64(i) {
+			t.Fatalf("Append() offset = %d, want %d", offset, i)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from, to uint64
+		want     []string
+	}{
+		{name: "all", from: 0, to: 5, want: []string{"evt-a", "evt-b", "evt-c", "evt-d", "evt-e"}},
+		{name: "middle", from: 1, to: 3, want: []string{"evt-b", "evt-c"}},
+		{name: "past the end", from: 3, to: 10, want: []string{"evt-d", "evt-e"}},
+		{name: "empty", from: 2, to: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := replayIDs(t, wal, tt.from, tt.to)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Replay() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Replay() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAheadLogCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	wal := openTestWAL(t, dir)
+
+	if err := wal.Register("hbase"); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := wal.Append(walEvent(i)); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	// A consumer registered later starts at the end instead of replaying
+	if err := wal.Register("file"); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if got := wal.Checkpoint("file"); got != 4 {
+		t.Errorf("Checkpoint(file) = %d, want 4", got)
+	}
+
+	if err := wal.Commit("hbase", 3); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if err := wal.Commit("hbase", 1); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if got := wal.Checkpoint("hbase"); got != 3 {
+		t.Errorf("Checkpoint(hbase) = %d after committing backwards, want 3", got)
+	}
+
+	// Only the segments below every checkpoint go
+	removed, err := wal.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Compact() removed %d segments, want 3", removed)
+	}
+	if got := replayIDs(t, wal, 3, 4); len(got) != 1 || got[0] != "evt-d" {
+		t.Errorf("Replay(3, 4) after Compact = %v, want [evt-d]", got)
+	}
+
+	dropped, err := wal.Prune([]string{"hbase"})
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if len(dropped) != 1 || dropped[0] != "file" {
+		t.Errorf("Prune() dropped %v, want [file]", dropped)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Checkpoints and the next offset survive a reopen
+	wal = openTestWAL(t, dir)
+	defer wal.Close()
+
+	if got := wal.Checkpoint("hbase"); got != 3 {
+		t.Errorf("Checkpoint(hbase) after reopen = %d, want 3", got)
+	}
+	if got := wal.Checkpoint("file"); got != 0 {
+		t.Errorf("Checkpoint(file) after reopen = %d, want pruned", got)
+	}
+	if got := wal.NextOffset(); got != 4 {
+		t.Errorf("NextOffset() after reopen = %d, want 4", got)
+	}
+}
+
+func TestWriteAheadLogTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWriteAheadLog(WALConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := wal.Append(walEvent(i)); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Cut the last record in half, as a crash during a write would
+	path := wal.segmentPath(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	wal, err = OpenWriteAheadLog(WALConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog() error = %v", err)
+	}
+	defer wal.Close()
+
+	if got := wal.NextOffset(); got != 1 {
+		t.Fatalf("NextOffset() = %d, want the torn record dropped", got)
+	}
+	if offset, err := wal.Append(walEvent(2)); err != nil || offset != 1 {
+		t.Fatalf("Append() = %d, %v, want 1", offset, err)
+	}
+	if got := replayIDs(t, wal, 0, 2); len(got) != 2 || got[0] != "evt-a" || got[1] != "evt-c" {
+		t.Errorf("Replay() = %v, want [evt-a evt-c]", got)
+	}
+}
+
+func TestWALFailures(t *testing.T) {
+	failures := newWALFailures()
+	failures.add("hbase", 7)
+	failures.add("hbase", 3)
+	failures.add(walSessionCheckpoint, 9)
+	failures.remove("hbase", 7)
+
+	tests := []struct {
+		name string
+		end  uint64
+		want uint64
+	}{
+		{name: "hbase", end: 10, want: 3},
+		{name: "hbase", end: 2, want: 2},
+		{name: walSessionCheckpoint, end: 10, want: 9},
+		{name: "file", end: 10, want: 10},
+	}
+	for _, tt := range tests {
+		if got := failures.limit(tt.name, tt.end); got != tt.want {
+			t.Errorf("limit(%s, %d) = %d, want %d", tt.name, tt.end, got, tt.want)
+		}
+	}
+
+	pending := failures.pending(9)
+	if len(pending["hbase"]) != 1 || pending["hbase"][0] != 3 || len(pending[walSessionCheckpoint]) != 0 {
+		t.Errorf("pending(9) = %v, want hbase [3]", pending)
+	}
+}
+
+func TestCollectorWALRedelivery(t *testing.T) {
+	flaky := &flakySink{MemorySink: NewMemorySink(), name: "flaky", failures: 1}
+	memory := NewMemorySink()
+	ec := newTestCollector(t, 8, flaky, memory)
+
+	wal, err := openCollectorWAL(EventCollectorConfig{WALDir: filepath.Join(t.TempDir(), "wal")}, ec.sinks, false)
+	if err != nil {
+		t.Fatalf("openCollectorWAL() error = %v", err)
+	}
+	defer wal.Close()
+	ec.wal = wal
+
+	if err := ec.trackLocal(walEvent(0), true); err == nil {
+		t.Fatal("trackLocal() error = nil, want the sink failure")
+	}
+	if err := ec.trackLocal(walEvent(1), true); err != nil {
+		t.Fatalf("trackLocal() error = %v", err)
+	}
+
+	// The re-delivery fails again, so flaky stays below the failed record
+	flaky.failures = 1
+	end := wal.NextOffset()
+	ec.commitWAL(end, rollupState{})
+	if got := wal.Checkpoint("flaky"); got != 0 {
+		t.Errorf("Checkpoint(flaky) = %d, want 0", got)
+	}
+	if got := wal.Checkpoint(SinkMemory); got != end {
+		t.Errorf("Checkpoint(memory) = %d, want %d", got, end)
+	}
+
+	ec.commitWAL(end, rollupState{})
+	if got := wal.Checkpoint("flaky"); got != end {
+		t.Errorf("Checkpoint(flaky) after re-delivery = %d, want %d", got, end)
+	}
+	if len(flaky.events) != 2 || len(memory.events) != 2 {
+		t.Errorf("sink events = %d, %d, want 2, 2", len(flaky.events), len(memory.events))
+	}
+
+	// Delivered by the checkpoint, the client retry is a duplicate
+	if err := ec.trackLocal(walEvent(0), true); err != ErrDuplicateEvent {
+		t.Errorf("retry error = %v, want %v", err, ErrDuplicateEvent)
+	}
+}
+
+func TestCollectorWALReplay(t *testing.T) {
+	flaky := &flakySink{MemorySink: NewMemorySink(), name: "flaky", failures: 1}
+	ec := newTestCollector(t, 8, flaky)
+
+	wal, err := openCollectorWAL(EventCollectorConfig{WALDir: filepath.Join(t.TempDir(), "wal")}, ec.sinks, true)
+	if err != nil {
+		t.Fatalf("openCollectorWAL() error = %v", err)
+	}
+	defer wal.Close()
+	ec.wal = wal
+	ec.walSessions = true
+
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append(walEvent(i)); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := wal.Commit(walSessionCheckpoint, 1); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	ec.replayWAL(0)
+
+	// The session manager gets the records after its checkpoint
+	if depth := ec.sessionManager.QueueMetrics().Depth; depth != 2 {
+		t.Errorf("session manager queue depth = %d, want 2", depth)
+	}
+	if first := <-ec.sessionManager.eventQueue.C(); first.EventID != "evt-b" {
+		t.Errorf("first replayed event = %s, want evt-b", first.EventID)
+	}
+
+	// The record flaky failed to take holds back its checkpoint
+	if len(flaky.events) != 2 {
+		t.Errorf("flaky events = %d, want 2", len(flaky.events))
+	}
+	if got := ec.walFailures.limit("flaky", 3); got != 0 {
+		t.Errorf("flaky commit limit = %d, want 0", got)
+	}
+}